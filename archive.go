@@ -0,0 +1,423 @@
+package exec
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type archiveEntry struct {
+	path    string
+	mode    os.FileMode
+	modTime time.Time
+	// only set for symlinks
+	target string
+	// only set for hard links
+	linkPath string
+	// only set for regular files
+	reader io.Reader
+}
+
+type archiveWriter interface {
+	writeEntry(name string, fileInfo os.FileInfo, target string, reader io.Reader) error
+	Close() error
+}
+
+func exportArchive(readFileManager ReadFileManager, writer io.Writer, archiveFormat ArchiveFormat, patterns []string) error {
+	archiveWriter, err := newArchiveWriter(writer, archiveFormat)
+	if err != nil {
+		return err
+	}
+	if err := walkTree(readFileManager, ".", func(path string, fileInfo os.FileInfo) error {
+		matches, err := matchesPathOrParent(readFileManager, patterns, path)
+		if err != nil || !matches {
+			return err
+		}
+		return exportArchiveEntry(readFileManager, archiveWriter, path, fileInfo)
+	}); err != nil {
+		_ = archiveWriter.Close()
+		return err
+	}
+	return archiveWriter.Close()
+}
+
+func exportArchiveEntry(readFileManager ReadFileManager, archiveWriter archiveWriter, path string, fileInfo os.FileInfo) (retErr error) {
+	name := readFileManager.ToSlash(path)
+	switch {
+	case fileInfo.IsDir():
+		return archiveWriter.writeEntry(name+"/", fileInfo, "", nil)
+	case fileInfo.Mode()&os.ModeSymlink != 0:
+		target, err := readFileManager.Readlink(path)
+		if err != nil {
+			return err
+		}
+		return archiveWriter.writeEntry(name, fileInfo, target, nil)
+	case fileInfo.Mode().IsRegular():
+		file, err := readFileManager.Open(path)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := file.Close(); err != nil && retErr == nil {
+				retErr = err
+			}
+		}()
+		return archiveWriter.writeEntry(name, fileInfo, "", file)
+	default:
+		return fmt.Errorf("exec: cannot archive %s with mode %v", path, fileInfo.Mode())
+	}
+}
+
+// matchesPathOrParent returns true if there are no patterns, or if any
+// pattern matches path or one of its parent directories.
+func matchesPathOrParent(readFileManager ReadFileManager, patterns []string, path string) (bool, error) {
+	if len(patterns) == 0 {
+		return true, nil
+	}
+	for ; path != "." && path != readFileManager.PathSeparator(); path = readFileManager.Dir(path) {
+		for _, pattern := range patterns {
+			matches, err := readFileManager.Match(pattern, path)
+			if err != nil {
+				return false, err
+			}
+			if matches {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func newArchiveWriter(writer io.Writer, archiveFormat ArchiveFormat) (archiveWriter, error) {
+	switch archiveFormat {
+	case ArchiveFormatTar:
+		return &tarArchiveWriter{tar.NewWriter(writer), nil}, nil
+	case ArchiveFormatTarGz:
+		gzipWriter := gzip.NewWriter(writer)
+		return &tarArchiveWriter{tar.NewWriter(gzipWriter), gzipWriter}, nil
+	case ArchiveFormatZip:
+		return &zipArchiveWriter{zip.NewWriter(writer)}, nil
+	default:
+		return nil, UnknownArchiveFormat(archiveFormat)
+	}
+}
+
+type tarArchiveWriter struct {
+	tarWriter *tar.Writer
+	// can be nil
+	gzipWriter *gzip.Writer
+}
+
+func (t *tarArchiveWriter) writeEntry(name string, fileInfo os.FileInfo, target string, reader io.Reader) error {
+	header, err := tar.FileInfoHeader(fileInfo, target)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := t.tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	if reader != nil {
+		if _, err := io.Copy(t.tarWriter, reader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tarArchiveWriter) Close() error {
+	err := t.tarWriter.Close()
+	if t.gzipWriter != nil {
+		if gzipErr := t.gzipWriter.Close(); gzipErr != nil && err == nil {
+			err = gzipErr
+		}
+	}
+	return err
+}
+
+type zipArchiveWriter struct {
+	zipWriter *zip.Writer
+}
+
+func (z *zipArchiveWriter) writeEntry(name string, fileInfo os.FileInfo, target string, reader io.Reader) error {
+	header, err := zip.FileInfoHeader(fileInfo)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if fileInfo.Mode().IsRegular() {
+		header.Method = zip.Deflate
+	}
+	writer, err := z.zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	// symlink targets are stored as the entry contents
+	if target != "" {
+		reader = strings.NewReader(target)
+	}
+	if reader != nil {
+		if _, err := io.Copy(writer, reader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (z *zipArchiveWriter) Close() error {
+	return z.zipWriter.Close()
+}
+
+func importArchive(writeFileManager WriteFileManager, reader io.Reader, archiveFormat ArchiveFormat, subDir string) error {
+	switch archiveFormat {
+	case ArchiveFormatTar:
+		return importTar(writeFileManager, tar.NewReader(reader), subDir)
+	case ArchiveFormatTarGz:
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		if err := importTar(writeFileManager, tar.NewReader(gzipReader), subDir); err != nil {
+			return err
+		}
+		return gzipReader.Close()
+	case ArchiveFormatZip:
+		return importZip(writeFileManager, reader, subDir)
+	default:
+		return UnknownArchiveFormat(archiveFormat)
+	}
+}
+
+func importTar(writeFileManager WriteFileManager, tarReader *tar.Reader, subDir string) error {
+	archiveImporter, err := newArchiveImporter(writeFileManager, subDir)
+	if err != nil {
+		return err
+	}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return archiveImporter.finish()
+		}
+		if err != nil {
+			return err
+		}
+		entry := &archiveEntry{
+			path:    header.Name,
+			mode:    header.FileInfo().Mode(),
+			modTime: header.ModTime,
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+		case tar.TypeReg, tar.TypeRegA:
+			entry.reader = tarReader
+		case tar.TypeSymlink:
+			entry.target = header.Linkname
+		case tar.TypeLink:
+			entry.linkPath = header.Linkname
+		default:
+			return fmt.Errorf("exec: cannot extract %s with type %c", header.Name, header.Typeflag)
+		}
+		if err := archiveImporter.importEntry(entry); err != nil {
+			return err
+		}
+	}
+}
+
+func importZip(writeFileManager WriteFileManager, reader io.Reader, subDir string) (retErr error) {
+	// zip archives need random access, so buffer the archive on the host
+	tempFile, err := ioutil.TempFile("", "exec-zip")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tempFile.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+		if err := os.Remove(tempFile.Name()); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	size, err := io.Copy(tempFile, reader)
+	if err != nil {
+		return err
+	}
+	zipReader, err := zip.NewReader(tempFile, size)
+	if err != nil {
+		return err
+	}
+	archiveImporter, err := newArchiveImporter(writeFileManager, subDir)
+	if err != nil {
+		return err
+	}
+	for _, zipFile := range zipReader.File {
+		if err := importZipFile(archiveImporter, zipFile); err != nil {
+			return err
+		}
+	}
+	return archiveImporter.finish()
+}
+
+func importZipFile(archiveImporter *archiveImporter, zipFile *zip.File) (retErr error) {
+	entry := &archiveEntry{
+		path:    zipFile.Name,
+		mode:    zipFile.Mode(),
+		modTime: zipFile.Modified,
+	}
+	if !entry.mode.IsDir() {
+		readCloser, err := zipFile.Open()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := readCloser.Close(); err != nil && retErr == nil {
+				retErr = err
+			}
+		}()
+		if entry.mode&os.ModeSymlink != 0 {
+			data, err := ioutil.ReadAll(readCloser)
+			if err != nil {
+				return err
+			}
+			entry.target = string(data)
+		} else {
+			entry.reader = readCloser
+		}
+	}
+	return archiveImporter.importEntry(entry)
+}
+
+// archiveDir is a directory whose mode and modification time are set once
+// its children are written, so that read-only directories can be imported
+type archiveDir struct {
+	path    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+type archiveImporter struct {
+	writeFileManager WriteFileManager
+	subDir           string
+	dirs             []archiveDir
+}
+
+func newArchiveImporter(writeFileManager WriteFileManager, subDir string) (*archiveImporter, error) {
+	if subDir == "" {
+		subDir = "."
+	}
+	subDir, err := cleanArchivePath(subDir)
+	if err != nil {
+		return nil, err
+	}
+	if subDir != "." {
+		if err := writeFileManager.MkdirAll(subDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &archiveImporter{writeFileManager, subDir, nil}, nil
+}
+
+// importEntry rejects entries that would escape the destination, either by
+// their path, by being written through a symlink in the destination, or by
+// being a symlink pointing outside of the destination.
+func (a *archiveImporter) importEntry(entry *archiveEntry) error {
+	path, err := cleanArchivePath(entry.path)
+	if err != nil {
+		return err
+	}
+	if path == "." {
+		return nil
+	}
+	fullPath := a.writeFileManager.Join(a.subDir, path)
+	if err := a.checkNoSymlinks(fullPath); err != nil {
+		return err
+	}
+	if entry.mode.IsDir() {
+		if err := a.writeFileManager.MkdirAll(fullPath, 0700); err != nil {
+			return err
+		}
+		a.dirs = append(a.dirs, archiveDir{fullPath, entry.mode.Perm(), entry.modTime})
+		return nil
+	}
+	if err := a.writeFileManager.MkdirAll(a.writeFileManager.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	switch {
+	case entry.mode&os.ModeSymlink != 0:
+		if filepath.IsAbs(entry.target) {
+			return ErrPathOutOfContext
+		}
+		if _, err := cleanArchivePath(filepath.Join(filepath.Dir(path), entry.target)); err != nil {
+			return err
+		}
+		return a.writeFileManager.Symlink(entry.target, fullPath)
+	case entry.linkPath != "":
+		linkPath, err := cleanArchivePath(entry.linkPath)
+		if err != nil {
+			return err
+		}
+		fullLinkPath := a.writeFileManager.Join(a.subDir, linkPath)
+		if err := a.checkNoSymlinks(a.writeFileManager.Dir(fullLinkPath)); err != nil {
+			return err
+		}
+		return a.writeFileManager.Link(fullLinkPath, fullPath)
+	case entry.mode.IsRegular():
+		if err := writeToWriteFileManager(a.writeFileManager, fullPath, entry.reader, entry.mode.Perm()); err != nil {
+			return err
+		}
+		return a.chtimes(fullPath, entry.modTime)
+	default:
+		return fmt.Errorf("exec: cannot extract %s with mode %v", path, entry.mode)
+	}
+}
+
+// checkNoSymlinks returns ErrPathOutOfContext if path or one of its parents
+// is a symlink in the destination, including ones that existed before the
+// import, as writing through it could escape the destination.
+func (a *archiveImporter) checkNoSymlinks(path string) error {
+	var paths []string
+	for ; path != "."; path = a.writeFileManager.Dir(path) {
+		paths = append(paths, path)
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		fileInfo, err := a.writeFileManager.Lstat(paths[i])
+		if err != nil {
+			// nothing below paths[i] exists either
+			if os.IsNotExist(err) || isNotDir(err) {
+				return nil
+			}
+			return err
+		}
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			return ErrPathOutOfContext
+		}
+	}
+	return nil
+}
+
+func (a *archiveImporter) chtimes(path string, modTime time.Time) error {
+	if modTime.IsZero() {
+		return nil
+	}
+	return a.writeFileManager.Chtimes(path, modTime, modTime)
+}
+
+// finish sets the modes and modification times of the directories, children
+// first, as writing in a directory changes its modification time
+func (a *archiveImporter) finish() error {
+	for i := len(a.dirs) - 1; i >= 0; i-- {
+		if err := a.writeFileManager.Chmod(a.dirs[i].path, a.dirs[i].mode); err != nil {
+			return err
+		}
+		if err := a.chtimes(a.dirs[i].path, a.dirs[i].modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
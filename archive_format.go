@@ -0,0 +1,50 @@
+package exec
+
+import "fmt"
+
+var (
+	ArchiveFormatTar   ArchiveFormat = 0
+	ArchiveFormatTarGz ArchiveFormat = 1
+	ArchiveFormatZip   ArchiveFormat = 2
+
+	archiveFormatToString = map[ArchiveFormat]string{
+		ArchiveFormatTar:   "tar",
+		ArchiveFormatTarGz: "tar.gz",
+		ArchiveFormatZip:   "zip",
+	}
+	stringToArchiveFormat = map[string]ArchiveFormat{
+		"tar":    ArchiveFormatTar,
+		"tar.gz": ArchiveFormatTarGz,
+		"tgz":    ArchiveFormatTarGz,
+		"zip":    ArchiveFormatZip,
+	}
+)
+
+type ArchiveFormat uint
+
+func AllArchiveFormats() []ArchiveFormat {
+	return []ArchiveFormat{
+		ArchiveFormatTar,
+		ArchiveFormatTarGz,
+		ArchiveFormatZip,
+	}
+}
+
+func ArchiveFormatOf(s string) (ArchiveFormat, error) {
+	archiveFormat, ok := stringToArchiveFormat[s]
+	if !ok {
+		return 0, UnknownArchiveFormat(s)
+	}
+	return archiveFormat, nil
+}
+
+func (a ArchiveFormat) String() string {
+	if s, ok := archiveFormatToString[a]; ok {
+		return s
+	}
+	return fmt.Sprintf("ArchiveFormat(%d)", uint(a))
+}
+
+func UnknownArchiveFormat(unknownArchiveFormat interface{}) error {
+	return fmt.Errorf("exec: unknown ArchiveFormat: %v", unknownArchiveFormat)
+}
@@ -0,0 +1,101 @@
+package exec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+type atomicWriteFile struct {
+	WriteFile
+	writeFileManager WriteFileManager
+	path             string
+	tempPath         string
+	perm             os.FileMode
+	done             bool
+}
+
+func createAtomic(writeFileManager WriteFileManager, path string, perm os.FileMode) (*atomicWriteFile, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	tempPath := writeFileManager.Join(
+		writeFileManager.Dir(path),
+		"."+writeFileManager.Base(path)+".tmp"+hex.EncodeToString(suffix),
+	)
+	file, err := writeFileManager.Create(tempPath)
+	if err != nil {
+		return nil, err
+	}
+	return &atomicWriteFile{file, writeFileManager, path, tempPath, perm, false}, nil
+}
+
+func (a *atomicWriteFile) Close() error {
+	if a.done {
+		return os.ErrClosed
+	}
+	a.done = true
+	if err := a.commit(); err != nil {
+		_ = a.writeFileManager.Remove(a.tempPath)
+		return err
+	}
+	return nil
+}
+
+func (a *atomicWriteFile) commit() error {
+	err := a.WriteFile.Chmod(a.perm)
+	if err == nil {
+		err = a.WriteFile.Sync()
+	}
+	if closeErr := a.WriteFile.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return a.writeFileManager.Rename(a.tempPath, a.path)
+}
+
+func (a *atomicWriteFile) Abort() error {
+	if a.done {
+		return nil
+	}
+	a.done = true
+	err := a.WriteFile.Close()
+	if removeErr := a.writeFileManager.Remove(a.tempPath); removeErr != nil && err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+func writeFileAtomic(writeFileManager WriteFileManager, path string, reader io.Reader, perm os.FileMode) (retErr error) {
+	file, err := createAtomic(writeFileManager, path, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Abort(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	if _, err := io.Copy(file, reader); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func writeAll(writeFileManager WriteFileManager, path string, data []byte, perm os.FileMode) error {
+	return writeFileAtomic(writeFileManager, path, bytes.NewReader(data), perm)
+}
+
+func writeLines(writeFileManager WriteFileManager, path string, lines []string, perm os.FileMode) error {
+	buffer := bytes.NewBuffer(nil)
+	for _, line := range lines {
+		buffer.WriteString(line)
+		buffer.WriteByte('\n')
+	}
+	return writeFileAtomic(writeFileManager, path, buffer, perm)
+}
@@ -0,0 +1,291 @@
+package exec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// cassette holds the commands run through a recording client provider, in
+// the order they finished.
+type cassette struct {
+	Interactions []*cassetteInteraction `json:"interactions"`
+}
+
+// cassetteInteraction is a command, or a list of piped commands, with its
+// result and the changes it made to the directory of its client
+type cassetteInteraction struct {
+	Cmds []*cassetteCmd `json:"cmds"`
+	// the hex SHA-256 of the StdinSize bytes of stdin read by the commands,
+	// nil is digested as empty
+	StdinDigest string `json:"stdin_digest"`
+	StdinSize   int64  `json:"stdin_size,omitempty"`
+	Stdout      []byte `json:"stdout,omitempty"`
+	Stderr      []byte `json:"stderr,omitempty"`
+	// 0 if the command did not exit with a status, see Err
+	ExitCode int          `json:"exit_code,omitempty"`
+	Err      *remoteError `json:"error,omitempty"`
+	// removed in reverse order, before Files are written
+	Removed []string        `json:"removed,omitempty"`
+	Files   []*cassetteFile `json:"files,omitempty"`
+}
+
+type cassetteCmd struct {
+	Args   []string `json:"args"`
+	SubDir string   `json:"sub_dir,omitempty"`
+	Env    []string `json:"env,omitempty"`
+}
+
+// cassetteFile is an added or changed entry, with the contents of regular
+// files
+type cassetteFile struct {
+	Entry *ManifestEntry `json:"entry"`
+	Data  []byte         `json:"data,omitempty"`
+}
+
+func readCassette(path string) (*cassette, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cassette := &cassette{}
+	if err := json.Unmarshal(data, cassette); err != nil {
+		return nil, fmt.Errorf("exec: invalid cassette %s: %v", path, err)
+	}
+	return cassette, nil
+}
+
+func writeCassette(path string, cassette *cassette) error {
+	data, err := json.MarshalIndent(cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func newCassetteCmd(args []string, subDir string, env []string) *cassetteCmd {
+	return &cassetteCmd{args, subDir, env}
+}
+
+func newCassetteCmds(pipeCmdList *PipeCmdList) []*cassetteCmd {
+	cassetteCmds := make([]*cassetteCmd, len(pipeCmdList.PipeCmds))
+	for i, pipeCmd := range pipeCmdList.PipeCmds {
+		cassetteCmds[i] = newCassetteCmd(pipeCmd.Args, pipeCmd.SubDir, pipeCmd.Env)
+	}
+	return cassetteCmds
+}
+
+func (c *cassetteCmd) String() string {
+	return cmdString(c.Args, c.SubDir, c.Env)
+}
+
+func isCassetteCmdsEqual(a []*cassetteCmd, b []*cassetteCmd) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !isStringsEqual(a[i].Args, b[i].Args) ||
+			a[i].SubDir != b[i].SubDir ||
+			!isStringsEqual(a[i].Env, b[i].Env) {
+			return false
+		}
+	}
+	return true
+}
+
+// nil and empty are equal, as after a round trip through JSON
+func isStringsEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// stdinDigester digests stdin as it is read by a command
+type stdinDigester struct {
+	reader io.Reader
+	hash   hash.Hash
+	size   int64
+	done   bool
+	lock   sync.Mutex
+}
+
+func newStdinDigester(reader io.Reader) *stdinDigester {
+	return &stdinDigester{reader: reader, hash: sha256.New()}
+}
+
+func (s *stdinDigester) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.done {
+		_, _ = s.hash.Write(p[:n])
+		s.size += int64(n)
+	}
+	return n, err
+}
+
+// digest returns the digest and size of what was read so far, anything read
+// afterwards is not digested
+func (s *stdinDigester) digest() (string, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.done = true
+	return hex.EncodeToString(s.hash.Sum(nil)), s.size
+}
+
+// readStdin reads at most size bytes of stdin, nil is read as empty
+func readStdin(stdin io.Reader, size int64) ([]byte, error) {
+	if stdin == nil {
+		return nil, nil
+	}
+	return ioutil.ReadAll(io.LimitReader(stdin, size))
+}
+
+func digestStdin(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+// exitCode is false if err is not an exit status of a command
+func exitCode(err error) (int, bool) {
+	// *exec.ExitError, *ReplayExitError and *RemoteExitError
+	var exitCoder interface{ ExitCode() int }
+	if errors.As(err, &exitCoder) {
+		return exitCoder.ExitCode(), true
+	}
+	// *ssh.ExitError
+	var exitStatuser interface{ ExitStatus() int }
+	if errors.As(err, &exitStatuser) {
+		return exitStatuser.ExitStatus(), true
+	}
+	return 0, false
+}
+
+// newCassetteChanges reads the entries added or changed between before and
+// after from readFileManager
+func newCassetteChanges(readFileManager ReadFileManager, before *Manifest, after *Manifest) ([]string, []*cassetteFile, error) {
+	manifestDiff := diff(before, after)
+	var removed []string
+	for _, entry := range manifestDiff.Removed {
+		removed = append(removed, entry.Path)
+	}
+	var entries []*ManifestEntry
+	entries = append(entries, manifestDiff.Added...)
+	for _, change := range manifestDiff.Changed {
+		entries = append(entries, change.New)
+	}
+	// parents are written before their children
+	sort.Sort(manifestEntriesByPath(entries))
+	cassetteFiles := make([]*cassetteFile, len(entries))
+	for i, entry := range entries {
+		cassetteFiles[i] = &cassetteFile{Entry: entry}
+		if entry.Mode.IsRegular() {
+			data, err := readAll(readFileManager, entry.Path)
+			if err != nil {
+				return nil, nil, err
+			}
+			cassetteFiles[i].Data = data
+		}
+	}
+	return removed, cassetteFiles, nil
+}
+
+// applyCassetteChanges makes the changes of cassetteInteraction to
+// readWriteFileManager
+func applyCassetteChanges(readWriteFileManager ReadWriteFileManager, cassetteInteraction *cassetteInteraction) error {
+	for i := len(cassetteInteraction.Removed) - 1; i >= 0; i-- {
+		if err := readWriteFileManager.RemoveAll(cassetteInteraction.Removed[i]); err != nil {
+			return err
+		}
+	}
+	for _, cassetteFile := range cassetteInteraction.Files {
+		entry := cassetteFile.Entry
+		fileInfo, err := readWriteFileManager.Lstat(entry.Path)
+		switch {
+		case err == nil && fileInfo.IsDir() && entry.Mode.IsDir():
+			if err := readWriteFileManager.Chmod(entry.Path, entry.Mode.Perm()); err != nil {
+				return err
+			}
+			continue
+		case err == nil:
+			if err := readWriteFileManager.RemoveAll(entry.Path); err != nil {
+				return err
+			}
+		}
+		if entry.Mode.IsRegular() {
+			if err := writeToWriteFileManager(readWriteFileManager, entry.Path, bytes.NewReader(cassetteFile.Data), entry.Mode.Perm()); err != nil {
+				return err
+			}
+			if err := readWriteFileManager.Chtimes(entry.Path, entry.ModTime, entry.ModTime); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := restoreManifestEntry(readWriteFileManager, entry, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cassettePlayer hands out every interaction of a cassette once
+type cassettePlayer struct {
+	cassette *cassette
+	used     []bool
+	lock     sync.Mutex
+}
+
+func newCassettePlayer(cassette *cassette) *cassettePlayer {
+	return &cassettePlayer{
+		cassette: cassette,
+		used:     make([]bool, len(cassette.Interactions)),
+	}
+}
+
+// maxStdinSize returns the most stdin read by an unused interaction for
+// cassetteCmds
+func (c *cassettePlayer) maxStdinSize(cassetteCmds []*cassetteCmd) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var maxStdinSize int64
+	for i, cassetteInteraction := range c.cassette.Interactions {
+		if !c.used[i] &&
+			cassetteInteraction.StdinSize > maxStdinSize &&
+			isCassetteCmdsEqual(cassetteInteraction.Cmds, cassetteCmds) {
+			maxStdinSize = cassetteInteraction.StdinSize
+		}
+	}
+	return maxStdinSize
+}
+
+// next returns the first unused interaction for cassetteCmds that read a
+// prefix of stdin, in recorded order
+func (c *cassettePlayer) next(cassetteCmds []*cassetteCmd, stdin []byte) (*cassetteInteraction, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, cassetteInteraction := range c.cassette.Interactions {
+		if c.used[i] ||
+			cassetteInteraction.StdinSize > int64(len(stdin)) ||
+			cassetteInteraction.StdinDigest != digestStdin(stdin[:cassetteInteraction.StdinSize]) ||
+			!isCassetteCmdsEqual(cassetteInteraction.Cmds, cassetteCmds) {
+			continue
+		}
+		c.used[i] = true
+		return cassetteInteraction, nil
+	}
+	return nil, newUnrecordedCommandError(cassetteCmds, digestStdin(stdin))
+}
@@ -7,6 +7,14 @@ func newClientProvider(execOptions ExecOptions) (ClientProvider, error) {
 	switch execOptions.Type() {
 	case ExecTypeOs:
 		return newOsClientProvider(execOptions.(*OsExecOptions)), nil
+	case ExecTypeRemote:
+		return dialRemoteClientProvider(execOptions.(*RemoteExecOptions))
+	case ExecTypeSSH:
+		return dialSSHClientProvider(execOptions.(*SSHExecOptions))
+	case ExecTypeOCI:
+		return newOCIClientProvider(execOptions.(*OCIExecOptions))
+	case ExecTypeReplay:
+		return newReplayClientProvider(execOptions.(*ReplayExecOptions))
 	default:
 		return nil, UnknownExecType(execOptions.Type())
 	}
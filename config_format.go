@@ -0,0 +1,46 @@
+package exec
+
+import "fmt"
+
+var (
+	ConfigFormatYAML ConfigFormat = 0
+	ConfigFormatJSON ConfigFormat = 1
+
+	configFormatToString = map[ConfigFormat]string{
+		ConfigFormatYAML: "yaml",
+		ConfigFormatJSON: "json",
+	}
+	stringToConfigFormat = map[string]ConfigFormat{
+		"yaml": ConfigFormatYAML,
+		"yml":  ConfigFormatYAML,
+		"json": ConfigFormatJSON,
+	}
+)
+
+type ConfigFormat uint
+
+func AllConfigFormats() []ConfigFormat {
+	return []ConfigFormat{
+		ConfigFormatYAML,
+		ConfigFormatJSON,
+	}
+}
+
+func ConfigFormatOf(s string) (ConfigFormat, error) {
+	configFormat, ok := stringToConfigFormat[s]
+	if !ok {
+		return 0, UnknownConfigFormat(s)
+	}
+	return configFormat, nil
+}
+
+func (c ConfigFormat) String() string {
+	if s, ok := configFormatToString[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("ConfigFormat(%d)", uint(c))
+}
+
+func UnknownConfigFormat(unknownConfigFormat interface{}) error {
+	return fmt.Errorf("exec: unknown ConfigFormat: %v", unknownConfigFormat)
+}
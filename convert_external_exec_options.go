@@ -1,16 +1,96 @@
 package exec
 
 func convertExternalExecOptions(externalExecOptions *ExternalExecOptions) (ExecOptions, error) {
-	execType, err := ExecTypeOf(externalExecOptions.Type)
-	if err != nil {
-		return nil, err
-	}
-	switch execType {
+	switch externalExecOptions.Type {
 	case ExecTypeOs:
+		tmpfsOptions, err := convertExternalTmpfsOptions(externalExecOptions.Tmpfs)
+		if err != nil {
+			return nil, err
+		}
 		return &OsExecOptions{
-			TmpDir: externalExecOptions.TmpDir,
+			TmpDir:    externalExecOptions.TmpDir,
+			MaxBytes:  externalExecOptions.MaxBytes,
+			MaxInodes: externalExecOptions.MaxInodes,
+			Tmpfs:     tmpfsOptions,
 		}, nil
+	case ExecTypeRemote:
+		remoteExecOptions := &RemoteExecOptions{}
+		if externalExecOptions.Remote != nil {
+			remoteExecOptions.Network = externalExecOptions.Remote.Network
+			remoteExecOptions.Address = externalExecOptions.Remote.Address
+		}
+		return remoteExecOptions, nil
+	case ExecTypeSSH:
+		sshExecOptions := &SSHExecOptions{}
+		if externalExecOptions.SSH != nil {
+			sshExecOptions.Host = externalExecOptions.SSH.Host
+			sshExecOptions.User = externalExecOptions.SSH.User
+			sshExecOptions.KeyFile = externalExecOptions.SSH.KeyFile
+			sshExecOptions.KnownHostsFile = externalExecOptions.SSH.KnownHostsFile
+			sshExecOptions.TmpDir = externalExecOptions.SSH.TmpDir
+		}
+		return sshExecOptions, nil
+	case ExecTypeOCI:
+		return convertExternalOCIOptions(externalExecOptions), nil
+	case ExecTypeReplay:
+		replayExecOptions := &ReplayExecOptions{TmpDir: externalExecOptions.TmpDir}
+		if externalExecOptions.Replay != nil {
+			replayExecOptions.CassetteFile = externalExecOptions.Replay.CassetteFile
+		}
+		return replayExecOptions, nil
 	default:
-		return nil, UnknownExecType(execType)
+		return nil, ValidationErrors{newValidationErrorUnknownExecType(externalExecOptions.Type.String())}
+	}
+}
+
+func convertExternalTmpfsOptions(externalTmpfsOptions *ExternalTmpfsOptions) (*TmpfsOptions, error) {
+	if externalTmpfsOptions == nil {
+		return nil, nil
+	}
+	tmpfsOptions := &TmpfsOptions{Fallback: externalTmpfsOptions.Fallback}
+	if externalTmpfsOptions.Size != "" {
+		size, err := parseByteSize(externalTmpfsOptions.Size)
+		if err != nil {
+			return nil, ValidationErrors{newValidationErrorInvalidValue("tmpfs.size", externalTmpfsOptions.Size, err)}
+		}
+		tmpfsOptions.Size = size
+	}
+	return tmpfsOptions, nil
+}
+
+func convertExternalOCIOptions(externalExecOptions *ExternalExecOptions) *OCIExecOptions {
+	ociExecOptions := &OCIExecOptions{
+		TmpDir:    externalExecOptions.TmpDir,
+		MaxBytes:  externalExecOptions.MaxBytes,
+		MaxInodes: externalExecOptions.MaxInodes,
+	}
+	externalOCIOptions := externalExecOptions.OCI
+	if externalOCIOptions == nil {
+		return ociExecOptions
+	}
+	ociExecOptions.Runtime = externalOCIOptions.Runtime
+	ociExecOptions.Rootfs = externalOCIOptions.Rootfs
+	ociExecOptions.Rootless = externalOCIOptions.Rootless
+	if externalOCIOptions.User != nil {
+		ociExecOptions.User = &OCIUser{
+			UID: externalOCIOptions.User.UID,
+			GID: externalOCIOptions.User.GID,
+		}
+	}
+	ociExecOptions.Env = externalOCIOptions.Env
+	for _, externalOCIMount := range externalOCIOptions.Mounts {
+		ociExecOptions.Mounts = append(ociExecOptions.Mounts, &OCIMount{
+			Source:      externalOCIMount.Source,
+			Destination: externalOCIMount.Destination,
+			ReadOnly:    externalOCIMount.ReadOnly,
+		})
+	}
+	for _, externalOCIRlimit := range externalOCIOptions.Rlimits {
+		ociExecOptions.Rlimits = append(ociExecOptions.Rlimits, &OCIRlimit{
+			Type: externalOCIRlimit.Type,
+			Soft: externalOCIRlimit.Soft,
+			Hard: externalOCIRlimit.Hard,
+		})
 	}
+	return ociExecOptions
 }
@@ -0,0 +1,314 @@
+package exec
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	SymlinkPolicyPreserve SymlinkPolicy = 0
+	SymlinkPolicyFollow   SymlinkPolicy = 1
+	SymlinkPolicySkip     SymlinkPolicy = 2
+	SymlinkPolicyError    SymlinkPolicy = 3
+)
+
+// What to do with symlinks found while copying
+type SymlinkPolicy uint
+
+// Called as data is written, size is the size of the file being copied
+type CopyProgressFunc func(path string, written int64, size int64)
+
+type CopyOptions struct {
+	SymlinkPolicy SymlinkPolicy
+	// Do not preserve modification times
+	IgnoreTimes bool
+	// Can be nil
+	Progress CopyProgressFunc
+}
+
+type copySource interface {
+	lstat(path string) (os.FileInfo, error)
+	stat(path string) (os.FileInfo, error)
+	readDir(path string) ([]os.FileInfo, error)
+	readlink(path string) (string, error)
+	open(path string) (io.ReadCloser, error)
+	join(elem ...string) string
+}
+
+type copyDestination interface {
+	// creates path only writable by the owner, the parents of path 0755
+	mkdir(path string) error
+	chmod(path string, perm os.FileMode) error
+	create(path string, perm os.FileMode) (io.WriteCloser, error)
+	symlink(target string, path string) error
+	chtimes(path string, fileInfo os.FileInfo) error
+	join(elem ...string) string
+}
+
+func copyIn(writeFileManager WriteFileManager, hostPath string, path string, copyOptions *CopyOptions) error {
+	return copyTree(hostCopySource{}, hostPath, newFileManagerCopyDestination(writeFileManager), path, copyOptions)
+}
+
+func copyOut(readFileManager ReadFileManager, path string, hostPath string, copyOptions *CopyOptions) error {
+	return copyTree(newFileManagerCopySource(readFileManager), path, hostCopyDestination{}, hostPath, copyOptions)
+}
+
+func copyBetween(from ReadFileManager, fromPath string, to WriteFileManager, toPath string, copyOptions *CopyOptions) error {
+	return copyTree(newFileManagerCopySource(from), fromPath, newFileManagerCopyDestination(to), toPath, copyOptions)
+}
+
+func copyTree(source copySource, fromPath string, destination copyDestination, toPath string, copyOptions *CopyOptions) error {
+	if copyOptions == nil {
+		copyOptions = &CopyOptions{}
+	}
+	fileInfo, err := source.lstat(fromPath)
+	if err != nil {
+		return err
+	}
+	return (&copier{source, destination, copyOptions, nil}).copy(fromPath, toPath, fileInfo)
+}
+
+type copier struct {
+	source      copySource
+	destination copyDestination
+	copyOptions *CopyOptions
+	// the directories being copied, used to detect symlink cycles
+	dirFileInfos []os.FileInfo
+}
+
+func (c *copier) copy(fromPath string, toPath string, fileInfo os.FileInfo) error {
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		switch c.copyOptions.SymlinkPolicy {
+		case SymlinkPolicyPreserve:
+			target, err := c.source.readlink(fromPath)
+			if err != nil {
+				return err
+			}
+			return c.destination.symlink(target, toPath)
+		case SymlinkPolicyFollow:
+			targetFileInfo, err := c.source.stat(fromPath)
+			if err != nil {
+				return err
+			}
+			fileInfo = targetFileInfo
+		case SymlinkPolicySkip:
+			return nil
+		default:
+			return fmt.Errorf("exec: cannot copy symlink %s", fromPath)
+		}
+	}
+	switch {
+	case fileInfo.IsDir():
+		return c.copyDir(fromPath, toPath, fileInfo)
+	case fileInfo.Mode().IsRegular():
+		return c.copyFile(fromPath, toPath, fileInfo)
+	default:
+		return fmt.Errorf("exec: cannot copy %s with mode %v", fromPath, fileInfo.Mode())
+	}
+}
+
+func (c *copier) copyDir(fromPath string, toPath string, fileInfo os.FileInfo) error {
+	for _, dirFileInfo := range c.dirFileInfos {
+		if sameFile(dirFileInfo, fileInfo) {
+			return fmt.Errorf("exec: symlink cycle at %s", fromPath)
+		}
+	}
+	c.dirFileInfos = append(c.dirFileInfos, fileInfo)
+	defer func() {
+		c.dirFileInfos = c.dirFileInfos[:len(c.dirFileInfos)-1]
+	}()
+	// the mode is set after the children are written, as it may not allow writing
+	if err := c.destination.mkdir(toPath); err != nil {
+		return err
+	}
+	fileInfos, err := c.source.readDir(fromPath)
+	if err != nil {
+		return err
+	}
+	for _, childFileInfo := range fileInfos {
+		if err := c.copy(
+			c.source.join(fromPath, childFileInfo.Name()),
+			c.destination.join(toPath, childFileInfo.Name()),
+			childFileInfo,
+		); err != nil {
+			return err
+		}
+	}
+	if err := c.destination.chmod(toPath, fileInfo.Mode().Perm()); err != nil {
+		return err
+	}
+	return c.chtimes(toPath, fileInfo)
+}
+
+func (c *copier) copyFile(fromPath string, toPath string, fileInfo os.FileInfo) (retErr error) {
+	reader, err := c.source.open(fromPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := reader.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	writeCloser, err := c.destination.create(toPath, fileInfo.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	var writer io.Writer = writeCloser
+	if c.copyOptions.Progress != nil {
+		writer = &progressWriter{writeCloser, c.copyOptions.Progress, toPath, 0, fileInfo.Size()}
+	}
+	_, err = io.Copy(writer, reader)
+	if closeErr := writeCloser.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return c.chtimes(toPath, fileInfo)
+}
+
+func (c *copier) chtimes(path string, fileInfo os.FileInfo) error {
+	if c.copyOptions.IgnoreTimes {
+		return nil
+	}
+	return c.destination.chtimes(path, fileInfo)
+}
+
+type progressWriter struct {
+	writer   io.Writer
+	progress CopyProgressFunc
+	path     string
+	written  int64
+	size     int64
+}
+
+func (p *progressWriter) Write(data []byte) (int, error) {
+	n, err := p.writer.Write(data)
+	p.written += int64(n)
+	p.progress(p.path, p.written, p.size)
+	return n, err
+}
+
+type hostCopySource struct{}
+
+func (hostCopySource) lstat(path string) (os.FileInfo, error)     { return os.Lstat(path) }
+func (hostCopySource) stat(path string) (os.FileInfo, error)      { return os.Stat(path) }
+func (hostCopySource) readDir(path string) ([]os.FileInfo, error) { return readHostDir(path) }
+func (hostCopySource) readlink(path string) (string, error)       { return os.Readlink(path) }
+func (hostCopySource) open(path string) (io.ReadCloser, error)    { return os.Open(path) }
+func (hostCopySource) join(elem ...string) string                 { return filepath.Join(elem...) }
+
+type hostCopyDestination struct{}
+
+func (hostCopyDestination) mkdir(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.MkdirAll(path, 0700)
+}
+
+func (hostCopyDestination) chmod(path string, perm os.FileMode) error {
+	return os.Chmod(path, perm)
+}
+
+func (hostCopyDestination) create(path string, perm os.FileMode) (io.WriteCloser, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(perm); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (hostCopyDestination) symlink(target string, path string) error {
+	return os.Symlink(target, path)
+}
+
+func (hostCopyDestination) chtimes(path string, fileInfo os.FileInfo) error {
+	return os.Chtimes(path, fileInfo.ModTime(), fileInfo.ModTime())
+}
+
+func (hostCopyDestination) join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+type fileManagerCopySource struct {
+	readFileManager ReadFileManager
+}
+
+func newFileManagerCopySource(readFileManager ReadFileManager) *fileManagerCopySource {
+	return &fileManagerCopySource{readFileManager}
+}
+
+func (f *fileManagerCopySource) lstat(path string) (os.FileInfo, error) {
+	return f.readFileManager.Lstat(path)
+}
+
+func (f *fileManagerCopySource) stat(path string) (os.FileInfo, error) {
+	return f.readFileManager.Stat(path)
+}
+
+func (f *fileManagerCopySource) readDir(path string) ([]os.FileInfo, error) {
+	return readDir(f.readFileManager, path)
+}
+
+func (f *fileManagerCopySource) readlink(path string) (string, error) {
+	return f.readFileManager.Readlink(path)
+}
+
+func (f *fileManagerCopySource) open(path string) (io.ReadCloser, error) {
+	return f.readFileManager.Open(path)
+}
+
+func (f *fileManagerCopySource) join(elem ...string) string {
+	return f.readFileManager.Join(elem...)
+}
+
+type fileManagerCopyDestination struct {
+	writeFileManager WriteFileManager
+}
+
+func newFileManagerCopyDestination(writeFileManager WriteFileManager) *fileManagerCopyDestination {
+	return &fileManagerCopyDestination{writeFileManager}
+}
+
+func (f *fileManagerCopyDestination) mkdir(path string) error {
+	if err := f.writeFileManager.MkdirAll(f.writeFileManager.Dir(path), 0755); err != nil {
+		return err
+	}
+	return f.writeFileManager.MkdirAll(path, 0700)
+}
+
+func (f *fileManagerCopyDestination) chmod(path string, perm os.FileMode) error {
+	return f.writeFileManager.Chmod(path, perm)
+}
+
+func (f *fileManagerCopyDestination) create(path string, perm os.FileMode) (io.WriteCloser, error) {
+	file, err := f.writeFileManager.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(perm); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *fileManagerCopyDestination) symlink(target string, path string) error {
+	return f.writeFileManager.Symlink(target, path)
+}
+
+func (f *fileManagerCopyDestination) chtimes(path string, fileInfo os.FileInfo) error {
+	return f.writeFileManager.Chtimes(path, fileInfo.ModTime(), fileInfo.ModTime())
+}
+
+func (f *fileManagerCopyDestination) join(elem ...string) string {
+	return f.writeFileManager.Join(elem...)
+}
@@ -0,0 +1,712 @@
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/codeship/go-concurrent"
+)
+
+// dryRunClientProvider wraps the clients of clientProvider so that nothing
+// is executed or changed in their directories, and writes the plan of what
+// would have been done on Destroy.
+type dryRunClientProvider struct {
+	concurrent.Destroyable
+	clientProvider ClientProvider
+	planner        *dryRunPlanner
+}
+
+func newDryRunClientProvider(clientProvider ClientProvider, dryRunOptions *DryRunOptions) *dryRunClientProvider {
+	if dryRunOptions == nil {
+		dryRunOptions = &DryRunOptions{}
+	}
+	planner := newDryRunPlanner()
+	return &dryRunClientProvider{
+		concurrent.NewDestroyable(func() error {
+			err := clientProvider.Destroy()
+			if writeErr := planner.write(dryRunOptions); writeErr != nil && err == nil {
+				err = writeErr
+			}
+			return err
+		}),
+		clientProvider,
+		planner,
+	}
+}
+
+func (d *dryRunClientProvider) NewTempDirExecutorReadFileManager() (ExecutorReadFileManager, error) {
+	return d.NewTempDirClient()
+}
+
+func (d *dryRunClientProvider) NewTempDirExecutorWriteFileManager() (ExecutorWriteFileManager, error) {
+	return d.NewTempDirClient()
+}
+
+func (d *dryRunClientProvider) NewTempDirClient() (Client, error) {
+	value, err := d.Do(func() (interface{}, error) {
+		return d.clientProvider.NewTempDirClient()
+	})
+	if err != nil {
+		return nil, err
+	}
+	client := value.(Client)
+	dryRunClient := newDryRunClient(client.Destroy, newDryRunLayers(client), d.planner, "")
+	if err := d.AddChild(dryRunClient); err != nil {
+		_ = dryRunClient.Destroy()
+		return nil, err
+	}
+	return dryRunClient, nil
+}
+
+// dryRunClient records commands instead of executing them, and makes file
+// changes to its layers. The steps are recorded once made, and writes once
+// the file is closed.
+type dryRunClient struct {
+	concurrent.Destroyable
+	layers   *dryRunLayers
+	planner  *dryRunPlanner
+	subPath  string
+	releaser *releaser
+}
+
+func newDryRunClient(destroyCallback func() error, layers *dryRunLayers, planner *dryRunPlanner, subPath string) *dryRunClient {
+	releaser := newReleaser()
+	return &dryRunClient{
+		concurrent.NewDestroyable(func() error {
+			err := releaser.destroy()
+			layers.lockTable.wake()
+			if callbackErr := destroyCallback(); callbackErr != nil && err == nil {
+				err = callbackErr
+			}
+			return err
+		}),
+		layers,
+		planner,
+		subPath,
+		releaser,
+	}
+}
+
+func (d *dryRunClient) DirName() string {
+	return d.layers.lower.Base(d.DirPath())
+}
+
+func (d *dryRunClient) DirPath() string {
+	if d.subPath == "" {
+		return d.layers.lower.DirPath()
+	}
+	return d.layers.lower.Join(d.layers.lower.DirPath(), d.subPath)
+}
+
+func (d *dryRunClient) Execute(cmd *Cmd) func() error {
+	return d.execute([]*PipeCmd{{Args: cmd.Args, SubDir: cmd.SubDir, Env: cmd.Env}})
+}
+
+func (d *dryRunClient) ExecutePiped(pipeCmdList *PipeCmdList) func() error {
+	return d.execute(pipeCmdList.PipeCmds)
+}
+
+func (d *dryRunClient) execute(pipeCmds []*PipeCmd) func() error {
+	dryRunCmds := make([]*DryRunCmd, len(pipeCmds))
+	for i, pipeCmd := range pipeCmds {
+		if len(pipeCmd.Args) == 0 {
+			return func() error { return ErrArgsEmpty }
+		}
+		subDir, err := d.layerPath(pipeCmd.SubDir)
+		if err != nil {
+			return func() error { return err }
+		}
+		if subDir == "." {
+			subDir = ""
+		}
+		dryRunCmds[i] = &DryRunCmd{
+			Args:   append([]string(nil), pipeCmd.Args...),
+			SubDir: subDir,
+			Env:    append([]string(nil), pipeCmd.Env...),
+		}
+	}
+	if _, err := d.Do(func() (interface{}, error) {
+		d.record(&DryRunStep{Op: DryRunOpExecute, Cmds: dryRunCmds})
+		return nil, nil
+	}); err != nil {
+		return func() error { return err }
+	}
+	return func() error { return nil }
+}
+
+func (d *dryRunClient) IsFileExists(path string) (bool, error) {
+	value, err := d.do(path, func(layerPath string) (interface{}, error) {
+		entry, err := d.layers.lookup(layerPath)
+		if err != nil {
+			return nil, err
+		}
+		return entry.exists(), nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return value.(bool), nil
+}
+
+func (d *dryRunClient) Open(path string) (ReadFile, error) {
+	return d.OpenFile(path, os.O_RDONLY, 0)
+}
+
+func (d *dryRunClient) Stat(path string) (os.FileInfo, error) {
+	value, err := d.do(path, func(layerPath string) (interface{}, error) {
+		resolvedPath, entry, outside, err := d.layers.resolve("stat", layerPath)
+		if err != nil {
+			return nil, err
+		}
+		if outside {
+			return d.layers.lower.Stat(resolvedPath)
+		}
+		if !entry.exists() {
+			return nil, &os.PathError{Op: "stat", Path: path, Err: syscall.ENOENT}
+		}
+		return entry.fileInfo, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(os.FileInfo), nil
+}
+
+func (d *dryRunClient) Lstat(path string) (os.FileInfo, error) {
+	value, err := d.do(path, func(layerPath string) (interface{}, error) {
+		entry, err := d.layers.lookupExisting("lstat", layerPath)
+		if err != nil {
+			return nil, err
+		}
+		return entry.fileInfo, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(os.FileInfo), nil
+}
+
+func (d *dryRunClient) Readlink(path string) (string, error) {
+	value, err := d.do(path, func(layerPath string) (interface{}, error) {
+		entry, err := d.layers.lookupExisting("readlink", layerPath)
+		if err != nil {
+			return nil, err
+		}
+		return d.layers.readlink(layerPath, entry)
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+func (d *dryRunClient) Create(path string) (WriteFile, error) {
+	return d.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (d *dryRunClient) OpenFile(path string, flag int, perm os.FileMode) (ReadWriteFile, error) {
+	value, err := d.do(path, func(layerPath string) (interface{}, error) {
+		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			entry, err := d.layers.lookup(layerPath)
+			if err != nil {
+				return nil, err
+			}
+			if entry.exists() {
+				return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EEXIST}
+			}
+		}
+		resolvedPath, entry, outside, err := d.layers.resolve("open", layerPath)
+		if err != nil {
+			return nil, err
+		}
+		if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_TRUNC) == 0 && (outside || entry.exists() || flag&os.O_CREATE == 0) {
+			return d.openRead(path, resolvedPath, entry, outside)
+		}
+		if outside {
+			return nil, &os.PathError{Op: "open", Path: path, Err: ErrPathOutOfContext}
+		}
+		switch {
+		case entry.exists() && entry.fileInfo.IsDir():
+			return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EISDIR}
+		case entry.exists():
+			node, err := d.layers.copyUp(resolvedPath, entry)
+			if err != nil {
+				return nil, err
+			}
+			if err := d.layers.load(node); err != nil {
+				return nil, err
+			}
+			file := d.newDryRunFile(path, resolvedPath, node, flag)
+			if flag&os.O_TRUNC != 0 {
+				truncate(node, 0)
+				file.written = true
+			}
+			return file, nil
+		case flag&os.O_CREATE != 0:
+			if err := d.layers.checkParent("open", resolvedPath); err != nil {
+				return nil, err
+			}
+			node := &dryRunNode{mode: perm.Perm()}
+			d.layers.create(resolvedPath, node)
+			d.layers.watchHub.notify(resolvedPath, WatchOpCreate)
+			file := d.newDryRunFile(path, resolvedPath, node, flag)
+			file.created = true
+			return file, nil
+		default:
+			return nil, &os.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(ReadWriteFile), nil
+}
+
+// this is only called in thread-safe context
+func (d *dryRunClient) openRead(path string, resolvedPath string, entry *dryRunEntry, outside bool) (ReadWriteFile, error) {
+	switch {
+	case outside:
+		return d.layers.lower.OpenFile(resolvedPath, os.O_RDONLY, 0)
+	case !entry.exists():
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+	case entry.fileInfo.IsDir():
+		fileInfos, err := d.layers.readDir(resolvedPath, entry)
+		if err != nil {
+			return nil, err
+		}
+		return newOverlayDir(path, entry.fileInfo, fileInfos), nil
+	case entry.node == nil:
+		return d.layers.lower.OpenFile(resolvedPath, os.O_RDONLY, 0)
+	case entry.node.lowerPath != "":
+		return d.layers.lower.OpenFile(entry.node.lowerPath, os.O_RDONLY, 0)
+	}
+	return d.newDryRunFile(path, resolvedPath, entry.node, os.O_RDONLY), nil
+}
+
+func (d *dryRunClient) newDryRunFile(name string, layerPath string, node *dryRunNode, flag int) *dryRunFile {
+	return &dryRunFile{
+		client:    d,
+		layers:    d.layers,
+		node:      node,
+		name:      name,
+		layerPath: layerPath,
+		flag:      flag,
+	}
+}
+
+func (d *dryRunClient) MkdirAll(path string, perm os.FileMode) error {
+	_, err := d.do(path, func(layerPath string) (interface{}, error) {
+		if layerPath == "." {
+			return nil, nil
+		}
+		elems := strings.Split(layerPath, string(filepath.Separator))
+		for i := range elems {
+			prefix := filepath.Join(elems[:i+1]...)
+			entry, err := d.layers.lookup(prefix)
+			if err != nil {
+				return nil, err
+			}
+			if entry.exists() {
+				if !entry.fileInfo.IsDir() {
+					return nil, &os.PathError{Op: "mkdir", Path: prefix, Err: syscall.ENOTDIR}
+				}
+				continue
+			}
+			if err := d.mkdir(prefix, perm); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// this is only called in thread-safe context
+func (d *dryRunClient) mkdir(layerPath string, perm os.FileMode) error {
+	if err := d.layers.mkdir(layerPath, perm); err != nil {
+		return err
+	}
+	d.record(&DryRunStep{Op: DryRunOpMkdir, Path: layerPath, Mode: os.ModeDir | perm.Perm()})
+	d.layers.watchHub.notify(layerPath, WatchOpCreate)
+	return nil
+}
+
+func (d *dryRunClient) Rename(oldpath string, newpath string) error {
+	newLayerPath, err := d.layerPath(newpath)
+	if err != nil {
+		return err
+	}
+	_, err = d.do(oldpath, func(oldLayerPath string) (interface{}, error) {
+		newLayerPath, err := d.layers.resolveParents("rename", newLayerPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.layers.rename(oldLayerPath, newLayerPath); err != nil {
+			return nil, err
+		}
+		d.record(&DryRunStep{Op: DryRunOpRename, Path: oldLayerPath, NewPath: newLayerPath})
+		d.layers.watchHub.notify(oldLayerPath, WatchOpRename)
+		d.layers.watchHub.notify(newLayerPath, WatchOpCreate)
+		return nil, nil
+	})
+	return err
+}
+
+func (d *dryRunClient) Remove(path string) error {
+	_, err := d.do(path, func(layerPath string) (interface{}, error) {
+		if err := d.layers.remove(layerPath); err != nil {
+			return nil, err
+		}
+		d.record(&DryRunStep{Op: DryRunOpRemove, Path: layerPath})
+		d.layers.watchHub.notify(layerPath, WatchOpRemove)
+		return nil, nil
+	})
+	return err
+}
+
+func (d *dryRunClient) RemoveAll(path string) error {
+	_, err := d.do(path, func(layerPath string) (interface{}, error) {
+		return nil, d.removeAll(layerPath)
+	})
+	return err
+}
+
+// this is only called in thread-safe context
+func (d *dryRunClient) removeAll(layerPath string) error {
+	entry, err := d.layers.lookup(layerPath)
+	if err != nil {
+		return err
+	}
+	if !entry.exists() {
+		return nil
+	}
+	var layerPaths []string
+	if err := d.layers.walk(layerPath, entry, func(path string, entry *dryRunEntry) error {
+		layerPaths = append(layerPaths, path)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := d.layers.removeAll(layerPath); err != nil {
+		return err
+	}
+	d.record(&DryRunStep{Op: DryRunOpRemoveAll, Path: layerPath})
+	for i := len(layerPaths) - 1; i >= 0; i-- {
+		d.layers.watchHub.notify(layerPaths[i], WatchOpRemove)
+	}
+	return nil
+}
+
+func (d *dryRunClient) Chmod(path string, mode os.FileMode) error {
+	return d.copyUpAnd("chmod", path, WatchOpChmod, func(layerPath string, node *dryRunNode) *DryRunStep {
+		node.mode = node.mode&^os.ModePerm | mode.Perm()
+		return &DryRunStep{Op: DryRunOpChmod, Path: layerPath, Mode: node.mode}
+	})
+}
+
+// The owner is not kept, only recorded
+func (d *dryRunClient) Chown(path string, uid int, gid int) error {
+	return d.copyUpAnd("chown", path, WatchOpChmod, func(layerPath string, node *dryRunNode) *DryRunStep {
+		return &DryRunStep{Op: DryRunOpChown, Path: layerPath, UID: uid, GID: gid}
+	})
+}
+
+func (d *dryRunClient) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return d.copyUpAnd("chtimes", path, WatchOpChmod, func(layerPath string, node *dryRunNode) *DryRunStep {
+		node.modTime = mtime
+		return &DryRunStep{Op: DryRunOpChtimes, Path: layerPath, ModTime: mtime}
+	})
+}
+
+func (d *dryRunClient) Truncate(path string, size int64) error {
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: path, Err: syscall.EINVAL}
+	}
+	_, err := d.do(path, func(layerPath string) (interface{}, error) {
+		resolvedPath, entry, err := d.resolveExisting("truncate", path, layerPath)
+		if err != nil {
+			return nil, err
+		}
+		if entry.fileInfo.IsDir() {
+			return nil, &os.PathError{Op: "truncate", Path: path, Err: syscall.EISDIR}
+		}
+		node, err := d.layers.copyUp(resolvedPath, entry)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.layers.load(node); err != nil {
+			return nil, err
+		}
+		truncate(node, size)
+		d.record(&DryRunStep{Op: DryRunOpTruncate, Path: resolvedPath, Size: size})
+		d.layers.watchHub.notify(resolvedPath, WatchOpWrite)
+		return nil, nil
+	})
+	return err
+}
+
+// copyUpAnd follows the symlinks at path, and records the step returned by
+// f for the entry they lead to
+func (d *dryRunClient) copyUpAnd(op string, path string, watchOp WatchOp, f func(string, *dryRunNode) *DryRunStep) error {
+	_, err := d.do(path, func(layerPath string) (interface{}, error) {
+		resolvedPath, entry, err := d.resolveExisting(op, path, layerPath)
+		if err != nil {
+			return nil, err
+		}
+		node, err := d.layers.copyUp(resolvedPath, entry)
+		if err != nil {
+			return nil, err
+		}
+		d.record(f(resolvedPath, node))
+		d.layers.watchHub.notify(resolvedPath, watchOp)
+		return nil, nil
+	})
+	return err
+}
+
+// this is only called in thread-safe context
+func (d *dryRunClient) resolveExisting(op string, path string, layerPath string) (string, *dryRunEntry, error) {
+	resolvedPath, entry, outside, err := d.layers.resolve(op, layerPath)
+	if err != nil {
+		return "", nil, err
+	}
+	if outside {
+		return "", nil, &os.PathError{Op: op, Path: path, Err: ErrPathOutOfContext}
+	}
+	if !entry.exists() {
+		return "", nil, &os.PathError{Op: op, Path: path, Err: syscall.ENOENT}
+	}
+	return resolvedPath, entry, nil
+}
+
+func (d *dryRunClient) Symlink(oldname string, newname string) error {
+	_, err := d.do(newname, func(layerPath string) (interface{}, error) {
+		if err := d.layers.prepareCreate("symlink", layerPath); err != nil {
+			return nil, err
+		}
+		d.layers.create(layerPath, &dryRunNode{mode: os.ModeSymlink | os.ModePerm, target: oldname})
+		d.record(&DryRunStep{Op: DryRunOpSymlink, Path: layerPath, Target: oldname})
+		d.layers.watchHub.notify(layerPath, WatchOpCreate)
+		return nil, nil
+	})
+	return err
+}
+
+func (d *dryRunClient) Link(oldname string, newname string) error {
+	newLayerPath, err := d.layerPath(newname)
+	if err != nil {
+		return err
+	}
+	_, err = d.do(oldname, func(oldLayerPath string) (interface{}, error) {
+		entry, err := d.layers.lookupExisting("link", oldLayerPath)
+		if err != nil {
+			return nil, err
+		}
+		newLayerPath, err := d.layers.resolveParents("link", newLayerPath)
+		if err != nil {
+			return nil, err
+		}
+		if entry.fileInfo.IsDir() {
+			return nil, &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+		}
+		if err := d.layers.prepareCreate("link", newLayerPath); err != nil {
+			return nil, err
+		}
+		node, err := d.layers.copyUp(oldLayerPath, entry)
+		if err != nil {
+			return nil, err
+		}
+		d.layers.upper[newLayerPath] = node
+		d.record(&DryRunStep{Op: DryRunOpLink, Path: newLayerPath, Target: oldLayerPath})
+		d.layers.watchHub.notify(newLayerPath, WatchOpCreate)
+		return nil, nil
+	})
+	return err
+}
+
+func (d *dryRunClient) Lock(path string, exclusive bool) (Unlocker, error) {
+	return d.lock(path, exclusive, true)
+}
+
+func (d *dryRunClient) TryLock(path string, exclusive bool) (Unlocker, error) {
+	return d.lock(path, exclusive, false)
+}
+
+func (d *dryRunClient) lock(path string, exclusive bool, wait bool) (Unlocker, error) {
+	layerPath, err := d.layerPath(path)
+	if err != nil {
+		return nil, err
+	}
+	// as with flock, the file is created if it does not exist
+	file, err := d.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	unlock, err := d.layers.lockTable.acquire(layerPath, exclusive, wait, d.releaser.isDestroyed)
+	if err != nil {
+		return nil, err
+	}
+	releasable, err := d.releaser.add(unlock)
+	if err != nil {
+		return nil, err
+	}
+	return releasable, nil
+}
+
+func (d *dryRunClient) ListRegularFiles(path string) ([]string, error) {
+	value, err := d.do(path, func(layerPath string) (interface{}, error) {
+		entry, err := d.layers.lookupExisting("lstat", layerPath)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		if err := d.layers.walk(layerPath, entry, func(childLayerPath string, childEntry *dryRunEntry) error {
+			if !childEntry.fileInfo.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(layerPath, childLayerPath)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.Join(path, rel))
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		return files, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]string), nil
+}
+
+func (d *dryRunClient) Join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+func (d *dryRunClient) Walk(root string, walkOptions *WalkOptions, walkFunc WalkFunc) error {
+	if _, err := d.layerPath(root); err != nil {
+		return err
+	}
+	return walk(d, root, walkOptions, walkFunc)
+}
+
+func (d *dryRunClient) Watch(path string, recursive bool) (Watcher, error) {
+	value, err := d.do(path, func(layerPath string) (interface{}, error) {
+		if _, err := d.layers.lookupExisting("watch", layerPath); err != nil {
+			return nil, err
+		}
+		return d.layers.watchHub.watch(layerPath, filepath.Clean(d.subPath), recursive), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addWatcher(d.releaser, value.(Watcher))
+}
+
+func (d *dryRunClient) Glob(patterns ...string) ([]string, error) {
+	return glob(d, patterns)
+}
+
+func (d *dryRunClient) Match(pattern string, path string) (bool, error) {
+	return matchPattern(filepath.ToSlash(pattern), filepath.ToSlash(path))
+}
+
+func (d *dryRunClient) ToSlash(path string) string {
+	return filepath.ToSlash(path)
+}
+
+func (d *dryRunClient) Base(path string) string {
+	return filepath.Base(path)
+}
+
+func (d *dryRunClient) Dir(path string) string {
+	return filepath.Dir(path)
+}
+
+func (d *dryRunClient) PathSeparator() string {
+	return string(os.PathSeparator)
+}
+
+func (d *dryRunClient) NewSubDirExecutorReadFileManager(path string) (ExecutorReadFileManager, error) {
+	return d.newSubDirClient(path)
+}
+
+func (d *dryRunClient) NewSubDirExecutorWriteFileManager(path string) (ExecutorWriteFileManager, error) {
+	return d.newSubDirClient(path)
+}
+
+func (d *dryRunClient) NewSubDirClient(path string) (Client, error) {
+	return d.newSubDirClient(path)
+}
+
+// The directory is removed from the layers when the sub directory client is
+// destroyed, which is recorded as it would be done.
+func (d *dryRunClient) newSubDirClient(path string) (*dryRunClient, error) {
+	value, err := d.do(path, func(layerPath string) (interface{}, error) {
+		entry, err := d.layers.lookup(layerPath)
+		if err != nil {
+			return nil, err
+		}
+		if entry.exists() {
+			return nil, ErrFileAlreadyExists
+		}
+		if err := d.mkdir(layerPath, 0755); err != nil {
+			return nil, err
+		}
+		return layerPath, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	subPath := value.(string)
+	subDirClient := newDryRunClient(
+		func() error {
+			d.layers.lock.Lock()
+			defer d.layers.lock.Unlock()
+			return d.removeAll(subPath)
+		},
+		d.layers,
+		d.planner,
+		subPath,
+	)
+	if err := d.AddChild(subDirClient); err != nil {
+		return nil, err
+	}
+	return subDirClient, nil
+}
+
+func (d *dryRunClient) record(step *DryRunStep) {
+	step.Dir = d.layers.lower.DirPath()
+	d.planner.add(step)
+}
+
+// do validates path and calls f with the path relative to the root of the
+// layers, with the symlinks of its parent directories followed, while
+// holding the layers lock.
+func (d *dryRunClient) do(path string, f func(string) (interface{}, error)) (interface{}, error) {
+	layerPath, err := d.layerPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return d.Do(func() (interface{}, error) {
+		d.layers.lock.Lock()
+		defer d.layers.lock.Unlock()
+		layerPath, err := d.layers.resolveParents("lstat", layerPath)
+		if err != nil {
+			return nil, err
+		}
+		return f(layerPath)
+	})
+}
+
+func (d *dryRunClient) layerPath(path string) (string, error) {
+	return joinSubPath(d.subPath, path)
+}
@@ -0,0 +1,646 @@
+package exec
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxDryRunSymlinks is the number of symlinks followed before ELOOP, as on Linux
+const maxDryRunSymlinks = 40
+
+// dryRunLayers keeps the changes made through dry run clients in memory, over
+// the directory of a client that is never modified. Paths are relative to
+// the root of the layers.
+type dryRunLayers struct {
+	lower Client
+	lock  sync.Mutex
+	upper map[string]*dryRunNode
+	// the lower layer entries at these paths, and below them, are hidden
+	removed map[string]bool
+	// shared by all the clients of the layers
+	lockTable *lockTable
+	watchHub  *watchHub
+}
+
+func newDryRunLayers(lower Client) *dryRunLayers {
+	return &dryRunLayers{
+		lower:     lower,
+		upper:     make(map[string]*dryRunNode),
+		removed:   make(map[string]bool),
+		lockTable: newLockTable(),
+		watchHub:  newWatchHub(),
+	}
+}
+
+// dryRunNode is shared by the paths hard linked to it
+type dryRunNode struct {
+	mode    os.FileMode
+	modTime time.Time
+	// for regular files, data is only read once lowerPath is empty
+	data      []byte
+	lowerPath string
+	lowerSize int64
+	// for symlinks
+	target string
+}
+
+func (d *dryRunNode) size() int64 {
+	if d.lowerPath != "" {
+		return d.lowerSize
+	}
+	return int64(len(d.data))
+}
+
+type dryRunFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	id      string
+}
+
+func newDryRunFileInfo(name string, node *dryRunNode) *dryRunFileInfo {
+	return &dryRunFileInfo{name, node.size(), node.mode, node.modTime, fmt.Sprintf("dryrun:%p", node)}
+}
+
+func (d *dryRunFileInfo) Name() string       { return d.name }
+func (d *dryRunFileInfo) Size() int64        { return d.size }
+func (d *dryRunFileInfo) Mode() os.FileMode  { return d.mode }
+func (d *dryRunFileInfo) ModTime() time.Time { return d.modTime }
+func (d *dryRunFileInfo) IsDir() bool        { return d.mode.IsDir() }
+func (d *dryRunFileInfo) Sys() interface{}   { return nil }
+
+func (d *dryRunFileInfo) fileID() string {
+	return d.id
+}
+
+type dryRunEntry struct {
+	fileInfo os.FileInfo
+	// nil if the entry is only in the lower layer
+	node *dryRunNode
+}
+
+func (d *dryRunEntry) exists() bool {
+	return d.fileInfo != nil
+}
+
+func (l *dryRunLayers) isHidden(path string) bool {
+	for {
+		if l.removed[path] {
+			return true
+		}
+		if path == "." {
+			return false
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// lookup returns the entry at path without following symlinks, path is
+// expected to have its parents resolved by resolveParents
+func (l *dryRunLayers) lookup(path string) (*dryRunEntry, error) {
+	if node, ok := l.upper[path]; ok {
+		return &dryRunEntry{newDryRunFileInfo(l.name(path), node), node}, nil
+	}
+	if l.isHidden(path) {
+		return &dryRunEntry{}, nil
+	}
+	fileInfo, err := l.lower.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) || isNotDir(err) {
+			return &dryRunEntry{}, nil
+		}
+		return nil, err
+	}
+	return &dryRunEntry{fileInfo, nil}, nil
+}
+
+func (l *dryRunLayers) lookupExisting(op string, path string) (*dryRunEntry, error) {
+	entry, err := l.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.exists() {
+		return nil, &os.PathError{Op: op, Path: path, Err: syscall.ENOENT}
+	}
+	return entry, nil
+}
+
+// resolve follows the symlinks at path and returns the path they lead to,
+// whose entry does not exist if they are dangling. The path of a symlink of
+// the lower layer pointing out of the layers is returned with outside set,
+// for the caller to use the lower layer.
+func (l *dryRunLayers) resolve(op string, path string) (string, *dryRunEntry, bool, error) {
+	links := 0
+	return l.follow(op, path, &links)
+}
+
+// resolveParents follows the symlinks of the parent directories of path, and
+// returns path in the directory they lead to, so that the entries of the
+// layers are only ever keyed by paths without symlinks in their parents.
+func (l *dryRunLayers) resolveParents(op string, path string) (string, error) {
+	links := 0
+	return l.followParents(op, path, &links)
+}
+
+// links counts the symlinks followed for a path, including those of its
+// parent directories
+func (l *dryRunLayers) follow(op string, path string, links *int) (string, *dryRunEntry, bool, error) {
+	path, err := l.followParents(op, path, links)
+	if err != nil {
+		return "", nil, false, err
+	}
+	for {
+		entry, err := l.lookup(path)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if !entry.exists() || entry.fileInfo.Mode()&os.ModeSymlink == 0 {
+			return path, entry, false, nil
+		}
+		if *links++; *links > maxDryRunSymlinks {
+			return "", nil, false, &os.PathError{Op: op, Path: path, Err: syscall.ELOOP}
+		}
+		target, err := l.readlink(path, entry)
+		if err != nil {
+			return "", nil, false, err
+		}
+		targetPath := filepath.Join(filepath.Dir(path), target)
+		if filepath.IsAbs(target) || targetPath == ".." || strings.HasPrefix(targetPath, ".."+string(filepath.Separator)) {
+			if entry.node == nil {
+				return path, entry, true, nil
+			}
+			return "", nil, false, &os.PathError{Op: op, Path: path, Err: ErrPathOutOfContext}
+		}
+		if path, err = l.followParents(op, targetPath, links); err != nil {
+			return "", nil, false, err
+		}
+	}
+}
+
+func (l *dryRunLayers) followParents(op string, path string, links *int) (string, error) {
+	dir := filepath.Dir(path)
+	if dir == "." {
+		return path, nil
+	}
+	dir, _, outside, err := l.follow(op, dir, links)
+	if err != nil {
+		return "", err
+	}
+	// the lower layer is not read through parents out of the layers
+	if outside {
+		return "", &os.PathError{Op: op, Path: path, Err: ErrPathOutOfContext}
+	}
+	// a missing or non-directory parent is left for the caller to report
+	return filepath.Join(dir, filepath.Base(path)), nil
+}
+
+func (l *dryRunLayers) readlink(path string, entry *dryRunEntry) (string, error) {
+	if entry.fileInfo.Mode()&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: syscall.EINVAL}
+	}
+	if entry.node != nil {
+		return entry.node.target, nil
+	}
+	return l.lower.Readlink(path)
+}
+
+// readDir returns the merged entries of the directory at path sorted by name
+func (l *dryRunLayers) readDir(path string, entry *dryRunEntry) ([]os.FileInfo, error) {
+	if !entry.fileInfo.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: syscall.ENOTDIR}
+	}
+	nameToFileInfo := make(map[string]os.FileInfo)
+	for childPath, node := range l.upper {
+		if childPath != path && filepath.Dir(childPath) == path {
+			nameToFileInfo[filepath.Base(childPath)] = newDryRunFileInfo(filepath.Base(childPath), node)
+		}
+	}
+	if !l.isHidden(path) {
+		fileInfos, err := readDir(l.lower, path)
+		if err != nil && !os.IsNotExist(err) && !isNotDir(err) {
+			return nil, err
+		}
+		for _, fileInfo := range fileInfos {
+			if _, ok := nameToFileInfo[fileInfo.Name()]; !ok && !l.removed[filepath.Join(path, fileInfo.Name())] {
+				nameToFileInfo[fileInfo.Name()] = fileInfo
+			}
+		}
+	}
+	fileInfos := make([]os.FileInfo, 0, len(nameToFileInfo))
+	for _, fileInfo := range nameToFileInfo {
+		fileInfos = append(fileInfos, fileInfo)
+	}
+	sort.Sort(fileInfosByName(fileInfos))
+	return fileInfos, nil
+}
+
+// checkParent makes sure that the parent of path is an existing directory,
+// path is expected to have its parents resolved by resolveParents
+func (l *dryRunLayers) checkParent(op string, path string) error {
+	entry, err := l.lookup(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if !entry.exists() {
+		return &os.PathError{Op: op, Path: path, Err: syscall.ENOENT}
+	}
+	if !entry.fileInfo.IsDir() {
+		return &os.PathError{Op: op, Path: path, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// prepareCreate makes sure that a new entry can be created at path
+func (l *dryRunLayers) prepareCreate(op string, path string) error {
+	entry, err := l.lookup(path)
+	if err != nil {
+		return err
+	}
+	if entry.exists() {
+		return &os.PathError{Op: op, Path: path, Err: syscall.EEXIST}
+	}
+	return l.checkParent(op, path)
+}
+
+// copyUp returns the upper layer node of the existing entry at path, which
+// keeps reading the data of a regular file from the lower layer.
+func (l *dryRunLayers) copyUp(path string, entry *dryRunEntry) (*dryRunNode, error) {
+	if entry.node != nil {
+		return entry.node, nil
+	}
+	node, err := l.newLowerNode(path, entry.fileInfo)
+	if err != nil {
+		return nil, err
+	}
+	l.upper[path] = node
+	return node, nil
+}
+
+func (l *dryRunLayers) newLowerNode(path string, fileInfo os.FileInfo) (*dryRunNode, error) {
+	node := &dryRunNode{mode: fileInfo.Mode(), modTime: fileInfo.ModTime()}
+	switch {
+	case fileInfo.IsDir():
+	case fileInfo.Mode().IsRegular():
+		node.lowerPath = path
+		node.lowerSize = fileInfo.Size()
+	case fileInfo.Mode()&os.ModeSymlink != 0:
+		target, err := l.lower.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		node.target = target
+	default:
+		return nil, &os.PathError{Op: "copyup", Path: path, Err: syscall.EINVAL}
+	}
+	return node, nil
+}
+
+// load reads the data of node from the lower layer if it was not yet
+func (l *dryRunLayers) load(node *dryRunNode) error {
+	if node.lowerPath == "" {
+		return nil
+	}
+	data, err := readAll(l.lower, node.lowerPath)
+	if err != nil {
+		return err
+	}
+	node.data = data
+	node.lowerPath = ""
+	node.lowerSize = 0
+	return nil
+}
+
+func (l *dryRunLayers) create(path string, node *dryRunNode) {
+	node.modTime = time.Now()
+	l.upper[path] = node
+}
+
+func (l *dryRunLayers) mkdir(path string, perm os.FileMode) error {
+	if err := l.prepareCreate("mkdir", path); err != nil {
+		return err
+	}
+	l.create(path, &dryRunNode{mode: os.ModeDir | perm.Perm()})
+	return nil
+}
+
+func (l *dryRunLayers) remove(path string) error {
+	entry, err := l.lookupExisting("remove", path)
+	if err != nil {
+		return err
+	}
+	if path == "." {
+		return &os.PathError{Op: "remove", Path: path, Err: syscall.EINVAL}
+	}
+	if entry.fileInfo.IsDir() {
+		fileInfos, err := l.readDir(path, entry)
+		if err != nil {
+			return err
+		}
+		if len(fileInfos) > 0 {
+			return &os.PathError{Op: "remove", Path: path, Err: syscall.ENOTEMPTY}
+		}
+	}
+	delete(l.upper, path)
+	l.removed[path] = true
+	return nil
+}
+
+func (l *dryRunLayers) removeAll(path string) error {
+	entry, err := l.lookup(path)
+	if err != nil {
+		return err
+	}
+	if !entry.exists() {
+		return nil
+	}
+	if entry.fileInfo.IsDir() {
+		fileInfos, err := l.readDir(path, entry)
+		if err != nil {
+			return err
+		}
+		for _, fileInfo := range fileInfos {
+			if err := l.removeAll(filepath.Join(path, fileInfo.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return l.remove(path)
+}
+
+// rename copies the entries below oldpath to the upper layer at newpath,
+// where the data of regular files keeps being read from the lower layer.
+func (l *dryRunLayers) rename(oldpath string, newpath string) error {
+	oldEntry, err := l.lookupExisting("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	if oldpath == newpath {
+		return nil
+	}
+	if oldpath == "." || strings.HasPrefix(newpath, oldpath+string(filepath.Separator)) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EINVAL}
+	}
+	if err := l.checkParent("rename", newpath); err != nil {
+		return err
+	}
+	newEntry, err := l.lookup(newpath)
+	if err != nil {
+		return err
+	}
+	if newEntry.exists() {
+		switch {
+		case newEntry.fileInfo.IsDir() && !oldEntry.fileInfo.IsDir():
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EISDIR}
+		case !newEntry.fileInfo.IsDir() && oldEntry.fileInfo.IsDir():
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOTDIR}
+		}
+		if err := l.remove(newpath); err != nil {
+			return err
+		}
+	}
+	pathToNode := make(map[string]*dryRunNode)
+	if err := l.walk(oldpath, oldEntry, func(path string, entry *dryRunEntry) error {
+		node := entry.node
+		if node == nil {
+			var err error
+			if node, err = l.newLowerNode(path, entry.fileInfo); err != nil {
+				return err
+			}
+		}
+		pathToNode[newpath+strings.TrimPrefix(path, oldpath)] = node
+		return nil
+	}); err != nil {
+		return err
+	}
+	for path := range l.upper {
+		if path == oldpath || strings.HasPrefix(path, oldpath+string(filepath.Separator)) {
+			delete(l.upper, path)
+		}
+	}
+	for path, node := range pathToNode {
+		l.upper[path] = node
+	}
+	l.removed[oldpath] = true
+	return nil
+}
+
+// walk calls f for the entry at path and every entry below it
+func (l *dryRunLayers) walk(path string, entry *dryRunEntry, f func(string, *dryRunEntry) error) error {
+	if err := f(path, entry); err != nil {
+		return err
+	}
+	if !entry.fileInfo.IsDir() {
+		return nil
+	}
+	fileInfos, err := l.readDir(path, entry)
+	if err != nil {
+		return err
+	}
+	for _, fileInfo := range fileInfos {
+		childPath := filepath.Join(path, fileInfo.Name())
+		childEntry, err := l.lookupExisting("lstat", childPath)
+		if err != nil {
+			return err
+		}
+		if err := l.walk(childPath, childEntry, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *dryRunLayers) name(path string) string {
+	if path == "." {
+		return l.lower.Base(l.lower.DirPath())
+	}
+	return filepath.Base(path)
+}
+
+// dryRunFile reads and writes the data of an upper layer node, and records
+// a write step on Close if the file was created or written to.
+type dryRunFile struct {
+	client    *dryRunClient
+	layers    *dryRunLayers
+	node      *dryRunNode
+	name      string
+	layerPath string
+	flag      int
+	offset    int64
+	created   bool
+	written   bool
+	closed    bool
+}
+
+func (d *dryRunFile) Name() string {
+	return d.name
+}
+
+func (d *dryRunFile) Stat() (os.FileInfo, error) {
+	d.layers.lock.Lock()
+	defer d.layers.lock.Unlock()
+	if err := d.check("stat", false, false); err != nil {
+		return nil, err
+	}
+	return newDryRunFileInfo(filepath.Base(d.name), d.node), nil
+}
+
+func (d *dryRunFile) Seek(offset int64, whence int) (int64, error) {
+	d.layers.lock.Lock()
+	defer d.layers.lock.Unlock()
+	if err := d.check("seek", false, false); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.node.size()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: d.name, Err: syscall.EINVAL}
+	}
+	d.offset = offset
+	return offset, nil
+}
+
+func (d *dryRunFile) Read(p []byte) (int, error) {
+	d.layers.lock.Lock()
+	defer d.layers.lock.Unlock()
+	n, err := d.readAt("read", p, d.offset)
+	d.offset += int64(n)
+	return n, err
+}
+
+func (d *dryRunFile) ReadAt(p []byte, offset int64) (int, error) {
+	d.layers.lock.Lock()
+	defer d.layers.lock.Unlock()
+	return d.readAt("read", p, offset)
+}
+
+func (d *dryRunFile) readAt(op string, p []byte, offset int64) (int, error) {
+	if err := d.check(op, true, false); err != nil {
+		return 0, err
+	}
+	if offset >= int64(len(d.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.node.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *dryRunFile) Write(p []byte) (int, error) {
+	d.layers.lock.Lock()
+	defer d.layers.lock.Unlock()
+	offset := d.offset
+	if d.flag&os.O_APPEND != 0 {
+		offset = int64(len(d.node.data))
+	}
+	n, err := d.writeAt(p, offset)
+	d.offset = offset + int64(n)
+	return n, err
+}
+
+func (d *dryRunFile) WriteAt(p []byte, offset int64) (int, error) {
+	d.layers.lock.Lock()
+	defer d.layers.lock.Unlock()
+	return d.writeAt(p, offset)
+}
+
+func (d *dryRunFile) writeAt(p []byte, offset int64) (int, error) {
+	if err := d.check("write", false, true); err != nil {
+		return 0, err
+	}
+	if end := offset + int64(len(p)); end > int64(len(d.node.data)) {
+		d.node.data = append(d.node.data, make([]byte, end-int64(len(d.node.data)))...)
+	}
+	copy(d.node.data[offset:], p)
+	d.node.modTime = time.Now()
+	d.written = true
+	return len(p), nil
+}
+
+func (d *dryRunFile) Truncate(size int64) error {
+	d.layers.lock.Lock()
+	defer d.layers.lock.Unlock()
+	if err := d.check("truncate", false, true); err != nil {
+		return err
+	}
+	truncate(d.node, size)
+	d.written = true
+	return nil
+}
+
+func (d *dryRunFile) Chmod(mode os.FileMode) error {
+	d.layers.lock.Lock()
+	defer d.layers.lock.Unlock()
+	if err := d.check("chmod", false, false); err != nil {
+		return err
+	}
+	d.node.mode = d.node.mode&^os.ModePerm | mode.Perm()
+	d.client.record(&DryRunStep{Op: DryRunOpChmod, Path: d.layerPath, Mode: d.node.mode})
+	d.layers.watchHub.notify(d.layerPath, WatchOpChmod)
+	return nil
+}
+
+func (d *dryRunFile) Sync() error {
+	d.layers.lock.Lock()
+	defer d.layers.lock.Unlock()
+	return d.check("sync", false, false)
+}
+
+func (d *dryRunFile) Readdir(n int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: d.name, Err: syscall.ENOTDIR}
+}
+
+func (d *dryRunFile) Readdirnames(n int) ([]string, error) {
+	return nil, &os.PathError{Op: "readdir", Path: d.name, Err: syscall.ENOTDIR}
+}
+
+func (d *dryRunFile) Close() error {
+	d.layers.lock.Lock()
+	defer d.layers.lock.Unlock()
+	if err := d.check("close", false, false); err != nil {
+		return err
+	}
+	d.closed = true
+	if d.created || d.written {
+		d.client.record(&DryRunStep{Op: DryRunOpWrite, Path: d.layerPath, Mode: d.node.mode, Size: d.node.size()})
+	}
+	if d.written {
+		d.layers.watchHub.notify(d.layerPath, WatchOpWrite)
+	}
+	return nil
+}
+
+// this is only called in thread-safe context
+func (d *dryRunFile) check(op string, read bool, write bool) error {
+	if d.closed {
+		return &os.PathError{Op: op, Path: d.name, Err: os.ErrClosed}
+	}
+	if (read && d.flag&(os.O_WRONLY|os.O_RDWR) == os.O_WRONLY) ||
+		(write && d.flag&(os.O_WRONLY|os.O_RDWR) == os.O_RDONLY) {
+		return &os.PathError{Op: op, Path: d.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+// this is only called in thread-safe context
+func truncate(node *dryRunNode, size int64) {
+	if size <= int64(len(node.data)) {
+		node.data = node.data[:size]
+	} else {
+		node.data = append(node.data, make([]byte, size-int64(len(node.data)))...)
+	}
+	node.modTime = time.Now()
+}
@@ -0,0 +1,212 @@
+package exec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	DryRunOpExecute   DryRunOp = 0
+	DryRunOpWrite     DryRunOp = 1
+	DryRunOpMkdir     DryRunOp = 2
+	DryRunOpRemove    DryRunOp = 3
+	DryRunOpRemoveAll DryRunOp = 4
+	DryRunOpRename    DryRunOp = 5
+	DryRunOpChmod     DryRunOp = 6
+	DryRunOpChown     DryRunOp = 7
+	DryRunOpChtimes   DryRunOp = 8
+	DryRunOpSymlink   DryRunOp = 9
+	DryRunOpLink      DryRunOp = 10
+	DryRunOpTruncate  DryRunOp = 11
+
+	dryRunOpToString = map[DryRunOp]string{
+		DryRunOpExecute:   "execute",
+		DryRunOpWrite:     "write",
+		DryRunOpMkdir:     "mkdir",
+		DryRunOpRemove:    "remove",
+		DryRunOpRemoveAll: "remove_all",
+		DryRunOpRename:    "rename",
+		DryRunOpChmod:     "chmod",
+		DryRunOpChown:     "chown",
+		DryRunOpChtimes:   "chtimes",
+		DryRunOpSymlink:   "symlink",
+		DryRunOpLink:      "link",
+		DryRunOpTruncate:  "truncate",
+	}
+	stringToDryRunOp = map[string]DryRunOp{
+		"execute":    DryRunOpExecute,
+		"write":      DryRunOpWrite,
+		"mkdir":      DryRunOpMkdir,
+		"remove":     DryRunOpRemove,
+		"remove_all": DryRunOpRemoveAll,
+		"rename":     DryRunOpRename,
+		"chmod":      DryRunOpChmod,
+		"chown":      DryRunOpChown,
+		"chtimes":    DryRunOpChtimes,
+		"symlink":    DryRunOpSymlink,
+		"link":       DryRunOpLink,
+		"truncate":   DryRunOpTruncate,
+	}
+)
+
+// DryRunOptions has the writers the plan of a dry run is written to on
+// Destroy, both can be nil.
+type DryRunOptions struct {
+	// one line per step
+	TextWriter io.Writer
+	// a DryRunPlan
+	JSONWriter io.Writer
+}
+
+// DryRunOp is marshaled as its string in text and JSON
+type DryRunOp uint
+
+func DryRunOpOf(s string) (DryRunOp, error) {
+	dryRunOp, ok := stringToDryRunOp[s]
+	if !ok {
+		return 0, UnknownDryRunOp(s)
+	}
+	return dryRunOp, nil
+}
+
+func (d DryRunOp) String() string {
+	if s, ok := dryRunOpToString[d]; ok {
+		return s
+	}
+	return fmt.Sprintf("DryRunOp(%d)", uint(d))
+}
+
+func (d DryRunOp) MarshalText() ([]byte, error) {
+	s, ok := dryRunOpToString[d]
+	if !ok {
+		return nil, UnknownDryRunOp(uint(d))
+	}
+	return []byte(s), nil
+}
+
+func (d *DryRunOp) UnmarshalText(text []byte) error {
+	dryRunOp, err := DryRunOpOf(string(text))
+	if err != nil {
+		return err
+	}
+	*d = dryRunOp
+	return nil
+}
+
+func UnknownDryRunOp(unknownDryRunOp interface{}) error {
+	return fmt.Errorf("exec: unknown DryRunOp: %v", unknownDryRunOp)
+}
+
+// DryRunPlan has the steps of a dry run in the order they were made
+type DryRunPlan struct {
+	Steps []*DryRunStep `json:"steps"`
+}
+
+// One line per step
+func (d *DryRunPlan) String() string {
+	var builder strings.Builder
+	for _, step := range d.Steps {
+		builder.WriteString(step.String())
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+type DryRunStep struct {
+	Op DryRunOp `json:"op"`
+	// the directory of the temporary directory client the step was made
+	// through, paths are relative to it
+	Dir  string `json:"dir"`
+	Path string `json:"path,omitempty"`
+	// set for rename
+	NewPath string `json:"new_path,omitempty"`
+	// set for symlink and link, Path is the created link
+	Target string `json:"target,omitempty"`
+	// set for execute, more than one if piped
+	Cmds []*DryRunCmd `json:"cmds,omitempty"`
+	// set for write, mkdir and chmod
+	Mode os.FileMode `json:"mode,omitempty"`
+	// set for write and truncate
+	Size int64 `json:"size,omitempty"`
+	// set for chown
+	UID int `json:"uid,omitempty"`
+	GID int `json:"gid,omitempty"`
+	// set for chtimes
+	ModTime time.Time `json:"mod_time,omitempty"`
+}
+
+func (d *DryRunStep) String() string {
+	var s string
+	switch d.Op {
+	case DryRunOpExecute:
+		cmds := make([]string, len(d.Cmds))
+		for i, cmd := range d.Cmds {
+			cmds[i] = cmd.String()
+		}
+		s = strings.Join(cmds, " | ")
+	case DryRunOpWrite:
+		s = fmt.Sprintf("%s %v %d bytes", d.Path, d.Mode, d.Size)
+	case DryRunOpMkdir, DryRunOpChmod:
+		s = fmt.Sprintf("%s %v", d.Path, d.Mode)
+	case DryRunOpRename:
+		s = fmt.Sprintf("%s to %s", d.Path, d.NewPath)
+	case DryRunOpChown:
+		s = fmt.Sprintf("%s %d:%d", d.Path, d.UID, d.GID)
+	case DryRunOpChtimes:
+		s = fmt.Sprintf("%s %s", d.Path, d.ModTime.Format(time.RFC3339Nano))
+	case DryRunOpSymlink, DryRunOpLink:
+		s = fmt.Sprintf("%s -> %s", d.Path, d.Target)
+	case DryRunOpTruncate:
+		s = fmt.Sprintf("%s %d bytes", d.Path, d.Size)
+	default:
+		s = d.Path
+	}
+	return fmt.Sprintf("%s: %v %s", d.Dir, d.Op, s)
+}
+
+// SubDir is relative to the Dir of the step
+type DryRunCmd struct {
+	Args   []string `json:"args"`
+	SubDir string   `json:"sub_dir,omitempty"`
+	Env    []string `json:"env,omitempty"`
+}
+
+func (d *DryRunCmd) String() string {
+	return cmdString(d.Args, d.SubDir, d.Env)
+}
+
+type dryRunPlanner struct {
+	plan *DryRunPlan
+	lock sync.Mutex
+}
+
+func newDryRunPlanner() *dryRunPlanner {
+	return &dryRunPlanner{plan: &DryRunPlan{}}
+}
+
+func (d *dryRunPlanner) add(step *DryRunStep) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.plan.Steps = append(d.plan.Steps, step)
+}
+
+func (d *dryRunPlanner) write(dryRunOptions *DryRunOptions) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if dryRunOptions.TextWriter != nil {
+		if _, err := io.WriteString(dryRunOptions.TextWriter, d.plan.String()); err != nil {
+			return err
+		}
+	}
+	if dryRunOptions.JSONWriter != nil {
+		encoder := json.NewEncoder(dryRunOptions.JSONWriter)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(d.plan)
+	}
+	return nil
+}
@@ -3,6 +3,9 @@ package exec
 import (
 	"errors"
 	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 var (
@@ -15,43 +18,237 @@ var (
 	ErrFileAlreadyExists   = errors.New("exec: file already exists")
 	ErrNotMultipleCommands = errors.New("exec: not multiple commands")
 	ErrNotADirectory       = errors.New("exec: not a directory")
+	ErrNotSupported        = errors.New("exec: not supported")
+	ErrSkipDir             = filepath.SkipDir
+	ErrLockHeld            = errors.New("exec: lock held")
 
-	ValidationErrorTypeNotAbsolutePath ValidationErrorType = "NotAbsolutePath"
-	ValidationErrorTypeUnknownExecType ValidationErrorType = "UnknownExecType"
+	errNegative       = errors.New("exec: must not be negative")
+	errEmpty          = errors.New("exec: must not be empty")
+	errUnknownNetwork = errors.New("exec: unknown network")
+	errIsADirectory   = errors.New("exec: is a directory")
+	errUnknownRlimit  = errors.New("exec: unknown rlimit")
+	errSoftAboveHard  = errors.New("exec: soft limit above hard limit")
+
+	ValidationErrorTypeNotAbsolutePath  ValidationErrorType = "NotAbsolutePath"
+	ValidationErrorTypeUnknownExecType  ValidationErrorType = "UnknownExecType"
+	ValidationErrorTypeFileDoesNotExist ValidationErrorType = "FileDoesNotExist"
+	ValidationErrorTypeNotADirectory    ValidationErrorType = "NotADirectory"
+	ValidationErrorTypeNotWritable      ValidationErrorType = "NotWritable"
+	ValidationErrorTypeInvalidValue     ValidationErrorType = "InvalidValue"
 )
 
 type ValidationErrorType string
 
+// The underlying error, if any, is available through errors.Unwrap
 type ValidationError interface {
 	error
 	Type() ValidationErrorType
+	// The dot-separated path of the invalid option as in
+	// ExternalExecOptions, for example "tmpfs.size", empty if the error is
+	// not about an option
+	Field() string
+	Tags() map[string]string
 }
+
 type validationError struct {
 	errorType ValidationErrorType
+	field     string
 	tags      map[string]string
+	err       error
 }
 
-func newValidationError(errorType ValidationErrorType, tags map[string]string) *validationError {
+func newValidationError(errorType ValidationErrorType, field string, tags map[string]string, err error) *validationError {
 	if tags == nil {
 		tags = make(map[string]string)
 	}
-	return &validationError{errorType, tags}
+	return &validationError{errorType, field, tags, err}
 }
 
 func (v *validationError) Error() string {
-	return fmt.Sprintf("%v %v", v.errorType, v.tags)
+	var buffer strings.Builder
+	buffer.WriteString("exec: ")
+	if v.field != "" {
+		buffer.WriteString(v.field)
+		buffer.WriteString(": ")
+	}
+	buffer.WriteString(string(v.errorType))
+	keys := make([]string, 0, len(v.tags))
+	for key := range v.tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&buffer, " %s=%q", key, v.tags[key])
+	}
+	if v.err != nil {
+		fmt.Fprintf(&buffer, ": %v", v.err)
+	}
+	return buffer.String()
 }
 
 func (v *validationError) Type() ValidationErrorType {
 	return v.errorType
 }
 
+func (v *validationError) Field() string {
+	return v.field
+}
+
+// Tags returns a copy
+func (v *validationError) Tags() map[string]string {
+	tags := make(map[string]string, len(v.tags))
+	for key, value := range v.tags {
+		tags[key] = value
+	}
+	return tags
+}
+
+func (v *validationError) Unwrap() error {
+	return v.err
+}
+
+// ValidationErrors holds every problem found when validating, in the order
+// of the options. errors.Is and errors.As look at each ValidationError.
+type ValidationErrors []ValidationError
+
+func (v ValidationErrors) Error() string {
+	messages := make([]string, len(v))
+	for i, validationError := range v {
+		messages[i] = validationError.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (v ValidationErrors) Unwrap() []error {
+	errs := make([]error, len(v))
+	for i, validationError := range v {
+		errs[i] = validationError
+	}
+	return errs
+}
+
+// Field returns the errors for field
+func (v ValidationErrors) Field(field string) ValidationErrors {
+	var fieldValidationErrors ValidationErrors
+	for _, validationError := range v {
+		if validationError.Field() == field {
+			fieldValidationErrors = append(fieldValidationErrors, validationError)
+		}
+	}
+	return fieldValidationErrors
+}
+
+// err returns nil if v is empty, so that callers do not get a non-nil
+// error interface holding an empty ValidationErrors
+func (v ValidationErrors) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// Path is empty if the quota was exceeded by executed commands
+type QuotaExceededError struct {
+	Path      string
+	Usage     DiskUsage
+	MaxBytes  int64
+	MaxInodes int64
+}
+
+func (q *QuotaExceededError) Error() string {
+	return fmt.Sprintf(
+		"exec: quota exceeded: %s: %d bytes and %d inodes used, max %d bytes and %d inodes",
+		q.Path,
+		q.Usage.Bytes,
+		q.Usage.Inodes,
+		q.MaxBytes,
+		q.MaxInodes,
+	)
+}
+
+// UnrecordedCommandError is returned by the replay type for a command that
+// is not in the cassette, or of which every recording was already replayed.
+type UnrecordedCommandError struct {
+	// Every piped command, with its Env and SubDir
+	Cmds        []string
+	StdinDigest string
+}
+
+func (u *UnrecordedCommandError) Error() string {
+	return fmt.Sprintf("exec: unrecorded command: %s with stdin sha256 %s", strings.Join(u.Cmds, " | "), u.StdinDigest)
+}
+
+// ReplayExitError is returned by the replay type for a command that exited
+// with a non-zero status.
+type ReplayExitError struct {
+	Code int
+}
+
+func (r *ReplayExitError) Error() string {
+	return fmt.Sprintf("exit status %d", r.Code)
+}
+
+func (r *ReplayExitError) ExitCode() int {
+	return r.Code
+}
+
+// RemoteExitError is returned by the remote type for a command that exited
+// with a non-zero status on the server.
+type RemoteExitError struct {
+	Code int
+}
+
+func (r *RemoteExitError) Error() string {
+	return fmt.Sprintf("exit status %d", r.Code)
+}
+
+func (r *RemoteExitError) ExitCode() int {
+	return r.Code
+}
+
+// UnexpectedCommandError is returned by a fake executor for a command that
+// matches no expectation that still expects commands.
+type UnexpectedCommandError struct {
+	// with its Env and SubDir
+	Cmd string
+}
+
+func (u *UnexpectedCommandError) Error() string {
+	return fmt.Sprintf("exec: unexpected command: %s", u.Cmd)
+}
+
+// FakeExitError is returned by a fake executor for an expectation with a
+// non-zero ExitCode.
+type FakeExitError struct {
+	Code int
+}
+
+func (f *FakeExitError) Error() string {
+	return fmt.Sprintf("exit status %d", f.Code)
+}
+
+func (f *FakeExitError) ExitCode() int {
+	return f.Code
+}
+
+func newUnrecordedCommandError(cassetteCmds []*cassetteCmd, stdinDigest string) *UnrecordedCommandError {
+	cmds := make([]string, len(cassetteCmds))
+	for i, cassetteCmd := range cassetteCmds {
+		cmds[i] = cassetteCmd.String()
+	}
+	return &UnrecordedCommandError{cmds, stdinDigest}
+}
+
 func newValidationErrorUnknownExecType(execType string) ValidationError {
-	return newValidationError(ValidationErrorTypeUnknownExecType, map[string]string{"execType": execType})
+	return newValidationError(ValidationErrorTypeUnknownExecType, "type", map[string]string{"execType": execType}, UnknownExecType(execType))
 }
 
 func newValidationErrorNotAbsolutePath(path string) ValidationError {
-	return newValidationError(ValidationErrorTypeNotAbsolutePath, map[string]string{"path": path})
+	return newValidationError(ValidationErrorTypeNotAbsolutePath, "", map[string]string{"path": path}, ErrNotAbsolutePath)
+}
+
+func newValidationErrorInvalidValue(field string, value string, err error) ValidationError {
+	return newValidationError(ValidationErrorTypeInvalidValue, field, map[string]string{"value": value}, err)
 }
 
 func newInternalError(validationError ValidationError) error {
@@ -2,7 +2,10 @@ package exec
 
 import (
 	"io"
+	"io/fs"
+	"net"
 	"os"
+	"time"
 
 	"github.com/codeship/go-concurrent"
 )
@@ -13,12 +16,121 @@ type ExecOptions interface {
 
 type OsExecOptions struct {
 	TmpDir string
+	// The maximum bytes and inodes used by each client, 0 for no limit,
+	// see QuotaExceededError
+	MaxBytes  int64
+	MaxInodes int64
+	// If set, every temporary directory is a tmpfs mount, which requires the
+	// process to be permitted to mount on Linux.
+	Tmpfs *TmpfsOptions
+}
+
+type TmpfsOptions struct {
+	// In bytes, 0 for the kernel default of half of the memory
+	Size int64
+	// If the process is not permitted to mount, create the temporary
+	// directories in TmpDir, or in /dev/shm if TmpDir is empty, with Size
+	// enforced as a quota instead of failing
+	Fallback bool
 }
 
 func (o *OsExecOptions) Type() ExecType {
 	return ExecTypeOs
 }
 
+// RemoteExecOptions connects to a server started with ServeRemote. The
+// connection is not authenticated or encrypted, so use it on trusted
+// networks or through a tunnel.
+type RemoteExecOptions struct {
+	// "tcp" if empty, see net.Dial
+	Network string
+	Address string
+}
+
+func (r *RemoteExecOptions) Type() ExecType {
+	return ExecTypeRemote
+}
+
+// SSHExecOptions creates the temporary directories of clients on Host, see
+// sshClient for what the host needs.
+type SSHExecOptions struct {
+	// With an optional port, 22 by default
+	Host string
+	User string
+	// The private key to authenticate with
+	KeyFile string
+	// The host key of Host must be in KnownHostsFile
+	KnownHostsFile string
+	// Absolute on the host, /tmp if empty
+	TmpDir string
+}
+
+func (s *SSHExecOptions) Type() ExecType {
+	return ExecTypeSSH
+}
+
+// OCIExecOptions runs every command in its own container with an OCI
+// runtime such as runc or crun. The directory of a client is mounted
+// read-write at /work over Rootfs, which is mounted read-only. Containers
+// have their own network namespace with only a loopback interface.
+type OCIExecOptions struct {
+	// A binary name or path, runc if empty
+	Runtime string
+	// An absolute path to the root filesystem of the containers
+	Rootfs string
+	// As for OsExecOptions
+	TmpDir    string
+	MaxBytes  int64
+	MaxInodes int64
+	// Maps User to the user running this process, in a user namespace
+	Rootless bool
+	// root if nil
+	User *OCIUser
+	// The environment of commands with no Env, a default PATH if empty. The
+	// runtime finds commands in the PATH of their environment.
+	Env     []string
+	Mounts  []*OCIMount
+	Rlimits []*OCIRlimit
+}
+
+type OCIUser struct {
+	UID uint32
+	GID uint32
+}
+
+// OCIMount bind mounts Source on the host at Destination in the container
+type OCIMount struct {
+	Source      string
+	Destination string
+	ReadOnly    bool
+}
+
+type OCIRlimit struct {
+	// For example RLIMIT_NOFILE
+	Type string
+	Soft uint64
+	Hard uint64
+}
+
+func (o *OCIExecOptions) Type() ExecType {
+	return ExecTypeOCI
+}
+
+// ReplayExecOptions serves commands from CassetteFile, as written by a
+// provider returned by NewRecordingClientProvider, instead of running them.
+// Every recording is replayed once, in recorded order for equal commands,
+// and other commands fail with an UnrecordedCommandError. Exit statuses are
+// returned as ReplayExitError.
+type ReplayExecOptions struct {
+	CassetteFile string
+	// As for OsExecOptions
+	TmpDir string
+}
+
+func (r *ReplayExecOptions) Type() ExecType {
+	return ExecTypeReplay
+}
+
 func NewExecutorReadFileManagerProvider(execOptions ExecOptions) (ExecutorReadFileManagerProvider, error) {
 	return NewClientProvider(execOptions)
 }
@@ -31,6 +143,24 @@ func NewClientProvider(execOptions ExecOptions) (ClientProvider, error) {
 	return newClientProvider(execOptions)
 }
 
+// NewRemoteClientProvider uses conn to a server started with ServeRemote
+// or ServeRemoteConn, conn is closed on Destroy.
+func NewRemoteClientProvider(conn net.Conn) ClientProvider {
+	return newRemoteClientProvider(conn)
+}
+
+// ServeRemote serves clientProvider to every connection accepted from
+// listener, until Accept fails. Everything created over a connection is
+// destroyed when the connection closes.
+func ServeRemote(clientProvider ClientProvider, listener net.Listener) error {
+	return serveRemote(clientProvider, listener)
+}
+
+// ServeRemoteConn returns once conn is closed
+func ServeRemoteConn(clientProvider ClientProvider, conn net.Conn) error {
+	return serveRemoteConn(clientProvider, conn)
+}
+
 func NewOsExecutor(absolutePath string) (Executor, error) {
 	return newOsAbsolutePathClient(absolutePath)
 }
@@ -39,10 +169,122 @@ func NewOsReadWriteFileManager(absolutePath string) (ReadWriteFileManager, error
 	return newOsAbsolutePathClient(absolutePath)
 }
 
+func NewTempDirClientFromDir(clientProvider ClientProvider, absolutePath string) (Client, error) {
+	return newTempDirClientFromDir(clientProvider, absolutePath)
+}
+
+func NewTempDirClientFromArchive(clientProvider ClientProvider, reader io.Reader) (Client, error) {
+	return newTempDirClientFromArchive(clientProvider, reader)
+}
+
+func NewTempDirClientFromClient(clientProvider ClientProvider, readFileManager ReadFileManager) (Client, error) {
+	return newTempDirClientFromClient(clientProvider, readFileManager)
+}
+
+// The returned Client reads from the directory at lowerAbsolutePath, which
+// is never modified, and writes to a private upper layer that is discarded
+// on Destroy.
+func NewOverlayClient(clientProvider ClientProvider, lowerAbsolutePath string) (Client, error) {
+	return newOverlayClient(clientProvider, lowerAbsolutePath)
+}
+
+// NewRecordingClientProvider records every command run by the clients of
+// clientProvider, with a digest of the stdin it read, output, exit status and
+// changes to the directory of its client, once the function returned by
+// Execute or ExecutePiped is called. The recordings are written to
+// cassetteFile on Destroy, for the replay type, which replays a recording for
+// stdin that starts with what the command read.
+func NewRecordingClientProvider(clientProvider ClientProvider, cassetteFile string) ClientProvider {
+	return newRecordingClientProvider(clientProvider, cassetteFile)
+}
+
+// NewDryRunClientProvider returns clients that record the commands they are
+// asked to execute instead of executing them, and make file changes to an
+// in-memory overlay of their directory so that reads see them. The
+// directories of the clients of clientProvider are never modified. The plan
+// of every command and file change is written to the writers of
+// dryRunOptions on Destroy.
+func NewDryRunClientProvider(clientProvider ClientProvider, dryRunOptions *DryRunOptions) ClientProvider {
+	return newDryRunClientProvider(clientProvider, dryRunOptions)
+}
+
+// NewFaultClientProvider injects the faults of the rules of faultOptions
+// into the calls to clientProvider, its clients and their sub directory
+// clients. Destroy destroys before returning an injected error. The commands
+// of Execute and ExecutePiped are killed after the latency of the rules
+// before the returned function returns an injected error, which is only
+// supported by the clients that run commands as host processes, those of the
+// os type and of mounted overlays, and ErrNotSupported is returned by the
+// others.
+func NewFaultClientProvider(clientProvider ClientProvider, faultOptions *FaultOptions) (ClientProvider, error) {
+	return newFaultClientProvider(clientProvider, faultOptions)
+}
+
+// NewFakeExecutor returns a FakeExecutor with the files of
+// readWriteFileManager, for testing code that executes commands without
+// running them.
+func NewFakeExecutor(readWriteFileManager ReadWriteFileManager) FakeExecutor {
+	return newFakeExecutor(readWriteFileManager)
+}
+
 func ValidateExecOptions(execOptions ExecOptions) error {
 	return validateExecOptions(execOptions)
 }
 
+func Snapshot(readFileManager ReadFileManager) (*Manifest, error) {
+	return snapshot(readFileManager, nil)
+}
+
+// SnapshotWithContents also stores the contents of every regular file in
+// contents, so that the snapshot can later be restored with Restore.
+func SnapshotWithContents(readFileManager ReadFileManager, contents WriteFileManager) (*Manifest, error) {
+	return snapshot(readFileManager, contents)
+}
+
+func Diff(a *Manifest, b *Manifest) *ManifestDiff {
+	return diff(a, b)
+}
+
+func Restore(readWriteFileManager ReadWriteFileManager, manifest *Manifest, contents ReadFileManager) error {
+	return restore(readWriteFileManager, manifest, contents)
+}
+
+// If no patterns are given, the whole tree is exported, otherwise only the
+// entries matching a pattern or whose parent directory matches a pattern.
+func ExportArchive(readFileManager ReadFileManager, writer io.Writer, archiveFormat ArchiveFormat, patterns ...string) error {
+	return exportArchive(readFileManager, writer, archiveFormat, patterns)
+}
+
+func ImportArchive(writeFileManager WriteFileManager, reader io.Reader, archiveFormat ArchiveFormat, subDir string) error {
+	return importArchive(writeFileManager, reader, archiveFormat, subDir)
+}
+
+func CopyIn(writeFileManager WriteFileManager, hostPath string, path string, copyOptions *CopyOptions) error {
+	return copyIn(writeFileManager, hostPath, path, copyOptions)
+}
+
+func CopyOut(readFileManager ReadFileManager, path string, hostPath string, copyOptions *CopyOptions) error {
+	return copyOut(readFileManager, path, hostPath, copyOptions)
+}
+
+func CopyBetween(from ReadFileManager, fromPath string, to WriteFileManager, toPath string, copyOptions *CopyOptions) error {
+	return copyBetween(from, fromPath, to, toPath, copyOptions)
+}
+
+// The returned fs.FS also implements fs.StatFS, fs.ReadDirFS, fs.ReadFileFS,
+// fs.GlobFS and fs.SubFS.
+func NewFS(readFileManager ReadFileManager) fs.FS {
+	return newReadFileManagerFS(readFileManager, ".")
+}
+
+func NewFSReadFileManager(fsys fs.FS) ReadFileManager {
+	return newFSReadFileManager(fsys)
+}
+
+func Usage(readFileManager ReadFileManager) (*DiskUsage, error) {
+	return diskUsage(readFileManager)
+}
+
 func ReadLines(readFileManager ReadFileManager, path string) ([]string, error) {
 	return readLines(readFileManager, path)
 }
@@ -55,6 +297,26 @@ func ReadAll(readFileManager ReadFileManager, path string) ([]byte, error) {
 	return readAll(readFileManager, path)
 }
 
+// WriteAll, WriteLines and WriteFileAtomic replace path atomically, see
+// CreateAtomic.
+func WriteAll(writeFileManager WriteFileManager, path string, data []byte, perm os.FileMode) error {
+	return writeAll(writeFileManager, path, data, perm)
+}
+
+func WriteLines(writeFileManager WriteFileManager, path string, lines []string, perm os.FileMode) error {
+	return writeLines(writeFileManager, path, lines, perm)
+}
+
+func WriteFileAtomic(writeFileManager WriteFileManager, path string, reader io.Reader, perm os.FileMode) error {
+	return writeFileAtomic(writeFileManager, path, reader, perm)
+}
+
+// CreateAtomic writes to a hidden temporary file in the directory of path,
+// which is synced and renamed to path on Close, or removed on Abort.
+func CreateAtomic(writeFileManager WriteFileManager, path string, perm os.FileMode) (AtomicWriteFile, error) {
+	return createAtomic(writeFileManager, path, perm)
+}
+
 type Cmd struct {
 	// Includes path
 	Args []string
@@ -98,6 +360,8 @@ type PipeCmdList struct {
 }
 
 type File interface {
+	io.Seeker
+	Name() string
 	Stat() (os.FileInfo, error)
 	Close() error
 }
@@ -105,6 +369,7 @@ type File interface {
 type ReadFile interface {
 	File
 	io.Reader
+	io.ReaderAt
 	Readdir(n int) ([]os.FileInfo, error)
 	Readdirnames(n int) ([]string, error)
 }
@@ -112,7 +377,21 @@ type ReadFile interface {
 type WriteFile interface {
 	File
 	io.Writer
+	io.WriterAt
 	Chmod(mode os.FileMode) error
+	Sync() error
+	Truncate(size int64) error
+}
+
+// Abort after Close does nothing, so Abort can always be deferred
+type AtomicWriteFile interface {
+	WriteFile
+	Abort() error
+}
+
+type ReadWriteFile interface {
+	ReadFile
+	WriteFile
 }
 
 type DirContext interface {
@@ -138,6 +417,12 @@ type ReadFileManager interface {
 	Dir(path string) string
 	PathSeparator() string
 	Open(path string) (ReadFile, error)
+	Walk(root string, walkOptions *WalkOptions, walkFunc WalkFunc) error
+	Glob(patterns ...string) ([]string, error)
+	Watch(path string, recursive bool) (Watcher, error)
+	Stat(path string) (os.FileInfo, error)
+	Lstat(path string) (os.FileInfo, error)
+	Readlink(path string) (string, error)
 }
 
 type ExecutorReadFileManager interface {
@@ -164,10 +449,22 @@ type WriteFileManager interface {
 	Base(path string) string
 	Dir(path string) string
 	PathSeparator() string
+	Stat(path string) (os.FileInfo, error)
+	Lstat(path string) (os.FileInfo, error)
+	Readlink(path string) (string, error)
 	Create(name string) (WriteFile, error)
 	MkdirAll(path string, perm os.FileMode) error
 	Rename(oldpath string, newpath string) error
 	Remove(path string) error
+	RemoveAll(path string) error
+	Chmod(path string, mode os.FileMode) error
+	Chown(path string, uid int, gid int) error
+	Chtimes(path string, atime time.Time, mtime time.Time) error
+	Symlink(oldname string, newname string) error
+	Link(oldname string, newname string) error
+	Truncate(path string, size int64) error
+	Lock(path string, exclusive bool) (Unlocker, error)
+	TryLock(path string, exclusive bool) (Unlocker, error)
 }
 
 type ExecutorWriteFileManager interface {
@@ -194,10 +491,26 @@ type ReadWriteFileManager interface {
 	Dir(path string) string
 	PathSeparator() string
 	Open(path string) (ReadFile, error)
+	Walk(root string, walkOptions *WalkOptions, walkFunc WalkFunc) error
+	Glob(patterns ...string) ([]string, error)
+	Watch(path string, recursive bool) (Watcher, error)
+	Stat(path string) (os.FileInfo, error)
+	Lstat(path string) (os.FileInfo, error)
+	Readlink(path string) (string, error)
+	OpenFile(path string, flag int, perm os.FileMode) (ReadWriteFile, error)
 	Create(name string) (WriteFile, error)
 	MkdirAll(path string, perm os.FileMode) error
 	Rename(oldpath string, newpath string) error
 	Remove(path string) error
+	RemoveAll(path string) error
+	Chmod(path string, mode os.FileMode) error
+	Chown(path string, uid int, gid int) error
+	Chtimes(path string, atime time.Time, mtime time.Time) error
+	Symlink(oldname string, newname string) error
+	Link(oldname string, newname string) error
+	Truncate(path string, size int64) error
+	Lock(path string, exclusive bool) (Unlocker, error)
+	TryLock(path string, exclusive bool) (Unlocker, error)
 }
 
 type Client interface {
@@ -1,8 +1,70 @@
 package exec
 
 type ExternalExecOptions struct {
-	Type   string `json:"type,omitempty" yaml:"type,omitempty"`
-	TmpDir string `json:"tmp_dir,omitempty" yaml:"tmp_dir,omitempty"`
+	Type      ExecType `json:"type,omitempty" yaml:"type,omitempty"`
+	TmpDir    string   `json:"tmp_dir,omitempty" yaml:"tmp_dir,omitempty"`
+	MaxBytes  int64    `json:"max_bytes,omitempty" yaml:"max_bytes,omitempty"`
+	MaxInodes int64    `json:"max_inodes,omitempty" yaml:"max_inodes,omitempty"`
+	// For example "tmpfs: {size: 512M}"
+	Tmpfs *ExternalTmpfsOptions `json:"tmpfs,omitempty" yaml:"tmpfs,omitempty"`
+	// For the remote type
+	Remote *ExternalRemoteOptions `json:"remote,omitempty" yaml:"remote,omitempty"`
+	// For the ssh type
+	SSH *ExternalSSHOptions `json:"ssh,omitempty" yaml:"ssh,omitempty"`
+	// For the oci type, which also uses TmpDir, MaxBytes and MaxInodes
+	OCI *ExternalOCIOptions `json:"oci,omitempty" yaml:"oci,omitempty"`
+	// For the replay type, which also uses TmpDir
+	Replay *ExternalReplayOptions `json:"replay,omitempty" yaml:"replay,omitempty"`
+}
+
+type ExternalTmpfsOptions struct {
+	// A number of bytes with an optional K, M, G or T suffix
+	Size     string `json:"size,omitempty" yaml:"size,omitempty"`
+	Fallback bool   `json:"fallback,omitempty" yaml:"fallback,omitempty"`
+}
+
+type ExternalRemoteOptions struct {
+	Network string `json:"network,omitempty" yaml:"network,omitempty"`
+	Address string `json:"address,omitempty" yaml:"address,omitempty"`
+}
+
+type ExternalSSHOptions struct {
+	Host           string `json:"host,omitempty" yaml:"host,omitempty"`
+	User           string `json:"user,omitempty" yaml:"user,omitempty"`
+	KeyFile        string `json:"key_file,omitempty" yaml:"key_file,omitempty"`
+	KnownHostsFile string `json:"known_hosts_file,omitempty" yaml:"known_hosts_file,omitempty"`
+	TmpDir         string `json:"tmp_dir,omitempty" yaml:"tmp_dir,omitempty"`
+}
+
+type ExternalOCIOptions struct {
+	Runtime  string               `json:"runtime,omitempty" yaml:"runtime,omitempty"`
+	Rootfs   string               `json:"rootfs,omitempty" yaml:"rootfs,omitempty"`
+	Rootless bool                 `json:"rootless,omitempty" yaml:"rootless,omitempty"`
+	User     *ExternalOCIUser     `json:"user,omitempty" yaml:"user,omitempty"`
+	Env      []string             `json:"env,omitempty" yaml:"env,omitempty"`
+	Mounts   []*ExternalOCIMount  `json:"mounts,omitempty" yaml:"mounts,omitempty"`
+	Rlimits  []*ExternalOCIRlimit `json:"rlimits,omitempty" yaml:"rlimits,omitempty"`
+}
+
+type ExternalOCIUser struct {
+	UID uint32 `json:"uid" yaml:"uid"`
+	GID uint32 `json:"gid" yaml:"gid"`
+}
+
+type ExternalOCIMount struct {
+	Source      string `json:"source,omitempty" yaml:"source,omitempty"`
+	Destination string `json:"destination,omitempty" yaml:"destination,omitempty"`
+	ReadOnly    bool   `json:"read_only,omitempty" yaml:"read_only,omitempty"`
+}
+
+type ExternalOCIRlimit struct {
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+	Soft uint64 `json:"soft" yaml:"soft"`
+	Hard uint64 `json:"hard" yaml:"hard"`
+}
+
+type ExternalReplayOptions struct {
+	CassetteFile string `json:"cassette_file,omitempty" yaml:"cassette_file,omitempty"`
 }
 
 func NewExternalExecutorReadFileManagerProvider(externalExecOptions *ExternalExecOptions) (ExecutorReadFileManagerProvider, error) {
@@ -20,3 +82,18 @@ func NewExternalClientProvider(externalExecOptions *ExternalExecOptions) (Client
 func ConvertExternalExecOptions(externalExecOptions *ExternalExecOptions) (ExecOptions, error) {
 	return convertExternalExecOptions(externalExecOptions)
 }
+
+// LoadExternalExecOptions reads the YAML or JSON file at path, chosen by
+// its extension, overlays the GOEXEC_* environment variables listed in
+// externalExecOptionsEnvVars, such as GOEXEC_SSH_HOST for ssh.host, and
+// converts and validates the result. Environment variables take precedence
+// over the file, and the file over the defaults. If path is empty, only the
+// environment variables are read.
+func LoadExternalExecOptions(path string) (ExecOptions, error) {
+	return loadExternalExecOptions(path)
+}
+
+// Unknown fields are an error
+func ParseExternalExecOptions(data []byte, configFormat ConfigFormat) (*ExternalExecOptions, error) {
+	return parseExternalExecOptions(data, configFormat)
+}
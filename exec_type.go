@@ -1,24 +1,44 @@
 package exec
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+)
 
 var (
-	ExecTypeOs ExecType = 0
+	ExecTypeOs     ExecType = 0
+	ExecTypeRemote ExecType = 1
+	ExecTypeSSH    ExecType = 2
+	ExecTypeOCI    ExecType = 3
+	ExecTypeReplay ExecType = 4
 
 	execTypeToString = map[ExecType]string{
-		ExecTypeOs: "os",
+		ExecTypeOs:     "os",
+		ExecTypeRemote: "remote",
+		ExecTypeSSH:    "ssh",
+		ExecTypeOCI:    "oci",
+		ExecTypeReplay: "replay",
 	}
-	lenExecTypeToString = len(execTypeToString)
-	stringToExecType    = map[string]ExecType{
-		"os": ExecTypeOs,
+	stringToExecType = map[string]ExecType{
+		"os":     ExecTypeOs,
+		"remote": ExecTypeRemote,
+		"ssh":    ExecTypeSSH,
+		"oci":    ExecTypeOCI,
+		"replay": ExecTypeReplay,
 	}
 )
 
+// ExecType is marshaled as its string in text, JSON and YAML, and
+// implements flag.Value.
 type ExecType uint
 
 func AllExecTypes() []ExecType {
 	return []ExecType{
 		ExecTypeOs,
+		ExecTypeRemote,
+		ExecTypeSSH,
+		ExecTypeOCI,
+		ExecTypeReplay,
 	}
 }
 
@@ -31,10 +51,47 @@ func ExecTypeOf(s string) (ExecType, error) {
 }
 
 func (e ExecType) String() string {
-	if int(e) < lenExecTypeToString {
-		return execTypeToString[e]
+	if s, ok := execTypeToString[e]; ok {
+		return s
+	}
+	return fmt.Sprintf("ExecType(%d)", uint(e))
+}
+
+func (e ExecType) MarshalText() ([]byte, error) {
+	s, ok := execTypeToString[e]
+	if !ok {
+		return nil, UnknownExecType(uint(e))
+	}
+	return []byte(s), nil
+}
+
+func (e *ExecType) UnmarshalText(text []byte) error {
+	execType, err := ExecTypeOf(string(text))
+	if err != nil {
+		return err
 	}
-	panic(UnknownExecType(e).Error())
+	*e = execType
+	return nil
+}
+
+func (e ExecType) MarshalJSON() ([]byte, error) {
+	text, err := e.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(text))
+}
+
+func (e *ExecType) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return e.UnmarshalText([]byte(s))
+}
+
+func (e *ExecType) Set(s string) error {
+	return e.UnmarshalText([]byte(s))
 }
 
 func UnknownExecType(unknownExecType interface{}) error {
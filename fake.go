@@ -0,0 +1,363 @@
+package exec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/codeship/go-concurrent"
+)
+
+// FakeExecutor runs the expectations registered with Expect instead of
+// commands. Its files are those of the ReadWriteFileManager it was created
+// with, which are not removed on Destroy.
+type FakeExecutor interface {
+	Client
+	// The first matching expectation that still expects commands is used, in
+	// the order they were registered. Commands that match none fail with an
+	// UnexpectedCommandError.
+	Expect(fakeExpectation *FakeExpectation)
+	// CheckExpectations returns an error if an expectation did not get the
+	// number of commands it expects, or if a command was unexpected.
+	CheckExpectations() error
+}
+
+// FakeExpectation matches commands with Args, SubDir and Env, and writes
+// Stdout and Stderr and exits with ExitCode, or calls Handler.
+type FakeExpectation struct {
+	// any args if nil
+	Args ArgsMatcher
+	// relative to the fake executor the expectation is registered on
+	SubDir string
+	// every one must be in the env of the command
+	Env []string
+
+	Stdout []byte
+	Stderr []byte
+	// a FakeExitError is returned if not 0
+	ExitCode int
+	// if set, called instead of writing Stdout and Stderr, its error is returned
+	Handler func(fakeCall *FakeCall) error
+
+	// the number of commands expected, 1 if 0, -1 for any number
+	Times int
+}
+
+// FakeCall is a command run by a fake executor. SubDir and paths of the
+// ReadWriteFileManager are relative to the fake executor the expectations
+// are registered on.
+type FakeCall struct {
+	Args   []string
+	SubDir string
+	Env    []string
+	// never nil
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	ReadWriteFileManager ReadWriteFileManager
+}
+
+type ArgsMatcher interface {
+	Match(args []string) bool
+	// used in errors
+	String() string
+}
+
+func ArgsEqual(args ...string) ArgsMatcher {
+	return argsEqualMatcher(args)
+}
+
+func ArgsPrefix(args ...string) ArgsMatcher {
+	return argsPrefixMatcher(args)
+}
+
+// description is used in errors
+func ArgsFunc(description string, f func(args []string) bool) ArgsMatcher {
+	return &argsFuncMatcher{description, f}
+}
+
+// fakeState holds the expectations of a fake executor and of its sub
+// directory clients.
+type fakeState struct {
+	lock         sync.Mutex
+	expectations []*FakeExpectation
+	// the number of commands that matched every expectation
+	calls      []int
+	unexpected []string
+}
+
+// next claims the first expectation matching fakeCall that still expects
+// commands, in the order they were registered
+func (f *fakeState) next(fakeCall *FakeCall) (*FakeExpectation, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for i, expectation := range f.expectations {
+		if !expectation.matches(fakeCall) {
+			continue
+		}
+		if times := expectation.times(); times >= 0 && f.calls[i] >= times {
+			continue
+		}
+		f.calls[i]++
+		return expectation, nil
+	}
+	cmd := cmdString(fakeCall.Args, fakeCall.SubDir, fakeCall.Env)
+	f.unexpected = append(f.unexpected, cmd)
+	return nil, &UnexpectedCommandError{cmd}
+}
+
+func (f *FakeExpectation) matches(fakeCall *FakeCall) bool {
+	if f.Args != nil && !f.Args.Match(fakeCall.Args) {
+		return false
+	}
+	if filepath.Clean(f.SubDir) != filepath.Clean(fakeCall.SubDir) {
+		return false
+	}
+	for _, env := range f.Env {
+		if !isStringIn(env, fakeCall.Env) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *FakeExpectation) times() int {
+	if f.Times == 0 {
+		return 1
+	}
+	return f.Times
+}
+
+func (f *FakeExpectation) String() string {
+	args := "any args"
+	if f.Args != nil {
+		args = f.Args.String()
+	}
+	return cmdString([]string{args}, f.SubDir, f.Env)
+}
+
+// run writes the canned output of the expectation, or calls its Handler
+func (f *FakeExpectation) run(fakeCall *FakeCall) error {
+	if f.Handler != nil {
+		return f.Handler(fakeCall)
+	}
+	if _, err := fakeCall.Stdout.Write(f.Stdout); err != nil {
+		return err
+	}
+	if _, err := fakeCall.Stderr.Write(f.Stderr); err != nil {
+		return err
+	}
+	if f.ExitCode != 0 {
+		return &FakeExitError{f.ExitCode}
+	}
+	return nil
+}
+
+type argsEqualMatcher []string
+
+func (a argsEqualMatcher) Match(args []string) bool {
+	return isStringsEqual(a, args)
+}
+
+func (a argsEqualMatcher) String() string {
+	return strings.Join(a, " ")
+}
+
+type argsPrefixMatcher []string
+
+func (a argsPrefixMatcher) Match(args []string) bool {
+	return len(args) >= len(a) && isStringsEqual(a, args[:len(a)])
+}
+
+func (a argsPrefixMatcher) String() string {
+	return strings.Join(append(append([]string(nil), a...), "..."), " ")
+}
+
+type argsFuncMatcher struct {
+	description string
+	f           func([]string) bool
+}
+
+func (a *argsFuncMatcher) Match(args []string) bool {
+	return a.f(args)
+}
+
+func (a *argsFuncMatcher) String() string {
+	return a.description
+}
+
+// fakeExecutor runs the expectations of its state instead of commands, with
+// the files of readWriteFileManager. subPath is relative to the fake
+// executor the expectations are registered on.
+type fakeExecutor struct {
+	concurrent.Destroyable
+	ReadWriteFileManager
+	// the file manager of the fake executor the expectations are registered on
+	root    ReadWriteFileManager
+	subPath string
+	state   *fakeState
+}
+
+func newFakeExecutor(readWriteFileManager ReadWriteFileManager) *fakeExecutor {
+	return &fakeExecutor{
+		concurrent.NewDestroyable(nil),
+		readWriteFileManager,
+		readWriteFileManager,
+		"",
+		&fakeState{},
+	}
+}
+
+func (f *fakeExecutor) Expect(fakeExpectation *FakeExpectation) {
+	f.state.lock.Lock()
+	defer f.state.lock.Unlock()
+	f.state.expectations = append(f.state.expectations, fakeExpectation)
+	f.state.calls = append(f.state.calls, 0)
+}
+
+func (f *fakeExecutor) CheckExpectations() error {
+	f.state.lock.Lock()
+	defer f.state.lock.Unlock()
+	var problems []string
+	for i, expectation := range f.state.expectations {
+		if times := expectation.times(); times >= 0 && f.state.calls[i] != times {
+			problems = append(problems, fmt.Sprintf("expected %s %d times, got %d", expectation, times, f.state.calls[i]))
+		}
+	}
+	for _, cmd := range f.state.unexpected {
+		problems = append(problems, fmt.Sprintf("unexpected %s", cmd))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("exec: unmet expectations: %s", strings.Join(problems, "; "))
+}
+
+func (f *fakeExecutor) Execute(cmd *Cmd) func() error {
+	return f.execute(
+		[]*PipeCmd{{Args: cmd.Args, SubDir: cmd.SubDir, Env: cmd.Env}},
+		cmd.Stdin,
+		cmd.Stdout,
+		cmd.Stderr,
+	)
+}
+
+// The commands are run one after the other, each with the output of the
+// previous one as input, and the first error is returned.
+func (f *fakeExecutor) ExecutePiped(pipeCmdList *PipeCmdList) func() error {
+	if len(pipeCmdList.PipeCmds) < 2 {
+		return func() error { return ErrNotMultipleCommands }
+	}
+	return f.execute(
+		pipeCmdList.PipeCmds,
+		pipeCmdList.Stdin,
+		pipeCmdList.Stdout,
+		pipeCmdList.Stderr,
+	)
+}
+
+func (f *fakeExecutor) execute(pipeCmds []*PipeCmd, stdin io.Reader, stdout io.Writer, stderr io.Writer) func() error {
+	value, err := f.Do(func() (interface{}, error) {
+		fakeCalls := make([]*FakeCall, len(pipeCmds))
+		expectations := make([]*FakeExpectation, len(pipeCmds))
+		for i, pipeCmd := range pipeCmds {
+			if len(pipeCmd.Args) == 0 {
+				return nil, ErrArgsEmpty
+			}
+			if _, err := joinSubPath(f.subPath, pipeCmd.SubDir); err != nil {
+				return nil, err
+			}
+			fakeCalls[i] = &FakeCall{
+				Args:                 pipeCmd.Args,
+				SubDir:               filepath.Join(f.subPath, pipeCmd.SubDir),
+				Env:                  pipeCmd.Env,
+				ReadWriteFileManager: f.root,
+			}
+			expectation, err := f.state.next(fakeCalls[i])
+			if err != nil {
+				return nil, err
+			}
+			expectations[i] = expectation
+		}
+		return func() error {
+			return runFakeCalls(fakeCalls, expectations, stdin, stdout, stderr)
+		}, nil
+	})
+	if err != nil {
+		return func() error { return err }
+	}
+	return value.(func() error)
+}
+
+func runFakeCalls(fakeCalls []*FakeCall, expectations []*FakeExpectation, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if stdin == nil {
+		stdin = bytes.NewReader(nil)
+	}
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	var retErr error
+	for i, fakeCall := range fakeCalls {
+		var output bytes.Buffer
+		fakeCall.Stdin = stdin
+		fakeCall.Stdout = &output
+		if i == len(fakeCalls)-1 {
+			fakeCall.Stdout = stdout
+		}
+		fakeCall.Stderr = stderr
+		if err := expectations[i].run(fakeCall); err != nil && retErr == nil {
+			retErr = err
+		}
+		stdin = &output
+	}
+	return retErr
+}
+
+func (f *fakeExecutor) NewSubDirExecutorReadFileManager(path string) (ExecutorReadFileManager, error) {
+	return f.NewSubDirClient(path)
+}
+
+func (f *fakeExecutor) NewSubDirExecutorWriteFileManager(path string) (ExecutorWriteFileManager, error) {
+	return f.NewSubDirClient(path)
+}
+
+// The directory is created in the file manager, and removed on Destroy
+func (f *fakeExecutor) NewSubDirClient(path string) (Client, error) {
+	value, err := f.Do(func() (interface{}, error) {
+		exists, err := f.IsFileExists(path)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, ErrFileAlreadyExists
+		}
+		if err := f.MkdirAll(path, 0755); err != nil {
+			return nil, err
+		}
+		return &fakeExecutor{
+			concurrent.NewDestroyable(func() error {
+				return f.RemoveAll(path)
+			}),
+			newSubDirFileManager(f.ReadWriteFileManager, path),
+			f.root,
+			filepath.Join(f.subPath, path),
+			f.state,
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	subDirClient := value.(*fakeExecutor)
+	if err := f.AddChild(subDirClient); err != nil {
+		return nil, err
+	}
+	return subDirClient, nil
+}
@@ -0,0 +1,518 @@
+package exec
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/codeship/go-concurrent"
+)
+
+var (
+	faultOps = map[string]bool{
+		"NewTempDirExecutorReadFileManager":  true,
+		"NewTempDirExecutorWriteFileManager": true,
+		"NewTempDirClient":                   true,
+		"Destroy":                            true,
+		"Execute":                            true,
+		"ExecutePiped":                       true,
+		"NewSubDirExecutorReadFileManager":   true,
+		"NewSubDirExecutorWriteFileManager":  true,
+		"NewSubDirClient":                    true,
+		"IsFileExists":                       true,
+		"ListRegularFiles":                   true,
+		"Open":                               true,
+		"Walk":                               true,
+		"Glob":                               true,
+		"Watch":                              true,
+		"Stat":                               true,
+		"Lstat":                              true,
+		"Readlink":                           true,
+		"OpenFile":                           true,
+		"Create":                             true,
+		"MkdirAll":                           true,
+		"Rename":                             true,
+		"Remove":                             true,
+		"RemoveAll":                          true,
+		"Chmod":                              true,
+		"Chown":                              true,
+		"Chtimes":                            true,
+		"Symlink":                            true,
+		"Link":                               true,
+		"Truncate":                           true,
+		"Lock":                               true,
+		"TryLock":                            true,
+	}
+)
+
+type FaultOptions struct {
+	// every rule that applies to a call injects its fault
+	Rules []*FaultRule
+	// seeds the choices of the rules with a Probability, which are the same
+	// for the same calls made in the same order
+	Seed int64
+}
+
+// FaultRule applies to the calls of Ops whose paths match Path, and sleeps
+// for Latency then returns Err instead of making the call. The commands of
+// Execute and ExecutePiped are instead started, and killed after Latency if
+// Err is set.
+type FaultRule struct {
+	// the names of the methods of ClientProvider and Client, such as
+	// "Create", "Rename", "Execute" or "Destroy", all if empty
+	Ops []string
+	// a slash-separated pattern as in WalkOptions, matched against the paths
+	// of the call relative to the temporary directory of the client, which
+	// is "." for the calls without a path, any if empty
+	Path string
+	// 0 to apply to every matching call
+	Probability float64
+	// if set, only applies to the Nth matching call, counting from 1
+	NthCall int
+	// can be nil to only inject Latency
+	Err     error
+	Latency time.Duration
+}
+
+// faultInjector decides which rules apply to a call, in the order of the
+// calls. It is shared by a provider and all of its clients.
+type faultInjector struct {
+	rules []*FaultRule
+	lock  sync.Mutex
+	rand  *rand.Rand
+	// the number of matching calls of every rule
+	calls []int
+}
+
+func newFaultInjector(faultOptions *FaultOptions) (*faultInjector, error) {
+	if faultOptions == nil {
+		faultOptions = &FaultOptions{}
+	}
+	for _, rule := range faultOptions.Rules {
+		for _, op := range rule.Ops {
+			if !faultOps[op] {
+				return nil, fmt.Errorf("exec: unknown fault op: %s", op)
+			}
+		}
+		if rule.Path != "" {
+			if _, err := matchPattern(rule.Path, "."); err != nil {
+				return nil, err
+			}
+		}
+		if rule.Probability < 0 || rule.Probability > 1 {
+			return nil, fmt.Errorf("exec: fault probability not between 0 and 1: %v", rule.Probability)
+		}
+		if rule.NthCall < 0 || rule.Latency < 0 {
+			return nil, errNegative
+		}
+	}
+	return &faultInjector{
+		rules: faultOptions.Rules,
+		rand:  rand.New(rand.NewSource(faultOptions.Seed)),
+		calls: make([]int, len(faultOptions.Rules)),
+	}, nil
+}
+
+// match returns the sum of the latencies of the rules that apply to the
+// call, and the error of the first of them that has one.
+func (f *faultInjector) match(op string, paths []string) (time.Duration, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var latency time.Duration
+	var retErr error
+	for i, rule := range f.rules {
+		matches, err := rule.matches(op, paths)
+		if err != nil {
+			return 0, err
+		}
+		if !matches {
+			continue
+		}
+		f.calls[i]++
+		if rule.NthCall != 0 && f.calls[i] != rule.NthCall {
+			continue
+		}
+		if rule.Probability != 0 && f.rand.Float64() >= rule.Probability {
+			continue
+		}
+		latency += rule.Latency
+		if retErr == nil {
+			retErr = rule.Err
+		}
+	}
+	return latency, retErr
+}
+
+// inject sleeps for the latency of the rules that apply to the call
+func (f *faultInjector) inject(op string, paths ...string) error {
+	latency, err := f.match(op, paths)
+	time.Sleep(latency)
+	return err
+}
+
+func (f *FaultRule) matches(op string, paths []string) (bool, error) {
+	if len(f.Ops) > 0 && !isStringIn(op, f.Ops) {
+		return false, nil
+	}
+	if f.Path == "" {
+		return true, nil
+	}
+	for _, path := range paths {
+		matches, err := matchPattern(f.Path, filepath.ToSlash(path))
+		if err != nil || matches {
+			return matches, err
+		}
+	}
+	return false, nil
+}
+
+func isStringIn(s string, slice []string) bool {
+	for _, elem := range slice {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
+
+// faultClientProvider injects the faults of its rules into the calls to
+// clientProvider and to its clients.
+type faultClientProvider struct {
+	concurrent.Destroyable
+	clientProvider ClientProvider
+	injector       *faultInjector
+}
+
+func newFaultClientProvider(clientProvider ClientProvider, faultOptions *FaultOptions) (*faultClientProvider, error) {
+	injector, err := newFaultInjector(faultOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &faultClientProvider{
+		concurrent.NewDestroyable(func() error {
+			injectErr := injector.inject("Destroy", ".")
+			if err := clientProvider.Destroy(); err != nil {
+				return err
+			}
+			return injectErr
+		}),
+		clientProvider,
+		injector,
+	}, nil
+}
+
+func (f *faultClientProvider) NewTempDirExecutorReadFileManager() (ExecutorReadFileManager, error) {
+	return f.newTempDirClient("NewTempDirExecutorReadFileManager")
+}
+
+func (f *faultClientProvider) NewTempDirExecutorWriteFileManager() (ExecutorWriteFileManager, error) {
+	return f.newTempDirClient("NewTempDirExecutorWriteFileManager")
+}
+
+func (f *faultClientProvider) NewTempDirClient() (Client, error) {
+	return f.newTempDirClient("NewTempDirClient")
+}
+
+func (f *faultClientProvider) newTempDirClient(op string) (Client, error) {
+	value, err := f.Do(func() (interface{}, error) {
+		if err := f.injector.inject(op, "."); err != nil {
+			return nil, err
+		}
+		return f.clientProvider.NewTempDirClient()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newFaultClient(value.(Client), f.injector, ""), nil
+}
+
+// faultClient matches the paths of calls relative to the temporary
+// directory, so that rules apply the same to sub directory clients.
+type faultClient struct {
+	Client
+	injector *faultInjector
+	subPath  string
+}
+
+func newFaultClient(client Client, injector *faultInjector, subPath string) *faultClient {
+	return &faultClient{client, injector, subPath}
+}
+
+// The client is destroyed before the error of a rule is returned
+func (f *faultClient) Destroy() error {
+	injectErr := f.inject("Destroy", ".")
+	if err := f.Client.Destroy(); err != nil {
+		return err
+	}
+	return injectErr
+}
+
+// Without an error, the returned function waits for the latency of the rules
+// and for the command. With an error, the command is killed after the
+// latency, and the returned function waits for it and returns the error.
+func (f *faultClient) Execute(cmd *Cmd) func() error {
+	return f.execute(
+		"Execute",
+		[]string{cmd.SubDir},
+		func() func() error {
+			return f.Client.Execute(cmd)
+		},
+		func(osClient *osClient) (func() error, func(), error) {
+			return osClient.executeKillable(cmd)
+		},
+	)
+}
+
+func (f *faultClient) ExecutePiped(pipeCmdList *PipeCmdList) func() error {
+	subDirs := make([]string, len(pipeCmdList.PipeCmds))
+	for i, pipeCmd := range pipeCmdList.PipeCmds {
+		subDirs[i] = pipeCmd.SubDir
+	}
+	return f.execute(
+		"ExecutePiped",
+		subDirs,
+		func() func() error {
+			return f.Client.ExecutePiped(pipeCmdList)
+		},
+		func(osClient *osClient) (func() error, func(), error) {
+			return osClient.executePipedKillable(pipeCmdList)
+		},
+	)
+}
+
+func (f *faultClient) execute(
+	op string,
+	subDirs []string,
+	execute func() func() error,
+	executeKillable func(*osClient) (func() error, func(), error),
+) func() error {
+	latency, injectErr := f.injector.match(op, f.paths(subDirs...))
+	if injectErr == nil {
+		wait := execute()
+		return func() error {
+			time.Sleep(latency)
+			return wait()
+		}
+	}
+	// only the commands of the os type are host processes, the clients that
+	// embed an os client, such as those of the oci type, run them elsewhere
+	osClient, ok := f.Client.(*osClient)
+	if !ok {
+		return func() error { return ErrNotSupported }
+	}
+	wait, kill, err := executeKillable(osClient)
+	if err != nil {
+		return func() error { return err }
+	}
+	timer := time.AfterFunc(latency, kill)
+	return func() error {
+		_ = wait()
+		timer.Stop()
+		return injectErr
+	}
+}
+
+func (f *faultClient) IsFileExists(path string) (bool, error) {
+	if err := f.inject("IsFileExists", path); err != nil {
+		return false, err
+	}
+	return f.Client.IsFileExists(path)
+}
+
+func (f *faultClient) ListRegularFiles(path string) ([]string, error) {
+	if err := f.inject("ListRegularFiles", path); err != nil {
+		return nil, err
+	}
+	return f.Client.ListRegularFiles(path)
+}
+
+func (f *faultClient) Open(path string) (ReadFile, error) {
+	if err := f.inject("Open", path); err != nil {
+		return nil, err
+	}
+	return f.Client.Open(path)
+}
+
+func (f *faultClient) Walk(root string, walkOptions *WalkOptions, walkFunc WalkFunc) error {
+	if err := f.inject("Walk", root); err != nil {
+		return err
+	}
+	return f.Client.Walk(root, walkOptions, walkFunc)
+}
+
+// Rules are matched with the directory of the client, not the patterns
+func (f *faultClient) Glob(patterns ...string) ([]string, error) {
+	if err := f.inject("Glob", "."); err != nil {
+		return nil, err
+	}
+	return f.Client.Glob(patterns...)
+}
+
+func (f *faultClient) Watch(path string, recursive bool) (Watcher, error) {
+	if err := f.inject("Watch", path); err != nil {
+		return nil, err
+	}
+	return f.Client.Watch(path, recursive)
+}
+
+func (f *faultClient) Stat(path string) (os.FileInfo, error) {
+	if err := f.inject("Stat", path); err != nil {
+		return nil, err
+	}
+	return f.Client.Stat(path)
+}
+
+func (f *faultClient) Lstat(path string) (os.FileInfo, error) {
+	if err := f.inject("Lstat", path); err != nil {
+		return nil, err
+	}
+	return f.Client.Lstat(path)
+}
+
+func (f *faultClient) Readlink(path string) (string, error) {
+	if err := f.inject("Readlink", path); err != nil {
+		return "", err
+	}
+	return f.Client.Readlink(path)
+}
+
+func (f *faultClient) OpenFile(path string, flag int, perm os.FileMode) (ReadWriteFile, error) {
+	if err := f.inject("OpenFile", path); err != nil {
+		return nil, err
+	}
+	return f.Client.OpenFile(path, flag, perm)
+}
+
+func (f *faultClient) Create(path string) (WriteFile, error) {
+	if err := f.inject("Create", path); err != nil {
+		return nil, err
+	}
+	return f.Client.Create(path)
+}
+
+func (f *faultClient) MkdirAll(path string, perm os.FileMode) error {
+	if err := f.inject("MkdirAll", path); err != nil {
+		return err
+	}
+	return f.Client.MkdirAll(path, perm)
+}
+
+func (f *faultClient) Rename(oldpath string, newpath string) error {
+	if err := f.inject("Rename", oldpath, newpath); err != nil {
+		return err
+	}
+	return f.Client.Rename(oldpath, newpath)
+}
+
+func (f *faultClient) Remove(path string) error {
+	if err := f.inject("Remove", path); err != nil {
+		return err
+	}
+	return f.Client.Remove(path)
+}
+
+func (f *faultClient) RemoveAll(path string) error {
+	if err := f.inject("RemoveAll", path); err != nil {
+		return err
+	}
+	return f.Client.RemoveAll(path)
+}
+
+func (f *faultClient) Chmod(path string, mode os.FileMode) error {
+	if err := f.inject("Chmod", path); err != nil {
+		return err
+	}
+	return f.Client.Chmod(path, mode)
+}
+
+func (f *faultClient) Chown(path string, uid int, gid int) error {
+	if err := f.inject("Chown", path); err != nil {
+		return err
+	}
+	return f.Client.Chown(path, uid, gid)
+}
+
+func (f *faultClient) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	if err := f.inject("Chtimes", path); err != nil {
+		return err
+	}
+	return f.Client.Chtimes(path, atime, mtime)
+}
+
+// Rules are matched with newname only, oldname is not resolved
+func (f *faultClient) Symlink(oldname string, newname string) error {
+	if err := f.inject("Symlink", newname); err != nil {
+		return err
+	}
+	return f.Client.Symlink(oldname, newname)
+}
+
+func (f *faultClient) Link(oldname string, newname string) error {
+	if err := f.inject("Link", oldname, newname); err != nil {
+		return err
+	}
+	return f.Client.Link(oldname, newname)
+}
+
+func (f *faultClient) Truncate(path string, size int64) error {
+	if err := f.inject("Truncate", path); err != nil {
+		return err
+	}
+	return f.Client.Truncate(path, size)
+}
+
+func (f *faultClient) Lock(path string, exclusive bool) (Unlocker, error) {
+	if err := f.inject("Lock", path); err != nil {
+		return nil, err
+	}
+	return f.Client.Lock(path, exclusive)
+}
+
+func (f *faultClient) TryLock(path string, exclusive bool) (Unlocker, error) {
+	if err := f.inject("TryLock", path); err != nil {
+		return nil, err
+	}
+	return f.Client.TryLock(path, exclusive)
+}
+
+func (f *faultClient) NewSubDirExecutorReadFileManager(path string) (ExecutorReadFileManager, error) {
+	return f.newSubDirClient("NewSubDirExecutorReadFileManager", path)
+}
+
+func (f *faultClient) NewSubDirExecutorWriteFileManager(path string) (ExecutorWriteFileManager, error) {
+	return f.newSubDirClient("NewSubDirExecutorWriteFileManager", path)
+}
+
+func (f *faultClient) NewSubDirClient(path string) (Client, error) {
+	return f.newSubDirClient("NewSubDirClient", path)
+}
+
+func (f *faultClient) newSubDirClient(op string, path string) (Client, error) {
+	if err := f.inject(op, path); err != nil {
+		return nil, err
+	}
+	client, err := f.Client.NewSubDirClient(path)
+	if err != nil {
+		return nil, err
+	}
+	return newFaultClient(client, f.injector, filepath.Join(f.subPath, path)), nil
+}
+
+func (f *faultClient) inject(op string, paths ...string) error {
+	return f.injector.inject(op, f.paths(paths...)...)
+}
+
+// paths makes paths relative to the temporary directory
+func (f *faultClient) paths(paths ...string) []string {
+	tempDirPaths := make([]string, len(paths))
+	for i, path := range paths {
+		tempDirPaths[i] = filepath.Join(f.subPath, path)
+		if tempDirPaths[i] == "" {
+			tempDirPaths[i] = "."
+		}
+	}
+	return tempDirPaths
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package exec
+
+import "os"
+
+func hostFileID(fileInfo os.FileInfo) string {
+	return ""
+}
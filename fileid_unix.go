@@ -0,0 +1,20 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package exec
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// hostFileID returns the device and inode of fileInfo, or "" if fileInfo
+// does not come from the host
+func hostFileID(fileInfo os.FileInfo) string {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+}
@@ -0,0 +1,18 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package exec
+
+var hostLockTable = newLockTable()
+
+// Locks are only visible within this process
+func flock(path string, exclusive bool) (func() error, error) {
+	file, err := openLockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return hostLockTable.acquire(path, exclusive, false, func() bool { return false })
+}
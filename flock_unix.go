@@ -0,0 +1,36 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package exec
+
+import (
+	"os"
+	"syscall"
+)
+
+// flock returns ErrLockHeld instead of waiting if the lock is held, the lock
+// is released by calling the returned function.
+func flock(path string, exclusive bool) (func() error, error) {
+	file, err := openLockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH | syscall.LOCK_NB
+	if exclusive {
+		how = syscall.LOCK_EX | syscall.LOCK_NB
+	}
+	for {
+		err = syscall.Flock(int(file.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		_ = file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLockHeld
+		}
+		return nil, &os.PathError{Op: "flock", Path: path, Err: err}
+	}
+	return file.Close, nil
+}
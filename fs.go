@@ -0,0 +1,368 @@
+package exec
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+type readFileManagerFS struct {
+	readFileManager ReadFileManager
+	// relative to the root of readFileManager, "." for the root
+	dir string
+}
+
+func newReadFileManagerFS(readFileManager ReadFileManager, dir string) *readFileManagerFS {
+	return &readFileManagerFS{readFileManager, dir}
+}
+
+func (r *readFileManagerFS) Open(name string) (fs.File, error) {
+	path, err := r.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := r.readFileManager.Open(path)
+	if err != nil {
+		return nil, newFSPathError("open", name, err)
+	}
+	return &readFileManagerFSFile{file, name}, nil
+}
+
+func (r *readFileManagerFS) Stat(name string) (fs.FileInfo, error) {
+	path, err := r.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := r.readFileManager.Stat(path)
+	if err != nil {
+		return nil, newFSPathError("stat", name, err)
+	}
+	return fileInfo, nil
+}
+
+func (r *readFileManagerFS) Lstat(name string) (fs.FileInfo, error) {
+	path, err := r.path("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := r.readFileManager.Lstat(path)
+	if err != nil {
+		return nil, newFSPathError("lstat", name, err)
+	}
+	return fileInfo, nil
+}
+
+func (r *readFileManagerFS) ReadLink(name string) (string, error) {
+	path, err := r.path("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	target, err := r.readFileManager.Readlink(path)
+	if err != nil {
+		return "", newFSPathError("readlink", name, err)
+	}
+	return target, nil
+}
+
+func (r *readFileManagerFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	path, err := r.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	fileInfos, err := readDir(r.readFileManager, path)
+	if err != nil {
+		return nil, newFSPathError("readdir", name, err)
+	}
+	return newDirEntries(fileInfos), nil
+}
+
+func (r *readFileManagerFS) ReadFile(name string) ([]byte, error) {
+	path, err := r.path("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readAll(r.readFileManager, path)
+	if err != nil {
+		return nil, newFSPathError("readfile", name, err)
+	}
+	return data, nil
+}
+
+func (r *readFileManagerFS) Glob(pattern string) ([]string, error) {
+	// hide the GlobFS implementation so that fs.Glob does not call back here
+	return fs.Glob(struct{ fs.ReadDirFS }{r}, pattern)
+}
+
+func (r *readFileManagerFS) Sub(dir string) (fs.FS, error) {
+	path, err := r.path("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	return newReadFileManagerFS(r.readFileManager, path), nil
+}
+
+func (r *readFileManagerFS) path(op string, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return r.readFileManager.Join(r.dir, name), nil
+}
+
+type readFileManagerFSFile struct {
+	ReadFile
+	name string
+}
+
+func (r *readFileManagerFSFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	fileInfos, err := r.Readdir(n)
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		sort.Sort(fileInfosByName(fileInfos))
+	}
+	return newDirEntries(fileInfos), nil
+}
+
+func newDirEntries(fileInfos []os.FileInfo) []fs.DirEntry {
+	dirEntries := make([]fs.DirEntry, len(fileInfos))
+	for i, fileInfo := range fileInfos {
+		dirEntries[i] = fs.FileInfoToDirEntry(fileInfo)
+	}
+	return dirEntries
+}
+
+func newFSPathError(op string, name string, err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return &fs.PathError{Op: op, Path: name, Err: pathErr.Err}
+	}
+	if err == ErrFileDoesNotExist {
+		err = fs.ErrNotExist
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// fsReadFileManager is a read-only ReadFileManager over an fs.FS, which
+// always uses slash-separated paths.
+type fsReadFileManager struct {
+	fsys fs.FS
+}
+
+func newFSReadFileManager(fsys fs.FS) *fsReadFileManager {
+	return &fsReadFileManager{fsys}
+}
+
+func (f *fsReadFileManager) DirName() string {
+	return "."
+}
+
+// There is no directory on the host backing an fs.FS
+func (f *fsReadFileManager) DirPath() string {
+	return ""
+}
+
+func (f *fsReadFileManager) IsFileExists(path string) (bool, error) {
+	name, err := f.name(path)
+	if err != nil {
+		return false, err
+	}
+	if _, err := fs.Stat(f.fsys, name); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (f *fsReadFileManager) ListRegularFiles(path string) ([]string, error) {
+	name, err := f.name(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	if err := fs.WalkDir(f.fsys, name, func(path string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if dirEntry.Type().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (f *fsReadFileManager) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+func (f *fsReadFileManager) Walk(root string, walkOptions *WalkOptions, walkFunc WalkFunc) error {
+	if _, err := f.name(root); err != nil {
+		return err
+	}
+	return walk(f, root, walkOptions, walkFunc)
+}
+
+// An fs.FS has no change notifications
+func (f *fsReadFileManager) Watch(path string, recursive bool) (Watcher, error) {
+	return nil, ErrNotSupported
+}
+
+func (f *fsReadFileManager) Glob(patterns ...string) ([]string, error) {
+	return glob(f, patterns)
+}
+
+func (f *fsReadFileManager) Match(pattern string, name string) (bool, error) {
+	return matchPattern(pattern, name)
+}
+
+func (f *fsReadFileManager) ToSlash(path string) string {
+	return path
+}
+
+func (f *fsReadFileManager) Base(name string) string {
+	return path.Base(name)
+}
+
+func (f *fsReadFileManager) Dir(name string) string {
+	return path.Dir(name)
+}
+
+func (f *fsReadFileManager) PathSeparator() string {
+	return "/"
+}
+
+func (f *fsReadFileManager) Open(path string) (ReadFile, error) {
+	name, err := f.name(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &fsReadFile{file, name}, nil
+}
+
+func (f *fsReadFileManager) name(name string) (string, error) {
+	if strings.HasPrefix(name, "/") {
+		return "", ErrNotRelativePath
+	}
+	name = path.Clean(name)
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", ErrPathOutOfContext
+	}
+	return name, nil
+}
+
+func (f *fsReadFileManager) Stat(path string) (os.FileInfo, error) {
+	name, err := f.name(path)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Stat(f.fsys, name)
+}
+
+// Lstat uses the listing of the parent directory unless fsys implements
+// Lstat itself, as fs.DirEntry does not follow symlinks.
+func (f *fsReadFileManager) Lstat(path string) (os.FileInfo, error) {
+	name, err := f.name(path)
+	if err != nil {
+		return nil, err
+	}
+	if lstatFS, ok := f.fsys.(interface {
+		Lstat(name string) (fs.FileInfo, error)
+	}); ok {
+		return lstatFS.Lstat(name)
+	}
+	if name == "." {
+		return fs.Stat(f.fsys, name)
+	}
+	dirEntries, err := fs.ReadDir(f.fsys, f.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	base := f.Base(name)
+	for _, dirEntry := range dirEntries {
+		if dirEntry.Name() == base {
+			return dirEntry.Info()
+		}
+	}
+	return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (f *fsReadFileManager) Readlink(path string) (string, error) {
+	name, err := f.name(path)
+	if err != nil {
+		return "", err
+	}
+	if readLinkFS, ok := f.fsys.(interface {
+		ReadLink(name string) (string, error)
+	}); ok {
+		return readLinkFS.ReadLink(name)
+	}
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: ErrNotSupported}
+}
+
+type fsReadFile struct {
+	fs.File
+	name string
+}
+
+func (f *fsReadFile) Name() string {
+	return f.name
+}
+
+func (f *fsReadFile) Seek(offset int64, whence int) (int64, error) {
+	if seeker, ok := f.File.(io.Seeker); ok {
+		return seeker.Seek(offset, whence)
+	}
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: ErrNotSupported}
+}
+
+func (f *fsReadFile) ReadAt(p []byte, offset int64) (int, error) {
+	if readerAt, ok := f.File.(io.ReaderAt); ok {
+		return readerAt.ReadAt(p, offset)
+	}
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: ErrNotSupported}
+}
+
+func (f *fsReadFile) Readdir(n int) ([]os.FileInfo, error) {
+	readDirFile, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: ErrNotADirectory}
+	}
+	dirEntries, err := readDirFile.ReadDir(n)
+	if err != nil {
+		return nil, err
+	}
+	fileInfos := make([]os.FileInfo, len(dirEntries))
+	for i, dirEntry := range dirEntries {
+		fileInfo, err := dirEntry.Info()
+		if err != nil {
+			return nil, err
+		}
+		fileInfos[i] = fileInfo
+	}
+	return fileInfos, nil
+}
+
+func (f *fsReadFile) Readdirnames(n int) ([]string, error) {
+	fileInfos, err := f.Readdir(n)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(fileInfos))
+	for i, fileInfo := range fileInfos {
+		names[i] = fileInfo.Name()
+	}
+	return names, nil
+}
@@ -0,0 +1,232 @@
+package exec
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// A pattern after brace expansion split into slash-separated elements, where
+// a "**" element matches any number of path elements, including none, and all
+// other elements are matched with path.Match.
+type globPattern []string
+
+// newGlobPatterns expands braces, so "{a,b}/*.{go,s}" gives four patterns,
+// and converts "[!...]" character classes to "[^...]".
+func newGlobPatterns(pattern string) ([]globPattern, error) {
+	expanded, err := expandBraces(pattern)
+	if err != nil {
+		return nil, err
+	}
+	globPatterns := make([]globPattern, len(expanded))
+	for i, pattern := range expanded {
+		globPattern := globPattern(strings.Split(pattern, "/"))
+		for j, elem := range globPattern {
+			if elem == "**" {
+				continue
+			}
+			elem = strings.Replace(elem, "[!", "[^", -1)
+			if _, err := path.Match(elem, ""); err != nil {
+				return nil, err
+			}
+			globPattern[j] = elem
+		}
+		globPatterns[i] = globPattern
+	}
+	return globPatterns, nil
+}
+
+func matchPattern(pattern string, name string) (bool, error) {
+	globPatterns, err := newGlobPatterns(pattern)
+	if err != nil {
+		return false, err
+	}
+	for _, globPattern := range globPatterns {
+		if globPattern.matches(name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (g globPattern) matches(name string) bool {
+	return matchGlobElems(g, strings.Split(name, "/"))
+}
+
+// matchesUnder returns true if the pattern can match a path below dir
+func (g globPattern) matchesUnder(dir string) bool {
+	patternElems := []string(g)
+	for _, dirElem := range strings.Split(dir, "/") {
+		if len(patternElems) == 0 {
+			return false
+		}
+		if patternElems[0] == "**" {
+			return true
+		}
+		if matches, _ := path.Match(patternElems[0], dirElem); !matches {
+			return false
+		}
+		patternElems = patternElems[1:]
+	}
+	return len(patternElems) > 0
+}
+
+// matchesAllUnder returns true if the pattern matches every path below dir
+func (g globPattern) matchesAllUnder(dir string) bool {
+	return len(g) > 1 && g[len(g)-1] == "**" && g[:len(g)-1].matches(dir)
+}
+
+func matchGlobElems(patternElems []string, nameElems []string) bool {
+	for len(patternElems) > 0 {
+		if patternElems[0] == "**" {
+			for len(patternElems) > 1 && patternElems[1] == "**" {
+				patternElems = patternElems[1:]
+			}
+			for i := 0; i <= len(nameElems); i++ {
+				if matchGlobElems(patternElems[1:], nameElems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(nameElems) == 0 {
+			return false
+		}
+		if matches, _ := path.Match(patternElems[0], nameElems[0]); !matches {
+			return false
+		}
+		patternElems = patternElems[1:]
+		nameElems = nameElems[1:]
+	}
+	return len(nameElems) == 0
+}
+
+func expandBraces(pattern string) ([]string, error) {
+	start := -1
+	depth := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '{':
+			if depth == 0 {
+				start = i
+			}
+			depth++
+		case '}':
+			if depth == 0 {
+				return nil, path.ErrBadPattern
+			}
+			depth--
+			if depth > 0 {
+				continue
+			}
+			var expanded []string
+			for _, alternative := range splitBraceAlternatives(pattern[start+1 : i]) {
+				alternativeExpanded, err := expandBraces(pattern[:start] + alternative + pattern[i+1:])
+				if err != nil {
+					return nil, err
+				}
+				expanded = append(expanded, alternativeExpanded...)
+			}
+			return expanded, nil
+		}
+	}
+	if depth != 0 {
+		return nil, path.ErrBadPattern
+	}
+	return []string{pattern}, nil
+}
+
+func splitBraceAlternatives(s string) []string {
+	var alternatives []string
+	start := 0
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				alternatives = append(alternatives, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(alternatives, s[start:])
+}
+
+type globRule struct {
+	globPattern globPattern
+	negate      bool
+}
+
+// glob returns the sorted slash-separated paths matching patterns. Patterns
+// starting with "!" exclude paths, and the last matching pattern wins.
+// Directories no pattern can match below are not walked.
+func glob(readFileManager ReadFileManager, patterns []string) ([]string, error) {
+	var globRules []*globRule
+	for _, pattern := range patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		if negate {
+			pattern = pattern[1:]
+		}
+		globPatterns, err := newGlobPatterns(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, globPattern := range globPatterns {
+			globRules = append(globRules, &globRule{globPattern, negate})
+		}
+	}
+	var matches []string
+	if err := walk(readFileManager, ".", nil, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == "." {
+			return nil
+		}
+		name := readFileManager.ToSlash(path)
+		if isGlobMatch(globRules, name) {
+			matches = append(matches, name)
+		}
+		if fileInfo.IsDir() && isGlobPruned(globRules, name) {
+			return ErrSkipDir
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func isGlobMatch(globRules []*globRule, name string) bool {
+	matches := false
+	for _, globRule := range globRules {
+		if globRule.globPattern.matches(name) {
+			matches = !globRule.negate
+		}
+	}
+	return matches
+}
+
+func isGlobPruned(globRules []*globRule, dir string) bool {
+	pruned := true
+	for _, globRule := range globRules {
+		if globRule.negate {
+			if globRule.globPattern.matchesAllUnder(dir) {
+				pruned = true
+			}
+		} else if globRule.globPattern.matchesUnder(dir) {
+			pruned = false
+		}
+	}
+	return pruned
+}
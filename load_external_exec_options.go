@@ -0,0 +1,232 @@
+package exec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// applied in order, later entries can rely on earlier ones
+	externalExecOptionsEnvVars = []*externalExecOptionsEnvVar{
+		{
+			"GOEXEC_TYPE",
+			func(e *ExternalExecOptions, value string) error {
+				return e.Type.UnmarshalText([]byte(value))
+			},
+		},
+		{
+			"GOEXEC_TMP_DIR",
+			func(e *ExternalExecOptions, value string) error {
+				e.TmpDir = value
+				return nil
+			},
+		},
+		{
+			"GOEXEC_MAX_BYTES",
+			func(e *ExternalExecOptions, value string) error {
+				return parseEnvInt64(value, &e.MaxBytes)
+			},
+		},
+		{
+			"GOEXEC_MAX_INODES",
+			func(e *ExternalExecOptions, value string) error {
+				return parseEnvInt64(value, &e.MaxInodes)
+			},
+		},
+		{
+			"GOEXEC_TMPFS_SIZE",
+			func(e *ExternalExecOptions, value string) error {
+				if e.Tmpfs == nil {
+					e.Tmpfs = &ExternalTmpfsOptions{}
+				}
+				e.Tmpfs.Size = value
+				return nil
+			},
+		},
+		{
+			"GOEXEC_REMOTE_NETWORK",
+			func(e *ExternalExecOptions, value string) error {
+				if e.Remote == nil {
+					e.Remote = &ExternalRemoteOptions{}
+				}
+				e.Remote.Network = value
+				return nil
+			},
+		},
+		{
+			"GOEXEC_REMOTE_ADDRESS",
+			func(e *ExternalExecOptions, value string) error {
+				if e.Remote == nil {
+					e.Remote = &ExternalRemoteOptions{}
+				}
+				e.Remote.Address = value
+				return nil
+			},
+		},
+		{
+			"GOEXEC_SSH_HOST",
+			func(e *ExternalExecOptions, value string) error {
+				externalSSHOptions(e).Host = value
+				return nil
+			},
+		},
+		{
+			"GOEXEC_SSH_USER",
+			func(e *ExternalExecOptions, value string) error {
+				externalSSHOptions(e).User = value
+				return nil
+			},
+		},
+		{
+			"GOEXEC_SSH_KEY_FILE",
+			func(e *ExternalExecOptions, value string) error {
+				externalSSHOptions(e).KeyFile = value
+				return nil
+			},
+		},
+		{
+			"GOEXEC_SSH_KNOWN_HOSTS_FILE",
+			func(e *ExternalExecOptions, value string) error {
+				externalSSHOptions(e).KnownHostsFile = value
+				return nil
+			},
+		},
+		{
+			"GOEXEC_SSH_TMP_DIR",
+			func(e *ExternalExecOptions, value string) error {
+				externalSSHOptions(e).TmpDir = value
+				return nil
+			},
+		},
+		{
+			"GOEXEC_OCI_RUNTIME",
+			func(e *ExternalExecOptions, value string) error {
+				externalOCIOptions(e).Runtime = value
+				return nil
+			},
+		},
+		{
+			"GOEXEC_OCI_ROOTFS",
+			func(e *ExternalExecOptions, value string) error {
+				externalOCIOptions(e).Rootfs = value
+				return nil
+			},
+		},
+		{
+			"GOEXEC_REPLAY_CASSETTE_FILE",
+			func(e *ExternalExecOptions, value string) error {
+				if e.Replay == nil {
+					e.Replay = &ExternalReplayOptions{}
+				}
+				e.Replay.CassetteFile = value
+				return nil
+			},
+		},
+	}
+)
+
+type externalExecOptionsEnvVar struct {
+	name  string
+	apply func(*ExternalExecOptions, string) error
+}
+
+func loadExternalExecOptions(path string) (ExecOptions, error) {
+	externalExecOptions := &ExternalExecOptions{}
+	if path != "" {
+		configFormat, err := ConfigFormatOf(strings.TrimPrefix(filepath.Ext(path), "."))
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if externalExecOptions, err = parseExternalExecOptions(data, configFormat); err != nil {
+			return nil, fmt.Errorf("exec: %s: %v", path, err)
+		}
+	}
+	if err := overlayExternalExecOptionsEnv(externalExecOptions, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	execOptions, err := ConvertExternalExecOptions(externalExecOptions)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateExecOptions(execOptions); err != nil {
+		return nil, err
+	}
+	return execOptions, nil
+}
+
+// parseExternalExecOptions rejects unknown fields, missing fields keep
+// their zero values, which are the defaults
+func parseExternalExecOptions(data []byte, configFormat ConfigFormat) (*ExternalExecOptions, error) {
+	externalExecOptions := &ExternalExecOptions{}
+	switch configFormat {
+	case ConfigFormatYAML:
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(externalExecOptions); err != nil && err != io.EOF {
+			return nil, err
+		}
+	case ConfigFormatJSON:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(externalExecOptions); err != nil {
+			return nil, err
+		}
+		if decoder.More() {
+			return nil, fmt.Errorf("exec: unexpected data after JSON object")
+		}
+	default:
+		return nil, UnknownConfigFormat(configFormat)
+	}
+	return externalExecOptions, nil
+}
+
+// Environment variables that are set and not empty take precedence over
+// the values of externalExecOptions.
+func overlayExternalExecOptionsEnv(externalExecOptions *ExternalExecOptions, lookupEnv func(string) (string, bool)) error {
+	for _, envVar := range externalExecOptionsEnvVars {
+		value, ok := lookupEnv(envVar.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := envVar.apply(externalExecOptions, value); err != nil {
+			return fmt.Errorf("exec: %s: %v", envVar.name, err)
+		}
+	}
+	return nil
+}
+
+func externalSSHOptions(externalExecOptions *ExternalExecOptions) *ExternalSSHOptions {
+	if externalExecOptions.SSH == nil {
+		externalExecOptions.SSH = &ExternalSSHOptions{}
+	}
+	return externalExecOptions.SSH
+}
+
+func externalOCIOptions(externalExecOptions *ExternalExecOptions) *ExternalOCIOptions {
+	if externalExecOptions.OCI == nil {
+		externalExecOptions.OCI = &ExternalOCIOptions{}
+	}
+	return externalExecOptions.OCI
+}
+
+func parseEnvInt64(value string, target *int64) error {
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return err
+	}
+	*target = i
+	return nil
+}
@@ -0,0 +1,97 @@
+package exec
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// how often a held host lock is tried again while waiting for it
+const hostLockPollInterval = 10 * time.Millisecond
+
+type Unlocker interface {
+	Unlock() error
+}
+
+// lockTable is an in-process lock table for backends that cannot use the
+// file locking of the host.
+type lockTable struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	entries map[string]*lockTableEntry
+}
+
+type lockTableEntry struct {
+	shared    int
+	exclusive bool
+}
+
+func newLockTable() *lockTable {
+	lockTable := &lockTable{entries: make(map[string]*lockTableEntry)}
+	lockTable.cond = sync.NewCond(&lockTable.lock)
+	return lockTable
+}
+
+// acquire returns ErrLockHeld if wait is false and the lock is held, and
+// stops waiting with ErrAlreadyDestroyed once isDestroyed returns true,
+// which must be followed by a call to wake.
+func (l *lockTable) acquire(key string, exclusive bool, wait bool, isDestroyed func() bool) (func() error, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for {
+		entry, ok := l.entries[key]
+		if !ok {
+			entry = &lockTableEntry{}
+			l.entries[key] = entry
+		}
+		if !entry.exclusive && (!exclusive || entry.shared == 0) {
+			if exclusive {
+				entry.exclusive = true
+			} else {
+				entry.shared++
+			}
+			return func() error {
+				l.release(key, exclusive)
+				return nil
+			}, nil
+		}
+		if !wait {
+			return nil, ErrLockHeld
+		}
+		if isDestroyed() {
+			return nil, ErrAlreadyDestroyed
+		}
+		l.cond.Wait()
+	}
+}
+
+func (l *lockTable) release(key string, exclusive bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entry := l.entries[key]
+	if exclusive {
+		entry.exclusive = false
+	} else {
+		entry.shared--
+	}
+	if !entry.exclusive && entry.shared == 0 {
+		delete(l.entries, key)
+	}
+	l.cond.Broadcast()
+}
+
+func (l *lockTable) wake() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.cond.Broadcast()
+}
+
+// openLockFile opens the file or directory at path, and creates a file if
+// nothing exists at path.
+func openLockFile(path string) (*os.File, error) {
+	file, err := os.Open(path)
+	if err == nil || !os.IsNotExist(err) {
+		return file, err
+	}
+	return os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+}
@@ -0,0 +1,445 @@
+package exec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/codeship/go-concurrent"
+	"github.com/codeship/go-osutils"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	defaultOCIRuntime = "runc"
+	// where the directory of a client is mounted in its containers
+	ociClientDirPath = "/work"
+	defaultOCIPath   = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+var (
+	// as runc spec
+	defaultOCICapabilities = []string{
+		"CAP_AUDIT_WRITE",
+		"CAP_KILL",
+		"CAP_NET_BIND_SERVICE",
+	}
+	defaultOCIRlimits = []*OCIRlimit{
+		{Type: "RLIMIT_NOFILE", Soft: 1024, Hard: 1024},
+	}
+	ociMaskedPaths = []string{
+		"/proc/acpi",
+		"/proc/asound",
+		"/proc/kcore",
+		"/proc/keys",
+		"/proc/latency_stats",
+		"/proc/timer_list",
+		"/proc/timer_stats",
+		"/proc/sched_debug",
+		"/proc/scsi",
+		"/sys/firmware",
+	}
+	ociReadonlyPaths = []string{
+		"/proc/bus",
+		"/proc/fs",
+		"/proc/irq",
+		"/proc/sys",
+		"/proc/sysrq-trigger",
+	}
+)
+
+// ociClientProvider keeps the directories of clients on the host, as the
+// os backend does, and runs commands with the runtime. The state of the
+// runtime and the bundles of running containers are kept in dirPath.
+type ociClientProvider struct {
+	concurrent.Destroyable
+	execOptions      *OCIExecOptions
+	osClientProvider *osClientProvider
+	runtime          string
+	dirPath          string
+	nextID           uint64
+}
+
+func newOCIClientProvider(execOptions *OCIExecOptions) (*ociClientProvider, error) {
+	runtime := execOptions.Runtime
+	if runtime == "" {
+		runtime = defaultOCIRuntime
+	}
+	runtime, err := exec.LookPath(runtime)
+	if err != nil {
+		return nil, err
+	}
+	dirPath, err := ioutil.TempDir(execOptions.TmpDir, "exec-oci")
+	if err != nil {
+		return nil, err
+	}
+	osClientProvider := newOsClientProvider(
+		&OsExecOptions{
+			TmpDir:    execOptions.TmpDir,
+			MaxBytes:  execOptions.MaxBytes,
+			MaxInodes: execOptions.MaxInodes,
+		},
+	)
+	return &ociClientProvider{
+		concurrent.NewDestroyable(func() error {
+			err := osClientProvider.Destroy()
+			if removeErr := os.RemoveAll(dirPath); removeErr != nil && err == nil {
+				err = removeErr
+			}
+			return err
+		}),
+		execOptions,
+		osClientProvider,
+		runtime,
+		dirPath,
+		0,
+	}, nil
+}
+
+func (o *ociClientProvider) NewTempDirExecutorReadFileManager() (ExecutorReadFileManager, error) {
+	return o.NewTempDirClient()
+}
+
+func (o *ociClientProvider) NewTempDirExecutorWriteFileManager() (ExecutorWriteFileManager, error) {
+	return o.NewTempDirClient()
+}
+
+func (o *ociClientProvider) NewTempDirClient() (Client, error) {
+	value, err := o.Do(func() (interface{}, error) {
+		return o.osClientProvider.NewTempDirClient()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ociClient{value.(*osClient), o}, nil
+}
+
+// ociContainer is a container to be run once and then removed
+type ociContainer struct {
+	clientProvider *ociClientProvider
+	id             string
+	bundlePath     string
+}
+
+// newContainer writes the bundle of a container running args in subDir of
+// the client directory at clientDirPath
+func (o *ociClientProvider) newContainer(clientDirPath string, args []string, subDir string, env []string) (*ociContainer, error) {
+	id := fmt.Sprintf("exec%d", atomic.AddUint64(&o.nextID, 1))
+	bundlePath := filepath.Join(o.dirPath, "bundles", id)
+	if err := os.MkdirAll(bundlePath, 0700); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(o.spec(clientDirPath, args, subDir, env), "", "  ")
+	if err != nil {
+		_ = os.RemoveAll(bundlePath)
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundlePath, "config.json"), data, 0600); err != nil {
+		_ = os.RemoveAll(bundlePath)
+		return nil, err
+	}
+	return &ociContainer{o, id, bundlePath}, nil
+}
+
+func (o *ociClientProvider) spec(clientDirPath string, args []string, subDir string, env []string) *specs.Spec {
+	if len(env) == 0 {
+		env = o.execOptions.Env
+	}
+	if len(env) == 0 {
+		env = []string{defaultOCIPath}
+	}
+	user := specs.User{}
+	if o.execOptions.User != nil {
+		user.UID = o.execOptions.User.UID
+		user.GID = o.execOptions.User.GID
+	}
+	ociRlimits := o.execOptions.Rlimits
+	if len(ociRlimits) == 0 {
+		ociRlimits = defaultOCIRlimits
+	}
+	rlimits := make([]specs.POSIXRlimit, len(ociRlimits))
+	for i, ociRlimit := range ociRlimits {
+		rlimits[i] = specs.POSIXRlimit{Type: ociRlimit.Type, Hard: ociRlimit.Hard, Soft: ociRlimit.Soft}
+	}
+	namespaces := []specs.LinuxNamespace{
+		{Type: specs.PIDNamespace},
+		{Type: specs.NetworkNamespace},
+		{Type: specs.IPCNamespace},
+		{Type: specs.UTSNamespace},
+		{Type: specs.MountNamespace},
+	}
+	var uidMappings []specs.LinuxIDMapping
+	var gidMappings []specs.LinuxIDMapping
+	if o.execOptions.Rootless {
+		namespaces = append(namespaces, specs.LinuxNamespace{Type: specs.UserNamespace})
+		uidMappings = []specs.LinuxIDMapping{{ContainerID: user.UID, HostID: uint32(os.Geteuid()), Size: 1}}
+		gidMappings = []specs.LinuxIDMapping{{ContainerID: user.GID, HostID: uint32(os.Getegid()), Size: 1}}
+	}
+	return &specs.Spec{
+		Version: specs.Version,
+		Process: &specs.Process{
+			User: user,
+			Args: args,
+			Env:  env,
+			Cwd:  path.Join(ociClientDirPath, filepath.ToSlash(subDir)),
+			Capabilities: &specs.LinuxCapabilities{
+				Bounding:  defaultOCICapabilities,
+				Effective: defaultOCICapabilities,
+				Permitted: defaultOCICapabilities,
+			},
+			Rlimits:         rlimits,
+			NoNewPrivileges: true,
+		},
+		Root: &specs.Root{
+			Path:     o.execOptions.Rootfs,
+			Readonly: true,
+		},
+		Hostname: "exec",
+		Mounts:   o.mounts(clientDirPath),
+		Linux: &specs.Linux{
+			UIDMappings:   uidMappings,
+			GIDMappings:   gidMappings,
+			Namespaces:    namespaces,
+			MaskedPaths:   ociMaskedPaths,
+			ReadonlyPaths: ociReadonlyPaths,
+		},
+	}
+}
+
+// mounts are those of runc spec, or runc spec --rootless, with a writable
+// /tmp and the client directory
+func (o *ociClientProvider) mounts(clientDirPath string) []specs.Mount {
+	devptsOptions := []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"}
+	sysMount := specs.Mount{
+		Destination: "/sys",
+		Type:        "sysfs",
+		Source:      "sysfs",
+		Options:     []string{"nosuid", "noexec", "nodev", "ro"},
+	}
+	if o.execOptions.Rootless {
+		sysMount = specs.Mount{
+			Destination: "/sys",
+			Type:        "none",
+			Source:      "/sys",
+			Options:     []string{"rbind", "nosuid", "noexec", "nodev", "ro"},
+		}
+	} else {
+		// the tty group is not mapped in a user namespace
+		devptsOptions = append(devptsOptions, "gid=5")
+	}
+	mounts := []specs.Mount{
+		{
+			Destination: "/proc",
+			Type:        "proc",
+			Source:      "proc",
+		},
+		{
+			Destination: "/dev",
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     []string{"nosuid", "strictatime", "mode=755", "size=65536k"},
+		},
+		{
+			Destination: "/dev/pts",
+			Type:        "devpts",
+			Source:      "devpts",
+			Options:     devptsOptions,
+		},
+		{
+			Destination: "/dev/shm",
+			Type:        "tmpfs",
+			Source:      "shm",
+			Options:     []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"},
+		},
+		{
+			Destination: "/dev/mqueue",
+			Type:        "mqueue",
+			Source:      "mqueue",
+			Options:     []string{"nosuid", "noexec", "nodev"},
+		},
+		sysMount,
+		{
+			Destination: "/tmp",
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     []string{"nosuid", "nodev", "mode=1777"},
+		},
+		{
+			Destination: ociClientDirPath,
+			Type:        "none",
+			Source:      clientDirPath,
+			Options:     []string{"rbind", "rw"},
+		},
+	}
+	for _, ociMount := range o.execOptions.Mounts {
+		options := []string{"rbind", "rw"}
+		if ociMount.ReadOnly {
+			options = []string{"rbind", "ro"}
+		}
+		mounts = append(mounts, specs.Mount{
+			Destination: ociMount.Destination,
+			Type:        "none",
+			Source:      ociMount.Source,
+			Options:     options,
+		})
+	}
+	return mounts
+}
+
+// args runs the container in the foreground, with the stdio of the runtime
+func (o *ociContainer) args() []string {
+	return []string{
+		o.clientProvider.runtime,
+		"--root", filepath.Join(o.clientProvider.dirPath, "state"),
+		"run",
+		"--bundle", o.bundlePath,
+		o.id,
+	}
+}
+
+// remove also removes the container if the runtime was killed
+func (o *ociContainer) remove() error {
+	_ = exec.Command(
+		o.clientProvider.runtime,
+		"--root", filepath.Join(o.clientProvider.dirPath, "state"),
+		"delete", "--force",
+		o.id,
+	).Run()
+	return os.RemoveAll(o.bundlePath)
+}
+
+// ociClient is an os client that runs commands in containers
+type ociClient struct {
+	*osClient
+	clientProvider *ociClientProvider
+}
+
+func (o *ociClient) Execute(cmd *Cmd) func() error {
+	if len(cmd.Args) == 0 {
+		return func() error { return ErrArgsEmpty }
+	}
+	if cmd.SubDir != "" {
+		if err := o.validatePath(cmd.SubDir); err != nil {
+			return func() error { return err }
+		}
+	}
+	value, err := o.Do(func() (interface{}, error) {
+		container, err := o.clientProvider.newContainer(o.dirPath, cmd.Args, cmd.SubDir, cmd.Env)
+		if err != nil {
+			return nil, err
+		}
+		wait, err := execute(
+			o.quota,
+			&osutils.Cmd{
+				Args:        container.args(),
+				AbsoluteDir: container.bundlePath,
+				Stdin:       cmd.Stdin,
+				Stdout:      cmd.Stdout,
+				Stderr:      cmd.Stderr,
+			},
+		)
+		if err != nil {
+			_ = container.remove()
+			return nil, err
+		}
+		return func() (retErr error) {
+			defer func() {
+				if err := container.remove(); err != nil && retErr == nil {
+					retErr = err
+				}
+			}()
+			return wait()
+		}, nil
+	})
+	if err != nil {
+		return func() error { return err }
+	}
+	return value.(func() error)
+}
+
+// ExecutePiped runs a container for every command, connected through pipes
+// on the host
+func (o *ociClient) ExecutePiped(pipeCmdList *PipeCmdList) func() error {
+	for _, pipeCmd := range pipeCmdList.PipeCmds {
+		if pipeCmd.SubDir != "" {
+			if err := o.validatePath(pipeCmd.SubDir); err != nil {
+				return func() error { return err }
+			}
+		}
+	}
+	value, err := o.Do(func() (interface{}, error) {
+		var containers []*ociContainer
+		removeContainers := func() error {
+			var retErr error
+			for _, container := range containers {
+				if err := container.remove(); err != nil && retErr == nil {
+					retErr = err
+				}
+			}
+			return retErr
+		}
+		pipeCmds := make([]*osutils.PipeCmd, len(pipeCmdList.PipeCmds))
+		for i, pipeCmd := range pipeCmdList.PipeCmds {
+			if len(pipeCmd.Args) == 0 {
+				_ = removeContainers()
+				return nil, ErrArgsEmpty
+			}
+			container, err := o.clientProvider.newContainer(o.dirPath, pipeCmd.Args, pipeCmd.SubDir, pipeCmd.Env)
+			if err != nil {
+				_ = removeContainers()
+				return nil, err
+			}
+			containers = append(containers, container)
+			pipeCmds[i] = &osutils.PipeCmd{
+				Args:        container.args(),
+				AbsoluteDir: container.bundlePath,
+			}
+		}
+		wait, err := executePiped(
+			o.quota,
+			&osutils.PipeCmdList{
+				PipeCmds: pipeCmds,
+				Stdin:    pipeCmdList.Stdin,
+				Stdout:   pipeCmdList.Stdout,
+				Stderr:   pipeCmdList.Stderr,
+			},
+		)
+		if err != nil {
+			_ = removeContainers()
+			return nil, err
+		}
+		return func() (retErr error) {
+			defer func() {
+				if err := removeContainers(); err != nil && retErr == nil {
+					retErr = err
+				}
+			}()
+			return wait()
+		}, nil
+	})
+	if err != nil {
+		return func() error { return err }
+	}
+	return value.(func() error)
+}
+
+func (o *ociClient) NewSubDirExecutorReadFileManager(path string) (ExecutorReadFileManager, error) {
+	return o.NewSubDirClient(path)
+}
+
+func (o *ociClient) NewSubDirExecutorWriteFileManager(path string) (ExecutorWriteFileManager, error) {
+	return o.NewSubDirClient(path)
+}
+
+func (o *ociClient) NewSubDirClient(path string) (Client, error) {
+	subDirClient, err := o.newSubDirClient(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ociClient{subDirClient, o.clientProvider}, nil
+}
@@ -2,7 +2,10 @@ package exec
 
 import (
 	"os"
+	"os/exec"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/codeship/go-concurrent"
 	"github.com/codeship/go-osutils"
@@ -34,28 +37,45 @@ func (o *osClientProvider) NewTempDirExecutorWriteFileManager() (ExecutorWriteFi
 }
 
 func (o *osClientProvider) NewTempDirClient() (Client, error) {
-	tempDir, err := o.createTempDir()
+	tempDir, maxBytes, err := o.createTempDir()
 	if err != nil {
 		return nil, err
 	}
-	client := newOsClient(func() error { return o.removeTempDir(tempDir) }, tempDir)
+	client := newOsClient(
+		func() error { return o.removeTempDir(tempDir) },
+		tempDir,
+		newQuota(tempDir, maxBytes, o.execOptions.MaxInodes),
+	)
 	if err := o.AddChild(client); err != nil {
 		return nil, err
 	}
 	return client, nil
 }
 
-func (o *osClientProvider) createTempDir() (string, error) {
-	value, err := o.Do(func() (interface{}, error) {
-		if o.execOptions.TmpDir != "" {
-			return osutils.NewTempSubDir(o.execOptions.TmpDir)
+// createTempDir also returns the byte limit for quotas within the directory
+func (o *osClientProvider) createTempDir() (string, int64, error) {
+	var tempDir string
+	maxBytes := o.execOptions.MaxBytes
+	if _, err := o.Do(func() (interface{}, error) {
+		var err error
+		if o.execOptions.Tmpfs != nil {
+			tempDir, maxBytes, err = o.createTmpfsTempDir()
+		} else {
+			tempDir, err = o.newTempDir(o.execOptions.TmpDir)
 		}
-		return osutils.NewTempDir()
-	})
-	if err != nil {
-		return "", err
+		return nil, err
+	}); err != nil {
+		return "", 0, err
 	}
-	return value.(string), nil
+	return tempDir, maxBytes, nil
+}
+
+// this is only called in thread-safe context
+func (o *osClientProvider) newTempDir(tmpDir string) (string, error) {
+	if tmpDir != "" {
+		return osutils.NewTempSubDir(tmpDir)
+	}
+	return osutils.NewTempDir()
 }
 
 // this is only called in thread-safe context
@@ -63,6 +83,11 @@ func (o *osClientProvider) removeTempDir(tempDir string) error {
 	if err := o.validateIsDir(tempDir); err != nil {
 		return err
 	}
+	if o.execOptions.Tmpfs != nil {
+		if err := unmountTmpfs(tempDir); err != nil {
+			return err
+		}
+	}
 	return os.RemoveAll(tempDir)
 }
 
@@ -80,7 +105,10 @@ func (o *osClientProvider) validateIsDir(path string) error {
 
 type osClient struct {
 	concurrent.Destroyable
-	dirPath string
+	dirPath  string
+	releaser *releaser
+	// can be nil
+	quota *quota
 }
 
 func newOsAbsolutePathClient(absolutePath string) (*osClient, error) {
@@ -91,11 +119,23 @@ func newOsAbsolutePathClient(absolutePath string) (*osClient, error) {
 	if err != nil {
 		return nil, err
 	}
-	return newOsClient(func() error { return nil }, absolutePath), nil
+	return newOsClient(func() error { return nil }, absolutePath, nil), nil
 }
 
-func newOsClient(destroyCallback func() error, dirPath string) *osClient {
-	return &osClient{concurrent.NewDestroyable(destroyCallback), dirPath}
+func newOsClient(destroyCallback func() error, dirPath string, quota *quota) *osClient {
+	releaser := newReleaser()
+	return &osClient{
+		concurrent.NewDestroyable(func() error {
+			err := releaser.destroy()
+			if callbackErr := destroyCallback(); callbackErr != nil && err == nil {
+				err = callbackErr
+			}
+			return err
+		}),
+		dirPath,
+		releaser,
+		quota,
+	}
 }
 
 func (o *osClient) DirName() string {
@@ -113,7 +153,7 @@ func (o *osClient) Execute(cmd *Cmd) func() error {
 		}
 	}
 	value, err := o.Do(func() (interface{}, error) {
-		return osutils.Execute(o.osutilsCmd(cmd))
+		return execute(o.quota, o.osutilsCmd(cmd))
 	})
 	if err != nil {
 		return func() error { return err }
@@ -130,7 +170,7 @@ func (o *osClient) ExecutePiped(pipeCmdList *PipeCmdList) func() error {
 		}
 	}
 	value, err := o.Do(func() (interface{}, error) {
-		return osutils.ExecutePiped(o.osutilsPipeCmdList(pipeCmdList))
+		return executePiped(o.quota, o.osutilsPipeCmdList(pipeCmdList))
 	})
 	if err != nil {
 		return func() error { return err }
@@ -138,6 +178,47 @@ func (o *osClient) ExecutePiped(pipeCmdList *PipeCmdList) func() error {
 	return value.(func() error)
 }
 
+// executeKillable also returns a function that kills the processes of the
+// command, for the fault type
+func (o *osClient) executeKillable(cmd *Cmd) (func() error, func(), error) {
+	return o.startKillable([]string{cmd.SubDir}, func() ([]*exec.Cmd, error) {
+		return newExecCmds(o.osutilsCmd(cmd))
+	})
+}
+
+func (o *osClient) executePipedKillable(pipeCmdList *PipeCmdList) (func() error, func(), error) {
+	subDirs := make([]string, len(pipeCmdList.PipeCmds))
+	for i, pipeCmd := range pipeCmdList.PipeCmds {
+		subDirs[i] = pipeCmd.SubDir
+	}
+	return o.startKillable(subDirs, func() ([]*exec.Cmd, error) {
+		return newPipedExecCmds(o.osutilsPipeCmdList(pipeCmdList))
+	})
+}
+
+func (o *osClient) startKillable(subDirs []string, newExecCmds func() ([]*exec.Cmd, error)) (func() error, func(), error) {
+	for _, subDir := range subDirs {
+		if subDir != "" {
+			if err := o.validatePath(subDir); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	var wait func() error
+	var kill func()
+	if _, err := o.Do(func() (interface{}, error) {
+		execCmds, err := newExecCmds()
+		if err != nil {
+			return nil, err
+		}
+		wait, kill, err = o.quota.execute(execCmds)
+		return nil, err
+	}); err != nil {
+		return nil, nil, err
+	}
+	return wait, kill, nil
+}
+
 func (o *osClient) IsFileExists(path string) (bool, error) {
 	if err := o.validatePath(path); err != nil {
 		return false, err
@@ -164,17 +245,83 @@ func (o *osClient) Open(path string) (ReadFile, error) {
 	return value.(*os.File), nil
 }
 
+func (o *osClient) Stat(path string) (os.FileInfo, error) {
+	return o.fileInfo(path, os.Stat)
+}
+
+func (o *osClient) Lstat(path string) (os.FileInfo, error) {
+	return o.fileInfo(path, os.Lstat)
+}
+
+func (o *osClient) fileInfo(path string, f func(string) (os.FileInfo, error)) (os.FileInfo, error) {
+	if err := o.validatePath(path); err != nil {
+		return nil, err
+	}
+	value, err := o.Do(func() (interface{}, error) {
+		return f(o.absolutePath(path))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(os.FileInfo), nil
+}
+
+func (o *osClient) Readlink(path string) (string, error) {
+	if err := o.validatePath(path); err != nil {
+		return "", err
+	}
+	value, err := o.Do(func() (interface{}, error) {
+		return os.Readlink(o.absolutePath(path))
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
 func (o *osClient) Create(path string) (WriteFile, error) {
 	if err := o.validatePath(path); err != nil {
 		return nil, err
 	}
 	value, err := o.Do(func() (interface{}, error) {
-		return osutils.Create(o.absolutePath(path))
+		if err := o.quota.reserveIfMissing(path, o.absolutePath(path)); err != nil {
+			return nil, err
+		}
+		file, err := osutils.Create(o.absolutePath(path))
+		if err != nil {
+			return nil, err
+		}
+		return newQuotaWriteFile(file, o.quota, path), nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	return value.(*os.File), nil
+	return value.(ReadWriteFile), nil
+}
+
+func (o *osClient) OpenFile(path string, flag int, perm os.FileMode) (ReadWriteFile, error) {
+	if err := o.validatePath(path); err != nil {
+		return nil, err
+	}
+	value, err := o.Do(func() (interface{}, error) {
+		if flag&os.O_CREATE != 0 {
+			if err := o.quota.reserveIfMissing(path, o.absolutePath(path)); err != nil {
+				return nil, err
+			}
+		}
+		file, err := os.OpenFile(o.absolutePath(path), flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND) == 0 {
+			return file, nil
+		}
+		return newQuotaWriteFile(file, o.quota, path), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(ReadWriteFile), nil
 }
 
 func (o *osClient) MkdirAll(path string, perm os.FileMode) error {
@@ -182,6 +329,9 @@ func (o *osClient) MkdirAll(path string, perm os.FileMode) error {
 		return err
 	}
 	_, err := o.Do(func() (interface{}, error) {
+		if err := o.quota.reserveMissingDirs(path, o.absolutePath(path)); err != nil {
+			return nil, err
+		}
 		return nil, osutils.MkdirAll(o.absolutePath(path), perm)
 	})
 	return err
@@ -210,6 +360,129 @@ func (o *osClient) Remove(path string) error {
 	return err
 }
 
+// The directory of the client itself cannot be removed, use Destroy
+func (o *osClient) RemoveAll(path string) error {
+	if err := o.validatePath(path); err != nil {
+		return err
+	}
+	if filepath.Clean(path) == "." {
+		return &os.PathError{Op: "removeall", Path: path, Err: syscall.EINVAL}
+	}
+	_, err := o.Do(func() (interface{}, error) {
+		return nil, os.RemoveAll(o.absolutePath(path))
+	})
+	return err
+}
+
+func (o *osClient) Chmod(path string, mode os.FileMode) error {
+	if err := o.validatePath(path); err != nil {
+		return err
+	}
+	_, err := o.Do(func() (interface{}, error) {
+		return nil, os.Chmod(o.absolutePath(path), mode)
+	})
+	return err
+}
+
+func (o *osClient) Chown(path string, uid int, gid int) error {
+	if err := o.validatePath(path); err != nil {
+		return err
+	}
+	_, err := o.Do(func() (interface{}, error) {
+		return nil, os.Chown(o.absolutePath(path), uid, gid)
+	})
+	return err
+}
+
+func (o *osClient) Truncate(path string, size int64) error {
+	if err := o.validatePath(path); err != nil {
+		return err
+	}
+	_, err := o.Do(func() (interface{}, error) {
+		if err := o.quota.reserveGrowth(path, o.absolutePath(path), size); err != nil {
+			return nil, err
+		}
+		return nil, os.Truncate(o.absolutePath(path), size)
+	})
+	return err
+}
+
+func (o *osClient) Symlink(oldname string, newname string) error {
+	if err := o.validatePath(newname); err != nil {
+		return err
+	}
+	_, err := o.Do(func() (interface{}, error) {
+		if err := o.quota.reserve(newname, 0, 1); err != nil {
+			return nil, err
+		}
+		return nil, os.Symlink(oldname, o.absolutePath(newname))
+	})
+	return err
+}
+
+func (o *osClient) Link(oldname string, newname string) error {
+	if err := o.validatePath(oldname); err != nil {
+		return err
+	}
+	if err := o.validatePath(newname); err != nil {
+		return err
+	}
+	_, err := o.Do(func() (interface{}, error) {
+		if err := o.quota.reserve(newname, 0, 1); err != nil {
+			return nil, err
+		}
+		return nil, os.Link(o.absolutePath(oldname), o.absolutePath(newname))
+	})
+	return err
+}
+
+func (o *osClient) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	if err := o.validatePath(path); err != nil {
+		return err
+	}
+	_, err := o.Do(func() (interface{}, error) {
+		return nil, os.Chtimes(o.absolutePath(path), atime, mtime)
+	})
+	return err
+}
+
+func (o *osClient) Lock(path string, exclusive bool) (Unlocker, error) {
+	return o.lock(path, exclusive, true)
+}
+
+func (o *osClient) TryLock(path string, exclusive bool) (Unlocker, error) {
+	return o.lock(path, exclusive, false)
+}
+
+// not called in Do, as waiting for the lock would block Destroy. A held
+// lock is tried again every hostLockPollInterval rather than waited for, so
+// that Destroy stops the wait with ErrAlreadyDestroyed.
+func (o *osClient) lock(path string, exclusive bool, wait bool) (Unlocker, error) {
+	if err := o.validatePath(path); err != nil {
+		return nil, err
+	}
+	var unlock func() error
+	for {
+		if o.releaser.isDestroyed() {
+			return nil, ErrAlreadyDestroyed
+		}
+		var err error
+		unlock, err = flock(o.absolutePath(path), exclusive)
+		if err == nil {
+			break
+		}
+		if err != ErrLockHeld || !wait {
+			return nil, err
+		}
+		time.Sleep(hostLockPollInterval)
+	}
+	releasable, err := o.releaser.add(unlock)
+	if err != nil {
+		return nil, err
+	}
+	return releasable, nil
+}
+
 func (o *osClient) ListRegularFiles(path string) ([]string, error) {
 	if err := o.validatePath(path); err != nil {
 		return nil, err
@@ -239,8 +512,32 @@ func (o *osClient) Join(elem ...string) string {
 	return filepath.Join(elem...)
 }
 
+func (o *osClient) Walk(root string, walkOptions *WalkOptions, walkFunc WalkFunc) error {
+	if err := o.validatePath(root); err != nil {
+		return err
+	}
+	return walk(o, root, walkOptions, walkFunc)
+}
+
+func (o *osClient) Watch(path string, recursive bool) (Watcher, error) {
+	if err := o.validatePath(path); err != nil {
+		return nil, err
+	}
+	value, err := o.Do(func() (interface{}, error) {
+		return newHostWatcher(o.dirPath, path, recursive)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addWatcher(o.releaser, value.(Watcher))
+}
+
+func (o *osClient) Glob(patterns ...string) ([]string, error) {
+	return glob(o, patterns)
+}
+
 func (o *osClient) Match(pattern string, path string) (bool, error) {
-	return filepath.Match(pattern, path)
+	return matchPattern(filepath.ToSlash(pattern), filepath.ToSlash(path))
 }
 
 func (o *osClient) ToSlash(path string) string {
@@ -285,7 +582,7 @@ func (o *osClient) newSubDirClient(path string) (*osClient, error) {
 	if err := osutils.Mkdir(o.absolutePath(path), 0755); err != nil {
 		return nil, err
 	}
-	subDirClient := newOsClient(func() error { return o.removeDir(path) }, o.absolutePath(path))
+	subDirClient := newOsClient(func() error { return o.removeDir(path) }, o.absolutePath(path), o.quota)
 	if err := o.AddChild(subDirClient); err != nil {
 		return nil, err
 	}
@@ -314,8 +611,8 @@ func (o *osClient) validateIsDir(path string) error {
 }
 
 func (o *osClient) validatePath(path string) error {
-	if filepath.IsAbs(path) {
-		return ErrNotRelativePath
+	if _, err := joinSubPath(".", path); err != nil {
+		return err
 	}
 	// TODO(pedge): EvalSymlinks fails if the file does not exist
 	//path, err := filepath.EvalSymlinks(filepath.Clean(o.absolutePath(path)))
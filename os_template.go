@@ -0,0 +1,111 @@
+package exec
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// hostDir is a directory whose mode and modification time are set once its
+// children are written, so that read-only directories can be copied
+type hostDir struct {
+	path    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// copyHostDir copies the tree rooted at fromDirPath into the existing
+// directory toDirPath, preserving modes, symlinks and modification times.
+func copyHostDir(fromDirPath string, toDirPath string) error {
+	var dirs []hostDir
+	if err := filepath.Walk(fromDirPath, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(fromDirPath, path)
+		if err != nil {
+			return err
+		}
+		toPath := filepath.Join(toDirPath, rel)
+		mode := fileInfo.Mode()
+		switch {
+		case mode.IsDir():
+			if rel != "." {
+				if err := os.Mkdir(toPath, 0700); err != nil {
+					return err
+				}
+			}
+			dirs = append(dirs, hostDir{toPath, mode.Perm(), fileInfo.ModTime()})
+			return nil
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, toPath)
+		case mode.IsRegular():
+			return copyHostFile(path, toPath, fileInfo)
+		default:
+			return fmt.Errorf("exec: cannot copy %s with mode %v", rel, mode)
+		}
+	}); err != nil {
+		return err
+	}
+	return setHostDirs(dirs)
+}
+
+// copyHostFile clones the file when the filesystem supports reflinks,
+// and falls back to a regular copy otherwise.
+func copyHostFile(fromPath string, toPath string, fileInfo os.FileInfo) (retErr error) {
+	fromFile, err := os.Open(fromPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := fromFile.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	if err := writeHostFile(toPath, fileInfo.Mode().Perm(), func(toFile *os.File) error {
+		if err := reflink(toFile, fromFile); err == nil {
+			return nil
+		}
+		_, err := io.Copy(toFile, fromFile)
+		return err
+	}); err != nil {
+		return err
+	}
+	return os.Chtimes(toPath, fileInfo.ModTime(), fileInfo.ModTime())
+}
+
+func writeHostFile(path string, perm os.FileMode, write func(*os.File) error) (retErr error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	if err := write(file); err != nil {
+		return err
+	}
+	return file.Chmod(perm)
+}
+
+// setHostDirs sets the modes and modification times of dirs, children first,
+// as writing in a directory changes its modification time
+func setHostDirs(dirs []hostDir) error {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
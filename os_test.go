@@ -1,17 +1,39 @@
 package exec
 
 import (
+	"archive/tar"
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"debug/elf"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
+	"testing/fstest"
+	"time"
 
 	"testing"
 
 	"github.com/codeship/go-concurrent"
+	"github.com/pkg/sftp"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 type Suite struct {
@@ -172,6 +194,1831 @@ func (s *Suite) TestLotsOfDestroys() {
 	require.Equal(s.T(), 9, count)
 }
 
+func (s *Suite) TestNewTempDirClientFromDir() {
+	dirPath, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), os.RemoveAll(dirPath))
+	}()
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(s.T(), os.MkdirAll(filepath.Join(dirPath, "dirOne"), 0755))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dirPath, "dirOne", "one"), []byte("one"), 0644))
+	require.NoError(s.T(), os.Chmod(filepath.Join(dirPath, "dirOne", "one"), 0751))
+	require.NoError(s.T(), os.Chtimes(filepath.Join(dirPath, "dirOne", "one"), modTime, modTime))
+	require.NoError(s.T(), os.Symlink("dirOne/one", filepath.Join(dirPath, "link")))
+	require.NoError(s.T(), os.MkdirAll(filepath.Join(dirPath, "readOnly"), 0755))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dirPath, "readOnly", "one"), []byte("one"), 0644))
+	require.NoError(s.T(), os.Chmod(filepath.Join(dirPath, "readOnly"), 0555))
+	defer func() {
+		require.NoError(s.T(), os.Chmod(filepath.Join(dirPath, "readOnly"), 0755))
+	}()
+
+	client, err := NewTempDirClientFromDir(s.clientProvider, dirPath)
+	require.NoError(s.T(), err)
+	fileInfo, err := client.Stat("readOnly")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), os.FileMode(0555), fileInfo.Mode().Perm())
+	require.NoError(s.T(), client.Chmod("readOnly", 0755))
+	data, err := ReadAll(client, "dirOne/one")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "one", string(data))
+	fileInfo, err = os.Stat(filepath.Join(client.DirPath(), "dirOne", "one"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), os.FileMode(0751), fileInfo.Mode().Perm())
+	require.True(s.T(), modTime.Equal(fileInfo.ModTime()))
+	target, err := os.Readlink(filepath.Join(client.DirPath(), "link"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "dirOne/one", target)
+
+	fromClient, err := NewTempDirClientFromClient(s.clientProvider, client)
+	require.NoError(s.T(), err)
+	data, err = ReadAll(fromClient, "link")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "one", string(data))
+	s.destroy(fromClient)
+	s.destroy(client)
+}
+
+func (s *Suite) TestNewTempDirClientFromArchive() {
+	var buffer bytes.Buffer
+	tarWriter := tar.NewWriter(&buffer)
+	require.NoError(s.T(), tarWriter.WriteHeader(&tar.Header{Name: "dirOne/", Typeflag: tar.TypeDir, Mode: 0755}))
+	require.NoError(s.T(), tarWriter.WriteHeader(&tar.Header{Name: "dirOne/one", Typeflag: tar.TypeReg, Mode: 0700, Size: 3}))
+	_, err := tarWriter.Write([]byte("one"))
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), tarWriter.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dirOne"}))
+	require.NoError(s.T(), tarWriter.Close())
+
+	client, err := NewTempDirClientFromArchive(s.clientProvider, &buffer)
+	require.NoError(s.T(), err)
+	data, err := ReadAll(client, "link/one")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "one", string(data))
+	fileInfo, err := os.Stat(filepath.Join(client.DirPath(), "dirOne", "one"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), os.FileMode(0700), fileInfo.Mode().Perm())
+	s.destroy(client)
+
+	buffer.Reset()
+	tarWriter = tar.NewWriter(&buffer)
+	require.NoError(s.T(), tarWriter.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/tmp"}))
+	require.NoError(s.T(), tarWriter.WriteHeader(&tar.Header{Name: "link/escaped", Typeflag: tar.TypeReg, Mode: 0644}))
+	require.NoError(s.T(), tarWriter.Close())
+	_, err = NewTempDirClientFromArchive(s.clientProvider, &buffer)
+	require.Equal(s.T(), ErrPathOutOfContext, err)
+
+	outsideDirPath, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), os.RemoveAll(outsideDirPath))
+	}()
+	buffer.Reset()
+	tarWriter = tar.NewWriter(&buffer)
+	require.NoError(s.T(), tarWriter.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outsideDirPath}))
+	require.NoError(s.T(), tarWriter.WriteHeader(&tar.Header{Name: "link/", Typeflag: tar.TypeDir, Mode: 0777}))
+	require.NoError(s.T(), tarWriter.Close())
+	_, err = NewTempDirClientFromArchive(s.clientProvider, &buffer)
+	require.Equal(s.T(), ErrPathOutOfContext, err)
+	fileInfo, err = os.Stat(outsideDirPath)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), os.FileMode(0700), fileInfo.Mode().Perm())
+}
+
+func (s *Suite) TestOverlayClient() {
+	s.testOverlayClient(true)
+}
+
+func (s *Suite) TestOverlayClientWithoutMount() {
+	s.testOverlayClient(false)
+}
+
+func (s *Suite) testOverlayClient(mount bool) {
+	lowerDirPath, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), os.RemoveAll(lowerDirPath))
+	}()
+	require.NoError(s.T(), os.MkdirAll(filepath.Join(lowerDirPath, "dirOne"), 0755))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(lowerDirPath, "dirOne", "one"), []byte("one"), 0644))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(lowerDirPath, "two"), []byte("two"), 0644))
+
+	client, err := s.clientProvider.(*osClientProvider).newOverlayClient(lowerDirPath, mount)
+	require.NoError(s.T(), err)
+	data, err := ReadAll(client, "dirOne/one")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "one", string(data))
+	file, err := client.Create("dirOne/one")
+	require.NoError(s.T(), err)
+	_, err = file.Write([]byte("changed"))
+	require.NoError(s.T(), err)
+	s.checkClose(file)
+	require.NoError(s.T(), client.Remove("two"))
+	require.NoError(s.T(), client.Rename("dirOne/one", "three"))
+	files, err := client.ListRegularFiles(".")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"three"}, files)
+	data, err = ReadAll(client, "three")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "changed", string(data))
+
+	if _, err := exec.LookPath("unshare"); runtime.GOOS == "linux" && (err == nil || mount) {
+		stdout, _ := s.execute(client, []string{"ls", "-1", "-R"})
+		require.Equal(s.T(), ".:\ndirOne\nthree\n\n./dirOne:", stdout)
+		s.execute(client, []string{"touch", "dirOne/four"})
+		exists, err := client.IsFileExists("dirOne/four")
+		require.NoError(s.T(), err)
+		require.True(s.T(), exists)
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(lowerDirPath, "dirOne", "one"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "one", string(data))
+	s.checkFileExists(filepath.Join(lowerDirPath, "two"))
+
+	subDirClient, err := client.NewSubDirClient("sub")
+	require.NoError(s.T(), err)
+	_, err = subDirClient.Stat("../three")
+	require.Equal(s.T(), ErrPathOutOfContext, err)
+	require.Equal(s.T(), ErrPathOutOfContext, subDirClient.RemoveAll("../dirOne"))
+	exists, err := client.IsFileExists("dirOne")
+	require.NoError(s.T(), err)
+	require.True(s.T(), exists)
+	s.destroy(client)
+	s.checkFileExists(lowerDirPath)
+}
+
+func (s *Suite) TestSnapshot() {
+	client := s.newClient()
+	contents := s.newClient()
+	require.NoError(s.T(), client.MkdirAll("dirOne/dirOneOne", 0755))
+	s.writeFile(client, "dirOne/one", "one")
+	s.writeFile(client, "two", "two")
+	s.execute(client, []string{"ln", "-s", "two", "link"})
+	require.NoError(s.T(), client.MkdirAll("readOnly", 0755))
+	s.writeFile(client, "readOnly/five", "five")
+	require.NoError(s.T(), client.Chmod("readOnly", 0555))
+	manifest, err := SnapshotWithContents(client, contents)
+	require.NoError(s.T(), err)
+	paths := make([]string, len(manifest.Entries))
+	for i, entry := range manifest.Entries {
+		paths[i] = entry.Path
+	}
+	require.Equal(s.T(), []string{"dirOne", "dirOne/dirOneOne", "dirOne/one", "link", "readOnly", "readOnly/five", "two"}, paths)
+	require.Equal(s.T(), "two", manifest.Entries[3].Target)
+
+	s.execute(client, []string{"sh", "-c", "echo changed > dirOne/one && rm two && mkdir three && touch three/four"})
+	after, err := Snapshot(client)
+	require.NoError(s.T(), err)
+	manifestDiff := Diff(manifest, after)
+	require.Equal(s.T(), 2, len(manifestDiff.Added))
+	require.Equal(s.T(), "three", manifestDiff.Added[0].Path)
+	require.Equal(s.T(), "three/four", manifestDiff.Added[1].Path)
+	require.Equal(s.T(), 1, len(manifestDiff.Removed))
+	require.Equal(s.T(), "two", manifestDiff.Removed[0].Path)
+	require.Equal(s.T(), 1, len(manifestDiff.Changed))
+	require.Equal(s.T(), "dirOne/one", manifestDiff.Changed[0].New.Path)
+
+	s.execute(client, []string{"sh", "-c", "rm link && chmod 0700 dirOne && chmod 0755 readOnly && rm -r readOnly"})
+	require.NoError(s.T(), Restore(client, manifest, contents))
+	restored, err := Snapshot(client)
+	require.NoError(s.T(), err)
+	require.True(s.T(), Diff(manifest, restored).IsEmpty())
+	data, err := ReadAll(client, "dirOne/one")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "one", string(data))
+	require.NoError(s.T(), client.Chmod("readOnly", 0755))
+	s.destroy(contents)
+	s.destroy(client)
+}
+
+func (s *Suite) TestArchive() {
+	for _, archiveFormat := range AllArchiveFormats() {
+		client := s.newClient()
+		require.NoError(s.T(), client.MkdirAll("dirOne/dirOneOne", 0755))
+		s.writeFile(client, "dirOne/one", "one")
+		s.writeFile(client, "two", "two")
+		s.execute(client, []string{"ln", "-s", "../two", "dirOne/link"})
+		s.execute(client, []string{"chmod", "0700", "two"})
+		var buffer bytes.Buffer
+		require.NoError(s.T(), ExportArchive(client, &buffer, archiveFormat, "dirOne", "two"))
+
+		importClient := s.newClient()
+		require.NoError(s.T(), ImportArchive(importClient, &buffer, archiveFormat, "sub"))
+		data, err := ReadAll(importClient, "sub/dirOne/link")
+		require.NoError(s.T(), err, archiveFormat.String())
+		require.Equal(s.T(), "two", string(data))
+		fileInfo, err := os.Stat(filepath.Join(importClient.DirPath(), "sub", "two"))
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), os.FileMode(0700), fileInfo.Mode().Perm())
+		exists, err := importClient.IsFileExists("sub/dirOne/dirOneOne")
+		require.NoError(s.T(), err)
+		require.True(s.T(), exists)
+
+		buffer.Reset()
+		s.execute(client, []string{"ln", "-s", "../outside", "escape"})
+		require.NoError(s.T(), ExportArchive(client, &buffer, archiveFormat, "escape"))
+		require.Equal(s.T(), ErrPathOutOfContext, ImportArchive(importClient, &buffer, archiveFormat, ""))
+
+		// symlinks that exist before the import are not written through
+		outsideDirPath, err := ioutil.TempDir("", "")
+		require.NoError(s.T(), err)
+		require.NoError(s.T(), importClient.Symlink(outsideDirPath, "outside"))
+		require.NoError(s.T(), client.MkdirAll("outside", 0755))
+		s.writeFile(client, "outside/escaped", "escaped")
+		buffer.Reset()
+		require.NoError(s.T(), ExportArchive(client, &buffer, archiveFormat, "outside"))
+		archive := buffer.Bytes()
+		require.Equal(s.T(), ErrPathOutOfContext, ImportArchive(importClient, bytes.NewReader(archive), archiveFormat, ""))
+		require.Equal(s.T(), ErrPathOutOfContext, ImportArchive(importClient, bytes.NewReader(archive), archiveFormat, "outside"))
+		fileInfos, err := ioutil.ReadDir(outsideDirPath)
+		require.NoError(s.T(), err)
+		require.Empty(s.T(), fileInfos)
+		require.NoError(s.T(), os.RemoveAll(outsideDirPath))
+
+		// the modes of directories are set after their children are written
+		require.NoError(s.T(), client.MkdirAll("readOnly", 0755))
+		s.writeFile(client, "readOnly/one", "one")
+		require.NoError(s.T(), client.Chmod("readOnly", 0555))
+		buffer.Reset()
+		require.NoError(s.T(), ExportArchive(client, &buffer, archiveFormat, "readOnly"))
+		require.NoError(s.T(), ImportArchive(importClient, &buffer, archiveFormat, ""))
+		data, err = ReadAll(importClient, "readOnly/one")
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), "one", string(data))
+		fileInfo, err = importClient.Stat("readOnly")
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), os.FileMode(0555), fileInfo.Mode().Perm())
+		require.NoError(s.T(), client.Chmod("readOnly", 0755))
+		require.NoError(s.T(), importClient.Chmod("readOnly", 0755))
+		s.destroy(importClient)
+		s.destroy(client)
+	}
+}
+
+func (s *Suite) TestCopy() {
+	dirPath, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), os.RemoveAll(dirPath))
+	}()
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(s.T(), os.MkdirAll(filepath.Join(dirPath, "in", "dirOne"), 0755))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dirPath, "in", "dirOne", "one"), []byte("one"), 0600))
+	require.NoError(s.T(), os.Chtimes(filepath.Join(dirPath, "in", "dirOne", "one"), modTime, modTime))
+	require.NoError(s.T(), os.Symlink("dirOne", filepath.Join(dirPath, "in", "link")))
+	require.NoError(s.T(), os.MkdirAll(filepath.Join(dirPath, "in", "readOnly"), 0755))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dirPath, "in", "readOnly", "two"), []byte("two"), 0644))
+	require.NoError(s.T(), os.Chmod(filepath.Join(dirPath, "in", "readOnly"), 0555))
+
+	client := s.newClient()
+	var written int64
+	require.NoError(s.T(), CopyIn(client, filepath.Join(dirPath, "in"), "copied", &CopyOptions{
+		Progress: func(path string, n int64, size int64) {
+			written = n
+			require.Equal(s.T(), int64(3), size)
+		},
+	}))
+	require.Equal(s.T(), int64(3), written)
+	data, err := ReadAll(client, "copied/link/one")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "one", string(data))
+
+	subDirClient, err := client.NewSubDirClient("sub")
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), CopyBetween(client, "copied", subDirClient, "between", &CopyOptions{SymlinkPolicy: SymlinkPolicyFollow}))
+	require.NoError(s.T(), CopyOut(subDirClient, "between", filepath.Join(dirPath, "out"), nil))
+	fileInfo, err := os.Lstat(filepath.Join(dirPath, "out", "link", "one"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), os.FileMode(0600), fileInfo.Mode())
+	require.True(s.T(), modTime.Equal(fileInfo.ModTime()))
+	fileInfo, err = os.Stat(filepath.Join(dirPath, "out", "readOnly"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), os.FileMode(0555), fileInfo.Mode().Perm())
+	for _, path := range []string{"in/readOnly", "out/readOnly"} {
+		require.NoError(s.T(), os.Chmod(filepath.Join(dirPath, path), 0755))
+	}
+	for _, path := range []string{"copied/readOnly", "sub/between/readOnly"} {
+		require.NoError(s.T(), client.Chmod(path, 0755))
+	}
+	s.destroy(client)
+}
+
+func (s *Suite) TestFS() {
+	client := s.newClient()
+	require.NoError(s.T(), client.MkdirAll("dirOne/dirOneOne", 0755))
+	s.writeFile(client, "dirOne/one", "one")
+	s.writeFile(client, "dirOne/dirOneOne/oneOne", "oneOne")
+	s.writeFile(client, "two", "two")
+	fsys := NewFS(client)
+	require.NoError(s.T(), fstest.TestFS(fsys, "dirOne/one", "dirOne/dirOneOne/oneOne", "two"))
+	matches, err := fs.Glob(fsys, "dirOne/*")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"dirOne/dirOneOne", "dirOne/one"}, matches)
+	subFS, err := fs.Sub(fsys, "dirOne")
+	require.NoError(s.T(), err)
+	data, err := fs.ReadFile(subFS, "dirOneOne/oneOne")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "oneOne", string(data))
+
+	readFileManager := NewFSReadFileManager(fstest.MapFS{
+		"dirOne/one": &fstest.MapFile{Data: []byte("one")},
+		"two":        &fstest.MapFile{Data: []byte("two")},
+	})
+	files, err := readFileManager.ListRegularFiles(".")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"dirOne/one", "two"}, files)
+	data, err = ReadAll(readFileManager, "dirOne/one")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "one", string(data))
+	copyClient, err := NewTempDirClientFromClient(s.clientProvider, readFileManager)
+	require.NoError(s.T(), err)
+	data, err = ReadAll(copyClient, "two")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "two", string(data))
+	s.destroy(copyClient)
+	s.destroy(client)
+}
+
+func (s *Suite) TestFileAPI() {
+	client := s.newClient()
+	s.testFileAPI(client)
+
+	subDirClient, err := client.NewSubDirClient("sub")
+	require.NoError(s.T(), err)
+	for _, path := range []string{"..", "sub/../..", "../sub"} {
+		require.Equal(s.T(), ErrPathOutOfContext, subDirClient.RemoveAll(path))
+		require.Equal(s.T(), ErrPathOutOfContext, subDirClient.Chmod(path, 0777))
+		require.Equal(s.T(), ErrPathOutOfContext, subDirClient.Truncate(path, 0))
+	}
+	require.Equal(s.T(), ErrPathOutOfContext, client.RemoveAll(".."))
+	require.Error(s.T(), subDirClient.RemoveAll("."))
+	s.checkFileExists(subDirClient.DirPath())
+	s.destroy(subDirClient)
+	s.destroy(client)
+}
+
+func (s *Suite) TestOverlayClientFileAPI() {
+	lowerDirPath, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), os.RemoveAll(lowerDirPath))
+	}()
+	client, err := s.clientProvider.(*osClientProvider).newOverlayClient(lowerDirPath, false)
+	require.NoError(s.T(), err)
+	s.testFileAPI(client)
+	s.destroy(client)
+}
+
+func (s *Suite) testFileAPI(client Client) {
+	s.writeFile(client, "one", "one")
+	file, err := client.OpenFile("one", os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(s.T(), err)
+	_, err = file.Write([]byte("two"))
+	require.NoError(s.T(), err)
+	s.checkClose(file)
+	data, err := ReadAll(client, "one")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "onetwo", string(data))
+	_, err = client.OpenFile("one", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	require.True(s.T(), os.IsExist(err))
+
+	require.NoError(s.T(), client.Truncate("one", 3))
+	require.NoError(s.T(), client.Chmod("one", 0600))
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(s.T(), client.Chtimes("one", modTime, modTime))
+	fileInfo, err := client.Stat("one")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), int64(3), fileInfo.Size())
+	require.Equal(s.T(), os.FileMode(0600), fileInfo.Mode())
+	require.True(s.T(), modTime.Equal(fileInfo.ModTime()))
+
+	require.NoError(s.T(), client.Symlink("one", "link"))
+	target, err := client.Readlink("link")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "one", target)
+	fileInfo, err = client.Lstat("link")
+	require.NoError(s.T(), err)
+	require.True(s.T(), fileInfo.Mode()&os.ModeSymlink != 0)
+	fileInfo, err = client.Stat("link")
+	require.NoError(s.T(), err)
+	require.True(s.T(), fileInfo.Mode().IsRegular())
+
+	require.NoError(s.T(), client.Link("one", "hard"))
+	data, err = ReadAll(client, "hard")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "one", string(data))
+
+	require.NoError(s.T(), client.MkdirAll("dirOne/dirOneOne", 0755))
+	s.writeFile(client, "dirOne/dirOneOne/oneOne", "oneOne")
+	require.NoError(s.T(), client.RemoveAll("dirOne"))
+	exists, err := client.IsFileExists("dirOne")
+	require.NoError(s.T(), err)
+	require.False(s.T(), exists)
+}
+
+func (s *Suite) TestRandomAccess() {
+	client := s.newClient()
+	s.writeFile(client, "one", "0123456789")
+	file, err := client.OpenFile("one", os.O_RDWR, 0)
+	require.NoError(s.T(), err)
+	_, err = file.WriteAt([]byte("ab"), 4)
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), file.Sync())
+	offset, err := file.Seek(-2, io.SeekEnd)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), int64(8), offset)
+	require.NoError(s.T(), file.Truncate(9))
+	s.checkClose(file)
+
+	readFile, err := client.Open("one")
+	require.NoError(s.T(), err)
+	data := make([]byte, 4)
+	_, err = readFile.ReadAt(data, 3)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "3ab6", string(data))
+	s.checkClose(readFile)
+
+	server := httptest.NewServer(http.FileServer(http.FS(NewFS(client))))
+	defer server.Close()
+	request, err := http.NewRequest("GET", server.URL+"/one", nil)
+	require.NoError(s.T(), err)
+	request.Header.Set("Range", "bytes=2-5")
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(s.T(), err)
+	body, err := ioutil.ReadAll(response.Body)
+	require.NoError(s.T(), err)
+	s.checkClose(response.Body)
+	require.Equal(s.T(), http.StatusPartialContent, response.StatusCode)
+	require.Equal(s.T(), "23ab", string(body))
+	s.destroy(client)
+}
+
+func (s *Suite) TestWalk() {
+	client := s.newClient()
+	require.NoError(s.T(), client.MkdirAll(filepath.Join("src", "a", "b"), 0755))
+	require.NoError(s.T(), client.MkdirAll("build", 0755))
+	require.NoError(s.T(), client.MkdirAll("vendor", 0755))
+	s.writeFile(client, filepath.Join("src", "one.go"), "")
+	s.writeFile(client, filepath.Join("src", "a", "b", "two.go"), "")
+	s.writeFile(client, filepath.Join("src", "a", "b", "two.txt"), "")
+	s.writeFile(client, filepath.Join("src", "a", "keep.log"), "")
+	s.writeFile(client, filepath.Join("src", "a", "drop.log"), "")
+	s.writeFile(client, filepath.Join("build", "out"), "")
+	s.writeFile(client, filepath.Join("vendor", "three.go"), "")
+	s.writeFile(client, ".gitignore", "# comment\nbuild/\n*.log\n")
+	s.writeFile(client, filepath.Join("src", "a", ".gitignore"), "!keep.log\n")
+	require.NoError(s.T(), client.Symlink("..", filepath.Join("src", "a", "up")))
+
+	walk := func(root string, walkOptions *WalkOptions) []string {
+		var paths []string
+		require.NoError(s.T(), client.Walk(root, walkOptions, func(path string, fileInfo os.FileInfo, err error) error {
+			require.NoError(s.T(), err)
+			paths = append(paths, filepath.ToSlash(path))
+			return nil
+		}))
+		return paths
+	}
+	require.Equal(
+		s.T(),
+		[]string{"src/a/b/two.go", "src/one.go"},
+		walk(".", &WalkOptions{Include: []string{"**/*.go"}, Exclude: []string{"vendor"}}),
+	)
+	require.Equal(
+		s.T(),
+		[]string{".", ".gitignore", "src", "src/a", "src/a/.gitignore", "src/a/b", "src/a/keep.log", "src/a/up", "src/one.go", "vendor"},
+		walk(".", &WalkOptions{MaxDepth: 3, IgnoreFileName: ".gitignore", Exclude: []string{"**/b/*", "vendor/*"}}),
+	)
+	require.Equal(s.T(), []string{"src", "src/one.go"}, walk("src", &WalkOptions{MaxDepth: 1, Exclude: []string{"a"}}))
+
+	var paths []string
+	require.NoError(s.T(), client.Walk("src", nil, func(path string, fileInfo os.FileInfo, err error) error {
+		paths = append(paths, filepath.ToSlash(path))
+		if fileInfo.Name() == "a" {
+			return ErrSkipDir
+		}
+		return nil
+	}))
+	require.Equal(s.T(), []string{"src", "src/a", "src/one.go"}, paths)
+
+	var cycles []string
+	require.NoError(s.T(), client.Walk("src", &WalkOptions{FollowSymlinks: true}, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			cycles = append(cycles, filepath.ToSlash(path))
+		}
+		return nil
+	}))
+	require.Equal(s.T(), []string{"src/a/up"}, cycles)
+
+	matches, err := client.Match("src/**/*.go", filepath.Join("src", "a", "b", "two.go"))
+	require.NoError(s.T(), err)
+	require.True(s.T(), matches)
+	matches, err = client.Match("src/**/*.go", filepath.Join("src", "one.go"))
+	require.NoError(s.T(), err)
+	require.True(s.T(), matches)
+	matches, err = client.Match("src/*.go", filepath.Join("src", "a", "b", "two.go"))
+	require.NoError(s.T(), err)
+	require.False(s.T(), matches)
+	s.destroy(client)
+}
+
+func (s *Suite) TestGlob() {
+	client := s.newClient()
+	require.NoError(s.T(), client.MkdirAll(filepath.Join("src", "a", "b"), 0755))
+	require.NoError(s.T(), client.MkdirAll(filepath.Join("vendor", "c"), 0755))
+	s.writeFile(client, filepath.Join("src", "one.go"), "")
+	s.writeFile(client, filepath.Join("src", "one_test.go"), "")
+	s.writeFile(client, filepath.Join("src", "a", "b", "two.go"), "")
+	s.writeFile(client, filepath.Join("src", "a", "b", "two.s"), "")
+	s.writeFile(client, filepath.Join("src", "a", "three.txt"), "")
+	s.writeFile(client, filepath.Join("vendor", "c", "four.go"), "")
+	s.writeFile(client, "file1", "")
+	s.writeFile(client, "file2", "")
+	s.writeFile(client, "file3", "")
+
+	matches, err := client.Glob("**/*.{go,s}", "!**/*_test.go", "!vendor/**")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"src/a/b/two.go", "src/a/b/two.s", "src/one.go"}, matches)
+	matches, err = client.Glob("file[!2]", "src/*")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"file1", "file3", "src/a", "src/one.go", "src/one_test.go"}, matches)
+	matches, err = client.Glob("src/{a/*.txt,one.go}", "!src/one.go")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"src/a/three.txt"}, matches)
+	matches, err = client.Glob("nothing/**")
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), matches)
+	_, err = client.Glob("src/{a")
+	require.Error(s.T(), err)
+	s.destroy(client)
+}
+
+func (s *Suite) TestWriteAtomic() {
+	client := s.newClient()
+	require.NoError(s.T(), client.MkdirAll("dir", 0755))
+	path := filepath.Join("dir", "config")
+	require.NoError(s.T(), WriteLines(client, path, []string{"one", "two"}, 0600))
+	lines, err := ReadLines(client, path)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"one", "two"}, lines)
+	fileInfo, err := client.Stat(path)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), os.FileMode(0600), fileInfo.Mode().Perm())
+
+	file, err := CreateAtomic(client, path, 0644)
+	require.NoError(s.T(), err)
+	_, err = file.Write([]byte("three"))
+	require.NoError(s.T(), err)
+	data, err := ReadAll(client, path)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "one\ntwo\n", string(data))
+	require.NoError(s.T(), file.Abort())
+	data, err = ReadAll(client, path)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "one\ntwo\n", string(data))
+
+	require.NoError(s.T(), WriteAll(client, path, []byte("four"), 0644))
+	data, err = ReadAll(client, path)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "four", string(data))
+	dir, err := client.Open("dir")
+	require.NoError(s.T(), err)
+	dirNames, err := dir.Readdirnames(-1)
+	require.NoError(s.T(), err)
+	s.checkClose(dir)
+	require.Equal(s.T(), []string{"config"}, dirNames)
+	s.destroy(client)
+}
+
+func (s *Suite) TestLock() {
+	client := s.newClient()
+	s.testLock(client)
+	absolutePathClient, err := newOsAbsolutePathClient(client.DirPath())
+	require.NoError(s.T(), err)
+	_, err = absolutePathClient.Lock("four", true)
+	require.NoError(s.T(), err)
+	_, err = client.TryLock("four", true)
+	require.Equal(s.T(), ErrLockHeld, err)
+	require.NoError(s.T(), absolutePathClient.Destroy())
+	unlocker, err := client.TryLock("four", true)
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), unlocker.Unlock())
+
+	// directories can be locked, and nothing is created in their place
+	require.NoError(s.T(), client.MkdirAll("dirOne", 0755))
+	unlocker, err = client.Lock("dirOne", true)
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), unlocker.Unlock())
+	fileInfo, err := client.Stat("dirOne")
+	require.NoError(s.T(), err)
+	require.True(s.T(), fileInfo.IsDir())
+
+	// Destroy stops waiting for a lock
+	subDirClient, err := client.NewSubDirClient("waiting")
+	require.NoError(s.T(), err)
+	unlocker, err = client.Lock(filepath.Join("waiting", "five"), true)
+	require.NoError(s.T(), err)
+	locked := make(chan error)
+	go func() {
+		_, err := subDirClient.Lock("five", true)
+		locked <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(s.T(), subDirClient.Destroy())
+	select {
+	case err := <-locked:
+		require.Equal(s.T(), ErrAlreadyDestroyed, err)
+	case <-time.After(time.Second):
+		s.T().Fatal("lock still waited for after Destroy")
+	}
+	require.NoError(s.T(), unlocker.Unlock())
+	s.destroy(client)
+}
+
+func (s *Suite) TestOverlayClientLock() {
+	lowerDirPath, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), os.RemoveAll(lowerDirPath))
+	}()
+	client, err := s.clientProvider.(*osClientProvider).newOverlayClient(lowerDirPath, false)
+	require.NoError(s.T(), err)
+	s.testLock(client)
+	s.destroy(client)
+}
+
+func (s *Suite) testLock(client Client) {
+	unlocker, err := client.Lock("one", true)
+	require.NoError(s.T(), err)
+	_, err = client.TryLock("one", false)
+	require.Equal(s.T(), ErrLockHeld, err)
+	otherUnlocker, err := client.TryLock("two", true)
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), otherUnlocker.Unlock())
+
+	locked := make(chan Unlocker)
+	go func() {
+		unlocker, err := client.Lock("one", false)
+		require.NoError(s.T(), err)
+		locked <- unlocker
+	}()
+	select {
+	case <-locked:
+		s.T().Fatal("lock acquired while held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(s.T(), unlocker.Unlock())
+	require.NoError(s.T(), unlocker.Unlock())
+	unlocker = <-locked
+	otherUnlocker, err = client.TryLock("one", false)
+	require.NoError(s.T(), err)
+	_, err = client.TryLock("one", true)
+	require.Equal(s.T(), ErrLockHeld, err)
+	require.NoError(s.T(), unlocker.Unlock())
+	require.NoError(s.T(), otherUnlocker.Unlock())
+
+	subDirClient, err := client.NewSubDirClient("sub")
+	require.NoError(s.T(), err)
+	_, err = subDirClient.Lock("three", true)
+	require.NoError(s.T(), err)
+	_, err = client.TryLock(filepath.Join("sub", "three"), true)
+	require.Equal(s.T(), ErrLockHeld, err)
+	require.NoError(s.T(), subDirClient.Destroy())
+	require.NoError(s.T(), client.MkdirAll("sub", 0755))
+	unlocker, err = client.TryLock(filepath.Join("sub", "three"), true)
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), unlocker.Unlock())
+}
+
+func (s *Suite) TestWatch() {
+	if runtime.GOOS != "linux" {
+		s.T().Skip("watching os clients is only supported on linux")
+	}
+	s.testWatch(s.newClient())
+}
+
+func (s *Suite) TestOverlayClientWatch() {
+	lowerDirPath, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), os.RemoveAll(lowerDirPath))
+	}()
+	client, err := s.clientProvider.(*osClientProvider).newOverlayClient(lowerDirPath, false)
+	require.NoError(s.T(), err)
+	s.testWatch(client)
+}
+
+func (s *Suite) testWatch(client Client) {
+	watcher, err := client.Watch(".", true)
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), client.MkdirAll("dir", 0755))
+	s.waitForWatchEvents(watcher, &WatchEvent{"dir", WatchOpCreate})
+	one := filepath.Join("dir", "one")
+	two := filepath.Join("dir", "two")
+	s.writeFile(client, one, "one")
+	require.NoError(s.T(), client.Chmod(one, 0600))
+	require.NoError(s.T(), client.Rename(one, two))
+	require.NoError(s.T(), client.Remove(two))
+	s.waitForWatchEvents(
+		watcher,
+		&WatchEvent{one, WatchOpCreate},
+		&WatchEvent{one, WatchOpWrite},
+		&WatchEvent{one, WatchOpChmod},
+		&WatchEvent{one, WatchOpRename},
+		&WatchEvent{two, WatchOpCreate},
+		&WatchEvent{two, WatchOpRemove},
+	)
+	s.destroy(client)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-watcher.Events():
+			if !ok {
+				return
+			}
+		case <-timeout:
+			s.T().Fatal("watcher not closed on destroy")
+		}
+	}
+}
+
+// waitForWatchEvents skips the events that are not expected
+func (s *Suite) waitForWatchEvents(watcher Watcher, expected ...*WatchEvent) {
+	timeout := time.After(5 * time.Second)
+	for len(expected) > 0 {
+		select {
+		case event := <-watcher.Events():
+			if *event == *expected[0] {
+				expected = expected[1:]
+			}
+		case err := <-watcher.Errors():
+			require.NoError(s.T(), err)
+		case <-timeout:
+			s.T().Fatalf("timed out waiting for %v", *expected[0])
+		}
+	}
+}
+
+func (s *Suite) TestQuota() {
+	clientProvider := newOsClientProvider(&OsExecOptions{MaxBytes: 100, MaxInodes: 4})
+	defer func() {
+		require.NoError(s.T(), clientProvider.Destroy())
+	}()
+	client, err := clientProvider.NewTempDirClient()
+	require.NoError(s.T(), err)
+	data := strings.Repeat("a", 60)
+	s.writeFile(client, "one", data)
+	file, err := client.Create("two")
+	require.NoError(s.T(), err)
+	_, err = file.Write([]byte(data))
+	var quotaExceededError *QuotaExceededError
+	require.True(s.T(), errors.As(err, &quotaExceededError))
+	require.Equal(s.T(), "two", quotaExceededError.Path)
+	require.Equal(s.T(), int64(100), quotaExceededError.MaxBytes)
+	s.checkClose(file)
+	require.NoError(s.T(), client.Remove("one"))
+	s.writeFile(client, "two", data)
+	usage, err := Usage(client)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), &DiskUsage{60, 1}, usage)
+	err = client.MkdirAll(filepath.Join("a", "b", "c", "d"), 0755)
+	require.True(s.T(), errors.As(err, &quotaExceededError))
+
+	defer func(interval time.Duration) {
+		quotaScanInterval = interval
+	}(quotaScanInterval)
+	quotaScanInterval = 10 * time.Millisecond
+	start := time.Now()
+	err = client.Execute(&Cmd{Args: []string{"sh", "-c", "head -c 1000 /dev/zero > big; sleep 10"}})()
+	require.True(s.T(), errors.As(err, &quotaExceededError))
+	require.True(s.T(), time.Since(start) < 5*time.Second)
+	require.NoError(s.T(), client.Remove("big"))
+	err = client.Execute(&Cmd{Args: []string{"sh", "-c", "head -c 1000 /dev/zero > big"}})()
+	require.True(s.T(), errors.As(err, &quotaExceededError))
+	require.NoError(s.T(), client.Remove("big"))
+	require.NoError(s.T(), client.Execute(&Cmd{Args: []string{"true"}})())
+	s.destroy(client)
+
+	// templates copied on the host are checked once copied
+	templateDir, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), os.RemoveAll(templateDir))
+	}()
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(templateDir, "big"), make([]byte, 1000), 0644))
+	_, err = NewTempDirClientFromDir(clientProvider, templateDir)
+	require.True(s.T(), errors.As(err, &quotaExceededError))
+	templateClient, err := NewTempDirClientFromDir(newOsClientProvider(&OsExecOptions{}), templateDir)
+	require.NoError(s.T(), err)
+	defer s.destroy(templateClient)
+	_, err = NewTempDirClientFromClient(clientProvider, templateClient)
+	require.True(s.T(), errors.As(err, &quotaExceededError))
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+	lowerDirPath, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), os.RemoveAll(lowerDirPath))
+	}()
+	overlayClient, err := clientProvider.newOverlayClient(lowerDirPath, false)
+	require.NoError(s.T(), err)
+	s.writeFile(overlayClient, "one", data)
+	err = WriteAll(overlayClient, "two", []byte(data), 0644)
+	require.True(s.T(), errors.As(err, &quotaExceededError))
+	s.destroy(overlayClient)
+}
+
+func (s *Suite) TestTmpfs() {
+	execOptions, err := ConvertExternalExecOptions(&ExternalExecOptions{
+		Type:  ExecTypeOs,
+		Tmpfs: &ExternalTmpfsOptions{Size: "64K", Fallback: true},
+	})
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), &TmpfsOptions{Size: 64 << 10, Fallback: true}, execOptions.(*OsExecOptions).Tmpfs)
+	_, err = ConvertExternalExecOptions(&ExternalExecOptions{
+		Type:  ExecTypeOs,
+		Tmpfs: &ExternalTmpfsOptions{Size: "64X"},
+	})
+	require.Error(s.T(), err)
+
+	clientProvider := newOsClientProvider(execOptions.(*OsExecOptions))
+	defer func() {
+		require.NoError(s.T(), clientProvider.Destroy())
+	}()
+	client, err := clientProvider.NewTempDirClient()
+	require.NoError(s.T(), err)
+	s.writeFile(client, "small", "hello")
+	err = WriteAll(client, "big", bytes.Repeat([]byte("a"), 128<<10), 0644)
+	require.Error(s.T(), err)
+	dirPath := client.DirPath()
+	s.destroy(client)
+	s.checkFileDoesNotExist(dirPath)
+
+	// the fallback keeps to TmpDir
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), os.RemoveAll(tmpDir))
+	}()
+	tmpDirClientProvider := newOsClientProvider(&OsExecOptions{TmpDir: tmpDir, Tmpfs: &TmpfsOptions{Size: 64 << 10, Fallback: true}})
+	defer func() {
+		require.NoError(s.T(), tmpDirClientProvider.Destroy())
+	}()
+	client, err = tmpDirClientProvider.NewTempDirClient()
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), tmpDir, filepath.Dir(client.DirPath()))
+	s.destroy(client)
+	// without the fallback, only a mount that succeeds gives a client
+	noFallbackClientProvider := newOsClientProvider(&OsExecOptions{TmpDir: tmpDir, Tmpfs: &TmpfsOptions{Size: 64 << 10}})
+	defer func() {
+		require.NoError(s.T(), noFallbackClientProvider.Destroy())
+	}()
+	client, err = noFallbackClientProvider.NewTempDirClient()
+	if err != nil {
+		require.True(s.T(), isMountDenied(err))
+		fileInfos, err := ioutil.ReadDir(tmpDir)
+		require.NoError(s.T(), err)
+		require.Empty(s.T(), fileInfos)
+	} else {
+		s.destroy(client)
+	}
+}
+
+func (s *Suite) TestLoadExternalExecOptions() {
+	externalExecOptions, err := ParseExternalExecOptions([]byte("tmp_dir: /tmp\ntmpfs: {size: 512M}\n"), ConfigFormatYAML)
+	require.NoError(s.T(), err)
+	require.Equal(
+		s.T(),
+		&ExternalExecOptions{Type: ExecTypeOs, TmpDir: "/tmp", Tmpfs: &ExternalTmpfsOptions{Size: "512M"}},
+		externalExecOptions,
+	)
+	externalExecOptions, err = ParseExternalExecOptions([]byte(`{"type": "os", "max_bytes": 100}`), ConfigFormatJSON)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), &ExternalExecOptions{Type: ExecTypeOs, MaxBytes: 100}, externalExecOptions)
+	_, err = ParseExternalExecOptions([]byte("tmpdir: /tmp\n"), ConfigFormatYAML)
+	require.Error(s.T(), err)
+	_, err = ParseExternalExecOptions([]byte(`{"tmpdir": "/tmp"}`), ConfigFormatJSON)
+	require.Error(s.T(), err)
+
+	tempDir, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), os.RemoveAll(tempDir))
+	}()
+	path := filepath.Join(tempDir, "exec.yml")
+	require.NoError(s.T(), ioutil.WriteFile(path, []byte("max_bytes: 100\nmax_inodes: 10\n"), 0644))
+	s.T().Setenv("GOEXEC_MAX_BYTES", "200")
+	s.T().Setenv("GOEXEC_TMPFS_SIZE", "1K")
+	execOptions, err := LoadExternalExecOptions(path)
+	require.NoError(s.T(), err)
+	require.Equal(
+		s.T(),
+		&OsExecOptions{MaxBytes: 200, MaxInodes: 10, Tmpfs: &TmpfsOptions{Size: 1024}},
+		execOptions,
+	)
+	s.T().Setenv("GOEXEC_MAX_BYTES", "a lot")
+	_, err = LoadExternalExecOptions(path)
+	require.Error(s.T(), err)
+	_, err = LoadExternalExecOptions(filepath.Join(tempDir, "exec.toml"))
+	require.Error(s.T(), err)
+}
+
+func (s *Suite) TestValidateExecOptions() {
+	require.NoError(s.T(), ValidateExecOptions(&OsExecOptions{TmpDir: os.TempDir()}))
+	tempFile, err := ioutil.TempFile("", "")
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), tempFile.Close())
+	defer func() {
+		require.NoError(s.T(), os.Remove(tempFile.Name()))
+	}()
+	err = ValidateExecOptions(&OsExecOptions{TmpDir: tempFile.Name(), MaxBytes: -1, Tmpfs: &TmpfsOptions{Size: -1}})
+	var validationErrors ValidationErrors
+	require.True(s.T(), errors.As(err, &validationErrors))
+	require.Len(s.T(), validationErrors, 3)
+	require.Equal(s.T(), ValidationErrorTypeNotADirectory, validationErrors.Field("tmp_dir")[0].Type())
+	require.Equal(s.T(), map[string]string{"path": tempFile.Name()}, validationErrors[0].Tags())
+	require.Equal(s.T(), ValidationErrorTypeInvalidValue, validationErrors.Field("max_bytes")[0].Type())
+	require.Len(s.T(), validationErrors.Field("tmpfs.size"), 1)
+	require.True(s.T(), errors.Is(err, ErrNotADirectory))
+	var validationError ValidationError
+	require.True(s.T(), errors.As(err, &validationError))
+	require.Equal(s.T(), "tmp_dir", validationError.Field())
+	require.Contains(s.T(), err.Error(), "max_bytes: InvalidValue")
+
+	err = ValidateExecOptions(&OsExecOptions{TmpDir: "tmp"})
+	require.True(s.T(), errors.Is(err, ErrNotAbsolutePath))
+	err = ValidateExecOptions(&OsExecOptions{TmpDir: tempFile.Name() + "-missing"})
+	require.True(s.T(), errors.As(err, &validationError))
+	require.Equal(s.T(), ValidationErrorTypeFileDoesNotExist, validationError.Type())
+	_, err = ConvertExternalExecOptions(&ExternalExecOptions{Type: ExecType(100)})
+	require.True(s.T(), errors.As(err, &validationError))
+	require.Equal(s.T(), "type", validationError.Field())
+}
+
+func (s *Suite) TestExecTypeMarshal() {
+	data, err := json.Marshal(&ExternalExecOptions{Type: ExecTypeOs, TmpDir: "/tmp"})
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), `{"tmp_dir":"/tmp"}`, string(data))
+	data, err = json.Marshal(struct{ Type ExecType }{ExecTypeOs})
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), `{"Type":"os"}`, string(data))
+	var execType ExecType
+	require.NoError(s.T(), json.Unmarshal([]byte(`"os"`), &execType))
+	require.Equal(s.T(), ExecTypeOs, execType)
+	require.Error(s.T(), json.Unmarshal([]byte(`"unknown"`), &execType))
+	_, err = json.Marshal(ExecType(100))
+	require.Error(s.T(), err)
+	require.Equal(s.T(), "ExecType(100)", ExecType(100).String())
+
+	externalExecOptions, err := ParseExternalExecOptions([]byte("type: os\n"), ConfigFormatYAML)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), ExecTypeOs, externalExecOptions.Type)
+	_, err = ParseExternalExecOptions([]byte("type: unknown\n"), ConfigFormatYAML)
+	require.Error(s.T(), err)
+
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	flagSet.SetOutput(ioutil.Discard)
+	execType = ExecType(100)
+	flagSet.Var(&execType, "exec_type", "")
+	require.NoError(s.T(), flagSet.Parse([]string{"-exec_type", "os"}))
+	require.Equal(s.T(), ExecTypeOs, execType)
+	require.Error(s.T(), flagSet.Parse([]string{"-exec_type", "unknown"}))
+}
+
+func (s *Suite) TestRemote() {
+	serverClientProvider := newOsClientProvider(&OsExecOptions{})
+	defer func() {
+		require.NoError(s.T(), serverClientProvider.Destroy())
+	}()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(s.T(), err)
+	defer func() {
+		_ = listener.Close()
+	}()
+	go func() {
+		_ = ServeRemote(serverClientProvider, listener)
+	}()
+	clientProvider, err := NewClientProvider(&RemoteExecOptions{Address: listener.Addr().String()})
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), clientProvider.Destroy())
+	}()
+	client, err := clientProvider.NewTempDirClient()
+	require.NoError(s.T(), err)
+	s.testFileAPI(client)
+	s.testLock(client)
+	_, err = client.Stat("missing")
+	require.True(s.T(), os.IsNotExist(err))
+
+	require.NoError(s.T(), client.MkdirAll("sub", 0755))
+	input := bytes.Repeat([]byte("0123456789"), 300000)
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	require.NoError(s.T(), client.Execute(&Cmd{
+		Args:   []string{"sh", "-c", "cat; pwd >&2; echo $FOO >&2"},
+		SubDir: "sub",
+		Env:    []string{"FOO=foo"},
+		Stdin:  bytes.NewReader(input),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})())
+	require.Equal(s.T(), input, stdout.Bytes())
+	require.Equal(s.T(), filepath.Join(client.DirPath(), "sub")+"\nfoo\n", stderr.String())
+	stdout.Reset()
+	require.NoError(s.T(), client.ExecutePiped(&PipeCmdList{
+		PipeCmds: []*PipeCmd{
+			{Args: []string{"echo", "hello"}},
+			{Args: []string{"tr", "a-z", "A-Z"}},
+		},
+		Stdout: &stdout,
+	})())
+	require.Equal(s.T(), "HELLO\n", stdout.String())
+	err = client.Execute(&Cmd{Args: []string{"sh", "-c", "exit 3"}})()
+	var remoteExitError *RemoteExitError
+	require.True(s.T(), errors.As(err, &remoteExitError))
+	require.Equal(s.T(), 3, remoteExitError.ExitCode())
+	s.testExecuteStdinPipe(client)
+	require.NoError(s.T(), client.MkdirAll(filepath.Join("cycle", "dir"), 0755))
+	require.NoError(s.T(), client.Symlink("..", filepath.Join("cycle", "dir", "up")))
+	copyDir, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), os.RemoveAll(copyDir))
+	}()
+	err = CopyOut(client, "cycle", filepath.Join(copyDir, "cycle"), &CopyOptions{SymlinkPolicy: SymlinkPolicyFollow})
+	require.Error(s.T(), err)
+	require.Contains(s.T(), err.Error(), "symlink cycle")
+	require.NoError(s.T(), client.RemoveAll("cycle"))
+	matches, err := client.Glob("**/one", "sub")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"one", "sub"}, matches)
+	s.destroy(client)
+
+	if runtime.GOOS == "linux" {
+		client, err = clientProvider.NewTempDirClient()
+		require.NoError(s.T(), err)
+		s.testWatch(client)
+	}
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(s.T(), err)
+	client, err = NewRemoteClientProvider(conn).NewTempDirClient()
+	require.NoError(s.T(), err)
+	s.checkFileExists(client.DirPath())
+	// the commands still running are killed when the connection closes
+	_ = client.Execute(&Cmd{Args: []string{"sh", "-c", "echo $$ > pid.tmp && mv pid.tmp pid && exec sleep 10"}})
+	var pidData []byte
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if pidData, err = ioutil.ReadFile(filepath.Join(client.DirPath(), "pid")); err == nil {
+			break
+		}
+	}
+	require.NoError(s.T(), err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidData)))
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), conn.Close())
+	destroyed := false
+	for start := time.Now(); time.Since(start) < 5*time.Second && !destroyed; time.Sleep(10 * time.Millisecond) {
+		_, err := os.Stat(client.DirPath())
+		destroyed = os.IsNotExist(err)
+	}
+	require.True(s.T(), destroyed, "client not destroyed when the connection closed")
+	process, err := os.FindProcess(pid)
+	require.NoError(s.T(), err)
+	require.Error(s.T(), process.Signal(syscall.Signal(0)))
+}
+
+// Execute starts the command, so that stdin can be written to before waiting
+func (s *Suite) testExecuteStdinPipe(client Client) {
+	reader, writer := io.Pipe()
+	var stdout bytes.Buffer
+	wait := client.Execute(&Cmd{Args: []string{"cat"}, Stdin: reader, Stdout: &stdout})
+	written := make(chan error, 1)
+	go func() {
+		_, err := writer.Write([]byte("hello"))
+		if closeErr := writer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		require.NoError(s.T(), err)
+	case <-time.After(5 * time.Second):
+		s.T().Fatal("stdin not read before waiting")
+	}
+	require.NoError(s.T(), wait())
+	require.Equal(s.T(), "hello", stdout.String())
+}
+
+func (s *Suite) TestSSH() {
+	if _, err := exec.LookPath("flock"); err != nil {
+		s.T().Skip("flock not installed")
+	}
+	tempDir, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), os.RemoveAll(tempDir))
+	}()
+	hostPublicKey, hostPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(s.T(), err)
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivateKey)
+	require.NoError(s.T(), err)
+	userPublicKey, userPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(s.T(), err)
+	userSSHPublicKey, err := ssh.NewPublicKey(userPublicKey)
+	require.NoError(s.T(), err)
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), userSSHPublicKey.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(s.T(), err)
+	defer func() {
+		_ = listener.Close()
+	}()
+	go serveTestSSH(listener, serverConfig)
+
+	pemBlock, err := ssh.MarshalPrivateKey(userPrivateKey, "")
+	require.NoError(s.T(), err)
+	keyFile := filepath.Join(tempDir, "id_ed25519")
+	require.NoError(s.T(), ioutil.WriteFile(keyFile, pem.EncodeToMemory(pemBlock), 0600))
+	hostSSHPublicKey, err := ssh.NewPublicKey(hostPublicKey)
+	require.NoError(s.T(), err)
+	knownHostsFile := filepath.Join(tempDir, "known_hosts")
+	knownHostsLine := knownhosts.Line([]string{listener.Addr().String()}, hostSSHPublicKey)
+	require.NoError(s.T(), ioutil.WriteFile(knownHostsFile, []byte(knownHostsLine+"\n"), 0600))
+
+	_, err = NewClientProvider(&SSHExecOptions{Host: listener.Addr().String()})
+	require.Error(s.T(), err)
+	validationErrors, ok := err.(ValidationErrors)
+	require.True(s.T(), ok)
+	require.NotNil(s.T(), validationErrors.Field("ssh.user"))
+	require.NotNil(s.T(), validationErrors.Field("ssh.key_file"))
+
+	clientProvider, err := NewClientProvider(&SSHExecOptions{
+		Host:           listener.Addr().String(),
+		User:           "test",
+		KeyFile:        keyFile,
+		KnownHostsFile: knownHostsFile,
+		TmpDir:         tempDir,
+	})
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), clientProvider.Destroy())
+	}()
+	client, err := clientProvider.NewTempDirClient()
+	require.NoError(s.T(), err)
+	s.checkFileExists(client.DirPath())
+	s.testFileAPI(client)
+	s.testLock(client)
+	_, err = client.Stat("missing")
+	require.True(s.T(), os.IsNotExist(err))
+	_, err = client.Watch("", false)
+	require.Equal(s.T(), ErrNotSupported, err)
+
+	require.NoError(s.T(), client.MkdirAll("sub dir", 0755))
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	require.NoError(s.T(), client.Execute(&Cmd{
+		Args:   []string{"sh", "-c", "cat; pwd >&2; echo \"$FOO\" >&2"},
+		SubDir: "sub dir",
+		Env:    []string{"FOO=it's"},
+		Stdin:  strings.NewReader("input"),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})())
+	require.Equal(s.T(), "input", stdout.String())
+	require.Equal(s.T(), filepath.Join(client.DirPath(), "sub dir")+"\nit's\n", stderr.String())
+	stdout.Reset()
+	require.NoError(s.T(), client.ExecutePiped(&PipeCmdList{
+		PipeCmds: []*PipeCmd{
+			{Args: []string{"echo", "hello"}},
+			{Args: []string{"tr", "a-z", "A-Z"}},
+		},
+		Stdout: &stdout,
+	})())
+	require.Equal(s.T(), "HELLO\n", stdout.String())
+	require.Error(s.T(), client.ExecutePiped(&PipeCmdList{
+		PipeCmds: []*PipeCmd{
+			{Args: []string{"false"}},
+			{Args: []string{"cat"}},
+		},
+	})())
+	require.Error(s.T(), client.Execute(&Cmd{Args: []string{"false"}})())
+	_, err = client.NewSubDirClient("/sub")
+	require.Equal(s.T(), ErrNotRelativePath, err)
+	outside := filepath.Join(filepath.Dir(client.DirPath()), filepath.Base(client.DirPath())+"-outside")
+	require.NoError(s.T(), ioutil.WriteFile(outside, []byte("outside"), 0644))
+	defer func() {
+		require.NoError(s.T(), os.Remove(outside))
+	}()
+	_, err = ReadAll(client, filepath.Join("..", filepath.Base(outside)))
+	require.Equal(s.T(), ErrPathOutOfContext, err)
+	require.Equal(s.T(), ErrPathOutOfContext, client.Remove(filepath.Join("..", filepath.Base(outside))))
+	require.Error(s.T(), client.RemoveAll("."))
+	s.checkFileExists(outside)
+	s.checkFileExists(client.DirPath())
+	s.destroy(client)
+}
+
+// serveTestSSH serves exec requests with sh and the sftp subsystem
+func serveTestSSH(listener net.Listener, serverConfig *ssh.ServerConfig) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, newChannels, requests, err := ssh.NewServerConn(conn, serverConfig)
+			if err != nil {
+				_ = conn.Close()
+				return
+			}
+			go ssh.DiscardRequests(requests)
+			for newChannel := range newChannels {
+				if newChannel.ChannelType() != "session" {
+					_ = newChannel.Reject(ssh.UnknownChannelType, "")
+					continue
+				}
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+				go serveTestSSHSession(channel, requests)
+			}
+		}()
+	}
+}
+
+func serveTestSSHSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	for request := range requests {
+		switch request.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(request.Payload, &payload); err != nil {
+				_ = request.Reply(false, nil)
+				continue
+			}
+			cmd := exec.Command("sh", "-c", payload.Command)
+			cmd.Stdout = channel
+			cmd.Stderr = channel.Stderr()
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				_ = request.Reply(false, nil)
+				continue
+			}
+			if err := cmd.Start(); err != nil {
+				_ = request.Reply(false, nil)
+				continue
+			}
+			_ = request.Reply(true, nil)
+			// as sshd, do not wait for the end of stdin once the command exits
+			go func() {
+				_, _ = io.Copy(stdin, channel)
+				_ = stdin.Close()
+			}()
+			go func() {
+				status := 0
+				if err := cmd.Wait(); err != nil {
+					status = 255
+					var exitErr *exec.ExitError
+					if errors.As(err, &exitErr) {
+						status = exitErr.ExitCode()
+					}
+				}
+				_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+				_ = channel.Close()
+			}()
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(request.Payload, &payload); err != nil || payload.Name != "sftp" {
+				_ = request.Reply(false, nil)
+				continue
+			}
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				_ = request.Reply(false, nil)
+				continue
+			}
+			_ = request.Reply(true, nil)
+			go func() {
+				_ = server.Serve()
+				_ = channel.Close()
+			}()
+		default:
+			_ = request.Reply(false, nil)
+		}
+	}
+}
+
+func (s *Suite) TestOCI() {
+	// empty commands are rejected before the runtime is run
+	emptyRootfs, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), os.RemoveAll(emptyRootfs))
+	}()
+	falseClientProvider, err := NewClientProvider(&OCIExecOptions{Runtime: "false", Rootfs: emptyRootfs})
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), falseClientProvider.Destroy())
+	}()
+	falseClient, err := falseClientProvider.NewTempDirClient()
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), ErrArgsEmpty, falseClient.Execute(&Cmd{})())
+	require.Equal(s.T(), ErrArgsEmpty, falseClient.ExecutePiped(&PipeCmdList{PipeCmds: []*PipeCmd{{}}})())
+	s.destroy(falseClient)
+
+	var runtime string
+	for _, name := range []string{"runc", "crun"} {
+		if _, err := exec.LookPath(name); err == nil {
+			runtime = name
+			break
+		}
+	}
+	if runtime == "" {
+		s.T().Skip("no OCI runtime installed")
+	}
+	rootfs := os.Getenv("GOEXEC_TEST_OCI_ROOTFS")
+	if rootfs == "" {
+		rootfs = s.newBusyboxRootfs()
+		defer func() {
+			require.NoError(s.T(), os.RemoveAll(rootfs))
+		}()
+	}
+	clientProvider, err := NewClientProvider(&OCIExecOptions{
+		Runtime:  runtime,
+		Rootfs:   rootfs,
+		Rootless: os.Geteuid() != 0,
+		Env:      []string{"PATH=/bin", "FOO=default"},
+		Rlimits:  []*OCIRlimit{{Type: "RLIMIT_NOFILE", Soft: 512, Hard: 512}},
+	})
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), clientProvider.Destroy())
+	}()
+	client, err := clientProvider.NewTempDirClient()
+	require.NoError(s.T(), err)
+	s.checkFileExists(client.DirPath())
+	s.testFileAPI(client)
+
+	require.NoError(s.T(), client.MkdirAll("sub", 0755))
+	var stdout bytes.Buffer
+	require.NoError(s.T(), client.Execute(&Cmd{
+		Args:   []string{"sh", "-c", "pwd; echo $FOO; ulimit -n; cat; echo created > created"},
+		SubDir: "sub",
+		Stdin:  strings.NewReader("input\n"),
+		Stdout: &stdout,
+	})())
+	require.Equal(s.T(), "/work/sub\ndefault\n512\ninput\n", stdout.String())
+	data, err := ReadAll(client, "sub/created")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "created\n", string(data))
+	stdout.Reset()
+	require.NoError(s.T(), client.Execute(&Cmd{
+		Args:   []string{"sh", "-c", "echo $FOO"},
+		Env:    []string{"PATH=/bin", "FOO=foo"},
+		Stdout: &stdout,
+	})())
+	require.Equal(s.T(), "foo\n", stdout.String())
+	require.Error(s.T(), client.Execute(&Cmd{Args: []string{"touch", "/bin/rootfs"}})())
+	require.Error(s.T(), client.Execute(&Cmd{Args: []string{"false"}})())
+
+	stdout.Reset()
+	require.NoError(s.T(), client.ExecutePiped(&PipeCmdList{
+		PipeCmds: []*PipeCmd{
+			{Args: []string{"sh", "-c", "echo hello"}},
+			{Args: []string{"tr", "a-z", "A-Z"}},
+		},
+		Stdout: &stdout,
+	})())
+	require.Equal(s.T(), "HELLO\n", stdout.String())
+
+	subDirClient, err := client.NewSubDirClient("subDir")
+	require.NoError(s.T(), err)
+	s.writeFile(subDirClient, "one", "one")
+	stdout.Reset()
+	require.NoError(s.T(), subDirClient.Execute(&Cmd{
+		Args:   []string{"sh", "-c", "pwd; cat one"},
+		Stdout: &stdout,
+	})())
+	require.Equal(s.T(), "/work\none", stdout.String())
+	s.destroy(client)
+	s.checkFileDoesNotExist(subDirClient.DirPath())
+}
+
+// newBusyboxRootfs needs a statically linked busybox
+func (s *Suite) newBusyboxRootfs() string {
+	busybox, err := exec.LookPath("busybox")
+	if err != nil {
+		s.T().Skip("busybox not installed and GOEXEC_TEST_OCI_ROOTFS not set")
+	}
+	elfFile, err := elf.Open(busybox)
+	require.NoError(s.T(), err)
+	libraries, err := elfFile.ImportedLibraries()
+	s.checkClose(elfFile)
+	require.NoError(s.T(), err)
+	if len(libraries) > 0 {
+		s.T().Skip("busybox is not statically linked and GOEXEC_TEST_OCI_ROOTFS not set")
+	}
+	rootfs, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	for _, dir := range []string{"bin", "dev", "proc", "sys", "tmp", "work"} {
+		require.NoError(s.T(), os.Mkdir(filepath.Join(rootfs, dir), 0755))
+	}
+	data, err := ioutil.ReadFile(busybox)
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(rootfs, "bin", "busybox"), data, 0755))
+	for _, applet := range []string{"sh", "cat", "tr", "pwd", "false", "touch"} {
+		require.NoError(s.T(), os.Symlink("busybox", filepath.Join(rootfs, "bin", applet)))
+	}
+	return rootfs
+}
+
+func (s *Suite) TestRecordReplay() {
+	tempDir, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), os.RemoveAll(tempDir))
+	}()
+	cassetteFile := filepath.Join(tempDir, "cassette.json")
+	script := "cat input; cat; echo err >&2; mkdir -p out; echo built > out/file; ln -s file out/link; rm input"
+	run := func(clientProvider ClientProvider) Client {
+		client, err := clientProvider.NewTempDirClient()
+		require.NoError(s.T(), err)
+		s.writeFile(client, "input", "input\n")
+		var stdout bytes.Buffer
+		var stderr bytes.Buffer
+		require.NoError(s.T(), client.Execute(&Cmd{
+			Args:   []string{"sh", "-c", script},
+			Stdin:  strings.NewReader("stdin\n"),
+			Stdout: &stdout,
+			Stderr: &stderr,
+		})())
+		require.Equal(s.T(), "input\nstdin\n", stdout.String())
+		require.Equal(s.T(), "err\n", stderr.String())
+		data, err := ReadAll(client, "out/file")
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), "built\n", string(data))
+		target, err := client.Readlink("out/link")
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), "file", target)
+		s.checkFileDoesNotExist(filepath.Join(client.DirPath(), "input"))
+
+		err = client.Execute(&Cmd{Args: []string{"sh", "-c", "exit 3"}})()
+		code, ok := exitCode(err)
+		require.True(s.T(), ok)
+		require.Equal(s.T(), 3, code)
+		stdout.Reset()
+		require.NoError(s.T(), client.ExecutePiped(&PipeCmdList{
+			PipeCmds: []*PipeCmd{
+				{Args: []string{"echo", "hello"}},
+				{Args: []string{"tr", "a-z", "A-Z"}},
+			},
+			Stdout: &stdout,
+		})())
+		require.Equal(s.T(), "HELLO\n", stdout.String())
+		subDirClient, err := client.NewSubDirClient("sub")
+		require.NoError(s.T(), err)
+		require.NoError(s.T(), subDirClient.Execute(&Cmd{Args: []string{"touch", "made"}, Env: []string{"A=a"}})())
+		s.checkFileExists(filepath.Join(subDirClient.DirPath(), "made"))
+		s.testExecuteStdinPipe(client)
+		return client
+	}
+
+	recordingClientProvider := NewRecordingClientProvider(newOsClientProvider(&OsExecOptions{}), cassetteFile)
+	run(recordingClientProvider)
+	require.NoError(s.T(), recordingClientProvider.Destroy())
+	s.checkFileExists(cassetteFile)
+
+	replayClientProvider, err := NewClientProvider(&ReplayExecOptions{CassetteFile: cassetteFile})
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), replayClientProvider.Destroy())
+	}()
+	client := run(replayClientProvider)
+	var unrecordedCommandError *UnrecordedCommandError
+	err = client.Execute(&Cmd{Args: []string{"true"}})()
+	require.True(s.T(), errors.As(err, &unrecordedCommandError))
+	require.Equal(s.T(), []string{"true"}, unrecordedCommandError.Cmds)
+	// every recording is replayed once
+	err = client.Execute(&Cmd{Args: []string{"sh", "-c", "exit 3"}})()
+	require.True(s.T(), errors.As(err, &unrecordedCommandError))
+	_, err = NewClientProvider(&ReplayExecOptions{CassetteFile: filepath.Join(tempDir, "missing")})
+	require.Error(s.T(), err)
+}
+
+func (s *Suite) TestDryRun() {
+	var text bytes.Buffer
+	var jsonBuffer bytes.Buffer
+	clientProvider := NewDryRunClientProvider(
+		newOsClientProvider(&OsExecOptions{}),
+		&DryRunOptions{TextWriter: &text, JSONWriter: &jsonBuffer},
+	)
+	client, err := clientProvider.NewTempDirClient()
+	require.NoError(s.T(), err)
+	s.testFileAPI(client)
+	s.testLock(client)
+	// nothing is changed in the directory of the client
+	fileInfos, err := ioutil.ReadDir(client.DirPath())
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), fileInfos)
+
+	lowerFile := filepath.Join(client.DirPath(), "lower", "dir", "file")
+	require.NoError(s.T(), os.MkdirAll(filepath.Dir(lowerFile), 0755))
+	require.NoError(s.T(), ioutil.WriteFile(lowerFile, []byte("lower"), 0644))
+	file, err := client.OpenFile(filepath.Join("lower", "dir", "file"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(s.T(), err)
+	_, err = file.Write([]byte("more"))
+	require.NoError(s.T(), err)
+	s.checkClose(file)
+	require.NoError(s.T(), client.Rename("lower", "renamed"))
+	data, err := ReadAll(client, filepath.Join("renamed", "dir", "file"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "lowermore", string(data))
+	exists, err := client.IsFileExists("lower")
+	require.NoError(s.T(), err)
+	require.False(s.T(), exists)
+	files, err := client.ListRegularFiles(".")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"hard", "one", filepath.Join("renamed", "dir", "file"), filepath.Join("sub", "three"), "two"}, files)
+	data, err = ioutil.ReadFile(lowerFile)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "lower", string(data))
+
+	// writes through symlinked directories of both layers
+	require.NoError(s.T(), client.MkdirAll("upperReal", 0755))
+	require.NoError(s.T(), client.Symlink("upperReal", "upperLink"))
+	s.writeFile(client, filepath.Join("upperLink", "file"), "linked")
+	data, err = ReadAll(client, filepath.Join("upperReal", "file"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "linked", string(data))
+	require.NoError(s.T(), os.Mkdir(filepath.Join(client.DirPath(), "lowerReal"), 0755))
+	require.NoError(s.T(), os.Symlink("lowerReal", filepath.Join(client.DirPath(), "lowerLink")))
+	s.writeFile(client, filepath.Join("lowerLink", "file"), "linked")
+	data, err = ReadAll(client, filepath.Join("lowerReal", "file"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "linked", string(data))
+	s.checkFileDoesNotExist(filepath.Join(client.DirPath(), "lowerReal", "file"))
+
+	require.NoError(s.T(), client.Execute(&Cmd{Args: []string{"touch", "made"}})())
+	require.NoError(s.T(), client.ExecutePiped(&PipeCmdList{
+		PipeCmds: []*PipeCmd{
+			{Args: []string{"echo", "hello"}},
+			{Args: []string{"tr", "a-z", "A-Z"}},
+		},
+	})())
+	subDirClient, err := client.NewSubDirClient("other")
+	require.NoError(s.T(), err)
+	_, err = subDirClient.Create(filepath.Join("..", "otherSibling"))
+	require.Equal(s.T(), ErrPathOutOfContext, err)
+	require.NoError(s.T(), subDirClient.Execute(&Cmd{Args: []string{"touch", "made"}, Env: []string{"A=a"}})())
+	require.NoError(s.T(), subDirClient.Destroy())
+	s.checkFileDoesNotExist(filepath.Join(client.DirPath(), "made"))
+	exists, err = client.IsFileExists("made")
+	require.NoError(s.T(), err)
+	require.False(s.T(), exists)
+	dir := client.DirPath()
+	s.destroy(client)
+	require.NoError(s.T(), clientProvider.Destroy())
+
+	lines := strings.Split(strings.TrimSuffix(text.String(), "\n"), "\n")
+	require.Contains(s.T(), lines, dir+": write one -rw-rw-rw- 3 bytes")
+	require.Contains(s.T(), lines, dir+": rename lower to renamed")
+	require.Contains(s.T(), lines, dir+": write "+filepath.Join("lower", "dir", "file")+" -rw-r--r-- 9 bytes")
+	require.Contains(s.T(), lines, dir+": execute touch made")
+	require.Contains(s.T(), lines, dir+": execute echo hello | tr a-z A-Z")
+	require.Contains(s.T(), lines, dir+": execute A=a (in other) touch made")
+	require.Equal(s.T(), dir+": remove_all other", lines[len(lines)-1])
+	plan := &DryRunPlan{}
+	require.NoError(s.T(), json.Unmarshal(jsonBuffer.Bytes(), plan))
+	require.Len(s.T(), plan.Steps, len(lines))
+	require.Equal(s.T(), text.String(), plan.String())
+
+	clientProvider = NewDryRunClientProvider(newOsClientProvider(&OsExecOptions{}), nil)
+	defer func() {
+		require.NoError(s.T(), clientProvider.Destroy())
+	}()
+	client, err = clientProvider.NewTempDirClient()
+	require.NoError(s.T(), err)
+	s.testWatch(client)
+
+	// the clients are destroyed with the provider, before the plan is written
+	destroyedClientProvider := NewDryRunClientProvider(newOsClientProvider(&OsExecOptions{}), nil)
+	client, err = destroyedClientProvider.NewTempDirClient()
+	require.NoError(s.T(), err)
+	_, err = client.Lock("lock", true)
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), destroyedClientProvider.Destroy())
+	require.Equal(s.T(), concurrent.ErrAlreadyDestroyed, client.Execute(&Cmd{Args: []string{"true"}})())
+	_, err = client.TryLock("lock", true)
+	require.Equal(s.T(), concurrent.ErrAlreadyDestroyed, err)
+	s.checkFileDoesNotExist(client.DirPath())
+}
+
+func (s *Suite) TestFault() {
+	errExecute := errors.New("killed")
+	errDestroy := errors.New("destroy")
+	clientProvider, err := NewFaultClientProvider(
+		newOsClientProvider(&OsExecOptions{}),
+		&FaultOptions{
+			Rules: []*FaultRule{
+				{Ops: []string{"Create"}, Path: "**/*.txt", NthCall: 2, Err: syscall.ENOSPC},
+				{Ops: []string{"Rename"}, Path: "sub/**", Err: syscall.EXDEV},
+				{Ops: []string{"Execute"}, Err: errExecute, Latency: 500 * time.Millisecond},
+				{Ops: []string{"Destroy"}, Path: "sub", Err: errDestroy},
+				{Ops: []string{"Stat"}, Latency: 20 * time.Millisecond},
+			},
+		},
+	)
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), clientProvider.Destroy())
+	}()
+	client, err := clientProvider.NewTempDirClient()
+	require.NoError(s.T(), err)
+	s.writeFile(client, "one.txt", "one")
+	_, err = client.Create("two.txt")
+	require.Equal(s.T(), syscall.ENOSPC, err)
+	s.writeFile(client, "three.txt", "three")
+
+	subDirClient, err := client.NewSubDirClient("sub")
+	require.NoError(s.T(), err)
+	s.writeFile(subDirClient, "four", "four")
+	require.Equal(s.T(), syscall.EXDEV, subDirClient.Rename("four", "five"))
+	require.Equal(s.T(), syscall.EXDEV, client.Rename("one.txt", filepath.Join("sub", "one.txt")))
+	require.NoError(s.T(), client.Rename("one.txt", "five.txt"))
+	// the command is killed after the latency, before the error is returned
+	start := time.Now()
+	require.Equal(s.T(), errExecute, subDirClient.Execute(&Cmd{Args: []string{"sh", "-c", "touch made; sleep 10; touch late"}})())
+	require.True(s.T(), time.Since(start) >= 500*time.Millisecond)
+	require.True(s.T(), time.Since(start) < 5*time.Second)
+	s.checkFileExists(filepath.Join(subDirClient.DirPath(), "made"))
+	s.checkFileDoesNotExist(filepath.Join(subDirClient.DirPath(), "late"))
+	start = time.Now()
+	_, err = subDirClient.Stat("made")
+	require.NoError(s.T(), err)
+	require.True(s.T(), time.Since(start) >= 20*time.Millisecond)
+	require.Equal(s.T(), errDestroy, subDirClient.Destroy())
+	s.checkFileDoesNotExist(subDirClient.DirPath())
+	s.destroy(client)
+
+	dryRunClientProvider, err := NewFaultClientProvider(
+		NewDryRunClientProvider(newOsClientProvider(&OsExecOptions{}), nil),
+		&FaultOptions{Rules: []*FaultRule{{Ops: []string{"Execute"}, Err: errExecute}}},
+	)
+	require.NoError(s.T(), err)
+	client, err = dryRunClientProvider.NewTempDirClient()
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), ErrNotSupported, client.Execute(&Cmd{Args: []string{"true"}})())
+	s.destroy(client)
+	require.NoError(s.T(), dryRunClientProvider.Destroy())
+	// oci clients embed an os client, but do not run commands on the host
+	rootfs, err := ioutil.TempDir("", "")
+	require.NoError(s.T(), err)
+	defer func() {
+		require.NoError(s.T(), os.RemoveAll(rootfs))
+	}()
+	ociClientProvider, err := NewClientProvider(&OCIExecOptions{Runtime: "false", Rootfs: rootfs})
+	require.NoError(s.T(), err)
+	ociClientProvider, err = NewFaultClientProvider(
+		ociClientProvider,
+		&FaultOptions{Rules: []*FaultRule{{Ops: []string{"Execute", "ExecutePiped"}, Err: errExecute}}},
+	)
+	require.NoError(s.T(), err)
+	client, err = ociClientProvider.NewTempDirClient()
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), ErrNotSupported, client.Execute(&Cmd{Args: []string{"touch", "made"}})())
+	require.Equal(s.T(), ErrNotSupported, client.ExecutePiped(&PipeCmdList{
+		PipeCmds: []*PipeCmd{{Args: []string{"touch", "made"}}, {Args: []string{"cat"}}},
+	})())
+	s.checkFileDoesNotExist(filepath.Join(client.DirPath(), "made"))
+	s.destroy(client)
+	require.NoError(s.T(), ociClientProvider.Destroy())
+
+	_, err = NewFaultClientProvider(clientProvider, &FaultOptions{Rules: []*FaultRule{{Ops: []string{"Unknown"}}}})
+	require.Error(s.T(), err)
+	_, err = NewFaultClientProvider(clientProvider, &FaultOptions{Rules: []*FaultRule{{Probability: 2}}})
+	require.Error(s.T(), err)
+
+	// the same calls with the same seed fail the same
+	faults := func(seed int64) []bool {
+		clientProvider, err := NewFaultClientProvider(
+			newOsClientProvider(&OsExecOptions{}),
+			&FaultOptions{
+				Rules: []*FaultRule{{Ops: []string{"IsFileExists"}, Probability: 0.5, Err: syscall.EIO}},
+				Seed:  seed,
+			},
+		)
+		require.NoError(s.T(), err)
+		defer func() {
+			require.NoError(s.T(), clientProvider.Destroy())
+		}()
+		client, err := clientProvider.NewTempDirClient()
+		require.NoError(s.T(), err)
+		defer s.destroy(client)
+		faults := make([]bool, 64)
+		for i := range faults {
+			_, err := client.IsFileExists("one")
+			faults[i] = err != nil
+		}
+		return faults
+	}
+	first := faults(1)
+	require.Equal(s.T(), first, faults(1))
+	require.Contains(s.T(), first, true)
+	require.Contains(s.T(), first, false)
+	require.NotEqual(s.T(), first, faults(2))
+}
+
+func (s *Suite) TestFake() {
+	client := s.newClient()
+	defer s.destroy(client)
+	fakeExecutor := NewFakeExecutor(client)
+	fakeExecutor.Expect(&FakeExpectation{Args: ArgsEqual("git", "rev-parse", "HEAD"), Stdout: []byte("abc\n"), Times: 2})
+	fakeExecutor.Expect(&FakeExpectation{Args: ArgsPrefix("git", "push"), Stderr: []byte("rejected\n"), ExitCode: 1})
+	fakeExecutor.Expect(
+		&FakeExpectation{
+			Args: ArgsFunc("make with a target", func(args []string) bool { return len(args) == 2 && args[0] == "make" }),
+			Env:  []string{"CC=gcc"},
+			Handler: func(fakeCall *FakeCall) error {
+				file, err := fakeCall.ReadWriteFileManager.Create(fakeCall.Args[1])
+				if err != nil {
+					return err
+				}
+				return file.Close()
+			},
+		},
+	)
+	fakeExecutor.Expect(
+		&FakeExpectation{
+			Args: ArgsEqual("tr", "a-z", "A-Z"),
+			Handler: func(fakeCall *FakeCall) error {
+				data, err := ioutil.ReadAll(fakeCall.Stdin)
+				if err != nil {
+					return err
+				}
+				_, err = fakeCall.Stdout.Write(bytes.ToUpper(data))
+				return err
+			},
+		},
+	)
+	fakeExecutor.Expect(&FakeExpectation{Args: ArgsEqual("ls"), SubDir: "sub", Stdout: []byte("one\n"), Times: 2})
+
+	stdout, _ := s.execute(fakeExecutor, []string{"git", "rev-parse", "HEAD"})
+	require.Equal(s.T(), "abc", stdout)
+	var stderr bytes.Buffer
+	err := fakeExecutor.Execute(&Cmd{Args: []string{"git", "push", "origin"}, Stderr: &stderr})()
+	var fakeExitError *FakeExitError
+	require.True(s.T(), errors.As(err, &fakeExitError))
+	require.Equal(s.T(), 1, fakeExitError.ExitCode())
+	require.Equal(s.T(), "rejected\n", stderr.String())
+
+	require.NoError(s.T(), fakeExecutor.Execute(&Cmd{Args: []string{"make", "all"}, Env: []string{"CC=gcc", "CFLAGS=-O2"}})())
+	s.checkFileExists(filepath.Join(client.DirPath(), "all"))
+
+	var output bytes.Buffer
+	require.NoError(
+		s.T(),
+		fakeExecutor.ExecutePiped(
+			&PipeCmdList{
+				PipeCmds: []*PipeCmd{
+					{Args: []string{"git", "rev-parse", "HEAD"}},
+					{Args: []string{"tr", "a-z", "A-Z"}},
+				},
+				Stdout: &output,
+			},
+		)(),
+	)
+	require.Equal(s.T(), "ABC\n", output.String())
+	require.Error(s.T(), fakeExecutor.CheckExpectations())
+
+	subDirClient, err := fakeExecutor.NewSubDirClient("sub")
+	require.NoError(s.T(), err)
+	stdout, _ = s.execute(subDirClient, []string{"ls"})
+	require.Equal(s.T(), "one", stdout)
+	require.NoError(s.T(), fakeExecutor.Execute(&Cmd{Args: []string{"ls"}, SubDir: "sub"})())
+	require.Equal(s.T(), ErrPathOutOfContext, subDirClient.Execute(&Cmd{Args: []string{"ls"}, SubDir: filepath.Join("..", "other")})())
+	require.Equal(s.T(), ErrPathOutOfContext, fakeExecutor.Execute(&Cmd{Args: []string{"ls"}, SubDir: filepath.Join("..", "sub")})())
+	s.destroy(subDirClient)
+	require.NoError(s.T(), fakeExecutor.CheckExpectations())
+
+	err = fakeExecutor.Execute(&Cmd{Args: []string{"ls"}})()
+	var unexpectedCommandError *UnexpectedCommandError
+	require.True(s.T(), errors.As(err, &unexpectedCommandError))
+	require.Equal(s.T(), "ls", unexpectedCommandError.Cmd)
+	require.Error(s.T(), fakeExecutor.CheckExpectations())
+	require.NoError(s.T(), fakeExecutor.Destroy())
+	s.checkFileExists(client.DirPath())
+}
+
 func (s *Suite) newClient() Client {
 	client, err := s.clientProvider.NewTempDirClient()
 	require.NoError(s.T(), err)
@@ -195,6 +2042,14 @@ func (s *Suite) execute(client Client, args []string) (stdout string, stderr str
 	return
 }
 
+func (s *Suite) writeFile(client Client, path string, data string) {
+	file, err := client.Create(path)
+	require.NoError(s.T(), err)
+	_, err = file.Write([]byte(data))
+	require.NoError(s.T(), err)
+	s.checkClose(file)
+}
+
 func (s *Suite) destroy(client Client) {
 	err := client.Destroy()
 	require.NoError(s.T(), err)
@@ -0,0 +1,1275 @@
+package exec
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/codeship/go-concurrent"
+	"github.com/codeship/go-osutils"
+)
+
+func newOverlayClient(clientProvider ClientProvider, lowerAbsolutePath string) (Client, error) {
+	osClientProvider, ok := clientProvider.(*osClientProvider)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if !filepath.IsAbs(lowerAbsolutePath) {
+		return nil, newValidationErrorNotAbsolutePath(lowerAbsolutePath)
+	}
+	fileInfo, err := os.Stat(lowerAbsolutePath)
+	if err != nil {
+		return nil, err
+	}
+	if !fileInfo.IsDir() {
+		return nil, ErrNotADirectory
+	}
+	return osClientProvider.newOverlayClient(filepath.Clean(lowerAbsolutePath), true)
+}
+
+const (
+	overlayUpperDirName  = "upper"
+	overlayWorkDirName   = "work"
+	overlayMergedDirName = "merged"
+)
+
+// newOverlayClient mounts an overlayfs when the process is permitted to,
+// and otherwise falls back to a pure-Go overlay. On linux, the commands of
+// the pure-Go overlay are run in a user namespace with its own overlayfs
+// mount, elsewhere Execute returns ErrNotSupported.
+func (o *osClientProvider) newOverlayClient(lowerDirPath string, mount bool) (Client, error) {
+	tempDir, maxBytes, err := o.createTempDir()
+	if err != nil {
+		return nil, err
+	}
+	layers := &overlayLayers{
+		lowerDirPath:  lowerDirPath,
+		upperDirPath:  filepath.Join(tempDir, overlayUpperDirName),
+		workDirPath:   filepath.Join(tempDir, overlayWorkDirName),
+		mergedDirPath: filepath.Join(tempDir, overlayMergedDirName),
+		lockTable:     newLockTable(),
+		watchHub:      newWatchHub(),
+	}
+	layers.quota = newQuota(layers.upperDirPath, maxBytes, o.execOptions.MaxInodes)
+	for _, dirPath := range []string{layers.upperDirPath, layers.workDirPath, layers.mergedDirPath} {
+		if err := os.Mkdir(dirPath, 0755); err != nil {
+			_ = o.removeTempDir(tempDir)
+			return nil, err
+		}
+	}
+	removeTempDir := func() error {
+		// the kernel leaves the work directories inaccessible
+		for _, name := range []string{"work", "index"} {
+			if err := os.Chmod(filepath.Join(layers.workDirPath, name), 0700); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return o.removeTempDir(tempDir)
+	}
+	var client Client
+	if mount && layers.mount() == nil {
+		client = newOsClient(
+			func() error {
+				if err := layers.unmount(); err != nil {
+					return err
+				}
+				return removeTempDir()
+			},
+			layers.mergedDirPath,
+			layers.quota,
+		)
+	} else {
+		client = newOverlayClientForLayers(removeTempDir, layers, "")
+	}
+	if err := o.AddChild(client); err != nil {
+		_ = client.Destroy()
+		return nil, err
+	}
+	return client, nil
+}
+
+type overlayLayers struct {
+	lowerDirPath  string
+	upperDirPath  string
+	workDirPath   string
+	mergedDirPath string
+	lock          sync.Mutex
+	// shared by all the clients of the layers
+	lockTable *lockTable
+	watchHub  *watchHub
+	// can be nil
+	quota *quota
+}
+
+type overlayEntry struct {
+	fileInfo os.FileInfo
+	// the entry exists in the upper layer
+	upper bool
+	// an entry exists at the same path in the lower layer, possibly hidden
+	lower bool
+	// the entry is a directory whose lower layer contents are visible
+	merged bool
+}
+
+func (e *overlayEntry) exists() bool {
+	return e.fileInfo != nil
+}
+
+// lookup resolves path, relative to the root of the layers, to its merged entry.
+func (l *overlayLayers) lookup(path string) (*overlayEntry, error) {
+	if path == "." {
+		fileInfo, err := os.Lstat(l.upperDirPath)
+		if err != nil {
+			return nil, err
+		}
+		return &overlayEntry{fileInfo, true, true, true}, nil
+	}
+	elems := strings.Split(path, string(filepath.Separator))
+	lowerVisible := true
+	for i := range elems {
+		prefix := filepath.Join(elems[:i+1]...)
+		last := i == len(elems)-1
+		upperFileInfo, err := lstatIfExists(filepath.Join(l.upperDirPath, prefix))
+		if err != nil {
+			return nil, err
+		}
+		var lowerFileInfo os.FileInfo
+		if lowerVisible {
+			lowerFileInfo, err = lstatIfExists(filepath.Join(l.lowerDirPath, prefix))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if upperFileInfo != nil {
+			if isOverlayWhiteout(filepath.Join(l.upperDirPath, prefix), upperFileInfo) {
+				return &overlayEntry{nil, false, lowerFileInfo != nil, false}, nil
+			}
+			if !upperFileInfo.IsDir() {
+				if last {
+					return &overlayEntry{upperFileInfo, true, lowerFileInfo != nil, false}, nil
+				}
+				return &overlayEntry{}, nil
+			}
+			opaque := isOverlayOpaque(filepath.Join(l.upperDirPath, prefix))
+			merged := lowerFileInfo != nil && lowerFileInfo.IsDir() && !opaque
+			if last {
+				return &overlayEntry{upperFileInfo, true, lowerFileInfo != nil, merged}, nil
+			}
+			lowerVisible = merged
+			continue
+		}
+		if lowerFileInfo == nil {
+			return &overlayEntry{}, nil
+		}
+		if last {
+			return &overlayEntry{lowerFileInfo, false, true, lowerFileInfo.IsDir()}, nil
+		}
+		if !lowerFileInfo.IsDir() {
+			return &overlayEntry{}, nil
+		}
+	}
+	return &overlayEntry{}, nil
+}
+
+func (l *overlayLayers) lookupExisting(op string, path string) (*overlayEntry, error) {
+	entry, err := l.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.exists() {
+		return nil, &os.PathError{Op: op, Path: path, Err: syscall.ENOENT}
+	}
+	return entry, nil
+}
+
+// readDir returns the merged entries of the directory at path sorted by name.
+func (l *overlayLayers) readDir(path string, entry *overlayEntry) ([]os.FileInfo, error) {
+	if !entry.fileInfo.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: syscall.ENOTDIR}
+	}
+	nameToFileInfo := make(map[string]os.FileInfo)
+	hidden := make(map[string]bool)
+	if entry.upper {
+		fileInfos, err := readHostDir(filepath.Join(l.upperDirPath, path))
+		if err != nil {
+			return nil, err
+		}
+		for _, fileInfo := range fileInfos {
+			if isOverlayWhiteout(filepath.Join(l.upperDirPath, path, fileInfo.Name()), fileInfo) {
+				hidden[fileInfo.Name()] = true
+			} else {
+				nameToFileInfo[fileInfo.Name()] = fileInfo
+			}
+		}
+	}
+	if entry.merged {
+		fileInfos, err := readHostDir(filepath.Join(l.lowerDirPath, path))
+		if err != nil {
+			return nil, err
+		}
+		for _, fileInfo := range fileInfos {
+			if _, ok := nameToFileInfo[fileInfo.Name()]; !ok && !hidden[fileInfo.Name()] {
+				nameToFileInfo[fileInfo.Name()] = fileInfo
+			}
+		}
+	}
+	fileInfos := make([]os.FileInfo, 0, len(nameToFileInfo))
+	for _, fileInfo := range nameToFileInfo {
+		fileInfos = append(fileInfos, fileInfo)
+	}
+	sort.Sort(fileInfosByName(fileInfos))
+	return fileInfos, nil
+}
+
+// copyUpParents makes sure every parent directory of path exists in the upper layer.
+func (l *overlayLayers) copyUpParents(path string) error {
+	dir := filepath.Dir(path)
+	if dir == "." {
+		return nil
+	}
+	elems := strings.Split(dir, string(filepath.Separator))
+	for i := range elems {
+		prefix := filepath.Join(elems[:i+1]...)
+		entry, err := l.lookupExisting("copyup", prefix)
+		if err != nil {
+			return err
+		}
+		if !entry.fileInfo.IsDir() {
+			return &os.PathError{Op: "copyup", Path: prefix, Err: syscall.ENOTDIR}
+		}
+		if entry.upper {
+			continue
+		}
+		upperPath := filepath.Join(l.upperDirPath, prefix)
+		if err := os.Mkdir(upperPath, entry.fileInfo.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(upperPath, entry.fileInfo.ModTime(), entry.fileInfo.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyUp copies the lower layer entry at fromPath to toPath in the upper layer.
+func (l *overlayLayers) copyUp(fromPath string, toPath string, fileInfo os.FileInfo) error {
+	lowerPath := filepath.Join(l.lowerDirPath, fromPath)
+	upperPath := filepath.Join(l.upperDirPath, toPath)
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(lowerPath)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, upperPath)
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return &os.PathError{Op: "copyup", Path: fromPath, Err: syscall.EINVAL}
+	}
+	return copyHostFile(lowerPath, upperPath, fileInfo)
+}
+
+// copyUpInPlace copies the entry at path to the upper layer if it only
+// exists in the lower layer, and returns its upper layer path.
+func (l *overlayLayers) copyUpInPlace(path string) (string, error) {
+	upperPath := filepath.Join(l.upperDirPath, path)
+	entry, err := l.lookupExisting("copyup", path)
+	if err != nil {
+		return "", err
+	}
+	if entry.upper {
+		return upperPath, nil
+	}
+	if err := l.copyUpParents(path); err != nil {
+		return "", err
+	}
+	if entry.fileInfo.IsDir() {
+		if err := os.Mkdir(upperPath, entry.fileInfo.Mode().Perm()); err != nil {
+			return "", err
+		}
+		return upperPath, os.Chtimes(upperPath, entry.fileInfo.ModTime(), entry.fileInfo.ModTime())
+	}
+	return upperPath, l.copyUp(path, path, entry.fileInfo)
+}
+
+// prepareCreate makes sure that a new entry can be created at path in the upper layer.
+func (l *overlayLayers) prepareCreate(op string, path string) error {
+	entry, err := l.lookup(path)
+	if err != nil {
+		return err
+	}
+	if entry.exists() {
+		return &os.PathError{Op: op, Path: path, Err: syscall.EEXIST}
+	}
+	if err := l.copyUpParents(path); err != nil {
+		return err
+	}
+	return l.clearUpper(path)
+}
+
+// clearUpper removes whatever is in the upper layer at path so that a new
+// entry can be created there.
+func (l *overlayLayers) clearUpper(path string) error {
+	upperPath := filepath.Join(l.upperDirPath, path)
+	fileInfo, err := lstatIfExists(upperPath)
+	if err != nil {
+		return err
+	}
+	if fileInfo != nil && isOverlayWhiteout(upperPath, fileInfo) {
+		return os.Remove(upperPath)
+	}
+	return nil
+}
+
+func (l *overlayLayers) whiteout(path string) error {
+	if err := l.copyUpParents(path); err != nil {
+		return err
+	}
+	return makeOverlayWhiteout(filepath.Join(l.upperDirPath, path))
+}
+
+// whiteoutLower hides the lower layer contents of the directory at path
+// that are not present in the upper layer directory at path.
+func (l *overlayLayers) whiteoutLower(path string) error {
+	lowerFileInfo, err := lstatIfExists(filepath.Join(l.lowerDirPath, path))
+	if err != nil {
+		return err
+	}
+	if lowerFileInfo == nil || !lowerFileInfo.IsDir() {
+		return nil
+	}
+	fileInfos, err := readHostDir(filepath.Join(l.lowerDirPath, path))
+	if err != nil {
+		return err
+	}
+	for _, fileInfo := range fileInfos {
+		childPath := filepath.Join(l.upperDirPath, path, fileInfo.Name())
+		childFileInfo, err := lstatIfExists(childPath)
+		if err != nil {
+			return err
+		}
+		if childFileInfo == nil {
+			if err := makeOverlayWhiteout(childPath); err != nil {
+				return err
+			}
+		} else if childFileInfo.IsDir() && !isOverlayWhiteout(childPath, childFileInfo) {
+			if err := l.whiteoutLower(filepath.Join(path, fileInfo.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l *overlayLayers) mkdir(path string, perm os.FileMode) error {
+	entry, err := l.lookup(path)
+	if err != nil {
+		return err
+	}
+	if entry.exists() {
+		return &os.PathError{Op: "mkdir", Path: path, Err: syscall.EEXIST}
+	}
+	if err := l.copyUpParents(path); err != nil {
+		return err
+	}
+	if err := l.clearUpper(path); err != nil {
+		return err
+	}
+	if err := os.Mkdir(filepath.Join(l.upperDirPath, path), perm); err != nil {
+		return err
+	}
+	if entry.lower {
+		return l.whiteoutLower(path)
+	}
+	return nil
+}
+
+func (l *overlayLayers) remove(path string) error {
+	entry, err := l.lookupExisting("remove", path)
+	if err != nil {
+		return err
+	}
+	if entry.fileInfo.IsDir() {
+		fileInfos, err := l.readDir(path, entry)
+		if err != nil {
+			return err
+		}
+		if len(fileInfos) > 0 {
+			return &os.PathError{Op: "remove", Path: path, Err: syscall.ENOTEMPTY}
+		}
+	}
+	if entry.upper {
+		if err := os.RemoveAll(filepath.Join(l.upperDirPath, path)); err != nil {
+			return err
+		}
+	}
+	if entry.lower {
+		return l.whiteout(path)
+	}
+	return nil
+}
+
+func (l *overlayLayers) removeAll(path string) error {
+	entry, err := l.lookup(path)
+	if err != nil {
+		return err
+	}
+	if !entry.exists() {
+		return nil
+	}
+	if entry.fileInfo.IsDir() {
+		fileInfos, err := l.readDir(path, entry)
+		if err != nil {
+			return err
+		}
+		for _, fileInfo := range fileInfos {
+			if err := l.removeAll(filepath.Join(path, fileInfo.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return l.remove(path)
+}
+
+func (l *overlayLayers) rename(oldpath string, newpath string) error {
+	oldEntry, err := l.lookupExisting("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	if oldEntry.fileInfo.IsDir() && oldEntry.lower {
+		// the kernel overlayfs returns the same without redirect_dir
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	newEntry, err := l.lookup(newpath)
+	if err != nil {
+		return err
+	}
+	if newEntry.exists() && newEntry.fileInfo.IsDir() {
+		if !oldEntry.fileInfo.IsDir() {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EISDIR}
+		}
+		if err := l.remove(newpath); err != nil {
+			return err
+		}
+	}
+	if err := l.copyUpParents(newpath); err != nil {
+		return err
+	}
+	if err := l.clearUpper(newpath); err != nil {
+		return err
+	}
+	if oldEntry.upper {
+		if err := os.Rename(filepath.Join(l.upperDirPath, oldpath), filepath.Join(l.upperDirPath, newpath)); err != nil {
+			return err
+		}
+		if oldEntry.fileInfo.IsDir() && newEntry.lower {
+			if err := l.whiteoutLower(newpath); err != nil {
+				return err
+			}
+		}
+	} else {
+		if err := os.RemoveAll(filepath.Join(l.upperDirPath, newpath)); err != nil {
+			return err
+		}
+		if err := l.copyUp(oldpath, newpath, oldEntry.fileInfo); err != nil {
+			return err
+		}
+	}
+	if oldEntry.lower {
+		return l.whiteout(oldpath)
+	}
+	return nil
+}
+
+type overlayClient struct {
+	concurrent.Destroyable
+	layers   *overlayLayers
+	subPath  string
+	releaser *releaser
+}
+
+func newOverlayClientForLayers(destroyCallback func() error, layers *overlayLayers, subPath string) *overlayClient {
+	releaser := newReleaser()
+	return &overlayClient{
+		concurrent.NewDestroyable(func() error {
+			err := releaser.destroy()
+			layers.lockTable.wake()
+			if callbackErr := destroyCallback(); callbackErr != nil && err == nil {
+				err = callbackErr
+			}
+			return err
+		}),
+		layers,
+		subPath,
+		releaser,
+	}
+}
+
+func (o *overlayClient) DirName() string {
+	return filepath.Base(o.DirPath())
+}
+
+func (o *overlayClient) DirPath() string {
+	return filepath.Join(o.layers.mergedDirPath, o.subPath)
+}
+
+func (o *overlayClient) Execute(cmd *Cmd) func() error {
+	if cmd.SubDir != "" {
+		if _, err := o.layerPath(cmd.SubDir); err != nil {
+			return func() error { return err }
+		}
+	}
+	args, err := o.overlayArgs(cmd.Args, cmd.SubDir)
+	if err != nil {
+		return func() error { return err }
+	}
+	value, err := o.Do(func() (interface{}, error) {
+		return execute(
+			o.layers.quota,
+			&osutils.Cmd{
+				Args:        args,
+				AbsoluteDir: o.layers.upperDirPath,
+				Env:         cmd.Env,
+				Stdin:       cmd.Stdin,
+				Stdout:      cmd.Stdout,
+				Stderr:      cmd.Stderr,
+			},
+		)
+	})
+	if err != nil {
+		return func() error { return err }
+	}
+	return value.(func() error)
+}
+
+func (o *overlayClient) ExecutePiped(pipeCmdList *PipeCmdList) func() error {
+	pipeCmds := make([]*osutils.PipeCmd, len(pipeCmdList.PipeCmds))
+	for i, pipeCmd := range pipeCmdList.PipeCmds {
+		if pipeCmd.SubDir != "" {
+			if _, err := o.layerPath(pipeCmd.SubDir); err != nil {
+				return func() error { return err }
+			}
+		}
+		args, err := o.overlayArgs(pipeCmd.Args, pipeCmd.SubDir)
+		if err != nil {
+			return func() error { return err }
+		}
+		pipeCmds[i] = &osutils.PipeCmd{
+			Args:        args,
+			AbsoluteDir: o.layers.upperDirPath,
+			Env:         pipeCmd.Env,
+		}
+	}
+	value, err := o.Do(func() (interface{}, error) {
+		return executePiped(
+			o.layers.quota,
+			&osutils.PipeCmdList{
+				PipeCmds: pipeCmds,
+				Stdin:    pipeCmdList.Stdin,
+				Stdout:   pipeCmdList.Stdout,
+				Stderr:   pipeCmdList.Stderr,
+			},
+		)
+	})
+	if err != nil {
+		return func() error { return err }
+	}
+	return value.(func() error)
+}
+
+func (o *overlayClient) IsFileExists(path string) (bool, error) {
+	value, err := o.do(path, func(layerPath string) (interface{}, error) {
+		entry, err := o.layers.lookup(layerPath)
+		if err != nil {
+			return nil, err
+		}
+		return entry.exists(), nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return value.(bool), nil
+}
+
+func (o *overlayClient) Open(path string) (ReadFile, error) {
+	value, err := o.do(path, func(layerPath string) (interface{}, error) {
+		entry, err := o.layers.lookupExisting("open", layerPath)
+		if err != nil {
+			return nil, err
+		}
+		if entry.fileInfo.IsDir() {
+			fileInfos, err := o.layers.readDir(layerPath, entry)
+			if err != nil {
+				return nil, err
+			}
+			return newOverlayDir(path, entry.fileInfo, fileInfos), nil
+		}
+		if entry.upper {
+			return os.Open(filepath.Join(o.layers.upperDirPath, layerPath))
+		}
+		return os.Open(filepath.Join(o.layers.lowerDirPath, layerPath))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(ReadFile), nil
+}
+
+func (o *overlayClient) Stat(path string) (os.FileInfo, error) {
+	value, err := o.do(path, func(layerPath string) (interface{}, error) {
+		entry, err := o.layers.lookupExisting("stat", layerPath)
+		if err != nil {
+			return nil, err
+		}
+		if entry.fileInfo.Mode()&os.ModeSymlink == 0 {
+			return entry.fileInfo, nil
+		}
+		if entry.upper {
+			return os.Stat(filepath.Join(o.layers.upperDirPath, layerPath))
+		}
+		return os.Stat(filepath.Join(o.layers.lowerDirPath, layerPath))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(os.FileInfo), nil
+}
+
+func (o *overlayClient) Lstat(path string) (os.FileInfo, error) {
+	value, err := o.do(path, func(layerPath string) (interface{}, error) {
+		entry, err := o.layers.lookupExisting("lstat", layerPath)
+		if err != nil {
+			return nil, err
+		}
+		return entry.fileInfo, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(os.FileInfo), nil
+}
+
+func (o *overlayClient) Readlink(path string) (string, error) {
+	value, err := o.do(path, func(layerPath string) (interface{}, error) {
+		entry, err := o.layers.lookupExisting("readlink", layerPath)
+		if err != nil {
+			return nil, err
+		}
+		if entry.upper {
+			return os.Readlink(filepath.Join(o.layers.upperDirPath, layerPath))
+		}
+		return os.Readlink(filepath.Join(o.layers.lowerDirPath, layerPath))
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+func (o *overlayClient) Create(path string) (WriteFile, error) {
+	value, err := o.do(path, func(layerPath string) (interface{}, error) {
+		entry, err := o.layers.lookup(layerPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := o.layers.copyUpParents(layerPath); err != nil {
+			return nil, err
+		}
+		if err := o.layers.clearUpper(layerPath); err != nil {
+			return nil, err
+		}
+		if !entry.exists() {
+			if err := o.layers.quota.reserve(layerPath, 0, 1); err != nil {
+				return nil, err
+			}
+		}
+		file, err := os.Create(filepath.Join(o.layers.upperDirPath, layerPath))
+		if err != nil {
+			return nil, err
+		}
+		if entry.exists() {
+			o.layers.watchHub.notify(layerPath, WatchOpWrite)
+		} else {
+			o.layers.watchHub.notify(layerPath, WatchOpCreate)
+		}
+		return o.newOverlayFile(file, layerPath), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*overlayFile), nil
+}
+
+func (o *overlayClient) OpenFile(path string, flag int, perm os.FileMode) (ReadWriteFile, error) {
+	value, err := o.do(path, func(layerPath string) (interface{}, error) {
+		if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+			entry, err := o.layers.lookupExisting("open", layerPath)
+			if err != nil {
+				return nil, err
+			}
+			if entry.fileInfo.IsDir() {
+				fileInfos, err := o.layers.readDir(layerPath, entry)
+				if err != nil {
+					return nil, err
+				}
+				return newOverlayDir(path, entry.fileInfo, fileInfos), nil
+			}
+			if entry.upper {
+				return os.OpenFile(filepath.Join(o.layers.upperDirPath, layerPath), flag, perm)
+			}
+			return os.OpenFile(filepath.Join(o.layers.lowerDirPath, layerPath), flag, perm)
+		}
+		entry, err := o.layers.lookup(layerPath)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case entry.exists() && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+			return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EEXIST}
+		case entry.exists():
+			if _, err := o.layers.copyUpInPlace(layerPath); err != nil {
+				return nil, err
+			}
+		case flag&os.O_CREATE != 0:
+			if err := o.layers.prepareCreate("open", layerPath); err != nil {
+				return nil, err
+			}
+			if err := o.layers.quota.reserve(layerPath, 0, 1); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, &os.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+		}
+		file, err := os.OpenFile(filepath.Join(o.layers.upperDirPath, layerPath), flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !entry.exists():
+			o.layers.watchHub.notify(layerPath, WatchOpCreate)
+		case flag&os.O_TRUNC != 0:
+			o.layers.watchHub.notify(layerPath, WatchOpWrite)
+		}
+		return o.newOverlayFile(file, layerPath), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(ReadWriteFile), nil
+}
+
+func (o *overlayClient) MkdirAll(path string, perm os.FileMode) error {
+	_, err := o.do(path, func(layerPath string) (interface{}, error) {
+		if layerPath == "." {
+			return nil, nil
+		}
+		elems := strings.Split(layerPath, string(filepath.Separator))
+		for i := range elems {
+			prefix := filepath.Join(elems[:i+1]...)
+			entry, err := o.layers.lookup(prefix)
+			if err != nil {
+				return nil, err
+			}
+			if entry.exists() {
+				if !entry.fileInfo.IsDir() {
+					return nil, &os.PathError{Op: "mkdir", Path: prefix, Err: syscall.ENOTDIR}
+				}
+				continue
+			}
+			if err := o.layers.quota.reserve(prefix, 0, 1); err != nil {
+				return nil, err
+			}
+			if err := o.layers.mkdir(prefix, perm); err != nil {
+				return nil, err
+			}
+			o.layers.watchHub.notify(prefix, WatchOpCreate)
+		}
+		return nil, nil
+	})
+	return err
+}
+
+func (o *overlayClient) Rename(oldpath string, newpath string) error {
+	newLayerPath, err := o.layerPath(newpath)
+	if err != nil {
+		return err
+	}
+	_, err = o.do(oldpath, func(oldLayerPath string) (interface{}, error) {
+		if err := o.layers.rename(oldLayerPath, newLayerPath); err != nil {
+			return nil, err
+		}
+		o.layers.watchHub.notify(oldLayerPath, WatchOpRename)
+		o.layers.watchHub.notify(newLayerPath, WatchOpCreate)
+		return nil, nil
+	})
+	return err
+}
+
+func (o *overlayClient) Remove(path string) error {
+	_, err := o.do(path, func(layerPath string) (interface{}, error) {
+		if err := o.layers.remove(layerPath); err != nil {
+			return nil, err
+		}
+		o.layers.watchHub.notify(layerPath, WatchOpRemove)
+		return nil, nil
+	})
+	return err
+}
+
+func (o *overlayClient) RemoveAll(path string) error {
+	_, err := o.do(path, func(layerPath string) (interface{}, error) {
+		return nil, o.removeAll(layerPath)
+	})
+	return err
+}
+
+// this is only called in thread-safe context
+func (o *overlayClient) removeAll(layerPath string) error {
+	var layerPaths []string
+	if err := o.walk(layerPath, layerPath, func(path string, fileInfo os.FileInfo) {
+		layerPaths = append(layerPaths, path)
+	}); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := o.layers.removeAll(layerPath); err != nil {
+		return err
+	}
+	for i := len(layerPaths) - 1; i >= 0; i-- {
+		o.layers.watchHub.notify(layerPaths[i], WatchOpRemove)
+	}
+	return nil
+}
+
+func (o *overlayClient) Chmod(path string, mode os.FileMode) error {
+	return o.copyUpAnd(path, WatchOpChmod, func(upperPath string) error {
+		return os.Chmod(upperPath, mode)
+	})
+}
+
+func (o *overlayClient) Chown(path string, uid int, gid int) error {
+	return o.copyUpAnd(path, WatchOpChmod, func(upperPath string) error {
+		return os.Chown(upperPath, uid, gid)
+	})
+}
+
+func (o *overlayClient) Truncate(path string, size int64) error {
+	return o.copyUpAnd(path, WatchOpWrite, func(upperPath string) error {
+		if err := o.layers.quota.reserveGrowth(path, upperPath, size); err != nil {
+			return err
+		}
+		return os.Truncate(upperPath, size)
+	})
+}
+
+func (o *overlayClient) copyUpAnd(path string, watchOp WatchOp, f func(string) error) error {
+	_, err := o.do(path, func(layerPath string) (interface{}, error) {
+		upperPath, err := o.layers.copyUpInPlace(layerPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := f(upperPath); err != nil {
+			return nil, err
+		}
+		o.layers.watchHub.notify(layerPath, watchOp)
+		return nil, nil
+	})
+	return err
+}
+
+func (o *overlayClient) Symlink(oldname string, newname string) error {
+	_, err := o.do(newname, func(layerPath string) (interface{}, error) {
+		if err := o.layers.prepareCreate("symlink", layerPath); err != nil {
+			return nil, err
+		}
+		if err := o.layers.quota.reserve(layerPath, 0, 1); err != nil {
+			return nil, err
+		}
+		if err := os.Symlink(oldname, filepath.Join(o.layers.upperDirPath, layerPath)); err != nil {
+			return nil, err
+		}
+		o.layers.watchHub.notify(layerPath, WatchOpCreate)
+		return nil, nil
+	})
+	return err
+}
+
+func (o *overlayClient) Link(oldname string, newname string) error {
+	newLayerPath, err := o.layerPath(newname)
+	if err != nil {
+		return err
+	}
+	_, err = o.do(oldname, func(oldLayerPath string) (interface{}, error) {
+		if _, err := o.layers.copyUpInPlace(oldLayerPath); err != nil {
+			return nil, err
+		}
+		if err := o.layers.prepareCreate("link", newLayerPath); err != nil {
+			return nil, err
+		}
+		if err := o.layers.quota.reserve(newLayerPath, 0, 1); err != nil {
+			return nil, err
+		}
+		if err := os.Link(filepath.Join(o.layers.upperDirPath, oldLayerPath), filepath.Join(o.layers.upperDirPath, newLayerPath)); err != nil {
+			return nil, err
+		}
+		o.layers.watchHub.notify(newLayerPath, WatchOpCreate)
+		return nil, nil
+	})
+	return err
+}
+
+func (o *overlayClient) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return o.copyUpAnd(path, WatchOpChmod, func(upperPath string) error {
+		return os.Chtimes(upperPath, atime, mtime)
+	})
+}
+
+func (o *overlayClient) Lock(path string, exclusive bool) (Unlocker, error) {
+	return o.lock(path, exclusive, true)
+}
+
+func (o *overlayClient) TryLock(path string, exclusive bool) (Unlocker, error) {
+	return o.lock(path, exclusive, false)
+}
+
+func (o *overlayClient) lock(path string, exclusive bool, wait bool) (Unlocker, error) {
+	layerPath, err := o.layerPath(path)
+	if err != nil {
+		return nil, err
+	}
+	// as with flock, the file is created if it does not exist
+	file, err := o.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	unlock, err := o.layers.lockTable.acquire(layerPath, exclusive, wait, o.releaser.isDestroyed)
+	if err != nil {
+		return nil, err
+	}
+	releasable, err := o.releaser.add(unlock)
+	if err != nil {
+		return nil, err
+	}
+	return releasable, nil
+}
+
+func (o *overlayClient) ListRegularFiles(path string) ([]string, error) {
+	value, err := o.do(path, func(layerPath string) (interface{}, error) {
+		var files []string
+		if err := o.walk(path, layerPath, func(path string, fileInfo os.FileInfo) {
+			if fileInfo.Mode().IsRegular() {
+				files = append(files, path)
+			}
+		}); err != nil {
+			return nil, err
+		}
+		return files, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]string), nil
+}
+
+// this is only called in thread-safe context
+func (o *overlayClient) walk(path string, layerPath string, f func(string, os.FileInfo)) error {
+	entry, err := o.layers.lookupExisting("lstat", layerPath)
+	if err != nil {
+		return err
+	}
+	f(path, entry.fileInfo)
+	if !entry.fileInfo.IsDir() {
+		return nil
+	}
+	fileInfos, err := o.layers.readDir(layerPath, entry)
+	if err != nil {
+		return err
+	}
+	for _, fileInfo := range fileInfos {
+		if err := o.walk(filepath.Join(path, fileInfo.Name()), filepath.Join(layerPath, fileInfo.Name()), f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *overlayClient) Join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+func (o *overlayClient) Walk(root string, walkOptions *WalkOptions, walkFunc WalkFunc) error {
+	if _, err := o.layerPath(root); err != nil {
+		return err
+	}
+	return walk(o, root, walkOptions, walkFunc)
+}
+
+// Only the changes made through the clients of the layers are reported, not
+// the changes made by executed commands.
+func (o *overlayClient) Watch(path string, recursive bool) (Watcher, error) {
+	value, err := o.do(path, func(layerPath string) (interface{}, error) {
+		if _, err := o.layers.lookupExisting("watch", layerPath); err != nil {
+			return nil, err
+		}
+		return o.layers.watchHub.watch(layerPath, filepath.Clean(o.subPath), recursive), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addWatcher(o.releaser, value.(Watcher))
+}
+
+func (o *overlayClient) Glob(patterns ...string) ([]string, error) {
+	return glob(o, patterns)
+}
+
+func (o *overlayClient) Match(pattern string, path string) (bool, error) {
+	return matchPattern(filepath.ToSlash(pattern), filepath.ToSlash(path))
+}
+
+func (o *overlayClient) ToSlash(path string) string {
+	return filepath.ToSlash(path)
+}
+
+func (o *overlayClient) Base(path string) string {
+	return filepath.Base(path)
+}
+
+func (o *overlayClient) Dir(path string) string {
+	return filepath.Dir(path)
+}
+
+func (o *overlayClient) PathSeparator() string {
+	return string(os.PathSeparator)
+}
+
+func (o *overlayClient) NewSubDirExecutorReadFileManager(path string) (ExecutorReadFileManager, error) {
+	return o.newSubDirClient(path)
+}
+
+func (o *overlayClient) NewSubDirExecutorWriteFileManager(path string) (ExecutorWriteFileManager, error) {
+	return o.newSubDirClient(path)
+}
+
+func (o *overlayClient) NewSubDirClient(path string) (Client, error) {
+	return o.newSubDirClient(path)
+}
+
+func (o *overlayClient) newSubDirClient(path string) (*overlayClient, error) {
+	value, err := o.do(path, func(layerPath string) (interface{}, error) {
+		entry, err := o.layers.lookup(layerPath)
+		if err != nil {
+			return nil, err
+		}
+		if entry.exists() {
+			return nil, ErrFileAlreadyExists
+		}
+		if err := o.layers.quota.reserve(layerPath, 0, 1); err != nil {
+			return nil, err
+		}
+		if err := o.layers.mkdir(layerPath, 0755); err != nil {
+			return nil, err
+		}
+		o.layers.watchHub.notify(layerPath, WatchOpCreate)
+		return layerPath, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	subPath := value.(string)
+	subDirClient := newOverlayClientForLayers(
+		func() error {
+			o.layers.lock.Lock()
+			defer o.layers.lock.Unlock()
+			return o.removeAll(subPath)
+		},
+		o.layers,
+		subPath,
+	)
+	if err := o.AddChild(subDirClient); err != nil {
+		return nil, err
+	}
+	return subDirClient, nil
+}
+
+// do validates path and calls f with the path relative to the root of the
+// layers while holding the layers lock.
+func (o *overlayClient) do(path string, f func(string) (interface{}, error)) (interface{}, error) {
+	layerPath, err := o.layerPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return o.Do(func() (interface{}, error) {
+		o.layers.lock.Lock()
+		defer o.layers.lock.Unlock()
+		return f(layerPath)
+	})
+}
+
+func (o *overlayClient) layerPath(path string) (string, error) {
+	return joinSubPath(o.subPath, path)
+}
+
+type overlayDir struct {
+	name      string
+	fileInfo  os.FileInfo
+	fileInfos []os.FileInfo
+	offset    int
+}
+
+func newOverlayDir(name string, fileInfo os.FileInfo, fileInfos []os.FileInfo) *overlayDir {
+	return &overlayDir{name, fileInfo, fileInfos, 0}
+}
+
+func (o *overlayDir) Name() string {
+	return o.name
+}
+
+// Seek only supports rewinding the directory listing
+func (o *overlayDir) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, &os.PathError{Op: "seek", Path: o.name, Err: syscall.EINVAL}
+	}
+	o.offset = 0
+	return 0, nil
+}
+
+func (o *overlayDir) Stat() (os.FileInfo, error) {
+	return o.fileInfo, nil
+}
+
+func (o *overlayDir) Close() error {
+	return nil
+}
+
+func (o *overlayDir) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: o.name, Err: syscall.EISDIR}
+}
+
+func (o *overlayDir) ReadAt(p []byte, offset int64) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: o.name, Err: syscall.EISDIR}
+}
+
+func (o *overlayDir) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: o.name, Err: syscall.EISDIR}
+}
+
+func (o *overlayDir) WriteAt(p []byte, offset int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: o.name, Err: syscall.EISDIR}
+}
+
+func (o *overlayDir) Sync() error {
+	return nil
+}
+
+func (o *overlayDir) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: o.name, Err: syscall.EISDIR}
+}
+
+func (o *overlayDir) Chmod(mode os.FileMode) error {
+	return &os.PathError{Op: "chmod", Path: o.name, Err: syscall.EBADF}
+}
+
+func (o *overlayDir) Readdir(n int) ([]os.FileInfo, error) {
+	remaining := o.fileInfos[o.offset:]
+	if n <= 0 {
+		o.offset = len(o.fileInfos)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	o.offset += n
+	return remaining[:n], nil
+}
+
+func (o *overlayDir) Readdirnames(n int) ([]string, error) {
+	fileInfos, err := o.Readdir(n)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(fileInfos))
+	for i, fileInfo := range fileInfos {
+		names[i] = fileInfo.Name()
+	}
+	return names, nil
+}
+
+func lstatIfExists(path string) (os.FileInfo, error) {
+	fileInfo, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) || isNotDir(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return fileInfo, nil
+}
+
+// overlayFile reserves the bytes written in the quota of the layers, and
+// reports a write to the watch hub when closed after being written to.
+type overlayFile struct {
+	*os.File
+	layers    *overlayLayers
+	layerPath string
+	written   bool
+}
+
+func (o *overlayClient) newOverlayFile(file *os.File, layerPath string) *overlayFile {
+	return &overlayFile{file, o.layers, layerPath, false}
+}
+
+func (o *overlayFile) Write(p []byte) (int, error) {
+	if err := o.layers.quota.reserve(o.layerPath, int64(len(p)), 0); err != nil {
+		return 0, err
+	}
+	o.written = true
+	return o.File.Write(p)
+}
+
+func (o *overlayFile) WriteAt(p []byte, offset int64) (int, error) {
+	if err := o.layers.quota.reserve(o.layerPath, int64(len(p)), 0); err != nil {
+		return 0, err
+	}
+	o.written = true
+	return o.File.WriteAt(p, offset)
+}
+
+func (o *overlayFile) WriteString(s string) (int, error) {
+	return o.Write([]byte(s))
+}
+
+func (o *overlayFile) ReadFrom(reader io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{o}, reader)
+}
+
+func (o *overlayFile) Truncate(size int64) error {
+	fileInfo, err := o.File.Stat()
+	if err != nil {
+		return err
+	}
+	if err := o.layers.quota.reserve(o.layerPath, size-fileInfo.Size(), 0); err != nil {
+		return err
+	}
+	o.written = true
+	return o.File.Truncate(size)
+}
+
+func (o *overlayFile) Close() error {
+	if err := o.File.Close(); err != nil {
+		return err
+	}
+	if o.written {
+		o.layers.watchHub.notify(o.layerPath, WatchOpWrite)
+	}
+	return nil
+}
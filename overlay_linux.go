@@ -0,0 +1,105 @@
+//go:build linux
+// +build linux
+
+package exec
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// overlayExecuteScript mounts the overlay inside the user and mount
+	// namespaces created by unshare, then runs the command in the merged view.
+	overlayExecuteScript = `"$1" -t overlay overlay -o "lowerdir=$2,upperdir=$3,workdir=$4,userxattr" "$5" && cd "$6" && shift 6 && exec "$@"`
+)
+
+var (
+	overlayOpaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+)
+
+func (l *overlayLayers) mount() error {
+	return syscall.Mount(
+		"overlay",
+		l.mergedDirPath,
+		"overlay",
+		0,
+		fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", l.lowerDirPath, l.upperDirPath, l.workDirPath),
+	)
+}
+
+func (l *overlayLayers) unmount() error {
+	return syscall.Unmount(l.mergedDirPath, 0)
+}
+
+// overlayArgs wraps args so that they are run by unshare in new user and
+// mount namespaces in which the overlay is mounted on the merged directory.
+func (o *overlayClient) overlayArgs(args []string, subDir string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, ErrArgsEmpty
+	}
+	unsharePath, err := exec.LookPath("unshare")
+	if err != nil {
+		return nil, ErrNotSupported
+	}
+	mountPath, err := exec.LookPath("mount")
+	if err != nil {
+		return nil, ErrNotSupported
+	}
+	argPath := args[0]
+	if !strings.Contains(argPath, string(filepath.Separator)) {
+		argPath, err = exec.LookPath(argPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(
+		[]string{
+			unsharePath,
+			"--user",
+			"--map-root-user",
+			"--mount",
+			"--",
+			"/bin/sh",
+			"-c",
+			overlayExecuteScript,
+			"sh",
+			mountPath,
+			o.layers.lowerDirPath,
+			o.layers.upperDirPath,
+			o.layers.workDirPath,
+			o.layers.mergedDirPath,
+			filepath.Join(o.DirPath(), subDir),
+			argPath,
+		},
+		args[1:]...,
+	), nil
+}
+
+func isOverlayWhiteout(path string, fileInfo os.FileInfo) bool {
+	if fileInfo.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+func isOverlayOpaque(path string) bool {
+	value := make([]byte, 1)
+	for _, xattr := range overlayOpaqueXattrs {
+		if n, err := syscall.Getxattr(path, xattr, value); err == nil && n == 1 && value[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// makeOverlayWhiteout creates a whiteout as overlayfs does, so that the
+// upper layer can be mounted by overlayClient.Execute
+func makeOverlayWhiteout(path string) error {
+	return syscall.Mknod(path, syscall.S_IFCHR, 0)
+}
@@ -0,0 +1,44 @@
+//go:build !linux
+// +build !linux
+
+package exec
+
+import (
+	"os"
+)
+
+// without overlayfs, whiteouts are symlinks to overlayWhiteoutTarget, as
+// creating the character devices overlayfs uses needs privileges
+const overlayWhiteoutTarget = ".exec-overlay-whiteout"
+
+func (l *overlayLayers) mount() error {
+	return ErrNotSupported
+}
+
+func (l *overlayLayers) unmount() error {
+	return ErrNotSupported
+}
+
+func (o *overlayClient) overlayArgs(args []string, subDir string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, ErrArgsEmpty
+	}
+	return nil, ErrNotSupported
+}
+
+func isOverlayWhiteout(path string, fileInfo os.FileInfo) bool {
+	if fileInfo.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	target, err := os.Readlink(path)
+	return err == nil && target == overlayWhiteoutTarget
+}
+
+// only overlayfs makes opaque directories
+func isOverlayOpaque(path string) bool {
+	return false
+}
+
+func makeOverlayWhiteout(path string) error {
+	return os.Symlink(overlayWhiteoutTarget, path)
+}
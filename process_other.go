@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package exec
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(execCmd *exec.Cmd) {}
+
+func killProcessGroup(execCmd *exec.Cmd) {
+	_ = execCmd.Process.Kill()
+}
@@ -0,0 +1,354 @@
+package exec
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/codeship/go-osutils"
+)
+
+// how often the usage of a client with a quota is checked while commands run
+var quotaScanInterval = time.Second
+
+// Bytes is the sum of the sizes of the regular files, Inodes the number of
+// entries below the root.
+type DiskUsage struct {
+	Bytes  int64
+	Inodes int64
+}
+
+func diskUsage(readFileManager ReadFileManager) (*DiskUsage, error) {
+	diskUsage := &DiskUsage{}
+	if err := walkTree(readFileManager, ".", func(path string, fileInfo os.FileInfo) error {
+		diskUsage.add(fileInfo)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return diskUsage, nil
+}
+
+func hostDiskUsage(dirPath string) (*DiskUsage, error) {
+	diskUsage := &DiskUsage{}
+	if err := filepath.Walk(dirPath, func(path string, fileInfo os.FileInfo, err error) error {
+		// entries can be removed by running commands while walking
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if path != dirPath {
+			diskUsage.add(fileInfo)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return diskUsage, nil
+}
+
+func (d *DiskUsage) add(fileInfo os.FileInfo) {
+	d.Inodes++
+	if fileInfo.Mode().IsRegular() {
+		d.Bytes += fileInfo.Size()
+	}
+}
+
+// quota tracks the usage of a host directory. A nil quota is unlimited.
+type quota struct {
+	dirPath   string
+	maxBytes  int64
+	maxInodes int64
+	lock      sync.Mutex
+	// the usage of the last scan plus the reservations made since, which
+	// overestimates the usage after overwrites and removals
+	usage DiskUsage
+}
+
+func newQuota(dirPath string, maxBytes int64, maxInodes int64) *quota {
+	if maxBytes == 0 && maxInodes == 0 {
+		return nil
+	}
+	return &quota{dirPath: dirPath, maxBytes: maxBytes, maxInodes: maxInodes}
+}
+
+// reserve rescans the directory before failing, so that overwrites,
+// removals and changes made by commands are accounted for.
+func (q *quota) reserve(path string, bytes int64, inodes int64) error {
+	if q == nil || (bytes <= 0 && inodes <= 0) {
+		return nil
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.fits(bytes, inodes) {
+		if err := q.scan(); err != nil {
+			return err
+		}
+		if !q.fits(bytes, inodes) {
+			return q.newQuotaExceededError(path, bytes, inodes)
+		}
+	}
+	q.usage.Bytes += bytes
+	q.usage.Inodes += inodes
+	return nil
+}
+
+// check rescans the directory and returns a *QuotaExceededError if the quota
+// is exceeded.
+func (q *quota) check() error {
+	if q == nil {
+		return nil
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err := q.scan(); err != nil {
+		return err
+	}
+	if !q.fits(0, 0) {
+		return q.newQuotaExceededError("", 0, 0)
+	}
+	return nil
+}
+
+// this is only called while holding the lock
+func (q *quota) fits(bytes int64, inodes int64) bool {
+	return (q.maxBytes == 0 || q.usage.Bytes+bytes <= q.maxBytes) &&
+		(q.maxInodes == 0 || q.usage.Inodes+inodes <= q.maxInodes)
+}
+
+// this is only called while holding the lock
+func (q *quota) scan() error {
+	diskUsage, err := hostDiskUsage(q.dirPath)
+	if err != nil {
+		return err
+	}
+	q.usage = *diskUsage
+	return nil
+}
+
+// this is only called while holding the lock
+func (q *quota) newQuotaExceededError(path string, bytes int64, inodes int64) *QuotaExceededError {
+	return &QuotaExceededError{
+		Path:      path,
+		Usage:     DiskUsage{q.usage.Bytes + bytes, q.usage.Inodes + inodes},
+		MaxBytes:  q.maxBytes,
+		MaxInodes: q.maxInodes,
+	}
+}
+
+// reserveGrowth reserves the bytes needed to grow the file at absolutePath
+// to size.
+func (q *quota) reserveGrowth(path string, absolutePath string, size int64) error {
+	if q == nil {
+		return nil
+	}
+	fileInfo, err := os.Stat(absolutePath)
+	if err != nil {
+		return err
+	}
+	return q.reserve(path, size-fileInfo.Size(), 0)
+}
+
+// reserveMissingDirs reserves an inode for every directory MkdirAll would
+// create for absolutePath.
+func (q *quota) reserveMissingDirs(path string, absolutePath string) error {
+	if q == nil {
+		return nil
+	}
+	var missing int64
+	for dirPath := absolutePath; dirPath != q.dirPath && dirPath != filepath.Dir(dirPath); dirPath = filepath.Dir(dirPath) {
+		if _, err := os.Lstat(dirPath); err == nil {
+			break
+		}
+		missing++
+	}
+	return q.reserve(path, 0, missing)
+}
+
+// reserveIfMissing reserves an inode if there is no file at absolutePath
+func (q *quota) reserveIfMissing(path string, absolutePath string) error {
+	if q == nil {
+		return nil
+	}
+	if _, err := os.Lstat(absolutePath); err == nil {
+		return nil
+	}
+	return q.reserve(path, 0, 1)
+}
+
+// quotaFile reserves the bytes written before writing them
+type quotaFile struct {
+	*os.File
+	quota *quota
+	path  string
+}
+
+func newQuotaWriteFile(file *os.File, quota *quota, path string) ReadWriteFile {
+	if quota == nil {
+		return file
+	}
+	return &quotaFile{file, quota, path}
+}
+
+func (q *quotaFile) Write(p []byte) (int, error) {
+	if err := q.quota.reserve(q.path, int64(len(p)), 0); err != nil {
+		return 0, err
+	}
+	return q.File.Write(p)
+}
+
+func (q *quotaFile) WriteAt(p []byte, offset int64) (int, error) {
+	if err := q.quota.reserve(q.path, int64(len(p)), 0); err != nil {
+		return 0, err
+	}
+	return q.File.WriteAt(p, offset)
+}
+
+func (q *quotaFile) WriteString(s string) (int, error) {
+	return q.Write([]byte(s))
+}
+
+func (q *quotaFile) ReadFrom(reader io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{q}, reader)
+}
+
+func (q *quotaFile) Truncate(size int64) error {
+	fileInfo, err := q.File.Stat()
+	if err != nil {
+		return err
+	}
+	if err := q.quota.reserve(q.path, size-fileInfo.Size(), 0); err != nil {
+		return err
+	}
+	return q.File.Truncate(size)
+}
+
+func execute(quota *quota, cmd *osutils.Cmd) (func() error, error) {
+	if quota == nil {
+		return osutils.Execute(cmd)
+	}
+	execCmds, err := newExecCmds(cmd)
+	if err != nil {
+		return nil, err
+	}
+	wait, _, err := quota.execute(execCmds)
+	return wait, err
+}
+
+func executePiped(quota *quota, pipeCmdList *osutils.PipeCmdList) (func() error, error) {
+	if quota == nil {
+		return osutils.ExecutePiped(pipeCmdList)
+	}
+	execCmds, err := newPipedExecCmds(pipeCmdList)
+	if err != nil {
+		return nil, err
+	}
+	wait, _, err := quota.execute(execCmds)
+	return wait, err
+}
+
+func newExecCmds(cmd *osutils.Cmd) ([]*exec.Cmd, error) {
+	if len(cmd.Args) == 0 {
+		return nil, ErrArgsEmpty
+	}
+	execCmd := exec.Command(cmd.Args[0], cmd.Args[1:]...)
+	execCmd.Dir = cmd.AbsoluteDir
+	execCmd.Env = cmd.Env
+	execCmd.Stdin = cmd.Stdin
+	execCmd.Stdout = cmd.Stdout
+	execCmd.Stderr = cmd.Stderr
+	return []*exec.Cmd{execCmd}, nil
+}
+
+func newPipedExecCmds(pipeCmdList *osutils.PipeCmdList) ([]*exec.Cmd, error) {
+	if len(pipeCmdList.PipeCmds) == 0 {
+		return nil, ErrNotMultipleCommands
+	}
+	execCmds := make([]*exec.Cmd, len(pipeCmdList.PipeCmds))
+	for i, pipeCmd := range pipeCmdList.PipeCmds {
+		if len(pipeCmd.Args) == 0 {
+			return nil, ErrArgsEmpty
+		}
+		execCmd := exec.Command(pipeCmd.Args[0], pipeCmd.Args[1:]...)
+		execCmd.Dir = pipeCmd.AbsoluteDir
+		execCmd.Env = pipeCmd.Env
+		execCmd.Stderr = pipeCmdList.Stderr
+		execCmds[i] = execCmd
+	}
+	execCmds[0].Stdin = pipeCmdList.Stdin
+	for i := 0; i < len(execCmds)-1; i++ {
+		reader, err := execCmds[i].StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		execCmds[i+1].Stdin = reader
+	}
+	execCmds[len(execCmds)-1].Stdout = pipeCmdList.Stdout
+	return execCmds, nil
+}
+
+// execute starts execCmds in their own process groups and kills them once
+// the quota is exceeded, which is checked every quotaScanInterval and once
+// they exit, or once the returned kill function is called.
+func (q *quota) execute(execCmds []*exec.Cmd) (func() error, func(), error) {
+	for i, execCmd := range execCmds {
+		setProcessGroup(execCmd)
+		if err := execCmd.Start(); err != nil {
+			for _, startedExecCmd := range execCmds[:i] {
+				killProcessGroup(startedExecCmd)
+				_ = startedExecCmd.Wait()
+			}
+			return nil, nil, err
+		}
+	}
+	kill := func() {
+		for _, execCmd := range execCmds {
+			killProcessGroup(execCmd)
+		}
+	}
+	done := make(chan struct{})
+	exceeded := make(chan error, 1)
+	if q != nil {
+		ticker := time.NewTicker(quotaScanInterval)
+		go func() {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if err := q.check(); err != nil {
+						if _, ok := err.(*QuotaExceededError); ok {
+							exceeded <- err
+							kill()
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+	return func() error {
+		var retErr error
+		for _, execCmd := range execCmds {
+			if err := execCmd.Wait(); err != nil && retErr == nil {
+				retErr = err
+			}
+		}
+		close(done)
+		select {
+		case err := <-exceeded:
+			return err
+		default:
+		}
+		if err := q.check(); err != nil {
+			return err
+		}
+		return retErr
+	}, kill, nil
+}
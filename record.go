@@ -0,0 +1,201 @@
+package exec
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/codeship/go-concurrent"
+)
+
+// recordingClientProvider records the commands of its clients and of their
+// sub directory clients, and writes them to cassetteFile on Destroy.
+type recordingClientProvider struct {
+	concurrent.Destroyable
+	clientProvider ClientProvider
+	recorder       *cassetteRecorder
+}
+
+func newRecordingClientProvider(clientProvider ClientProvider, cassetteFile string) *recordingClientProvider {
+	recorder := &cassetteRecorder{cassette: &cassette{}}
+	return &recordingClientProvider{
+		concurrent.NewDestroyable(func() error {
+			err := clientProvider.Destroy()
+			if writeErr := recorder.write(cassetteFile); writeErr != nil && err == nil {
+				err = writeErr
+			}
+			return err
+		}),
+		clientProvider,
+		recorder,
+	}
+}
+
+func (r *recordingClientProvider) NewTempDirExecutorReadFileManager() (ExecutorReadFileManager, error) {
+	return r.NewTempDirClient()
+}
+
+func (r *recordingClientProvider) NewTempDirExecutorWriteFileManager() (ExecutorWriteFileManager, error) {
+	return r.NewTempDirClient()
+}
+
+func (r *recordingClientProvider) NewTempDirClient() (Client, error) {
+	value, err := r.Do(func() (interface{}, error) {
+		return r.clientProvider.NewTempDirClient()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &recordingClient{value.(Client), r.recorder}, nil
+}
+
+type cassetteRecorder struct {
+	cassette *cassette
+	lock     sync.Mutex
+}
+
+func (c *cassetteRecorder) record(cassetteInteraction *cassetteInteraction) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cassette.Interactions = append(c.cassette.Interactions, cassetteInteraction)
+}
+
+func (c *cassetteRecorder) write(path string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return writeCassette(path, c.cassette)
+}
+
+// recordingClient records a command once the function returned by Execute
+// or ExecutePiped is called. File changes are found by snapshots of the
+// directory before and after the command, so they are only right if no
+// other changes are made to the directory meanwhile.
+type recordingClient struct {
+	Client
+	recorder *cassetteRecorder
+}
+
+func (r *recordingClient) Execute(cmd *Cmd) func() error {
+	return r.record(
+		[]*cassetteCmd{newCassetteCmd(cmd.Args, cmd.SubDir, cmd.Env)},
+		cmd.Stdin,
+		cmd.Stdout,
+		cmd.Stderr,
+		func(stdin io.Reader, stdout io.Writer, stderr io.Writer) func() error {
+			recordedCmd := *cmd
+			recordedCmd.Stdin = stdin
+			recordedCmd.Stdout = stdout
+			recordedCmd.Stderr = stderr
+			return r.Client.Execute(&recordedCmd)
+		},
+	)
+}
+
+func (r *recordingClient) ExecutePiped(pipeCmdList *PipeCmdList) func() error {
+	return r.record(
+		newCassetteCmds(pipeCmdList),
+		pipeCmdList.Stdin,
+		pipeCmdList.Stdout,
+		pipeCmdList.Stderr,
+		func(stdin io.Reader, stdout io.Writer, stderr io.Writer) func() error {
+			recordedPipeCmdList := *pipeCmdList
+			recordedPipeCmdList.Stdin = stdin
+			recordedPipeCmdList.Stdout = stdout
+			recordedPipeCmdList.Stderr = stderr
+			return r.Client.ExecutePiped(&recordedPipeCmdList)
+		},
+	)
+}
+
+func (r *recordingClient) record(
+	cassetteCmds []*cassetteCmd,
+	stdin io.Reader,
+	stdout io.Writer,
+	stderr io.Writer,
+	execute func(io.Reader, io.Writer, io.Writer) func() error,
+) func() error {
+	var digester *stdinDigester
+	if stdin != nil {
+		digester = newStdinDigester(stdin)
+		stdin = digester
+	}
+	before, err := snapshot(r.Client, nil)
+	if err != nil {
+		return func() error { return err }
+	}
+	stdoutBuffer := &recordBuffer{}
+	stderrBuffer := &recordBuffer{}
+	wait := execute(stdin, teeWriter(stdout, stdoutBuffer), teeWriter(stderr, stderrBuffer))
+	return func() error {
+		err := wait()
+		stdinDigest, stdinSize := digestStdin(nil), int64(0)
+		if digester != nil {
+			stdinDigest, stdinSize = digester.digest()
+		}
+		after, snapshotErr := snapshot(r.Client, nil)
+		if snapshotErr != nil {
+			return snapshotErr
+		}
+		removed, cassetteFiles, changesErr := newCassetteChanges(r.Client, before, after)
+		if changesErr != nil {
+			return changesErr
+		}
+		cassetteInteraction := &cassetteInteraction{
+			Cmds:        cassetteCmds,
+			StdinDigest: stdinDigest,
+			StdinSize:   stdinSize,
+			Stdout:      stdoutBuffer.Bytes(),
+			Stderr:      stderrBuffer.Bytes(),
+			Removed:     removed,
+			Files:       cassetteFiles,
+		}
+		if exitCode, ok := exitCode(err); ok {
+			cassetteInteraction.ExitCode = exitCode
+		} else {
+			cassetteInteraction.Err = newRemoteError(err)
+		}
+		r.recorder.record(cassetteInteraction)
+		return err
+	}
+}
+
+func (r *recordingClient) NewSubDirExecutorReadFileManager(path string) (ExecutorReadFileManager, error) {
+	return r.NewSubDirClient(path)
+}
+
+func (r *recordingClient) NewSubDirExecutorWriteFileManager(path string) (ExecutorWriteFileManager, error) {
+	return r.NewSubDirClient(path)
+}
+
+func (r *recordingClient) NewSubDirClient(path string) (Client, error) {
+	client, err := r.Client.NewSubDirClient(path)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingClient{client, r.recorder}, nil
+}
+
+func teeWriter(writer io.Writer, recordBuffer *recordBuffer) io.Writer {
+	if writer == nil {
+		return recordBuffer
+	}
+	return io.MultiWriter(writer, recordBuffer)
+}
+
+// recordBuffer can be written by the commands of a pipe concurrently
+type recordBuffer struct {
+	buffer bytes.Buffer
+	lock   sync.Mutex
+}
+
+func (r *recordBuffer) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.buffer.Write(p)
+}
+
+func (r *recordBuffer) Bytes() []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]byte(nil), r.buffer.Bytes()...)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package exec
+
+import (
+	"errors"
+	"os"
+)
+
+func reflink(toFile *os.File, fromFile *os.File) error {
+	return errors.New("exec: reflink not supported")
+}
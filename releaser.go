@@ -0,0 +1,76 @@
+package exec
+
+import (
+	"sync"
+)
+
+// releaser tracks the locks and watchers held through a client, so that
+// they are released when the client is destroyed.
+type releaser struct {
+	lock        sync.Mutex
+	releasables map[*releasable]bool
+	destroyed   bool
+}
+
+func newReleaser() *releaser {
+	return &releaser{releasables: make(map[*releasable]bool)}
+}
+
+// add calls release and returns ErrAlreadyDestroyed if the client was
+// destroyed in the meantime.
+func (r *releaser) add(release func() error) (*releasable, error) {
+	r.lock.Lock()
+	if r.destroyed {
+		r.lock.Unlock()
+		if err := release(); err != nil {
+			return nil, err
+		}
+		return nil, ErrAlreadyDestroyed
+	}
+	releasable := &releasable{r, release}
+	r.releasables[releasable] = true
+	r.lock.Unlock()
+	return releasable, nil
+}
+
+func (r *releaser) isDestroyed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.destroyed
+}
+
+func (r *releaser) destroy() error {
+	r.lock.Lock()
+	r.destroyed = true
+	releasables := r.releasables
+	r.releasables = make(map[*releasable]bool)
+	r.lock.Unlock()
+	var retErr error
+	for releasable := range releasables {
+		if err := releasable.release(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}
+	return retErr
+}
+
+type releasable struct {
+	releaser *releaser
+	release  func() error
+}
+
+// Release does nothing if already released
+func (r *releasable) Release() error {
+	r.releaser.lock.Lock()
+	held := r.releaser.releasables[r]
+	delete(r.releaser.releasables, r)
+	r.releaser.lock.Unlock()
+	if !held {
+		return nil
+	}
+	return r.release()
+}
+
+func (r *releasable) Unlock() error {
+	return r.Release()
+}
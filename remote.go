@@ -0,0 +1,612 @@
+package exec
+
+import (
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codeship/go-concurrent"
+)
+
+type remoteClientProvider struct {
+	concurrent.Destroyable
+	conn *remoteConn
+}
+
+func dialRemoteClientProvider(execOptions *RemoteExecOptions) (*remoteClientProvider, error) {
+	network := execOptions.Network
+	if network == "" {
+		network = defaultRemoteNetwork
+	}
+	conn, err := net.Dial(network, execOptions.Address)
+	if err != nil {
+		return nil, err
+	}
+	return newRemoteClientProvider(conn), nil
+}
+
+func newRemoteClientProvider(conn net.Conn) *remoteClientProvider {
+	remoteConn := newRemoteConn(conn)
+	return &remoteClientProvider{concurrent.NewDestroyable(remoteConn.Close), remoteConn}
+}
+
+func (r *remoteClientProvider) NewTempDirExecutorReadFileManager() (ExecutorReadFileManager, error) {
+	return r.NewTempDirClient()
+}
+
+func (r *remoteClientProvider) NewTempDirExecutorWriteFileManager() (ExecutorWriteFileManager, error) {
+	return r.NewTempDirClient()
+}
+
+func (r *remoteClientProvider) NewTempDirClient() (Client, error) {
+	value, err := r.Do(func() (interface{}, error) {
+		return r.conn.call("NewTempDirClient", &remoteArgs{})
+	})
+	if err != nil {
+		return nil, err
+	}
+	client := newRemoteClient(r.conn, value.(*remoteResult))
+	if err := r.AddChild(client); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// remoteClient makes every call on the server, except for the path
+// functions, which use the path separator of the server.
+type remoteClient struct {
+	concurrent.Destroyable
+	conn          *remoteConn
+	handle        uint64
+	dirName       string
+	dirPath       string
+	pathSeparator string
+	releaser      *releaser
+}
+
+func newRemoteClient(conn *remoteConn, result *remoteResult) *remoteClient {
+	releaser := newReleaser()
+	return &remoteClient{
+		concurrent.NewDestroyable(func() error {
+			err := releaser.destroy()
+			if _, callErr := conn.call("Destroy", &remoteArgs{Handle: result.Handle}); callErr != nil && err == nil {
+				err = callErr
+			}
+			return err
+		}),
+		conn,
+		result.Handle,
+		result.DirName,
+		result.DirPath,
+		result.PathSeparator,
+		releaser,
+	}
+}
+
+func (r *remoteClient) call(method string, args *remoteArgs) (*remoteResult, error) {
+	args.Handle = r.handle
+	value, err := r.Do(func() (interface{}, error) {
+		return r.conn.call(method, args)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*remoteResult), nil
+}
+
+// DirPath is the path on the server
+func (r *remoteClient) DirPath() string {
+	return r.dirPath
+}
+
+func (r *remoteClient) DirName() string {
+	return r.dirName
+}
+
+func (r *remoteClient) Execute(cmd *Cmd) func() error {
+	return r.execute(
+		&remoteArgs{Cmds: []*remoteCmd{{cmd.Args, cmd.SubDir, cmd.Env}}},
+		cmd.Stdin,
+		cmd.Stdout,
+		cmd.Stderr,
+	)
+}
+
+func (r *remoteClient) ExecutePiped(pipeCmdList *PipeCmdList) func() error {
+	cmds := make([]*remoteCmd, len(pipeCmdList.PipeCmds))
+	for i, pipeCmd := range pipeCmdList.PipeCmds {
+		cmds[i] = &remoteCmd{pipeCmd.Args, pipeCmd.SubDir, pipeCmd.Env}
+	}
+	return r.execute(
+		&remoteArgs{Cmds: cmds, Piped: true},
+		pipeCmdList.Stdin,
+		pipeCmdList.Stdout,
+		pipeCmdList.Stderr,
+	)
+}
+
+// execute starts the process on the server and streams stdin to it while
+// reading its output, as the os backend does, so that stdin can be written
+// to before waiting. The returned function waits for the process to finish.
+func (r *remoteClient) execute(args *remoteArgs, stdin io.Reader, stdout io.Writer, stderr io.Writer) func() error {
+	args.Stdin = stdin != nil
+	args.Stdout = stdout != nil
+	args.Stderr = stderr != nil
+	result, err := r.call("Execute", args)
+	if err != nil {
+		return func() error { return err }
+	}
+	handle := result.Handle
+	if stdin != nil {
+		go r.writeStdin(handle, stdin)
+	}
+	done := make(chan struct{})
+	var retErr error
+	go func() {
+		defer close(done)
+		retErr = r.readOutput(handle, stdout, stderr)
+	}()
+	return func() error {
+		<-done
+		return retErr
+	}
+}
+
+// readOutput reads the output until the process finishes, a failed write to
+// stdout or stderr is returned once the process finished if the process did
+// not fail itself.
+func (r *remoteClient) readOutput(handle uint64, stdout io.Writer, stderr io.Writer) error {
+	var writeErr error
+	for {
+		result, err := r.conn.call("ProcessRead", &remoteArgs{Handle: handle})
+		if err != nil {
+			return err
+		}
+		if len(result.Data) > 0 && writeErr == nil {
+			_, writeErr = stdout.Write(result.Data)
+		}
+		if len(result.Stderr) > 0 && writeErr == nil {
+			_, writeErr = stderr.Write(result.Stderr)
+		}
+		if result.Done {
+			if err := result.ResultErr.err(); err != nil {
+				return err
+			}
+			return writeErr
+		}
+	}
+}
+
+// writeStdin stops once the process no longer reads stdin
+func (r *remoteClient) writeStdin(handle uint64, stdin io.Reader) {
+	data := make([]byte, 32*1024)
+	for {
+		n, err := stdin.Read(data)
+		if n > 0 {
+			if _, err := r.conn.call("ProcessWrite", &remoteArgs{Handle: handle, Data: data[:n]}); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			_, _ = r.conn.call("ProcessCloseStdin", &remoteArgs{Handle: handle})
+			return
+		}
+	}
+}
+
+func (r *remoteClient) IsFileExists(path string) (bool, error) {
+	result, err := r.call("IsFileExists", &remoteArgs{Path: path})
+	if err != nil {
+		return false, err
+	}
+	return result.Bool, nil
+}
+
+func (r *remoteClient) ListRegularFiles(path string) ([]string, error) {
+	result, err := r.call("ListRegularFiles", &remoteArgs{Path: path})
+	if err != nil {
+		return nil, err
+	}
+	return result.Strings, nil
+}
+
+func (r *remoteClient) Open(path string) (ReadFile, error) {
+	return r.openFile("Open", &remoteArgs{Path: path})
+}
+
+func (r *remoteClient) OpenFile(path string, flag int, perm os.FileMode) (ReadWriteFile, error) {
+	return r.openFile("OpenFile", &remoteArgs{Path: path, Flag: flag, Perm: perm})
+}
+
+func (r *remoteClient) Create(path string) (WriteFile, error) {
+	return r.openFile("Create", &remoteArgs{Path: path})
+}
+
+func (r *remoteClient) openFile(method string, args *remoteArgs) (*remoteFile, error) {
+	result, err := r.call(method, args)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteFile{r.conn, result.Handle, result.String}, nil
+}
+
+func (r *remoteClient) Stat(path string) (os.FileInfo, error) {
+	return r.fileInfo("Stat", path)
+}
+
+func (r *remoteClient) Lstat(path string) (os.FileInfo, error) {
+	return r.fileInfo("Lstat", path)
+}
+
+func (r *remoteClient) fileInfo(method string, path string) (os.FileInfo, error) {
+	result, err := r.call(method, &remoteArgs{Path: path})
+	if err != nil {
+		return nil, err
+	}
+	return result.FileInfo, nil
+}
+
+func (r *remoteClient) Readlink(path string) (string, error) {
+	result, err := r.call("Readlink", &remoteArgs{Path: path})
+	if err != nil {
+		return "", err
+	}
+	return result.String, nil
+}
+
+func (r *remoteClient) MkdirAll(path string, perm os.FileMode) error {
+	_, err := r.call("MkdirAll", &remoteArgs{Path: path, Perm: perm})
+	return err
+}
+
+func (r *remoteClient) Rename(oldpath string, newpath string) error {
+	_, err := r.call("Rename", &remoteArgs{Path: oldpath, NewPath: newpath})
+	return err
+}
+
+func (r *remoteClient) Remove(path string) error {
+	_, err := r.call("Remove", &remoteArgs{Path: path})
+	return err
+}
+
+func (r *remoteClient) RemoveAll(path string) error {
+	_, err := r.call("RemoveAll", &remoteArgs{Path: path})
+	return err
+}
+
+func (r *remoteClient) Chmod(path string, mode os.FileMode) error {
+	_, err := r.call("Chmod", &remoteArgs{Path: path, Perm: mode})
+	return err
+}
+
+func (r *remoteClient) Chown(path string, uid int, gid int) error {
+	_, err := r.call("Chown", &remoteArgs{Path: path, UID: uid, GID: gid})
+	return err
+}
+
+func (r *remoteClient) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	_, err := r.call("Chtimes", &remoteArgs{Path: path, Atime: atime, Mtime: mtime})
+	return err
+}
+
+func (r *remoteClient) Symlink(oldname string, newname string) error {
+	_, err := r.call("Symlink", &remoteArgs{Path: oldname, NewPath: newname})
+	return err
+}
+
+func (r *remoteClient) Link(oldname string, newname string) error {
+	_, err := r.call("Link", &remoteArgs{Path: oldname, NewPath: newname})
+	return err
+}
+
+func (r *remoteClient) Truncate(path string, size int64) error {
+	_, err := r.call("Truncate", &remoteArgs{Path: path, Size: size})
+	return err
+}
+
+func (r *remoteClient) Lock(path string, exclusive bool) (Unlocker, error) {
+	return r.lock("Lock", path, exclusive)
+}
+
+func (r *remoteClient) TryLock(path string, exclusive bool) (Unlocker, error) {
+	return r.lock("TryLock", path, exclusive)
+}
+
+// not called in Do, as waiting for the lock would block Destroy
+func (r *remoteClient) lock(method string, path string, exclusive bool) (Unlocker, error) {
+	if r.releaser.isDestroyed() {
+		return nil, ErrAlreadyDestroyed
+	}
+	result, err := r.conn.call(method, &remoteArgs{Handle: r.handle, Path: path, Bool: exclusive})
+	if err != nil {
+		return nil, err
+	}
+	releasable, err := r.releaser.add(func() error {
+		_, err := r.conn.call("Unlock", &remoteArgs{Handle: result.Handle})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return releasable, nil
+}
+
+func (r *remoteClient) Watch(path string, recursive bool) (Watcher, error) {
+	result, err := r.call("Watch", &remoteArgs{Path: path, Bool: recursive})
+	if err != nil {
+		return nil, err
+	}
+	return addWatcher(r.releaser, newRemoteWatcher(r.conn, result.Handle))
+}
+
+func (r *remoteClient) Walk(root string, walkOptions *WalkOptions, walkFunc WalkFunc) error {
+	return walk(r, root, walkOptions, walkFunc)
+}
+
+func (r *remoteClient) Glob(patterns ...string) ([]string, error) {
+	return glob(r, patterns)
+}
+
+func (r *remoteClient) Join(elem ...string) string {
+	if r.pathSeparator == "/" {
+		return path.Join(elem...)
+	}
+	return filepath.Join(elem...)
+}
+
+func (r *remoteClient) Match(pattern string, path string) (bool, error) {
+	return matchPattern(r.ToSlash(pattern), r.ToSlash(path))
+}
+
+func (r *remoteClient) ToSlash(path string) string {
+	return strings.Replace(path, r.pathSeparator, "/", -1)
+}
+
+func (r *remoteClient) Base(name string) string {
+	if r.pathSeparator == "/" {
+		return path.Base(name)
+	}
+	return filepath.Base(name)
+}
+
+func (r *remoteClient) Dir(name string) string {
+	if r.pathSeparator == "/" {
+		return path.Dir(name)
+	}
+	return filepath.Dir(name)
+}
+
+func (r *remoteClient) PathSeparator() string {
+	return r.pathSeparator
+}
+
+func (r *remoteClient) NewSubDirExecutorReadFileManager(path string) (ExecutorReadFileManager, error) {
+	return r.newSubDirClient(path)
+}
+
+func (r *remoteClient) NewSubDirExecutorWriteFileManager(path string) (ExecutorWriteFileManager, error) {
+	return r.newSubDirClient(path)
+}
+
+func (r *remoteClient) NewSubDirClient(path string) (Client, error) {
+	return r.newSubDirClient(path)
+}
+
+func (r *remoteClient) newSubDirClient(path string) (*remoteClient, error) {
+	result, err := r.call("NewSubDirClient", &remoteArgs{Path: path})
+	if err != nil {
+		return nil, err
+	}
+	subDirClient := newRemoteClient(r.conn, result)
+	if err := r.AddChild(subDirClient); err != nil {
+		return nil, err
+	}
+	return subDirClient, nil
+}
+
+type remoteFile struct {
+	conn   *remoteConn
+	handle uint64
+	name   string
+}
+
+func (r *remoteFile) call(method string, args *remoteArgs) (*remoteResult, error) {
+	args.Handle = r.handle
+	return r.conn.call(method, args)
+}
+
+func (r *remoteFile) Name() string {
+	return r.name
+}
+
+func (r *remoteFile) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	result, err := r.call("FileRead", &remoteArgs{N: len(p)})
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, result.Data), nil
+}
+
+func (r *remoteFile) ReadAt(p []byte, offset int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		result, err := r.call("FileReadAt", &remoteArgs{Offset: offset + int64(n), N: len(p) - n})
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], result.Data)
+		if err := result.ResultErr.err(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (r *remoteFile) Write(p []byte) (int, error) {
+	return r.write(p, func(chunk []byte, offset int64) *remoteArgs {
+		return &remoteArgs{Data: chunk}
+	}, "FileWrite", 0)
+}
+
+func (r *remoteFile) WriteAt(p []byte, offset int64) (int, error) {
+	return r.write(p, func(chunk []byte, offset int64) *remoteArgs {
+		return &remoteArgs{Data: chunk, Offset: offset}
+	}, "FileWriteAt", offset)
+}
+
+func (r *remoteFile) write(p []byte, newArgs func([]byte, int64) *remoteArgs, method string, offset int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > remoteMaxChunkSize {
+			chunk = chunk[:remoteMaxChunkSize]
+		}
+		result, err := r.call(method, newArgs(chunk, offset+int64(n)))
+		if result != nil {
+			n += int(result.N)
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (r *remoteFile) Seek(offset int64, whence int) (int64, error) {
+	result, err := r.call("FileSeek", &remoteArgs{Offset: offset, Whence: whence})
+	if err != nil {
+		return 0, err
+	}
+	return result.N, nil
+}
+
+func (r *remoteFile) Stat() (os.FileInfo, error) {
+	result, err := r.call("FileStat", &remoteArgs{})
+	if err != nil {
+		return nil, err
+	}
+	return result.FileInfo, nil
+}
+
+func (r *remoteFile) Close() error {
+	_, err := r.call("FileClose", &remoteArgs{})
+	return err
+}
+
+func (r *remoteFile) Readdir(n int) ([]os.FileInfo, error) {
+	result, err := r.call("FileReaddir", &remoteArgs{N: n})
+	if err != nil {
+		return nil, err
+	}
+	return osFileInfos(result.FileInfos), nil
+}
+
+func (r *remoteFile) Readdirnames(n int) ([]string, error) {
+	result, err := r.call("FileReaddirnames", &remoteArgs{N: n})
+	if err != nil {
+		return nil, err
+	}
+	return result.Strings, nil
+}
+
+func (r *remoteFile) Chmod(mode os.FileMode) error {
+	_, err := r.call("FileChmod", &remoteArgs{Perm: mode})
+	return err
+}
+
+func (r *remoteFile) Sync() error {
+	_, err := r.call("FileSync", &remoteArgs{})
+	return err
+}
+
+func (r *remoteFile) Truncate(size int64) error {
+	_, err := r.call("FileTruncate", &remoteArgs{Size: size})
+	return err
+}
+
+// remoteWatcher polls the server for events until closed
+type remoteWatcher struct {
+	conn      *remoteConn
+	handle    uint64
+	events    chan *WatchEvent
+	errors    chan error
+	closeOnce sync.Once
+	closed    chan struct{}
+	stopped   chan struct{}
+}
+
+func newRemoteWatcher(conn *remoteConn, handle uint64) *remoteWatcher {
+	remoteWatcher := &remoteWatcher{
+		conn:    conn,
+		handle:  handle,
+		events:  make(chan *WatchEvent),
+		errors:  make(chan error),
+		closed:  make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go remoteWatcher.run()
+	return remoteWatcher
+}
+
+func (r *remoteWatcher) Events() <-chan *WatchEvent {
+	return r.events
+}
+
+func (r *remoteWatcher) Errors() <-chan error {
+	return r.errors
+}
+
+func (r *remoteWatcher) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		_, err = r.conn.call("WatchClose", &remoteArgs{Handle: r.handle})
+		<-r.stopped
+	})
+	return err
+}
+
+func (r *remoteWatcher) run() {
+	defer func() {
+		close(r.events)
+		close(r.errors)
+		close(r.stopped)
+	}()
+	for {
+		result, err := r.conn.call("WatchNext", &remoteArgs{Handle: r.handle})
+		if err == nil {
+			err = result.ResultErr.err()
+		}
+		if err != nil {
+			select {
+			case r.errors <- err:
+			case <-r.closed:
+				return
+			}
+			if result == nil {
+				// the connection failed
+				<-r.closed
+				return
+			}
+			continue
+		}
+		for _, event := range result.Events {
+			select {
+			case r.events <- event:
+			case <-r.closed:
+				return
+			}
+		}
+		if result.Done {
+			return
+		}
+	}
+}
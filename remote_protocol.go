@@ -0,0 +1,311 @@
+package exec
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRemoteNetwork = "tcp"
+	// the maximum data moved by a single call or buffered per output stream
+	remoteMaxChunkSize = 1 << 20
+)
+
+var (
+	errRemoteConnClosed = errors.New("exec: remote connection closed")
+
+	// checked in order with errors.Is, so that errors such as os.IsNotExist
+	// still work on the client
+	remoteErrorKinds = []*remoteErrorKind{
+		{"AlreadyDestroyed", ErrAlreadyDestroyed},
+		{"FileDoesNotExist", ErrFileDoesNotExist},
+		{"NotRelativePath", ErrNotRelativePath},
+		{"NotAbsolutePath", ErrNotAbsolutePath},
+		{"PathOutOfContext", ErrPathOutOfContext},
+		{"ArgsEmpty", ErrArgsEmpty},
+		{"FileAlreadyExists", ErrFileAlreadyExists},
+		{"NotMultipleCommands", ErrNotMultipleCommands},
+		{"NotADirectory", ErrNotADirectory},
+		{"NotSupported", ErrNotSupported},
+		{"LockHeld", ErrLockHeld},
+		{"EOF", io.EOF},
+		{"UnexpectedEOF", io.ErrUnexpectedEOF},
+		{"ClosedPipe", io.ErrClosedPipe},
+		{"NotExist", fs.ErrNotExist},
+		{"Exist", fs.ErrExist},
+		{"Permission", fs.ErrPermission},
+		{"Closed", fs.ErrClosed},
+		{"Invalid", fs.ErrInvalid},
+	}
+)
+
+type remoteErrorKind struct {
+	name string
+	err  error
+}
+
+// remoteError is an error as sent over the wire. Known errors are sent by
+// kind and restored on the client, others only keep their message.
+type remoteError struct {
+	Op      string
+	Path    string
+	Kind    string
+	Message string
+	// for the exit status of a command
+	Exited   bool
+	ExitCode int
+}
+
+// newRemoteError returns nil if err is nil
+func newRemoteError(err error) *remoteError {
+	if err == nil {
+		return nil
+	}
+	remoteError := &remoteError{}
+	if exitCode, ok := exitCode(err); ok {
+		remoteError.Exited = true
+		remoteError.ExitCode = exitCode
+		remoteError.Message = err.Error()
+		return remoteError
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		remoteError.Op = pathErr.Op
+		remoteError.Path = pathErr.Path
+		err = pathErr.Err
+	}
+	remoteError.Message = err.Error()
+	for _, remoteErrorKind := range remoteErrorKinds {
+		if errors.Is(err, remoteErrorKind.err) {
+			remoteError.Kind = remoteErrorKind.name
+			break
+		}
+	}
+	return remoteError
+}
+
+// err returns nil if r is nil
+func (r *remoteError) err() error {
+	if r == nil {
+		return nil
+	}
+	if r.Exited {
+		return &RemoteExitError{r.ExitCode}
+	}
+	err := errors.New(r.Message)
+	for _, remoteErrorKind := range remoteErrorKinds {
+		if remoteErrorKind.name == r.Kind {
+			err = remoteErrorKind.err
+			break
+		}
+	}
+	if r.Op != "" {
+		return &fs.PathError{Op: r.Op, Path: r.Path, Err: err}
+	}
+	return err
+}
+
+// remoteArgs holds the arguments of every method, each method uses the
+// fields it needs.
+type remoteArgs struct {
+	// the client, file, lock, watcher or process
+	Handle  uint64
+	Path    string
+	NewPath string
+	Flag    int
+	Perm    os.FileMode
+	UID     int
+	GID     int
+	Atime   time.Time
+	Mtime   time.Time
+	Size    int64
+	Offset  int64
+	Whence  int
+	N       int
+	Data    []byte
+	Bool    bool
+	Cmds    []*remoteCmd
+	Piped   bool
+	Stdin   bool
+	Stdout  bool
+	Stderr  bool
+}
+
+type remoteCmd struct {
+	Args   []string
+	SubDir string
+	Env    []string
+}
+
+type remoteResult struct {
+	Handle        uint64
+	Bool          bool
+	N             int64
+	String        string
+	Strings       []string
+	FileInfo      *remoteFileInfo
+	FileInfos     []*remoteFileInfo
+	Data          []byte
+	Stderr        []byte
+	Events        []*WatchEvent
+	Done          bool
+	DirName       string
+	DirPath       string
+	PathSeparator string
+	// the error of a finished process or watcher, or of a partial ReadAt
+	ResultErr *remoteError
+}
+
+type remoteRequest struct {
+	ID     uint64
+	Method string
+	Args   *remoteArgs
+}
+
+type remoteResponse struct {
+	ID     uint64
+	Result *remoteResult
+	Err    *remoteError
+}
+
+type remoteFileInfo struct {
+	FileName    string
+	FileSize    int64
+	FileMode    os.FileMode
+	FileModTime time.Time
+	// identifies the file on the server, empty if unknown, see sameFile
+	ID string
+}
+
+// newRemoteFileInfo returns nil if fileInfo is nil
+func newRemoteFileInfo(fileInfo os.FileInfo) *remoteFileInfo {
+	if fileInfo == nil {
+		return nil
+	}
+	return &remoteFileInfo{
+		fileInfo.Name(),
+		fileInfo.Size(),
+		fileInfo.Mode(),
+		fileInfo.ModTime(),
+		hostFileID(fileInfo),
+	}
+}
+
+func newRemoteFileInfos(fileInfos []os.FileInfo) []*remoteFileInfo {
+	remoteFileInfos := make([]*remoteFileInfo, len(fileInfos))
+	for i, fileInfo := range fileInfos {
+		remoteFileInfos[i] = newRemoteFileInfo(fileInfo)
+	}
+	return remoteFileInfos
+}
+
+func (r *remoteFileInfo) Name() string       { return r.FileName }
+func (r *remoteFileInfo) Size() int64        { return r.FileSize }
+func (r *remoteFileInfo) Mode() os.FileMode  { return r.FileMode }
+func (r *remoteFileInfo) ModTime() time.Time { return r.FileModTime }
+func (r *remoteFileInfo) IsDir() bool        { return r.FileMode.IsDir() }
+func (r *remoteFileInfo) Sys() interface{}   { return nil }
+
+func (r *remoteFileInfo) fileID() string {
+	return r.ID
+}
+
+func osFileInfos(remoteFileInfos []*remoteFileInfo) []os.FileInfo {
+	fileInfos := make([]os.FileInfo, len(remoteFileInfos))
+	for i, remoteFileInfo := range remoteFileInfos {
+		fileInfos[i] = remoteFileInfo
+	}
+	return fileInfos
+}
+
+// remoteConn is the client end of a connection, calls can be made
+// concurrently.
+type remoteConn struct {
+	conn      net.Conn
+	encoder   *gob.Encoder
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	nextID    uint64
+	pending   map[uint64]chan *remoteResponse
+	err       error
+}
+
+func newRemoteConn(conn net.Conn) *remoteConn {
+	remoteConn := &remoteConn{
+		conn:    conn,
+		encoder: gob.NewEncoder(conn),
+		pending: make(map[uint64]chan *remoteResponse),
+	}
+	go remoteConn.read()
+	return remoteConn
+}
+
+func (r *remoteConn) call(method string, args *remoteArgs) (*remoteResult, error) {
+	responseC := make(chan *remoteResponse, 1)
+	r.lock.Lock()
+	if r.err != nil {
+		r.lock.Unlock()
+		return nil, r.err
+	}
+	r.nextID++
+	id := r.nextID
+	r.pending[id] = responseC
+	r.lock.Unlock()
+	r.writeLock.Lock()
+	err := r.encoder.Encode(&remoteRequest{id, method, args})
+	r.writeLock.Unlock()
+	if err != nil {
+		r.fail(err)
+	}
+	response := <-responseC
+	if response.Err != nil {
+		return nil, response.Err.err()
+	}
+	return response.Result, nil
+}
+
+func (r *remoteConn) read() {
+	decoder := gob.NewDecoder(r.conn)
+	for {
+		response := &remoteResponse{}
+		if err := decoder.Decode(response); err != nil {
+			r.fail(err)
+			return
+		}
+		r.lock.Lock()
+		responseC, ok := r.pending[response.ID]
+		delete(r.pending, response.ID)
+		r.lock.Unlock()
+		if ok {
+			responseC <- response
+		}
+	}
+}
+
+// fail fails all pending and future calls
+func (r *remoteConn) fail(err error) {
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		err = errRemoteConnClosed
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+	for id, responseC := range r.pending {
+		responseC <- &remoteResponse{ID: id, Err: newRemoteError(r.err)}
+		delete(r.pending, id)
+	}
+}
+
+func (r *remoteConn) Close() error {
+	err := r.conn.Close()
+	r.fail(errRemoteConnClosed)
+	return err
+}
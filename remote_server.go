@@ -0,0 +1,722 @@
+package exec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+var (
+	remoteHandlers = map[string]func(*remoteSession, *remoteArgs) (*remoteResult, error){
+		"NewTempDirClient": (*remoteSession).newTempDirClient,
+		"NewSubDirClient":  (*remoteSession).newSubDirClient,
+		"Destroy":          (*remoteSession).destroy,
+		"IsFileExists": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				exists, err := client.IsFileExists(args.Path)
+				return &remoteResult{Bool: exists}, err
+			})
+		},
+		"ListRegularFiles": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				files, err := client.ListRegularFiles(args.Path)
+				return &remoteResult{Strings: files}, err
+			})
+		},
+		"Stat": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				fileInfo, err := client.Stat(args.Path)
+				return &remoteResult{FileInfo: newRemoteFileInfo(fileInfo)}, err
+			})
+		},
+		"Lstat": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				fileInfo, err := client.Lstat(args.Path)
+				return &remoteResult{FileInfo: newRemoteFileInfo(fileInfo)}, err
+			})
+		},
+		"Readlink": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				target, err := client.Readlink(args.Path)
+				return &remoteResult{String: target}, err
+			})
+		},
+		"Open": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				file, err := client.Open(args.Path)
+				if err != nil {
+					return nil, err
+				}
+				return &remoteResult{Handle: r.add(file), String: file.Name()}, nil
+			})
+		},
+		"OpenFile": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				file, err := client.OpenFile(args.Path, args.Flag, args.Perm)
+				if err != nil {
+					return nil, err
+				}
+				return &remoteResult{Handle: r.add(file), String: file.Name()}, nil
+			})
+		},
+		"Create": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				file, err := client.Create(args.Path)
+				if err != nil {
+					return nil, err
+				}
+				return &remoteResult{Handle: r.add(file), String: file.Name()}, nil
+			})
+		},
+		"MkdirAll": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				return nil, client.MkdirAll(args.Path, args.Perm)
+			})
+		},
+		"Rename": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				return nil, client.Rename(args.Path, args.NewPath)
+			})
+		},
+		"Remove": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				return nil, client.Remove(args.Path)
+			})
+		},
+		"RemoveAll": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				return nil, client.RemoveAll(args.Path)
+			})
+		},
+		"Chmod": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				return nil, client.Chmod(args.Path, args.Perm)
+			})
+		},
+		"Chown": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				return nil, client.Chown(args.Path, args.UID, args.GID)
+			})
+		},
+		"Chtimes": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				return nil, client.Chtimes(args.Path, args.Atime, args.Mtime)
+			})
+		},
+		"Symlink": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				return nil, client.Symlink(args.Path, args.NewPath)
+			})
+		},
+		"Link": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				return nil, client.Link(args.Path, args.NewPath)
+			})
+		},
+		"Truncate": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				return nil, client.Truncate(args.Path, args.Size)
+			})
+		},
+		"Lock": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				unlocker, err := client.Lock(args.Path, args.Bool)
+				if err != nil {
+					return nil, err
+				}
+				return &remoteResult{Handle: r.add(unlocker)}, nil
+			})
+		},
+		"TryLock": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				unlocker, err := client.TryLock(args.Path, args.Bool)
+				if err != nil {
+					return nil, err
+				}
+				return &remoteResult{Handle: r.add(unlocker)}, nil
+			})
+		},
+		"Unlock": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			value := r.remove(args.Handle)
+			unlocker, ok := value.(Unlocker)
+			if !ok {
+				return nil, nil
+			}
+			return nil, unlocker.Unlock()
+		},
+		"Watch": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withClient(args, func(client Client) (*remoteResult, error) {
+				watcher, err := client.Watch(args.Path, args.Bool)
+				if err != nil {
+					return nil, err
+				}
+				return &remoteResult{Handle: r.add(watcher)}, nil
+			})
+		},
+		"WatchNext":  (*remoteSession).watchNext,
+		"WatchClose": (*remoteSession).watchClose,
+		"Execute":    (*remoteSession).execute,
+		"ProcessWrite": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			process, err := r.process(args.Handle)
+			if err != nil {
+				return nil, err
+			}
+			_, err = process.stdinWriter.Write(args.Data)
+			return nil, err
+		},
+		"ProcessCloseStdin": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			process, err := r.process(args.Handle)
+			if err != nil {
+				return nil, err
+			}
+			return nil, process.stdinWriter.Close()
+		},
+		"ProcessRead": (*remoteSession).processRead,
+		"FileRead": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withFile(args, func(file File) (*remoteResult, error) {
+				readFile, ok := file.(io.Reader)
+				if !ok {
+					return nil, ErrNotSupported
+				}
+				data := make([]byte, remoteChunkSize(args.N))
+				n, err := readFile.Read(data)
+				if n > 0 {
+					return &remoteResult{Data: data[:n]}, nil
+				}
+				return nil, err
+			})
+		},
+		"FileReadAt": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withFile(args, func(file File) (*remoteResult, error) {
+				readerAt, ok := file.(io.ReaderAt)
+				if !ok {
+					return nil, ErrNotSupported
+				}
+				data := make([]byte, remoteChunkSize(args.N))
+				n, err := readerAt.ReadAt(data, args.Offset)
+				return &remoteResult{Data: data[:n], ResultErr: newRemoteError(err)}, nil
+			})
+		},
+		"FileWrite": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withWriteFile(args, func(writeFile WriteFile) (*remoteResult, error) {
+				n, err := writeFile.Write(args.Data)
+				return &remoteResult{N: int64(n)}, err
+			})
+		},
+		"FileWriteAt": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withWriteFile(args, func(writeFile WriteFile) (*remoteResult, error) {
+				n, err := writeFile.WriteAt(args.Data, args.Offset)
+				return &remoteResult{N: int64(n)}, err
+			})
+		},
+		"FileSeek": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withFile(args, func(file File) (*remoteResult, error) {
+				offset, err := file.Seek(args.Offset, args.Whence)
+				return &remoteResult{N: offset}, err
+			})
+		},
+		"FileStat": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withFile(args, func(file File) (*remoteResult, error) {
+				fileInfo, err := file.Stat()
+				return &remoteResult{FileInfo: newRemoteFileInfo(fileInfo)}, err
+			})
+		},
+		"FileClose": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			file, ok := r.remove(args.Handle).(File)
+			if !ok {
+				return nil, os.ErrClosed
+			}
+			return nil, file.Close()
+		},
+		"FileReaddir": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withReadFile(args, func(readFile ReadFile) (*remoteResult, error) {
+				fileInfos, err := readFile.Readdir(args.N)
+				return &remoteResult{FileInfos: newRemoteFileInfos(fileInfos)}, err
+			})
+		},
+		"FileReaddirnames": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withReadFile(args, func(readFile ReadFile) (*remoteResult, error) {
+				names, err := readFile.Readdirnames(args.N)
+				return &remoteResult{Strings: names}, err
+			})
+		},
+		"FileChmod": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withWriteFile(args, func(writeFile WriteFile) (*remoteResult, error) {
+				return nil, writeFile.Chmod(args.Perm)
+			})
+		},
+		"FileSync": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withWriteFile(args, func(writeFile WriteFile) (*remoteResult, error) {
+				return nil, writeFile.Sync()
+			})
+		},
+		"FileTruncate": func(r *remoteSession, args *remoteArgs) (*remoteResult, error) {
+			return r.withWriteFile(args, func(writeFile WriteFile) (*remoteResult, error) {
+				return nil, writeFile.Truncate(args.Size)
+			})
+		},
+	}
+)
+
+func serveRemote(clientProvider ClientProvider, listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			_ = serveRemoteConn(clientProvider, conn)
+		}()
+	}
+}
+
+func serveRemoteConn(clientProvider ClientProvider, conn net.Conn) (retErr error) {
+	session := newRemoteSession(clientProvider)
+	defer func() {
+		if err := session.close(); err != nil && retErr == nil {
+			retErr = err
+		}
+		if err := conn.Close(); err != nil && retErr == nil && !errors.Is(err, net.ErrClosed) {
+			retErr = err
+		}
+	}()
+	decoder := gob.NewDecoder(conn)
+	encoder := gob.NewEncoder(conn)
+	var writeLock sync.Mutex
+	for {
+		request := &remoteRequest{}
+		if err := decoder.Decode(request); err != nil {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		// calls such as Lock and ProcessRead block, so every request gets
+		// its own goroutine
+		go func() {
+			response := &remoteResponse{ID: request.ID}
+			handler, ok := remoteHandlers[request.Method]
+			if !ok {
+				response.Err = newRemoteError(fmt.Errorf("exec: unknown remote method: %s", request.Method))
+			} else {
+				args := request.Args
+				if args == nil {
+					args = &remoteArgs{}
+				}
+				result, err := handler(session, args)
+				response.Result = result
+				response.Err = newRemoteError(err)
+			}
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			_ = encoder.Encode(response)
+		}()
+	}
+}
+
+// remoteSession holds what was created over a connection, which is
+// destroyed or closed when the connection closes.
+type remoteSession struct {
+	clientProvider ClientProvider
+	lock           sync.Mutex
+	nextHandle     uint64
+	// Clients, Files, Unlockers, Watchers and processes
+	handles map[uint64]interface{}
+	// the clients destroyed on close, sub-directory clients are destroyed
+	// with them
+	tempDirClients map[uint64]Client
+	closed         bool
+}
+
+func newRemoteSession(clientProvider ClientProvider) *remoteSession {
+	return &remoteSession{
+		clientProvider: clientProvider,
+		handles:        make(map[uint64]interface{}),
+		tempDirClients: make(map[uint64]Client),
+	}
+}
+
+func (r *remoteSession) add(value interface{}) uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.nextHandle++
+	r.handles[r.nextHandle] = value
+	return r.nextHandle
+}
+
+func (r *remoteSession) get(handle uint64) interface{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.handles[handle]
+}
+
+func (r *remoteSession) remove(handle uint64) interface{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	value := r.handles[handle]
+	delete(r.handles, handle)
+	delete(r.tempDirClients, handle)
+	return value
+}
+
+func (r *remoteSession) withClient(args *remoteArgs, f func(Client) (*remoteResult, error)) (*remoteResult, error) {
+	client, ok := r.get(args.Handle).(Client)
+	if !ok {
+		return nil, ErrAlreadyDestroyed
+	}
+	return f(client)
+}
+
+func (r *remoteSession) withFile(args *remoteArgs, f func(File) (*remoteResult, error)) (*remoteResult, error) {
+	file, ok := r.get(args.Handle).(File)
+	if !ok {
+		return nil, os.ErrClosed
+	}
+	return f(file)
+}
+
+func (r *remoteSession) withReadFile(args *remoteArgs, f func(ReadFile) (*remoteResult, error)) (*remoteResult, error) {
+	return r.withFile(args, func(file File) (*remoteResult, error) {
+		readFile, ok := file.(ReadFile)
+		if !ok {
+			return nil, ErrNotSupported
+		}
+		return f(readFile)
+	})
+}
+
+func (r *remoteSession) withWriteFile(args *remoteArgs, f func(WriteFile) (*remoteResult, error)) (*remoteResult, error) {
+	return r.withFile(args, func(file File) (*remoteResult, error) {
+		writeFile, ok := file.(WriteFile)
+		if !ok {
+			return nil, ErrNotSupported
+		}
+		return f(writeFile)
+	})
+}
+
+func (r *remoteSession) newTempDirClient(args *remoteArgs) (*remoteResult, error) {
+	client, err := r.clientProvider.NewTempDirClient()
+	if err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return nil, client.Destroy()
+	}
+	r.nextHandle++
+	handle := r.nextHandle
+	r.handles[handle] = client
+	r.tempDirClients[handle] = client
+	r.lock.Unlock()
+	return newRemoteClientResult(handle, client), nil
+}
+
+func (r *remoteSession) newSubDirClient(args *remoteArgs) (*remoteResult, error) {
+	return r.withClient(args, func(client Client) (*remoteResult, error) {
+		subDirClient, err := client.NewSubDirClient(args.Path)
+		if err != nil {
+			return nil, err
+		}
+		return newRemoteClientResult(r.add(subDirClient), subDirClient), nil
+	})
+}
+
+func newRemoteClientResult(handle uint64, client Client) *remoteResult {
+	return &remoteResult{
+		Handle:        handle,
+		DirName:       client.DirName(),
+		DirPath:       client.DirPath(),
+		PathSeparator: client.PathSeparator(),
+	}
+}
+
+func (r *remoteSession) destroy(args *remoteArgs) (*remoteResult, error) {
+	client, ok := r.remove(args.Handle).(Client)
+	if !ok {
+		return nil, ErrAlreadyDestroyed
+	}
+	return nil, client.Destroy()
+}
+
+func (r *remoteSession) watchNext(args *remoteArgs) (*remoteResult, error) {
+	watcher, ok := r.get(args.Handle).(Watcher)
+	if !ok {
+		return &remoteResult{Done: true}, nil
+	}
+	result := &remoteResult{}
+	select {
+	case event, ok := <-watcher.Events():
+		if !ok {
+			result.Done = true
+			return result, nil
+		}
+		result.Events = append(result.Events, event)
+	case err, ok := <-watcher.Errors():
+		if !ok {
+			result.Done = true
+			return result, nil
+		}
+		result.ResultErr = newRemoteError(err)
+		return result, nil
+	}
+	// send what is already queued along
+	for len(result.Events) < 1024 {
+		select {
+		case event, ok := <-watcher.Events():
+			if !ok {
+				return result, nil
+			}
+			result.Events = append(result.Events, event)
+		default:
+			return result, nil
+		}
+	}
+	return result, nil
+}
+
+func (r *remoteSession) watchClose(args *remoteArgs) (*remoteResult, error) {
+	watcher, ok := r.remove(args.Handle).(Watcher)
+	if !ok {
+		return nil, nil
+	}
+	return nil, watcher.Close()
+}
+
+func (r *remoteSession) execute(args *remoteArgs) (*remoteResult, error) {
+	return r.withClient(args, func(client Client) (*remoteResult, error) {
+		process := newRemoteProcess()
+		var stdin io.Reader
+		var stdinReader *io.PipeReader
+		if args.Stdin {
+			stdinReader, process.stdinWriter = io.Pipe()
+			stdin = stdinReader
+		} else {
+			// writes fail as nothing reads
+			_, process.stdinWriter = io.Pipe()
+			_ = process.stdinWriter.Close()
+		}
+		var stdout, stderr io.Writer
+		if args.Stdout {
+			stdout = process.output.writer(&process.output.stdout)
+		}
+		if args.Stderr {
+			stderr = process.output.writer(&process.output.stderr)
+		}
+		// the commands of os clients are killed when the session closes,
+		// the others run until they finish
+		osClient, killable := client.(*osClient)
+		var execute func() error
+		var err error
+		if args.Piped {
+			pipeCmds := make([]*PipeCmd, len(args.Cmds))
+			for i, cmd := range args.Cmds {
+				pipeCmds[i] = &PipeCmd{Args: cmd.Args, SubDir: cmd.SubDir, Env: cmd.Env}
+			}
+			pipeCmdList := &PipeCmdList{pipeCmds, stdin, stdout, stderr}
+			if killable {
+				execute, process.kill, err = osClient.executePipedKillable(pipeCmdList)
+			} else {
+				execute = client.ExecutePiped(pipeCmdList)
+			}
+		} else {
+			if len(args.Cmds) != 1 {
+				return nil, ErrArgsEmpty
+			}
+			remoteCmd := args.Cmds[0]
+			cmd := &Cmd{remoteCmd.Args, remoteCmd.SubDir, remoteCmd.Env, stdin, stdout, stderr}
+			if killable {
+				execute, process.kill, err = osClient.executeKillable(cmd)
+			} else {
+				execute = client.Execute(cmd)
+			}
+		}
+		if err != nil {
+			execute = func() error { return err }
+		}
+		handle := r.add(process)
+		go func() {
+			defer close(process.done)
+			err := execute()
+			if stdinReader != nil {
+				_ = stdinReader.CloseWithError(io.ErrClosedPipe)
+			}
+			process.output.finish(err)
+		}()
+		return &remoteResult{Handle: handle}, nil
+	})
+}
+
+func (r *remoteSession) process(handle uint64) (*remoteProcess, error) {
+	process, ok := r.get(handle).(*remoteProcess)
+	if !ok {
+		return nil, io.ErrClosedPipe
+	}
+	return process, nil
+}
+
+func (r *remoteSession) processRead(args *remoteArgs) (*remoteResult, error) {
+	process, err := r.process(args.Handle)
+	if err != nil {
+		return nil, err
+	}
+	result := process.output.read()
+	if result.Done {
+		r.remove(args.Handle)
+	}
+	return result, nil
+}
+
+func (r *remoteSession) close() error {
+	r.lock.Lock()
+	r.closed = true
+	handles := r.handles
+	tempDirClients := r.tempDirClients
+	r.handles = make(map[uint64]interface{})
+	r.tempDirClients = make(map[uint64]Client)
+	r.lock.Unlock()
+	var retErr error
+	for _, value := range handles {
+		var err error
+		switch value := value.(type) {
+		case File:
+			err = value.Close()
+		case Unlocker:
+			err = value.Unlock()
+		case Watcher:
+			err = value.Close()
+		case *remoteProcess:
+			value.close()
+		}
+		if err != nil && retErr == nil {
+			retErr = err
+		}
+	}
+	for _, client := range tempDirClients {
+		if err := client.Destroy(); err != nil && err != ErrAlreadyDestroyed && retErr == nil {
+			retErr = err
+		}
+	}
+	return retErr
+}
+
+type remoteProcess struct {
+	stdinWriter *io.PipeWriter
+	output      *remoteOutput
+	// nil if the commands are not host processes
+	kill func()
+	done chan struct{}
+}
+
+func newRemoteProcess() *remoteProcess {
+	return &remoteProcess{output: newRemoteOutput(), done: make(chan struct{})}
+}
+
+// close kills the process and waits for it if it can, otherwise it lets the
+// process finish without anyone reading its output
+func (r *remoteProcess) close() {
+	_ = r.stdinWriter.Close()
+	r.output.discard()
+	if r.kill == nil {
+		return
+	}
+	select {
+	case <-r.done:
+	default:
+		r.kill()
+		<-r.done
+	}
+}
+
+// remoteOutput buffers the stdout and stderr of a process until read, and
+// blocks the process when too much is buffered.
+type remoteOutput struct {
+	lock      sync.Mutex
+	cond      *sync.Cond
+	stdout    bytes.Buffer
+	stderr    bytes.Buffer
+	done      bool
+	err       error
+	discarded bool
+}
+
+func newRemoteOutput() *remoteOutput {
+	remoteOutput := &remoteOutput{}
+	remoteOutput.cond = sync.NewCond(&remoteOutput.lock)
+	return remoteOutput
+}
+
+func (r *remoteOutput) writer(buffer *bytes.Buffer) io.Writer {
+	return &remoteOutputWriter{r, buffer}
+}
+
+func (r *remoteOutput) read() *remoteResult {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for r.stdout.Len() == 0 && r.stderr.Len() == 0 && !r.done {
+		r.cond.Wait()
+	}
+	result := &remoteResult{}
+	if r.stdout.Len() > 0 {
+		result.Data = append([]byte(nil), r.stdout.Bytes()...)
+		r.stdout.Reset()
+	}
+	if r.stderr.Len() > 0 {
+		result.Stderr = append([]byte(nil), r.stderr.Bytes()...)
+		r.stderr.Reset()
+	}
+	if r.done && result.Data == nil && result.Stderr == nil {
+		result.Done = true
+		result.ResultErr = newRemoteError(r.err)
+	}
+	r.cond.Broadcast()
+	return result
+}
+
+func (r *remoteOutput) finish(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.done = true
+	r.err = err
+	r.cond.Broadcast()
+}
+
+func (r *remoteOutput) discard() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.discarded = true
+	r.stdout.Reset()
+	r.stderr.Reset()
+	r.cond.Broadcast()
+}
+
+type remoteOutputWriter struct {
+	output *remoteOutput
+	buffer *bytes.Buffer
+}
+
+func (r *remoteOutputWriter) Write(p []byte) (int, error) {
+	r.output.lock.Lock()
+	defer r.output.lock.Unlock()
+	for r.buffer.Len() >= remoteMaxChunkSize && !r.output.discarded {
+		r.output.cond.Wait()
+	}
+	if !r.output.discarded {
+		r.buffer.Write(p)
+		r.output.cond.Broadcast()
+	}
+	return len(p), nil
+}
+
+func remoteChunkSize(n int) int {
+	if n <= 0 || n > remoteMaxChunkSize {
+		return remoteMaxChunkSize
+	}
+	return n
+}
@@ -0,0 +1,133 @@
+package exec
+
+import (
+	"io"
+
+	"github.com/codeship/go-concurrent"
+)
+
+// replayClientProvider keeps the directories of clients on the host, as the
+// os backend does, and serves commands from a cassette written by a
+// recording client provider instead of running them.
+type replayClientProvider struct {
+	concurrent.Destroyable
+	osClientProvider *osClientProvider
+	player           *cassettePlayer
+}
+
+func newReplayClientProvider(execOptions *ReplayExecOptions) (*replayClientProvider, error) {
+	cassette, err := readCassette(execOptions.CassetteFile)
+	if err != nil {
+		return nil, err
+	}
+	osClientProvider := newOsClientProvider(&OsExecOptions{TmpDir: execOptions.TmpDir})
+	return &replayClientProvider{
+		concurrent.NewDestroyable(osClientProvider.Destroy),
+		osClientProvider,
+		newCassettePlayer(cassette),
+	}, nil
+}
+
+func (r *replayClientProvider) NewTempDirExecutorReadFileManager() (ExecutorReadFileManager, error) {
+	return r.NewTempDirClient()
+}
+
+func (r *replayClientProvider) NewTempDirExecutorWriteFileManager() (ExecutorWriteFileManager, error) {
+	return r.NewTempDirClient()
+}
+
+func (r *replayClientProvider) NewTempDirClient() (Client, error) {
+	value, err := r.Do(func() (interface{}, error) {
+		return r.osClientProvider.NewTempDirClient()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &replayClient{value.(Client), r.player}, nil
+}
+
+// replayClient takes the recording of a command when it is executed, and
+// writes its output and makes its file changes when the returned function
+// is called
+type replayClient struct {
+	Client
+	player *cassettePlayer
+}
+
+func (r *replayClient) Execute(cmd *Cmd) func() error {
+	return r.replay(
+		[]*cassetteCmd{newCassetteCmd(cmd.Args, cmd.SubDir, cmd.Env)},
+		cmd.Stdin,
+		cmd.Stdout,
+		cmd.Stderr,
+	)
+}
+
+func (r *replayClient) ExecutePiped(pipeCmdList *PipeCmdList) func() error {
+	return r.replay(
+		newCassetteCmds(pipeCmdList),
+		pipeCmdList.Stdin,
+		pipeCmdList.Stdout,
+		pipeCmdList.Stderr,
+	)
+}
+
+func (r *replayClient) replay(cassetteCmds []*cassetteCmd, stdin io.Reader, stdout io.Writer, stderr io.Writer) func() error {
+	value, err := r.Do(func() (interface{}, error) {
+		return r.player.maxStdinSize(cassetteCmds), nil
+	})
+	if err != nil {
+		return func() error { return err }
+	}
+	// read stdin while the caller writes it, as a command would
+	var stdinData []byte
+	var stdinErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stdinData, stdinErr = readStdin(stdin, value.(int64))
+	}()
+	return func() error {
+		<-done
+		if stdinErr != nil {
+			return stdinErr
+		}
+		cassetteInteraction, err := r.player.next(cassetteCmds, stdinData)
+		if err != nil {
+			return err
+		}
+		if stdout != nil {
+			if _, err := stdout.Write(cassetteInteraction.Stdout); err != nil {
+				return err
+			}
+		}
+		if stderr != nil {
+			if _, err := stderr.Write(cassetteInteraction.Stderr); err != nil {
+				return err
+			}
+		}
+		if err := applyCassetteChanges(r.Client, cassetteInteraction); err != nil {
+			return err
+		}
+		if cassetteInteraction.ExitCode != 0 {
+			return &ReplayExitError{cassetteInteraction.ExitCode}
+		}
+		return cassetteInteraction.Err.err()
+	}
+}
+
+func (r *replayClient) NewSubDirExecutorReadFileManager(path string) (ExecutorReadFileManager, error) {
+	return r.NewSubDirClient(path)
+}
+
+func (r *replayClient) NewSubDirExecutorWriteFileManager(path string) (ExecutorWriteFileManager, error) {
+	return r.NewSubDirClient(path)
+}
+
+func (r *replayClient) NewSubDirClient(path string) (Client, error) {
+	client, err := r.Client.NewSubDirClient(path)
+	if err != nil {
+		return nil, err
+	}
+	return &replayClient{client, r.player}, nil
+}
@@ -0,0 +1,242 @@
+package exec
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+type ManifestEntry struct {
+	Path    string      `json:"path,omitempty" yaml:"path,omitempty"`
+	Mode    os.FileMode `json:"mode,omitempty" yaml:"mode,omitempty"`
+	Size    int64       `json:"size,omitempty" yaml:"size,omitempty"`
+	ModTime time.Time   `json:"mod_time,omitempty" yaml:"mod_time,omitempty"`
+	// only set for regular files
+	Hash string `json:"hash,omitempty" yaml:"hash,omitempty"`
+	// only set for symlinks
+	Target string `json:"target,omitempty" yaml:"target,omitempty"`
+}
+
+// Sorted by Path
+type Manifest struct {
+	Entries []*ManifestEntry `json:"entries,omitempty" yaml:"entries,omitempty"`
+}
+
+type ManifestEntryChange struct {
+	Old *ManifestEntry `json:"old,omitempty" yaml:"old,omitempty"`
+	New *ManifestEntry `json:"new,omitempty" yaml:"new,omitempty"`
+}
+
+type ManifestDiff struct {
+	Added   []*ManifestEntry       `json:"added,omitempty" yaml:"added,omitempty"`
+	Removed []*ManifestEntry       `json:"removed,omitempty" yaml:"removed,omitempty"`
+	Changed []*ManifestEntryChange `json:"changed,omitempty" yaml:"changed,omitempty"`
+}
+
+func (m *ManifestDiff) IsEmpty() bool {
+	return len(m.Added) == 0 && len(m.Removed) == 0 && len(m.Changed) == 0
+}
+
+func snapshot(readFileManager ReadFileManager, contents WriteFileManager) (*Manifest, error) {
+	manifest := &Manifest{}
+	if err := walkTree(readFileManager, ".", func(path string, fileInfo os.FileInfo) error {
+		entry, err := newManifestEntry(readFileManager, path, fileInfo, contents)
+		if err != nil {
+			return err
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Sort(manifestEntriesByPath(manifest.Entries))
+	return manifest, nil
+}
+
+func newManifestEntry(readFileManager ReadFileManager, path string, fileInfo os.FileInfo, contents WriteFileManager) (*ManifestEntry, error) {
+	entry := &ManifestEntry{
+		Path:    readFileManager.ToSlash(path),
+		Mode:    fileInfo.Mode(),
+		ModTime: fileInfo.ModTime(),
+	}
+	switch {
+	case fileInfo.Mode()&os.ModeSymlink != 0:
+		target, err := readFileManager.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		entry.Target = target
+	case fileInfo.Mode().IsRegular():
+		entry.Size = fileInfo.Size()
+		hash, err := hashFile(readFileManager, path)
+		if err != nil {
+			return nil, err
+		}
+		entry.Hash = hash
+		if contents != nil {
+			if err := storeContents(readFileManager, path, hash, contents); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return entry, nil
+}
+
+func hashFile(readFileManager ReadFileManager, path string) (retValue string, retErr error) {
+	file, err := readFileManager.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := file.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func contentsPath(contents WriteFileManager, hash string) string {
+	return contents.Join(hash[:2], hash)
+}
+
+func storeContents(readFileManager ReadFileManager, path string, hash string, contents WriteFileManager) (retErr error) {
+	contentsPath := contentsPath(contents, hash)
+	exists, err := contents.IsFileExists(contentsPath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	if err := contents.MkdirAll(contents.Dir(contentsPath), 0755); err != nil {
+		return err
+	}
+	file, err := readFileManager.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	return writeToWriteFileManager(contents, contentsPath, file, 0644)
+}
+
+func diff(a *Manifest, b *Manifest) *ManifestDiff {
+	manifestDiff := &ManifestDiff{}
+	i, j := 0, 0
+	for i < len(a.Entries) || j < len(b.Entries) {
+		switch {
+		case j == len(b.Entries) || (i < len(a.Entries) && a.Entries[i].Path < b.Entries[j].Path):
+			manifestDiff.Removed = append(manifestDiff.Removed, a.Entries[i])
+			i++
+		case i == len(a.Entries) || b.Entries[j].Path < a.Entries[i].Path:
+			manifestDiff.Added = append(manifestDiff.Added, b.Entries[j])
+			j++
+		default:
+			if isManifestEntryChanged(a.Entries[i], b.Entries[j]) {
+				manifestDiff.Changed = append(manifestDiff.Changed, &ManifestEntryChange{a.Entries[i], b.Entries[j]})
+			}
+			i++
+			j++
+		}
+	}
+	return manifestDiff
+}
+
+func isManifestEntryChanged(a *ManifestEntry, b *ManifestEntry) bool {
+	if a.Mode != b.Mode || a.Size != b.Size || a.Hash != b.Hash || a.Target != b.Target {
+		return true
+	}
+	// directory modification times change with their contents, and the ones
+	// of symlinks cannot be set through a file manager
+	return a.Mode.IsRegular() && !a.ModTime.Equal(b.ModTime)
+}
+
+// restore makes the tree of readWriteFileManager match manifest, reading the
+// contents of regular files from contents as stored by snapshot.
+func restore(readWriteFileManager ReadWriteFileManager, manifest *Manifest, contents ReadFileManager) error {
+	current, err := snapshot(readWriteFileManager, nil)
+	if err != nil {
+		return err
+	}
+	manifestDiff := diff(manifest, current)
+	// children sort after their parents, so remove in reverse order
+	for i := len(manifestDiff.Added) - 1; i >= 0; i-- {
+		if err := readWriteFileManager.Remove(manifestDiff.Added[i].Path); err != nil {
+			return err
+		}
+	}
+	for i := len(manifestDiff.Changed) - 1; i >= 0; i-- {
+		change := manifestDiff.Changed[i]
+		if change.Old.Mode.IsDir() && change.New.Mode.IsDir() {
+			continue
+		}
+		if err := readWriteFileManager.RemoveAll(change.New.Path); err != nil {
+			return err
+		}
+	}
+	var entries []*ManifestEntry
+	entries = append(entries, manifestDiff.Removed...)
+	for _, change := range manifestDiff.Changed {
+		entries = append(entries, change.Old)
+	}
+	sort.Sort(manifestEntriesByPath(entries))
+	var dirs []*ManifestEntry
+	for _, entry := range entries {
+		if err := restoreManifestEntry(readWriteFileManager, entry, contents); err != nil {
+			return err
+		}
+		if entry.Mode.IsDir() {
+			dirs = append(dirs, entry)
+		}
+	}
+	// the modes of directories are set after their children are restored, as
+	// they may not allow writing
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := readWriteFileManager.Chmod(dirs[i].Path, dirs[i].Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restoreManifestEntry(readWriteFileManager ReadWriteFileManager, entry *ManifestEntry, contents ReadFileManager) (retErr error) {
+	switch {
+	case entry.Mode.IsDir():
+		return readWriteFileManager.MkdirAll(entry.Path, 0700)
+	case entry.Mode.IsRegular():
+		file, err := contents.Open(contents.Join(entry.Hash[:2], entry.Hash))
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := file.Close(); err != nil && retErr == nil {
+				retErr = err
+			}
+		}()
+		if err := writeToWriteFileManager(readWriteFileManager, entry.Path, file, entry.Mode.Perm()); err != nil {
+			return err
+		}
+		return readWriteFileManager.Chtimes(entry.Path, entry.ModTime, entry.ModTime)
+	case entry.Mode&os.ModeSymlink != 0:
+		return readWriteFileManager.Symlink(entry.Target, entry.Path)
+	default:
+		return fmt.Errorf("exec: cannot restore %s with mode %v", entry.Path, entry.Mode)
+	}
+}
+
+type manifestEntriesByPath []*ManifestEntry
+
+func (m manifestEntriesByPath) Len() int           { return len(m) }
+func (m manifestEntriesByPath) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m manifestEntriesByPath) Less(i, j int) bool { return m[i].Path < m[j].Path }
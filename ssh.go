@@ -0,0 +1,734 @@
+package exec
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/codeship/go-concurrent"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	defaultSSHPort   = "22"
+	defaultSSHTmpDir = "/tmp"
+	// the exit code of flock when the lock is held, see sshClient.lock
+	sshFlockConflictExitCode = 75
+)
+
+type sshClientProvider struct {
+	concurrent.Destroyable
+	execOptions *SSHExecOptions
+	conn        *ssh.Client
+	sftpClient  *sftp.Client
+}
+
+func dialSSHClientProvider(execOptions *SSHExecOptions) (*sshClientProvider, error) {
+	key, err := ioutil.ReadFile(execOptions.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := knownhosts.New(execOptions.KnownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	address := execOptions.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, defaultSSHPort)
+	}
+	conn, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            execOptions.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return nil, err
+	}
+	sftpClient, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &sshClientProvider{
+		concurrent.NewDestroyable(func() error {
+			err := sftpClient.Close()
+			if closeErr := conn.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+			return err
+		}),
+		execOptions,
+		conn,
+		sftpClient,
+	}, nil
+}
+
+func (s *sshClientProvider) NewTempDirExecutorReadFileManager() (ExecutorReadFileManager, error) {
+	return s.NewTempDirClient()
+}
+
+func (s *sshClientProvider) NewTempDirExecutorWriteFileManager() (ExecutorWriteFileManager, error) {
+	return s.NewTempDirClient()
+}
+
+func (s *sshClientProvider) NewTempDirClient() (Client, error) {
+	value, err := s.Do(func() (interface{}, error) {
+		return s.createTempDir()
+	})
+	if err != nil {
+		return nil, err
+	}
+	tempDir := value.(string)
+	client := newSSHClient(
+		func() error { return s.sftpClient.RemoveAll(tempDir) },
+		s.conn,
+		s.sftpClient,
+		tempDir,
+	)
+	if err := s.AddChild(client); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// this is only called in thread-safe context
+func (s *sshClientProvider) createTempDir() (string, error) {
+	tmpDir := s.execOptions.TmpDir
+	if tmpDir == "" {
+		tmpDir = defaultSSHTmpDir
+	}
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	tempDir := path.Join(tmpDir, "exec"+hex.EncodeToString(random))
+	if err := s.sftpClient.Mkdir(tempDir); err != nil {
+		return "", err
+	}
+	if err := s.sftpClient.Chmod(tempDir, 0700); err != nil {
+		_ = s.sftpClient.RemoveAll(tempDir)
+		return "", err
+	}
+	return tempDir, nil
+}
+
+// sshClient manages files over SFTP and runs each command in its own SSH
+// session, the host must have a POSIX shell, env and, for Lock and
+// TryLock, flock from util-linux.
+type sshClient struct {
+	concurrent.Destroyable
+	conn       *ssh.Client
+	sftpClient *sftp.Client
+	dirPath    string
+	releaser   *releaser
+}
+
+func newSSHClient(destroyCallback func() error, conn *ssh.Client, sftpClient *sftp.Client, dirPath string) *sshClient {
+	releaser := newReleaser()
+	return &sshClient{
+		concurrent.NewDestroyable(func() error {
+			err := releaser.destroy()
+			if callbackErr := destroyCallback(); callbackErr != nil && err == nil {
+				err = callbackErr
+			}
+			return err
+		}),
+		conn,
+		sftpClient,
+		dirPath,
+		releaser,
+	}
+}
+
+func (s *sshClient) DirName() string {
+	return path.Base(s.dirPath)
+}
+
+// DirPath is the path on the host
+func (s *sshClient) DirPath() string {
+	return s.dirPath
+}
+
+func (s *sshClient) Execute(cmd *Cmd) func() error {
+	if err := s.validateCmd(cmd.Args, cmd.SubDir); err != nil {
+		return func() error { return err }
+	}
+	value, err := s.Do(func() (interface{}, error) {
+		return s.start(cmd.Args, cmd.SubDir, cmd.Env, cmd.Stdin, cmd.Stdout, cmd.Stderr)
+	})
+	if err != nil {
+		return func() error { return err }
+	}
+	session := value.(*ssh.Session)
+	return func() error {
+		defer session.Close()
+		return session.Wait()
+	}
+}
+
+// ExecutePiped connects the sessions of the commands through this process,
+// so that the failure of every command is seen as with the os backend.
+func (s *sshClient) ExecutePiped(pipeCmdList *PipeCmdList) func() error {
+	if len(pipeCmdList.PipeCmds) == 0 {
+		return func() error { return ErrArgsEmpty }
+	}
+	for _, pipeCmd := range pipeCmdList.PipeCmds {
+		if err := s.validateCmd(pipeCmd.Args, pipeCmd.SubDir); err != nil {
+			return func() error { return err }
+		}
+	}
+	value, err := s.Do(func() (interface{}, error) {
+		var sessions []*ssh.Session
+		// the pipe each session writes to and reads from, nil for the
+		// stdout of the last and the stdin of the first session
+		var pipeWriters []*io.PipeWriter
+		var pipeReaders []*io.PipeReader
+		var pipeReader *io.PipeReader
+		for i, pipeCmd := range pipeCmdList.PipeCmds {
+			stdin := pipeCmdList.Stdin
+			if pipeReader != nil {
+				stdin = pipeReader
+			}
+			stdout := pipeCmdList.Stdout
+			var pipeWriter *io.PipeWriter
+			var nextPipeReader *io.PipeReader
+			if i < len(pipeCmdList.PipeCmds)-1 {
+				nextPipeReader, pipeWriter = io.Pipe()
+				stdout = pipeWriter
+			}
+			session, err := s.start(pipeCmd.Args, pipeCmd.SubDir, pipeCmd.Env, stdin, stdout, pipeCmdList.Stderr)
+			if err != nil {
+				for j, session := range sessions {
+					_ = session.Close()
+					_ = pipeWriters[j].Close()
+				}
+				return nil, err
+			}
+			sessions = append(sessions, session)
+			pipeWriters = append(pipeWriters, pipeWriter)
+			pipeReaders = append(pipeReaders, pipeReader)
+			pipeReader = nextPipeReader
+		}
+		return func() error {
+			errC := make(chan error, len(sessions))
+			for i, session := range sessions {
+				i, session := i, session
+				go func() {
+					err := session.Wait()
+					_ = session.Close()
+					// the next command sees the end of its input, and the
+					// previous one fails writing as with a broken pipe
+					if pipeWriters[i] != nil {
+						_ = pipeWriters[i].Close()
+					}
+					if pipeReaders[i] != nil {
+						_ = pipeReaders[i].CloseWithError(io.ErrClosedPipe)
+					}
+					errC <- err
+				}()
+			}
+			var retErr error
+			for range sessions {
+				if err := <-errC; err != nil && retErr == nil {
+					retErr = err
+				}
+			}
+			return retErr
+		}, nil
+	})
+	if err != nil {
+		return func() error { return err }
+	}
+	return value.(func() error)
+}
+
+func (s *sshClient) validateCmd(args []string, subDir string) error {
+	if len(args) == 0 {
+		return ErrArgsEmpty
+	}
+	if subDir != "" {
+		return s.validatePath(subDir)
+	}
+	return nil
+}
+
+// this is only called in thread-safe context
+func (s *sshClient) start(args []string, subDir string, env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (*ssh.Session, error) {
+	session, err := s.conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if err := session.Start(sshCommand(s.absolutePath(subDir), args, env)); err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// sshCommand replaces the environment with env if not empty, as the os
+// backend does
+func sshCommand(dir string, args []string, env []string) string {
+	words := []string{"exec"}
+	if len(env) > 0 {
+		words = append(words, "env", "-i")
+		for _, variable := range env {
+			words = append(words, shellQuote(variable))
+		}
+	}
+	for _, arg := range args {
+		words = append(words, shellQuote(arg))
+	}
+	return fmt.Sprintf("cd %s && %s", shellQuote(dir), strings.Join(words, " "))
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func (s *sshClient) IsFileExists(path string) (bool, error) {
+	if err := s.validatePath(path); err != nil {
+		return false, err
+	}
+	value, err := s.Do(func() (interface{}, error) {
+		if _, err := s.sftpClient.Stat(s.absolutePath(path)); err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return value.(bool), nil
+}
+
+func (s *sshClient) ListRegularFiles(path string) ([]string, error) {
+	if err := s.validatePath(path); err != nil {
+		return nil, err
+	}
+	var files []string
+	if err := walk(s, path, nil, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileInfo.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (s *sshClient) Open(path string) (ReadFile, error) {
+	return s.openFile(path, os.O_RDONLY, 0)
+}
+
+func (s *sshClient) Create(path string) (WriteFile, error) {
+	return s.openFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0)
+}
+
+func (s *sshClient) OpenFile(path string, flag int, perm os.FileMode) (ReadWriteFile, error) {
+	return s.openFile(path, flag, perm)
+}
+
+// SFTP creates files with the default mode of the server, so a non-zero
+// perm is set afterwards on files that did not exist before, without umask
+func (s *sshClient) openFile(path string, flag int, perm os.FileMode) (*sshFile, error) {
+	if err := s.validatePath(path); err != nil {
+		return nil, err
+	}
+	value, err := s.Do(func() (interface{}, error) {
+		absolutePath := s.absolutePath(path)
+		created := false
+		if flag&os.O_CREATE != 0 {
+			_, err := s.sftpClient.Lstat(absolutePath)
+			switch {
+			case os.IsNotExist(err):
+				created = perm != 0
+			case err == nil && flag&os.O_EXCL != 0:
+				// SFTP version 3 only reports a generic failure
+				return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrExist}
+			}
+		}
+		file, err := s.sftpClient.OpenFile(absolutePath, flag)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			if err := file.Chmod(perm); err != nil {
+				_ = file.Close()
+				return nil, err
+			}
+		}
+		// writes carry an offset and not all servers append, so start at the
+		// end, this is not atomic with writers on the host
+		if flag&os.O_APPEND != 0 {
+			if _, err := file.Seek(0, io.SeekEnd); err != nil {
+				_ = file.Close()
+				return nil, err
+			}
+		}
+		return &sshFile{File: file, sftpClient: s.sftpClient}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*sshFile), nil
+}
+
+func (s *sshClient) Stat(path string) (os.FileInfo, error) {
+	return s.fileInfo(path, s.sftpClient.Stat)
+}
+
+func (s *sshClient) Lstat(path string) (os.FileInfo, error) {
+	return s.fileInfo(path, s.sftpClient.Lstat)
+}
+
+func (s *sshClient) fileInfo(path string, f func(string) (os.FileInfo, error)) (os.FileInfo, error) {
+	if err := s.validatePath(path); err != nil {
+		return nil, err
+	}
+	value, err := s.Do(func() (interface{}, error) {
+		return f(s.absolutePath(path))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(os.FileInfo), nil
+}
+
+func (s *sshClient) Readlink(path string) (string, error) {
+	if err := s.validatePath(path); err != nil {
+		return "", err
+	}
+	value, err := s.Do(func() (interface{}, error) {
+		return s.sftpClient.ReadLink(s.absolutePath(path))
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+// perm is only set on the last directory, if it did not exist before
+func (s *sshClient) MkdirAll(path string, perm os.FileMode) error {
+	return s.do(func() error {
+		absolutePath := s.absolutePath(path)
+		if fileInfo, err := s.sftpClient.Stat(absolutePath); err == nil && fileInfo.IsDir() {
+			return nil
+		}
+		if err := s.sftpClient.MkdirAll(absolutePath); err != nil {
+			return err
+		}
+		return s.sftpClient.Chmod(absolutePath, perm)
+	}, path)
+}
+
+// Rename replaces newpath as with the os backend if the server supports
+// the posix-rename extension
+func (s *sshClient) Rename(oldpath string, newpath string) error {
+	return s.do(func() error {
+		if _, ok := s.sftpClient.HasExtension("posix-rename@openssh.com"); ok {
+			return s.sftpClient.PosixRename(s.absolutePath(oldpath), s.absolutePath(newpath))
+		}
+		return s.sftpClient.Rename(s.absolutePath(oldpath), s.absolutePath(newpath))
+	}, oldpath, newpath)
+}
+
+func (s *sshClient) Remove(path string) error {
+	return s.do(func() error {
+		return s.sftpClient.Remove(s.absolutePath(path))
+	}, path)
+}
+
+func (s *sshClient) RemoveAll(path string) error {
+	return s.do(func() error {
+		if s.absolutePath(path) == s.dirPath {
+			return &os.PathError{Op: "removeall", Path: path, Err: syscall.EINVAL}
+		}
+		if err := s.sftpClient.RemoveAll(s.absolutePath(path)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}, path)
+}
+
+func (s *sshClient) Chmod(path string, mode os.FileMode) error {
+	return s.do(func() error {
+		return s.sftpClient.Chmod(s.absolutePath(path), mode)
+	}, path)
+}
+
+func (s *sshClient) Chown(path string, uid int, gid int) error {
+	return s.do(func() error {
+		return s.sftpClient.Chown(s.absolutePath(path), uid, gid)
+	}, path)
+}
+
+func (s *sshClient) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return s.do(func() error {
+		return s.sftpClient.Chtimes(s.absolutePath(path), atime, mtime)
+	}, path)
+}
+
+// oldname is stored as given, as with os.Symlink
+func (s *sshClient) Symlink(oldname string, newname string) error {
+	return s.do(func() error {
+		return s.sftpClient.Symlink(oldname, s.absolutePath(newname))
+	}, newname)
+}
+
+func (s *sshClient) Link(oldname string, newname string) error {
+	return s.do(func() error {
+		return s.sftpClient.Link(s.absolutePath(oldname), s.absolutePath(newname))
+	}, oldname, newname)
+}
+
+func (s *sshClient) Truncate(path string, size int64) error {
+	return s.do(func() error {
+		return s.sftpClient.Truncate(s.absolutePath(path), size)
+	}, path)
+}
+
+func (s *sshClient) do(f func() error, paths ...string) error {
+	for _, path := range paths {
+		if err := s.validatePath(path); err != nil {
+			return err
+		}
+	}
+	_, err := s.Do(func() (interface{}, error) {
+		return nil, f()
+	})
+	return err
+}
+
+func (s *sshClient) Lock(path string, exclusive bool) (Unlocker, error) {
+	return s.lock(path, exclusive, true)
+}
+
+func (s *sshClient) TryLock(path string, exclusive bool) (Unlocker, error) {
+	return s.lock(path, exclusive, false)
+}
+
+// lock runs flock on the host, holding the lock until the stdin of the
+// session is closed. Not called in Do, as waiting for the lock would block
+// Destroy.
+func (s *sshClient) lock(path string, exclusive bool, wait bool) (Unlocker, error) {
+	if err := s.validatePath(path); err != nil {
+		return nil, err
+	}
+	if s.releaser.isDestroyed() {
+		return nil, ErrAlreadyDestroyed
+	}
+	args := []string{"flock", "-E", fmt.Sprint(sshFlockConflictExitCode)}
+	if exclusive {
+		args = append(args, "-x")
+	} else {
+		args = append(args, "-s")
+	}
+	if !wait {
+		args = append(args, "-n")
+	}
+	args = append(args, s.absolutePath(path), "sh", "-c", "echo locked && exec cat >/dev/null")
+	session, err := s.conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	if err := session.Start(sshCommand(s.dirPath, args, nil)); err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	if line, _ := bufio.NewReader(stdout).ReadString('\n'); line != "locked\n" {
+		err := session.Wait()
+		_ = session.Close()
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == sshFlockConflictExitCode {
+			return nil, ErrLockHeld
+		}
+		if err == nil {
+			err = fmt.Errorf("exec: flock of %s did not lock", path)
+		}
+		return nil, err
+	}
+	releasable, err := s.releaser.add(func() error {
+		defer session.Close()
+		if err := stdin.Close(); err != nil {
+			return err
+		}
+		return session.Wait()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return releasable, nil
+}
+
+// SFTP has no change notifications
+func (s *sshClient) Watch(path string, recursive bool) (Watcher, error) {
+	return nil, ErrNotSupported
+}
+
+// SFTP does not identify files, so symlink cycles are only stopped by
+// MaxDepth
+func (s *sshClient) Walk(root string, walkOptions *WalkOptions, walkFunc WalkFunc) error {
+	if err := s.validatePath(root); err != nil {
+		return err
+	}
+	return walk(s, root, walkOptions, walkFunc)
+}
+
+func (s *sshClient) Glob(patterns ...string) ([]string, error) {
+	return glob(s, patterns)
+}
+
+func (s *sshClient) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+func (s *sshClient) Match(pattern string, path string) (bool, error) {
+	return matchPattern(pattern, path)
+}
+
+func (s *sshClient) ToSlash(path string) string {
+	return path
+}
+
+func (s *sshClient) Base(name string) string {
+	return path.Base(name)
+}
+
+func (s *sshClient) Dir(name string) string {
+	return path.Dir(name)
+}
+
+func (s *sshClient) PathSeparator() string {
+	return "/"
+}
+
+func (s *sshClient) NewSubDirExecutorReadFileManager(path string) (ExecutorReadFileManager, error) {
+	return s.newSubDirClient(path)
+}
+
+func (s *sshClient) NewSubDirExecutorWriteFileManager(path string) (ExecutorWriteFileManager, error) {
+	return s.newSubDirClient(path)
+}
+
+func (s *sshClient) NewSubDirClient(path string) (Client, error) {
+	return s.newSubDirClient(path)
+}
+
+func (s *sshClient) newSubDirClient(path string) (*sshClient, error) {
+	if err := s.validatePath(path); err != nil {
+		return nil, err
+	}
+	exists, err := s.IsFileExists(path)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrFileAlreadyExists
+	}
+	absolutePath := s.absolutePath(path)
+	if err := s.sftpClient.Mkdir(absolutePath); err != nil {
+		return nil, err
+	}
+	subDirClient := newSSHClient(
+		func() error { return s.sftpClient.RemoveAll(absolutePath) },
+		s.conn,
+		s.sftpClient,
+		absolutePath,
+	)
+	if err := s.AddChild(subDirClient); err != nil {
+		return nil, err
+	}
+	return subDirClient, nil
+}
+
+func (s *sshClient) validatePath(path string) error {
+	if strings.HasPrefix(path, "/") {
+		return ErrNotRelativePath
+	}
+	_, err := joinSubPath(".", path)
+	return err
+}
+
+func (s *sshClient) absolutePath(path string) string {
+	return s.Join(s.dirPath, path)
+}
+
+// sshFile lists directories with the SFTP client, as sftp.File cannot
+type sshFile struct {
+	*sftp.File
+	sftpClient *sftp.Client
+	// the entries not yet returned by Readdir, nil until the first call
+	dirFileInfos []os.FileInfo
+}
+
+func (s *sshFile) Readdir(n int) ([]os.FileInfo, error) {
+	if s.dirFileInfos == nil {
+		fileInfos, err := s.sftpClient.ReadDir(s.Name())
+		if err != nil {
+			return nil, err
+		}
+		s.dirFileInfos = append([]os.FileInfo{}, fileInfos...)
+	}
+	if n <= 0 {
+		fileInfos := s.dirFileInfos
+		s.dirFileInfos = s.dirFileInfos[len(s.dirFileInfos):]
+		return fileInfos, nil
+	}
+	if len(s.dirFileInfos) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(s.dirFileInfos) {
+		n = len(s.dirFileInfos)
+	}
+	fileInfos := s.dirFileInfos[:n]
+	s.dirFileInfos = s.dirFileInfos[n:]
+	return fileInfos, nil
+}
+
+func (s *sshFile) Readdirnames(n int) ([]string, error) {
+	fileInfos, err := s.Readdir(n)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(fileInfos))
+	for i, fileInfo := range fileInfos {
+		names[i] = fileInfo.Name()
+	}
+	return names, nil
+}
@@ -0,0 +1,305 @@
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// subDirFileManager is the sub directory at subPath of readWriteFileManager
+type subDirFileManager struct {
+	readWriteFileManager ReadWriteFileManager
+	subPath              string
+}
+
+func newSubDirFileManager(readWriteFileManager ReadWriteFileManager, subPath string) *subDirFileManager {
+	return &subDirFileManager{readWriteFileManager, filepath.Clean(subPath)}
+}
+
+func (s *subDirFileManager) DirName() string {
+	return s.readWriteFileManager.Base(s.DirPath())
+}
+
+func (s *subDirFileManager) DirPath() string {
+	return s.readWriteFileManager.Join(s.readWriteFileManager.DirPath(), s.subPath)
+}
+
+func (s *subDirFileManager) IsFileExists(path string) (bool, error) {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return false, err
+	}
+	return s.readWriteFileManager.IsFileExists(parentPath)
+}
+
+func (s *subDirFileManager) ListRegularFiles(path string) ([]string, error) {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return nil, err
+	}
+	parentFiles, err := s.readWriteFileManager.ListRegularFiles(parentPath)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, len(parentFiles))
+	for i, parentFile := range parentFiles {
+		files[i] = s.subDirPath(parentFile)
+	}
+	return files, nil
+}
+
+func (s *subDirFileManager) Join(elem ...string) string {
+	return s.readWriteFileManager.Join(elem...)
+}
+
+func (s *subDirFileManager) Match(pattern string, path string) (bool, error) {
+	return s.readWriteFileManager.Match(pattern, path)
+}
+
+func (s *subDirFileManager) ToSlash(path string) string {
+	return s.readWriteFileManager.ToSlash(path)
+}
+
+func (s *subDirFileManager) Base(path string) string {
+	return s.readWriteFileManager.Base(path)
+}
+
+func (s *subDirFileManager) Dir(path string) string {
+	return s.readWriteFileManager.Dir(path)
+}
+
+func (s *subDirFileManager) PathSeparator() string {
+	return s.readWriteFileManager.PathSeparator()
+}
+
+func (s *subDirFileManager) Open(path string) (ReadFile, error) {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.readWriteFileManager.Open(parentPath)
+}
+
+func (s *subDirFileManager) Walk(root string, walkOptions *WalkOptions, walkFunc WalkFunc) error {
+	if _, err := s.parentPath(root); err != nil {
+		return err
+	}
+	return walk(s, root, walkOptions, walkFunc)
+}
+
+func (s *subDirFileManager) Glob(patterns ...string) ([]string, error) {
+	return glob(s, patterns)
+}
+
+func (s *subDirFileManager) Watch(path string, recursive bool) (Watcher, error) {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := s.readWriteFileManager.Watch(parentPath, recursive)
+	if err != nil {
+		return nil, err
+	}
+	return newSubDirWatcher(watcher, s.subDirPath), nil
+}
+
+func (s *subDirFileManager) Stat(path string) (os.FileInfo, error) {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.readWriteFileManager.Stat(parentPath)
+}
+
+func (s *subDirFileManager) Lstat(path string) (os.FileInfo, error) {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.readWriteFileManager.Lstat(parentPath)
+}
+
+func (s *subDirFileManager) Readlink(path string) (string, error) {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return "", err
+	}
+	return s.readWriteFileManager.Readlink(parentPath)
+}
+
+func (s *subDirFileManager) OpenFile(path string, flag int, perm os.FileMode) (ReadWriteFile, error) {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.readWriteFileManager.OpenFile(parentPath, flag, perm)
+}
+
+func (s *subDirFileManager) Create(path string) (WriteFile, error) {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.readWriteFileManager.Create(parentPath)
+}
+
+func (s *subDirFileManager) MkdirAll(path string, perm os.FileMode) error {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return err
+	}
+	return s.readWriteFileManager.MkdirAll(parentPath, perm)
+}
+
+func (s *subDirFileManager) Rename(oldpath string, newpath string) error {
+	oldParentPath, err := s.parentPath(oldpath)
+	if err != nil {
+		return err
+	}
+	newParentPath, err := s.parentPath(newpath)
+	if err != nil {
+		return err
+	}
+	return s.readWriteFileManager.Rename(oldParentPath, newParentPath)
+}
+
+func (s *subDirFileManager) Remove(path string) error {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return err
+	}
+	return s.readWriteFileManager.Remove(parentPath)
+}
+
+func (s *subDirFileManager) RemoveAll(path string) error {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return err
+	}
+	return s.readWriteFileManager.RemoveAll(parentPath)
+}
+
+func (s *subDirFileManager) Chmod(path string, mode os.FileMode) error {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return err
+	}
+	return s.readWriteFileManager.Chmod(parentPath, mode)
+}
+
+func (s *subDirFileManager) Chown(path string, uid int, gid int) error {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return err
+	}
+	return s.readWriteFileManager.Chown(parentPath, uid, gid)
+}
+
+func (s *subDirFileManager) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return err
+	}
+	return s.readWriteFileManager.Chtimes(parentPath, atime, mtime)
+}
+
+// oldname is the target of the symlink, and is kept as is
+func (s *subDirFileManager) Symlink(oldname string, newname string) error {
+	parentPath, err := s.parentPath(newname)
+	if err != nil {
+		return err
+	}
+	return s.readWriteFileManager.Symlink(oldname, parentPath)
+}
+
+func (s *subDirFileManager) Link(oldname string, newname string) error {
+	oldParentPath, err := s.parentPath(oldname)
+	if err != nil {
+		return err
+	}
+	newParentPath, err := s.parentPath(newname)
+	if err != nil {
+		return err
+	}
+	return s.readWriteFileManager.Link(oldParentPath, newParentPath)
+}
+
+func (s *subDirFileManager) Truncate(path string, size int64) error {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return err
+	}
+	return s.readWriteFileManager.Truncate(parentPath, size)
+}
+
+func (s *subDirFileManager) Lock(path string, exclusive bool) (Unlocker, error) {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.readWriteFileManager.Lock(parentPath, exclusive)
+}
+
+func (s *subDirFileManager) TryLock(path string, exclusive bool) (Unlocker, error) {
+	parentPath, err := s.parentPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.readWriteFileManager.TryLock(parentPath, exclusive)
+}
+
+// parentPath returns path relative to the parent file manager
+func (s *subDirFileManager) parentPath(path string) (string, error) {
+	return joinSubPath(s.subPath, path)
+}
+
+// subDirPath returns parentPath, which is in the sub directory, relative to it
+func (s *subDirFileManager) subDirPath(parentPath string) string {
+	if parentPath == s.subPath {
+		return "."
+	}
+	return strings.TrimPrefix(parentPath, s.subPath+string(filepath.Separator))
+}
+
+// subDirWatcher makes the paths of the events of a watcher of the parent
+// file manager relative to the sub directory
+type subDirWatcher struct {
+	watcher   Watcher
+	events    chan *WatchEvent
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSubDirWatcher(watcher Watcher, subDirPath func(string) string) *subDirWatcher {
+	s := &subDirWatcher{
+		watcher: watcher,
+		events:  make(chan *WatchEvent),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(s.events)
+		for event := range watcher.Events() {
+			select {
+			case s.events <- &WatchEvent{subDirPath(event.Path), event.Op}:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *subDirWatcher) Events() <-chan *WatchEvent {
+	return s.events
+}
+
+func (s *subDirWatcher) Errors() <-chan error {
+	return s.watcher.Errors()
+}
+
+func (s *subDirWatcher) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return s.watcher.Close()
+}
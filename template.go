@@ -0,0 +1,126 @@
+package exec
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func newTempDirClientFromDir(clientProvider ClientProvider, absolutePath string) (Client, error) {
+	if !filepath.IsAbs(absolutePath) {
+		return nil, newValidationErrorNotAbsolutePath(absolutePath)
+	}
+	fileInfo, err := os.Stat(absolutePath)
+	if err != nil {
+		return nil, err
+	}
+	if !fileInfo.IsDir() {
+		return nil, ErrNotADirectory
+	}
+	return newTempDirClientFrom(clientProvider, func(client Client) error {
+		if osClient, ok := client.(*osClient); ok {
+			_, err := osClient.Do(func() (interface{}, error) {
+				return nil, copyHostDirIn(absolutePath, osClient)
+			})
+			return err
+		}
+		return copyIn(client, absolutePath, ".", nil)
+	})
+}
+
+func newTempDirClientFromArchive(clientProvider ClientProvider, reader io.Reader) (Client, error) {
+	return newTempDirClientFrom(clientProvider, func(client Client) error {
+		tarReader, err := newTarReader(reader)
+		if err != nil {
+			return err
+		}
+		return importTar(client, tarReader, ".")
+	})
+}
+
+func newTempDirClientFromClient(clientProvider ClientProvider, readFileManager ReadFileManager) (Client, error) {
+	return newTempDirClientFrom(clientProvider, func(client Client) error {
+		fromOsClient, fromOk := readFileManager.(*osClient)
+		toOsClient, toOk := client.(*osClient)
+		if fromOk && toOk {
+			_, err := fromOsClient.Do(func() (interface{}, error) {
+				return toOsClient.Do(func() (interface{}, error) {
+					return nil, copyHostDirIn(fromOsClient.DirPath(), toOsClient)
+				})
+			})
+			return err
+		}
+		return copyBetween(readFileManager, ".", client, ".", nil)
+	})
+}
+
+// copyHostDirIn copies fromDirPath into the directory of osClient, whose
+// quota is checked once the copy is done as nothing is reserved for it.
+func copyHostDirIn(fromDirPath string, osClient *osClient) error {
+	if err := copyHostDir(fromDirPath, osClient.DirPath()); err != nil {
+		return err
+	}
+	return osClient.quota.check()
+}
+
+func newTempDirClientFrom(clientProvider ClientProvider, populate func(Client) error) (Client, error) {
+	client, err := clientProvider.NewTempDirClient()
+	if err != nil {
+		return nil, err
+	}
+	if err := populate(client); err != nil {
+		_ = client.Destroy()
+		return nil, err
+	}
+	return client, nil
+}
+
+func newTarReader(reader io.Reader) (*tar.Reader, error) {
+	bufReader := bufio.NewReader(reader)
+	magic, err := bufReader.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(bufReader)
+		if err != nil {
+			return nil, err
+		}
+		return tar.NewReader(gzipReader), nil
+	}
+	return tar.NewReader(bufReader), nil
+}
+
+// cleanArchivePath returns the cleaned relative path for an archive entry,
+// or ErrPathOutOfContext if the entry would escape the destination.
+func cleanArchivePath(name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) {
+		return "", ErrPathOutOfContext
+	}
+	name = filepath.Clean(name)
+	if name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", ErrPathOutOfContext
+	}
+	return name, nil
+}
+
+func writeToWriteFileManager(writeFileManager WriteFileManager, path string, reader io.Reader, perm os.FileMode) (retErr error) {
+	file, err := writeFileManager.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	if _, err := io.Copy(file, reader); err != nil {
+		return err
+	}
+	return file.Chmod(perm)
+}
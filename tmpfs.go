@@ -0,0 +1,96 @@
+package exec
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/codeship/go-osutils"
+)
+
+const sharedMemoryDirPath = "/dev/shm"
+
+var (
+	byteSizeSuffixToShift = map[string]uint{
+		"":  0,
+		"K": 10,
+		"M": 20,
+		"G": 30,
+		"T": 40,
+	}
+)
+
+// parseByteSize parses sizes such as "4096", "512M" or "1GiB", where the
+// suffixes are powers of 1024.
+func parseByteSize(s string) (int64, error) {
+	trimmed := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	i := strings.IndexFunc(trimmed, func(r rune) bool { return r < '0' || r > '9' })
+	if i == -1 {
+		i = len(trimmed)
+	}
+	shift, ok := byteSizeSuffixToShift[trimmed[i:]]
+	if !ok || i == 0 {
+		return 0, fmt.Errorf("exec: invalid byte size: %q", s)
+	}
+	size, err := strconv.ParseInt(trimmed[:i], 10, 64)
+	if err != nil || size > (1<<63-1)>>shift {
+		return 0, fmt.Errorf("exec: invalid byte size: %q", s)
+	}
+	return size << shift, nil
+}
+
+// createTmpfsTempDir mounts a tmpfs on a new temporary directory. If the
+// process is not permitted to mount and Fallback is set, a temporary
+// directory in TmpDir, or in /dev/shm if TmpDir is empty, is used instead
+// with the size of the tmpfs enforced as a quota. The returned byte limit is
+// the one the quota of the directory should use.
+//
+// An unprivileged process cannot mount in a mount namespace of its own
+// either: unshare only moves the calling thread to the new namespace, which
+// the other threads of the Go runtime that use the directory do not see,
+// and the user namespace needed to be permitted to mount cannot be entered
+// by a multithreaded process at all.
+//
+// this is only called in thread-safe context
+func (o *osClientProvider) createTmpfsTempDir() (string, int64, error) {
+	tmpfsOptions := o.execOptions.Tmpfs
+	tempDir, err := o.newTempDir(o.execOptions.TmpDir)
+	if err != nil {
+		return "", 0, err
+	}
+	err = mountTmpfs(tempDir, tmpfsOptions.Size)
+	if err == nil {
+		return tempDir, o.execOptions.MaxBytes, nil
+	}
+	if removeErr := os.Remove(tempDir); removeErr != nil {
+		return "", 0, removeErr
+	}
+	if !tmpfsOptions.Fallback || !isMountDenied(err) {
+		return "", 0, err
+	}
+	tmpDir := o.execOptions.TmpDir
+	if tmpDir == "" {
+		exists, err := osutils.IsDirExists(sharedMemoryDirPath)
+		if err != nil {
+			return "", 0, err
+		}
+		if exists {
+			tmpDir = sharedMemoryDirPath
+		}
+	}
+	if tempDir, err = o.newTempDir(tmpDir); err != nil {
+		return "", 0, err
+	}
+	maxBytes := o.execOptions.MaxBytes
+	if tmpfsOptions.Size > 0 && (maxBytes == 0 || tmpfsOptions.Size < maxBytes) {
+		maxBytes = tmpfsOptions.Size
+	}
+	return tempDir, maxBytes, nil
+}
+
+// isMountDenied is true if the process is not permitted to mount, or cannot
+// mount a tmpfs on this platform
+func isMountDenied(err error) bool {
+	return os.IsPermission(err) || err == ErrNotSupported
+}
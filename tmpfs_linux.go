@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package exec
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// A size of 0 uses the kernel default of half of the memory
+func mountTmpfs(dirPath string, size int64) error {
+	data := "mode=0700"
+	if size > 0 {
+		data = fmt.Sprintf("%s,size=%d", data, size)
+	}
+	return syscall.Mount("tmpfs", dirPath, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, data)
+}
+
+// unmountTmpfs does nothing if dirPath is not a mount point
+func unmountTmpfs(dirPath string) error {
+	if err := syscall.Unmount(dirPath, 0); err != nil && err != syscall.EINVAL {
+		return err
+	}
+	return nil
+}
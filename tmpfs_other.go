@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package exec
+
+func mountTmpfs(dirPath string, size int64) error {
+	return ErrNotSupported
+}
+
+func unmountTmpfs(dirPath string) error {
+	return nil
+}
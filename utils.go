@@ -5,7 +5,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
 )
 
 func readLines(readFileManager ReadFileManager, path string) (retValue []string, retErr error) {
@@ -70,3 +74,87 @@ func checkFileExists(readFileManager ReadFileManager, path string) error {
 	}
 	return nil
 }
+
+// walkTree calls f for every entry below path in lexical order, parents
+// before their children, without following symlinks.
+func walkTree(readFileManager ReadFileManager, path string, f func(string, os.FileInfo) error) error {
+	return walk(readFileManager, path, nil, func(childPath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if childPath == path {
+			return nil
+		}
+		return f(childPath, fileInfo)
+	})
+}
+
+func readDir(readFileManager ReadFileManager, path string) ([]os.FileInfo, error) {
+	dir, err := readFileManager.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fileInfos, err := dir.Readdir(-1)
+	if closeErr := dir.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(fileInfosByName(fileInfos))
+	return fileInfos, nil
+}
+
+func readHostDir(path string) ([]os.FileInfo, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fileInfos, err := dir.Readdir(-1)
+	if closeErr := dir.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return fileInfos, err
+}
+
+type fileInfosByName []os.FileInfo
+
+func (f fileInfosByName) Len() int           { return len(f) }
+func (f fileInfosByName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f fileInfosByName) Less(i, j int) bool { return f[i].Name() < f[j].Name() }
+
+func isNotDir(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err == syscall.ENOTDIR
+	}
+	return false
+}
+
+func cmdString(args []string, subDir string, env []string) string {
+	s := strings.Join(args, " ")
+	if subDir != "" {
+		s = fmt.Sprintf("(in %s) %s", subDir, s)
+	}
+	if len(env) > 0 {
+		s = fmt.Sprintf("%s %s", strings.Join(env, " "), s)
+	}
+	return s
+}
+
+// joinSubPath joins path to subPath, both relative, and returns
+// ErrPathOutOfContext if the result is not in subPath.
+func joinSubPath(subPath string, path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return "", ErrNotRelativePath
+	}
+	subPath = filepath.Clean(subPath)
+	joined := filepath.Join(subPath, path)
+	if subPath == "." {
+		if joined == ".." || strings.HasPrefix(joined, ".."+string(filepath.Separator)) {
+			return "", ErrPathOutOfContext
+		}
+	} else if joined != subPath && !strings.HasPrefix(joined, subPath+string(filepath.Separator)) {
+		return "", ErrPathOutOfContext
+	}
+	return joined, nil
+}
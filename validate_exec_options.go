@@ -1,10 +1,233 @@
 package exec
 
-func validateExecOptions(execOptions ExecOptions) ValidationError {
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+var (
+	ociRlimitTypes = map[string]bool{
+		"RLIMIT_AS":         true,
+		"RLIMIT_CORE":       true,
+		"RLIMIT_CPU":        true,
+		"RLIMIT_DATA":       true,
+		"RLIMIT_FSIZE":      true,
+		"RLIMIT_LOCKS":      true,
+		"RLIMIT_MEMLOCK":    true,
+		"RLIMIT_MSGQUEUE":   true,
+		"RLIMIT_NICE":       true,
+		"RLIMIT_NOFILE":     true,
+		"RLIMIT_NPROC":      true,
+		"RLIMIT_RSS":        true,
+		"RLIMIT_RTPRIO":     true,
+		"RLIMIT_RTTIME":     true,
+		"RLIMIT_SIGPENDING": true,
+		"RLIMIT_STACK":      true,
+	}
+)
+
+// validateExecOptions returns nil or ValidationErrors
+func validateExecOptions(execOptions ExecOptions) error {
 	switch execOptions.Type() {
 	case ExecTypeOs:
-		return nil
+		return validateOsExecOptions(execOptions.(*OsExecOptions)).err()
+	case ExecTypeRemote:
+		return validateRemoteExecOptions(execOptions.(*RemoteExecOptions)).err()
+	case ExecTypeSSH:
+		return validateSSHExecOptions(execOptions.(*SSHExecOptions)).err()
+	case ExecTypeOCI:
+		return validateOCIExecOptions(execOptions.(*OCIExecOptions)).err()
+	case ExecTypeReplay:
+		return validateReplayExecOptions(execOptions.(*ReplayExecOptions)).err()
 	default:
-		return newValidationErrorUnknownExecType(execOptions.Type().String())
+		return ValidationErrors{newValidationErrorUnknownExecType(execOptions.Type().String())}
+	}
+}
+
+func validateOsExecOptions(osExecOptions *OsExecOptions) ValidationErrors {
+	var validationErrors ValidationErrors
+	if osExecOptions.TmpDir != "" {
+		if validationError := validateTmpDir(osExecOptions.TmpDir); validationError != nil {
+			validationErrors = append(validationErrors, validationError)
+		}
+	}
+	validationErrors = appendIfNegative(validationErrors, "max_bytes", osExecOptions.MaxBytes)
+	validationErrors = appendIfNegative(validationErrors, "max_inodes", osExecOptions.MaxInodes)
+	if osExecOptions.Tmpfs != nil {
+		validationErrors = appendIfNegative(validationErrors, "tmpfs.size", osExecOptions.Tmpfs.Size)
+	}
+	return validationErrors
+}
+
+func validateTmpDir(tmpDir string) ValidationError {
+	tags := map[string]string{"path": tmpDir}
+	if !filepath.IsAbs(tmpDir) {
+		return newValidationError(ValidationErrorTypeNotAbsolutePath, "tmp_dir", tags, ErrNotAbsolutePath)
+	}
+	fileInfo, err := os.Stat(tmpDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return newValidationError(ValidationErrorTypeFileDoesNotExist, "tmp_dir", tags, ErrFileDoesNotExist)
+		}
+		return newValidationError(ValidationErrorTypeInvalidValue, "tmp_dir", tags, err)
+	}
+	if !fileInfo.IsDir() {
+		return newValidationError(ValidationErrorTypeNotADirectory, "tmp_dir", tags, ErrNotADirectory)
+	}
+	// permission bits do not tell for root or ACLs, so try
+	file, err := ioutil.TempFile(tmpDir, ".exec-validate")
+	if err != nil {
+		return newValidationError(ValidationErrorTypeNotWritable, "tmp_dir", tags, err)
+	}
+	_ = file.Close()
+	_ = os.Remove(file.Name())
+	return nil
+}
+
+func appendIfNegative(validationErrors ValidationErrors, field string, value int64) ValidationErrors {
+	if value < 0 {
+		return append(validationErrors, newValidationErrorInvalidValue(field, strconv.FormatInt(value, 10), errNegative))
+	}
+	return validationErrors
+}
+
+func appendIfEmpty(validationErrors ValidationErrors, field string, value string) ValidationErrors {
+	if value == "" {
+		return append(validationErrors, newValidationErrorInvalidValue(field, value, errEmpty))
+	}
+	return validationErrors
+}
+
+func validateRemoteExecOptions(remoteExecOptions *RemoteExecOptions) ValidationErrors {
+	var validationErrors ValidationErrors
+	switch remoteExecOptions.Network {
+	case "", "tcp", "tcp4", "tcp6", "unix":
+	default:
+		validationErrors = append(
+			validationErrors,
+			newValidationErrorInvalidValue("remote.network", remoteExecOptions.Network, errUnknownNetwork),
+		)
+	}
+	return appendIfEmpty(validationErrors, "remote.address", remoteExecOptions.Address)
+}
+
+func validateSSHExecOptions(sshExecOptions *SSHExecOptions) ValidationErrors {
+	var validationErrors ValidationErrors
+	validationErrors = appendIfEmpty(validationErrors, "ssh.host", sshExecOptions.Host)
+	validationErrors = appendIfEmpty(validationErrors, "ssh.user", sshExecOptions.User)
+	validationErrors = appendIfNotFile(validationErrors, "ssh.key_file", sshExecOptions.KeyFile)
+	validationErrors = appendIfNotFile(validationErrors, "ssh.known_hosts_file", sshExecOptions.KnownHostsFile)
+	// the directory is on the host, so only its form is checked
+	if sshExecOptions.TmpDir != "" && !path.IsAbs(sshExecOptions.TmpDir) {
+		validationErrors = append(
+			validationErrors,
+			newValidationError(
+				ValidationErrorTypeNotAbsolutePath,
+				"ssh.tmp_dir",
+				map[string]string{"path": sshExecOptions.TmpDir},
+				ErrNotAbsolutePath,
+			),
+		)
+	}
+	return validationErrors
+}
+
+func appendIfNotFile(validationErrors ValidationErrors, field string, filePath string) ValidationErrors {
+	if filePath == "" {
+		return appendIfEmpty(validationErrors, field, filePath)
+	}
+	tags := map[string]string{"path": filePath}
+	fileInfo, err := os.Stat(filePath)
+	switch {
+	case os.IsNotExist(err):
+		return append(validationErrors, newValidationError(ValidationErrorTypeFileDoesNotExist, field, tags, ErrFileDoesNotExist))
+	case err != nil:
+		return append(validationErrors, newValidationError(ValidationErrorTypeInvalidValue, field, tags, err))
+	case fileInfo.IsDir():
+		return append(validationErrors, newValidationError(ValidationErrorTypeInvalidValue, field, tags, errIsADirectory))
+	}
+	return validationErrors
+}
+
+func appendIfNotDir(validationErrors ValidationErrors, field string, dirPath string) ValidationErrors {
+	if dirPath == "" {
+		return appendIfEmpty(validationErrors, field, dirPath)
+	}
+	tags := map[string]string{"path": dirPath}
+	if !filepath.IsAbs(dirPath) {
+		return append(validationErrors, newValidationError(ValidationErrorTypeNotAbsolutePath, field, tags, ErrNotAbsolutePath))
+	}
+	fileInfo, err := os.Stat(dirPath)
+	switch {
+	case os.IsNotExist(err):
+		return append(validationErrors, newValidationError(ValidationErrorTypeFileDoesNotExist, field, tags, ErrFileDoesNotExist))
+	case err != nil:
+		return append(validationErrors, newValidationError(ValidationErrorTypeInvalidValue, field, tags, err))
+	case !fileInfo.IsDir():
+		return append(validationErrors, newValidationError(ValidationErrorTypeNotADirectory, field, tags, ErrNotADirectory))
+	}
+	return validationErrors
+}
+
+func validateOCIExecOptions(ociExecOptions *OCIExecOptions) ValidationErrors {
+	var validationErrors ValidationErrors
+	if ociExecOptions.TmpDir != "" {
+		if validationError := validateTmpDir(ociExecOptions.TmpDir); validationError != nil {
+			validationErrors = append(validationErrors, validationError)
+		}
+	}
+	validationErrors = appendIfNegative(validationErrors, "max_bytes", ociExecOptions.MaxBytes)
+	validationErrors = appendIfNegative(validationErrors, "max_inodes", ociExecOptions.MaxInodes)
+	validationErrors = appendIfNotDir(validationErrors, "oci.rootfs", ociExecOptions.Rootfs)
+	for i, ociMount := range ociExecOptions.Mounts {
+		field := fmt.Sprintf("oci.mounts[%d]", i)
+		if _, err := os.Stat(ociMount.Source); err != nil {
+			validationErrors = append(
+				validationErrors,
+				newValidationErrorInvalidValue(field+".source", ociMount.Source, err),
+			)
+		}
+		// the destination is in the container
+		if !path.IsAbs(ociMount.Destination) {
+			validationErrors = append(
+				validationErrors,
+				newValidationError(
+					ValidationErrorTypeNotAbsolutePath,
+					field+".destination",
+					map[string]string{"path": ociMount.Destination},
+					ErrNotAbsolutePath,
+				),
+			)
+		}
+	}
+	for i, ociRlimit := range ociExecOptions.Rlimits {
+		field := fmt.Sprintf("oci.rlimits[%d]", i)
+		if !ociRlimitTypes[ociRlimit.Type] {
+			validationErrors = append(
+				validationErrors,
+				newValidationErrorInvalidValue(field+".type", ociRlimit.Type, errUnknownRlimit),
+			)
+		}
+		if ociRlimit.Soft > ociRlimit.Hard {
+			validationErrors = append(
+				validationErrors,
+				newValidationErrorInvalidValue(field+".soft", strconv.FormatUint(ociRlimit.Soft, 10), errSoftAboveHard),
+			)
+		}
+	}
+	return validationErrors
+}
+
+func validateReplayExecOptions(replayExecOptions *ReplayExecOptions) ValidationErrors {
+	var validationErrors ValidationErrors
+	if replayExecOptions.TmpDir != "" {
+		if validationError := validateTmpDir(replayExecOptions.TmpDir); validationError != nil {
+			validationErrors = append(validationErrors, validationError)
+		}
 	}
+	return appendIfNotFile(validationErrors, "replay.cassette_file", replayExecOptions.CassetteFile)
 }
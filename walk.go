@@ -0,0 +1,270 @@
+package exec
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Return ErrSkipDir to not walk a directory, or the rest of the parent
+// directory of a file
+type WalkFunc func(path string, fileInfo os.FileInfo, err error) error
+
+// Patterns are slash-separated and relative to the root of the walk, and
+// "**" matches any number of directories.
+type WalkOptions struct {
+	// If set, only matching paths are passed to the WalkFunc, but all
+	// directories are still walked
+	Include []string
+	// Matching paths are not passed to the WalkFunc, and matching directories
+	// are not walked
+	Exclude []string
+	// The root has depth 0, 0 means no limit
+	MaxDepth int
+	// Symlinks to directories are walked, symlink cycles are passed to the
+	// WalkFunc as errors
+	FollowSymlinks bool
+	// The name of .gitignore-style files to read in every directory, for
+	// example ".gitignore", empty for none
+	IgnoreFileName string
+}
+
+func walk(readFileManager ReadFileManager, root string, walkOptions *WalkOptions, walkFunc WalkFunc) error {
+	if walkOptions == nil {
+		walkOptions = &WalkOptions{}
+	}
+	for _, patterns := range [][]string{walkOptions.Include, walkOptions.Exclude} {
+		for _, pattern := range patterns {
+			if _, err := matchPattern(pattern, "."); err != nil {
+				return err
+			}
+		}
+	}
+	fileInfo, err := readFileManager.Lstat(root)
+	if err != nil {
+		err = walkFunc(root, nil, err)
+	} else {
+		err = (&walker{readFileManager, walkOptions, walkFunc, nil}).walk(root, ".", 0, fileInfo, nil)
+	}
+	if err == ErrSkipDir {
+		return nil
+	}
+	return err
+}
+
+type walker struct {
+	readFileManager ReadFileManager
+	walkOptions     *WalkOptions
+	walkFunc        WalkFunc
+	// the directories being walked, used to detect symlink cycles
+	dirFileInfos []os.FileInfo
+}
+
+func (w *walker) walk(path string, relPath string, depth int, fileInfo os.FileInfo, ignoreRules []*ignoreRule) error {
+	if fileInfo.Mode()&os.ModeSymlink != 0 && w.walkOptions.FollowSymlinks {
+		targetFileInfo, err := w.readFileManager.Stat(path)
+		if err != nil && !os.IsNotExist(err) {
+			return w.walkFunc(path, fileInfo, err)
+		}
+		// dangling symlinks are passed as they are
+		if err == nil {
+			fileInfo = targetFileInfo
+		}
+	}
+	if relPath != "." {
+		excluded, err := w.isExcluded(relPath, fileInfo, ignoreRules)
+		if err != nil {
+			return err
+		}
+		if excluded {
+			return nil
+		}
+	}
+	included, err := w.isIncluded(relPath)
+	if err != nil {
+		return err
+	}
+	if included {
+		if err := w.walkFunc(path, fileInfo, nil); err != nil {
+			if err == ErrSkipDir && fileInfo.IsDir() {
+				return nil
+			}
+			return err
+		}
+	}
+	if !fileInfo.IsDir() || (w.walkOptions.MaxDepth > 0 && depth >= w.walkOptions.MaxDepth) {
+		return nil
+	}
+	return w.walkDir(path, relPath, depth, fileInfo, ignoreRules)
+}
+
+func (w *walker) walkDir(path string, relPath string, depth int, fileInfo os.FileInfo, ignoreRules []*ignoreRule) error {
+	if w.walkOptions.FollowSymlinks {
+		for _, dirFileInfo := range w.dirFileInfos {
+			if sameFile(dirFileInfo, fileInfo) {
+				return w.dirErr(path, fileInfo, fmt.Errorf("exec: symlink cycle at %s", path))
+			}
+		}
+		w.dirFileInfos = append(w.dirFileInfos, fileInfo)
+		defer func() {
+			w.dirFileInfos = w.dirFileInfos[:len(w.dirFileInfos)-1]
+		}()
+	}
+	ignoreRules, err := w.readIgnoreRules(path, relPath, ignoreRules)
+	if err != nil {
+		return w.dirErr(path, fileInfo, err)
+	}
+	fileInfos, err := readDir(w.readFileManager, path)
+	if err != nil {
+		return w.dirErr(path, fileInfo, err)
+	}
+	for _, childFileInfo := range fileInfos {
+		childRelPath := childFileInfo.Name()
+		if relPath != "." {
+			childRelPath = relPath + "/" + childRelPath
+		}
+		if err := w.walk(
+			w.readFileManager.Join(path, childFileInfo.Name()),
+			childRelPath,
+			depth+1,
+			childFileInfo,
+			ignoreRules,
+		); err != nil {
+			if err == ErrSkipDir {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *walker) dirErr(path string, fileInfo os.FileInfo, err error) error {
+	if err := w.walkFunc(path, fileInfo, err); err != nil && err != ErrSkipDir {
+		return err
+	}
+	return nil
+}
+
+func (w *walker) isIncluded(relPath string) (bool, error) {
+	if len(w.walkOptions.Include) == 0 {
+		return true, nil
+	}
+	return matchAnyPattern(w.walkOptions.Include, relPath)
+}
+
+func (w *walker) isExcluded(relPath string, fileInfo os.FileInfo, ignoreRules []*ignoreRule) (bool, error) {
+	if isIgnored(ignoreRules, relPath, fileInfo.IsDir()) {
+		return true, nil
+	}
+	return matchAnyPattern(w.walkOptions.Exclude, relPath)
+}
+
+func (w *walker) readIgnoreRules(path string, relPath string, ignoreRules []*ignoreRule) ([]*ignoreRule, error) {
+	if w.walkOptions.IgnoreFileName == "" {
+		return ignoreRules, nil
+	}
+	ignoreFilePath := w.readFileManager.Join(path, w.walkOptions.IgnoreFileName)
+	exists, err := w.readFileManager.IsFileExists(ignoreFilePath)
+	if err != nil || !exists {
+		return ignoreRules, err
+	}
+	data, err := readAll(w.readFileManager, ignoreFilePath)
+	if err != nil {
+		return nil, err
+	}
+	// copy so that sibling directories do not share rules
+	return append(append([]*ignoreRule{}, ignoreRules...), parseIgnoreRules(relPath, string(data))...), nil
+}
+
+// sameFile also compares the files of backends that identify them with a
+// fileID method, as os.SameFile only knows about the host
+func sameFile(fileInfo1 os.FileInfo, fileInfo2 os.FileInfo) bool {
+	if os.SameFile(fileInfo1, fileInfo2) {
+		return true
+	}
+	identified1, ok1 := fileInfo1.(interface{ fileID() string })
+	identified2, ok2 := fileInfo2.(interface{ fileID() string })
+	return ok1 && ok2 && identified1.fileID() != "" && identified1.fileID() == identified2.fileID()
+}
+
+func matchAnyPattern(patterns []string, name string) (bool, error) {
+	for _, pattern := range patterns {
+		matches, err := matchPattern(pattern, name)
+		if err != nil {
+			return false, err
+		}
+		if matches {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type ignoreRule struct {
+	// the directory of the ignore file relative to the root of the walk
+	dir     string
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+func parseIgnoreRules(dir string, data string) []*ignoreRule {
+	var ignoreRules []*ignoreRule
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(line, "\r ")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ignoreRule := &ignoreRule{dir: dir}
+		if strings.HasPrefix(line, "!") {
+			ignoreRule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			ignoreRule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		// patterns without a slash match at any depth, others are
+		// relative to the directory of the ignore file
+		if strings.Contains(line, "/") {
+			line = strings.TrimPrefix(line, "/")
+		} else {
+			line = "**/" + line
+		}
+		if line == "" || line == "**/" {
+			continue
+		}
+		ignoreRule.pattern = line
+		ignoreRules = append(ignoreRules, ignoreRule)
+	}
+	return ignoreRules
+}
+
+func (i *ignoreRule) matches(relPath string, isDir bool) bool {
+	if i.dirOnly && !isDir {
+		return false
+	}
+	if i.dir != "." {
+		if !strings.HasPrefix(relPath, i.dir+"/") {
+			return false
+		}
+		relPath = relPath[len(i.dir)+1:]
+	}
+	// invalid patterns never match, as with git
+	matches, _ := matchPattern(i.pattern, relPath)
+	return matches
+}
+
+// the last matching rule wins
+func isIgnored(ignoreRules []*ignoreRule, relPath string, isDir bool) bool {
+	ignored := false
+	for _, ignoreRule := range ignoreRules {
+		if ignoreRule.matches(relPath, isDir) {
+			ignored = !ignoreRule.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,192 @@
+package exec
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	WatchOpCreate WatchOp = 0
+	WatchOpWrite  WatchOp = 1
+	WatchOpRemove WatchOp = 2
+	WatchOpRename WatchOp = 3
+	WatchOpChmod  WatchOp = 4
+
+	watchOpToString = map[WatchOp]string{
+		WatchOpCreate: "create",
+		WatchOpWrite:  "write",
+		WatchOpRemove: "remove",
+		WatchOpRename: "rename",
+		WatchOpChmod:  "chmod",
+	}
+)
+
+type WatchOp uint
+
+func (w WatchOp) String() string {
+	if s, ok := watchOpToString[w]; ok {
+		return s
+	}
+	return fmt.Sprintf("WatchOp(%d)", uint(w))
+}
+
+// Path is relative to the client Watch was called on. A rename gives a
+// WatchOpRename event for the old path and a WatchOpCreate event for the
+// new path.
+type WatchEvent struct {
+	Path string
+	Op   WatchOp
+}
+
+// Events and Errors are closed once the Watcher is closed
+type Watcher interface {
+	Events() <-chan *WatchEvent
+	Errors() <-chan error
+	Close() error
+}
+
+type releasableWatcher struct {
+	Watcher
+	releasable *releasable
+}
+
+func addWatcher(releaser *releaser, watcher Watcher) (Watcher, error) {
+	releasable, err := releaser.add(watcher.Close)
+	if err != nil {
+		return nil, err
+	}
+	return &releasableWatcher{watcher, releasable}, nil
+}
+
+func (r *releasableWatcher) Close() error {
+	return r.releasable.Release()
+}
+
+// watchHub delivers events for the operations made through the clients of
+// backends without native change notifications, which call notify.
+type watchHub struct {
+	lock     sync.Mutex
+	watchers map[*hubWatcher]bool
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*hubWatcher]bool)}
+}
+
+// path and dir are relative to the root of the hub, and event paths are made
+// relative to dir.
+func (w *watchHub) watch(path string, dir string, recursive bool) *hubWatcher {
+	hubWatcher := &hubWatcher{
+		hub:       w,
+		path:      path,
+		dir:       dir,
+		recursive: recursive,
+		events:    make(chan *WatchEvent),
+		errors:    make(chan error),
+		done:      make(chan struct{}),
+	}
+	hubWatcher.cond = sync.NewCond(&hubWatcher.lock)
+	w.lock.Lock()
+	w.watchers[hubWatcher] = true
+	w.lock.Unlock()
+	go hubWatcher.run()
+	return hubWatcher
+}
+
+// notify never blocks, events are queued until they are received
+func (w *watchHub) notify(path string, op WatchOp) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for hubWatcher := range w.watchers {
+		if hubWatcher.matches(path) {
+			hubWatcher.push(path, op)
+		}
+	}
+}
+
+func (w *watchHub) remove(hubWatcher *hubWatcher) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.watchers, hubWatcher)
+}
+
+type hubWatcher struct {
+	hub       *watchHub
+	path      string
+	dir       string
+	recursive bool
+	lock      sync.Mutex
+	cond      *sync.Cond
+	queue     []*WatchEvent
+	closed    bool
+	events    chan *WatchEvent
+	errors    chan error
+	done      chan struct{}
+}
+
+func (h *hubWatcher) Events() <-chan *WatchEvent {
+	return h.events
+}
+
+func (h *hubWatcher) Errors() <-chan error {
+	return h.errors
+}
+
+func (h *hubWatcher) Close() error {
+	h.hub.remove(h)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	close(h.done)
+	h.cond.Signal()
+	return nil
+}
+
+func (h *hubWatcher) matches(path string) bool {
+	if path == h.path {
+		return true
+	}
+	if !h.recursive {
+		return filepath.Dir(path) == h.path
+	}
+	return h.path == "." || strings.HasPrefix(path, h.path+string(filepath.Separator))
+}
+
+func (h *hubWatcher) push(path string, op WatchOp) {
+	rel, err := filepath.Rel(h.dir, path)
+	if err != nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.queue = append(h.queue, &WatchEvent{rel, op})
+	h.cond.Signal()
+}
+
+func (h *hubWatcher) run() {
+	defer close(h.errors)
+	defer close(h.events)
+	for {
+		h.lock.Lock()
+		for len(h.queue) == 0 && !h.closed {
+			h.cond.Wait()
+		}
+		if h.closed {
+			h.lock.Unlock()
+			return
+		}
+		event := h.queue[0]
+		h.queue = h.queue[1:]
+		h.lock.Unlock()
+		select {
+		case h.events <- event:
+		case <-h.done:
+			return
+		}
+	}
+}
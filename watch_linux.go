@@ -0,0 +1,207 @@
+package exec
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE |
+	syscall.IN_MODIFY |
+	syscall.IN_DELETE |
+	syscall.IN_DELETE_SELF |
+	syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO |
+	syscall.IN_ATTRIB
+
+type inotifyWatcher struct {
+	// the file is non-blocking so that closing it stops a pending read
+	file      *os.File
+	fd        int
+	dirPath   string
+	path      string
+	recursive bool
+	// paths relative to dirPath, only used by run after creation
+	watches   map[int]string
+	lock      sync.Mutex
+	closed    bool
+	closeOnce sync.Once
+	events    chan *WatchEvent
+	errors    chan error
+	done      chan struct{}
+}
+
+func newHostWatcher(dirPath string, path string, recursive bool) (Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	inotifyWatcher := &inotifyWatcher{
+		file:      os.NewFile(uintptr(fd), "inotify"),
+		fd:        fd,
+		dirPath:   dirPath,
+		path:      path,
+		recursive: recursive,
+		watches:   make(map[int]string),
+		events:    make(chan *WatchEvent),
+		errors:    make(chan error),
+		done:      make(chan struct{}),
+	}
+	if err := inotifyWatcher.add(path, false); err != nil {
+		_ = inotifyWatcher.file.Close()
+		return nil, err
+	}
+	go inotifyWatcher.run()
+	return inotifyWatcher, nil
+}
+
+func (i *inotifyWatcher) Events() <-chan *WatchEvent {
+	return i.events
+}
+
+func (i *inotifyWatcher) Errors() <-chan error {
+	return i.errors
+}
+
+func (i *inotifyWatcher) Close() error {
+	var err error
+	i.closeOnce.Do(func() {
+		close(i.done)
+		i.lock.Lock()
+		defer i.lock.Unlock()
+		i.closed = true
+		err = i.file.Close()
+	})
+	return err
+}
+
+// add watches path, and the directories below path if recursive. Entries of
+// new directories may be created before they are watched, so if report is
+// true a create event is sent for every entry found.
+func (i *inotifyWatcher) add(path string, report bool) error {
+	absolutePath := filepath.Join(i.dirPath, path)
+	i.lock.Lock()
+	if i.closed {
+		i.lock.Unlock()
+		return nil
+	}
+	wd, err := syscall.InotifyAddWatch(i.fd, absolutePath, inotifyMask)
+	i.lock.Unlock()
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+	}
+	i.watches[wd] = path
+	if !i.recursive {
+		return nil
+	}
+	fileInfo, err := os.Lstat(absolutePath)
+	if err != nil || !fileInfo.IsDir() {
+		return err
+	}
+	fileInfos, err := readHostDir(absolutePath)
+	if err != nil {
+		return err
+	}
+	for _, fileInfo := range fileInfos {
+		childPath := filepath.Join(path, fileInfo.Name())
+		if report && !i.send(childPath, WatchOpCreate) {
+			return nil
+		}
+		if fileInfo.IsDir() {
+			if err := i.add(childPath, report); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (i *inotifyWatcher) run() {
+	defer close(i.errors)
+	defer close(i.events)
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := i.file.Read(buffer)
+		if err != nil {
+			i.sendError(err)
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			rawEvent := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameOffset := offset + syscall.SizeofInotifyEvent
+			offset = nameOffset + int(rawEvent.Len)
+			name := strings.TrimRight(string(buffer[nameOffset:offset]), "\x00")
+			if !i.handle(int(rawEvent.Wd), rawEvent.Mask, name) {
+				return
+			}
+		}
+	}
+}
+
+// handle returns false once the watcher is closed
+func (i *inotifyWatcher) handle(wd int, mask uint32, name string) bool {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		return i.sendError(errors.New("exec: inotify queue overflow"))
+	}
+	path, ok := i.watches[wd]
+	if !ok {
+		return true
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(i.watches, wd)
+		return true
+	}
+	if name != "" {
+		path = filepath.Join(path, name)
+	}
+	switch {
+	case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		if !i.send(path, WatchOpCreate) {
+			return false
+		}
+		if i.recursive && mask&syscall.IN_ISDIR != 0 {
+			if err := i.add(path, true); err != nil && !os.IsNotExist(err) {
+				return i.sendError(err)
+			}
+		}
+		return true
+	case mask&syscall.IN_MODIFY != 0:
+		return i.send(path, WatchOpWrite)
+	case mask&syscall.IN_DELETE != 0:
+		return i.send(path, WatchOpRemove)
+	case mask&syscall.IN_DELETE_SELF != 0:
+		// the removal of other directories is reported by their parent
+		if path == i.path {
+			return i.send(path, WatchOpRemove)
+		}
+		return true
+	case mask&syscall.IN_MOVED_FROM != 0:
+		return i.send(path, WatchOpRename)
+	case mask&syscall.IN_ATTRIB != 0:
+		return i.send(path, WatchOpChmod)
+	default:
+		return true
+	}
+}
+
+func (i *inotifyWatcher) send(path string, op WatchOp) bool {
+	select {
+	case i.events <- &WatchEvent{path, op}:
+		return true
+	case <-i.done:
+		return false
+	}
+}
+
+func (i *inotifyWatcher) sendError(err error) bool {
+	select {
+	case i.errors <- err:
+		return true
+	case <-i.done:
+		return false
+	}
+}
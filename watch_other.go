@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package exec
+
+func newHostWatcher(dirPath string, path string, recursive bool) (Watcher, error) {
+	return nil, ErrNotSupported
+}